@@ -0,0 +1,93 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/split"
+)
+
+// Backend dials the flows decided to a net-id it is registered for with
+// Tunnel.SetBackend, typically over a tunnel the embedder runs in userspace,
+// such as a wireguard device on wireguard-go's netstack. The contract:
+//
+// DialContext is called with the network "tcp" or "udp" (never "tcp4" and
+// such) and the flow's target as ip:port; no names are ever resolved.
+//
+// For tcp, it returns a stream conn to the target. If the conn has
+// CloseRead and CloseWrite methods, they are called on half-close; the
+// conn is closed once both directions are done.
+//
+// For udp, it returns a connected datagram conn: each Write sends one
+// datagram to the target and each Read returns one datagram from it.
+// Replies are sent to the app from the target address.
+//
+// Conns are closed by the tunnel when flows end. Sockets the backend itself
+// dials to its peers escape the vpn only if protected, see protect.MakeDialer.
+// DialContext must be safe for concurrent use. Backends whose upstreams
+// compress streams are registered wrapped in protect.MakeCompressingDialer.
+type Backend interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+var errReservedNetId = errors.New("net-id is reserved")
+
+// isReservedNetId returns true for the net-ids the tunnel handles itself.
+func isReservedNetId(netid string) bool {
+	switch netid {
+	case protect.NetIdBlock, protect.NetIdActive, protect.NetIdBaseUnprotected:
+		return true
+	}
+	return false
+}
+
+// loopbackDecision is that of flows to loopback addresses, which never
+// leave the device, and so are neither protected nor decided by the flow.
+var loopbackDecision = protect.Decision{NetId: protect.NetIdBaseUnprotected}
+
+// backendConn adapts a tcp conn from a backend to a split.DuplexConn,
+// closing it once both its halves are.
+type backendConn struct {
+	net.Conn
+	halves int32 // atomic; closed halves
+}
+
+func newBackendConn(c net.Conn) split.DuplexConn {
+	return &backendConn{Conn: c}
+}
+
+func (c *backendConn) ReadFrom(r io.Reader) (int64, error) {
+	// hide ReadFrom from io.Copy, lest it recurse
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func (c *backendConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		hc.CloseRead()
+	}
+	return c.closeHalf()
+}
+
+func (c *backendConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		hc.CloseWrite()
+	}
+	return c.closeHalf()
+}
+
+func (c *backendConn) closeHalf() error {
+	if atomic.AddInt32(&c.halves, 1) == 2 {
+		return c.Conn.Close()
+	}
+	return nil
+}
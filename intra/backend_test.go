@@ -0,0 +1,153 @@
+package intra
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// fakeTunnel is a backend that hands out one end of a pipe for each dial.
+type fakeTunnel struct {
+	mu    sync.Mutex
+	dials []string // network addr
+	peers chan net.Conn
+}
+
+func newFakeTunnel() *fakeTunnel {
+	return &fakeTunnel{peers: make(chan net.Conn, 4)}
+}
+
+func (f *fakeTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	f.dials = append(f.dials, network+" "+addr)
+	f.mu.Unlock()
+	c, peer := net.Pipe()
+	f.peers <- peer
+	return c, nil
+}
+
+func (f *fakeTunnel) dialed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.dials...)
+}
+
+func TestTCPBackend(t *testing.T) {
+	wg := newFakeTunnel()
+	l := newFakeListener()
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, &fakeFlow{"wg0"}, mode, l)
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}
+
+	local, app := tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+		t.Fatal("flow to an unset backend not firewalled")
+	}
+
+	h.SetBackend("wg0", wg)
+	local, app = tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := wg.dialed(); len(got) != 1 || got[0] != "tcp 192.0.2.1:8080" {
+		t.Fatalf("dialed %v", got)
+	}
+	peer := <-wg.peers
+
+	if _, err := app.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := peer.Read(b); err != nil || string(b) != "hi" {
+		t.Fatalf("upload failed: %v %s", err, b)
+	}
+	go peer.Write([]byte("yo"))
+	if _, err := app.Read(b); err != nil || string(b) != "yo" {
+		t.Fatalf("download failed: %v %s", err, b)
+	}
+
+	peer.Close()
+	app.Close()
+	select {
+	case s := <-l.tcp:
+		if s.UploadBytes != 2 || s.DownloadBytes != 2 {
+			t.Errorf("summary up %d down %d", s.UploadBytes, s.DownloadBytes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
+
+type datagram struct {
+	data string
+	from *net.UDPAddr
+}
+
+// recordingUDPConn sends datagrams written to the app on a channel.
+type recordingUDPConn struct {
+	fakeUDPConn
+	got chan datagram
+}
+
+func (c *recordingUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.got <- datagram{string(data), addr}
+	return len(data), nil
+}
+
+func TestUDPBackend(t *testing.T) {
+	wg := newFakeTunnel()
+	h := newTestUDPHandler("wg0", newFakeListener())
+	h.SetBackend("wg0", wg)
+	conn := &recordingUDPConn{
+		fakeUDPConn: fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}},
+		got:         make(chan datagram, 1),
+	}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4500}
+
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(conn)
+	if got := wg.dialed(); len(got) != 1 || got[0] != "udp 192.0.2.1:4500" {
+		t.Fatalf("dialed %v", got)
+	}
+	peer := <-wg.peers
+
+	go h.ReceiveTo(conn, []byte("ping"), target)
+	b := make([]byte, 16)
+	n, err := peer.Read(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("upload failed: %v %s", err, b[:n])
+	}
+	go peer.Write([]byte("pong"))
+	select {
+	case d := <-conn.got:
+		if d.data != "pong" || !d.from.IP.Equal(target.IP) || d.from.Port != target.Port {
+			t.Errorf("got %q from %s", d.data, d.from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+}
+
+func TestSetBackendReserved(t *testing.T) {
+	tun := &intratunnel{
+		tcp: NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, &fakeFlow{}, &settings.TunMode{}, newFakeListener()),
+		udp: newTestUDPHandler("", newFakeListener()),
+	}
+	for _, netid := range []string{"allow", "block", "base-unprotected"} {
+		if err := tun.SetBackend(netid, newFakeTunnel()); !errors.Is(err, errReservedNetId) {
+			t.Errorf("%s: got %v, want errReservedNetId", netid, err)
+		}
+	}
+	if err := tun.SetBackend("wg0", newFakeTunnel()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+// reasons flows are blocked for, besides those given by protect.Flow
+const (
+	reasonFlow        = "firewalled"
+	reasonSink        = "block mode sink"
+	reasonPort        = "destination port blocked"
+	reasonUnprotected = "unprotected connection"
+	reasonRewrite     = "target rewriter"
+	reasonNoNetId     = "no such netid"
+	reasonNoTarget    = "no target"
+	reasonHostLimit   = "per-host limit"
+	reasonSpoofed     = "spoofed source"
+)
+
+// BlockedError is returned for tcp and udp flows that are blocked, with
+// the reason they are: the one protect.Flow gave in its decision, as in
+// "block#reason=tracker list", if it blocked them, or one of the tunnel's
+// own otherwise.
+type BlockedError struct {
+	// Reason is why the flow was blocked.
+	Reason string
+	// err is the sentinel of the reason, if any, such as ErrBlockedPort.
+	err error
+}
+
+func (e *BlockedError) Error() string {
+	return "flow blocked: " + e.Reason
+}
+
+func (e *BlockedError) Unwrap() error {
+	return e.err
+}
+
+// blocked returns a BlockedError for reason.
+func blocked(reason string) *BlockedError {
+	return &BlockedError{Reason: reason}
+}
+
+// blockedBy returns a BlockedError for the reason protect.Flow gave to
+// block a flow, if any.
+func blockedBy(reason string) *BlockedError {
+	if len(reason) == 0 {
+		reason = reasonFlow
+	}
+	return blocked(reason)
+}
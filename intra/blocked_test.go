@@ -0,0 +1,62 @@
+package intra
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestBlockedReason(t *testing.T) {
+	defer SetBlockedPorts(nil)
+	SetBlockedPorts([]int{445})
+
+	tcp := func(netid string, blockMode, port int) error {
+		mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: blockMode}
+		h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(&countingProtector{}), &fakeFlow{netid}, mode, newFakeListener())
+		local, app := tcpPair(t)
+		defer app.Close()
+		defer local.Close()
+		return h.Handle(&fakeTCPConn{local}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	}
+	udp := func(netid string, blockMode, port int) error {
+		mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: blockMode}
+		h := NewUDPHandler(net.UDPAddr{}, time.Minute, &fakeFlow{netid}, mode, &net.ListenConfig{}, newFakeListener())
+		conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+		return h.Connect(conn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	}
+
+	for _, tc := range []struct {
+		name      string
+		netid     string
+		blockMode int
+		port      int
+		reason    string
+	}{
+		{"policy", protect.NetIdBlock + "#reason=tracker list", settings.BlockModeFilter, 80, "tracker list"},
+		{"policy without a reason", protect.NetIdBlock, settings.BlockModeFilter, 80, reasonFlow},
+		{"sink", protect.NetIdActive, settings.BlockModeSink, 80, reasonSink},
+		{"blocked port", protect.NetIdActive, settings.BlockModeFilter, 445, reasonPort},
+		{"no such netid", "wg9", settings.BlockModeFilter, 80, reasonNoNetId + " wg9"},
+	} {
+		for proto, connect := range map[string]func(string, int, int) error{"tcp": tcp, "udp": udp} {
+			err := connect(tc.netid, tc.blockMode, tc.port)
+			var be *BlockedError
+			if !errors.As(err, &be) {
+				t.Errorf("%s %s: got %v, want a BlockedError", proto, tc.name, err)
+				continue
+			}
+			if be.Reason != tc.reason {
+				t.Errorf("%s %s: blocked for %q, want %q", proto, tc.name, be.Reason, tc.reason)
+			}
+		}
+	}
+
+	// blocked ports are still ErrBlockedPort
+	if err := tcp(protect.NetIdActive, settings.BlockModeFilter, 445); !errors.Is(err, ErrBlockedPort) {
+		t.Errorf("got %v, want ErrBlockedPort", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBlockedPort is wrapped by the BlockedError of flows to ports set by
+// SetBlockedPorts.
+var ErrBlockedPort = errors.New("destination port blocked")
+
+// blockedPorts holds a portSet; protocol 0 is for ports of either.
+var blockedPorts atomic.Value
+
+// serializes updates to blockedPorts
+var blockedPortsMu sync.Mutex
+
+type portSet map[int32]map[int]struct{}
+
+// SetBlockedPorts blocks tcp and udp flows to ports, say smb's 445, before
+// they are up to protect.Flow, which never sees them; they fail with a
+// BlockedError wrapping ErrBlockedPort. An empty ports unblocks those
+// blocked for both protocols.
+func SetBlockedPorts(ports []int) {
+	SetBlockedProtocolPorts(0, ports)
+}
+
+// SetBlockedProtocolPorts is SetBlockedPorts for flows of protocol alone,
+// 6 for tcp or 17 for udp, as in protect.Flow; ports blocked for both
+// protocols stay blocked.
+func SetBlockedProtocolPorts(protocol int32, ports []int) {
+	blockedPortsMu.Lock()
+	defer blockedPortsMu.Unlock()
+	old, _ := blockedPorts.Load().(portSet)
+	set := make(portSet, len(old)+1)
+	for proto, ps := range old {
+		set[proto] = ps
+	}
+	delete(set, protocol)
+	if len(ports) > 0 {
+		ps := make(map[int]struct{}, len(ports))
+		for _, port := range ports {
+			ps[port] = struct{}{}
+		}
+		set[protocol] = ps
+	}
+	blockedPorts.Store(set)
+}
+
+// portBlocked returns true if flows of protocol to port are blocked.
+func portBlocked(protocol int32, port int) bool {
+	set, _ := blockedPorts.Load().(portSet)
+	if len(set) == 0 {
+		return false
+	}
+	if _, ok := set[0][port]; ok {
+		return true
+	}
+	_, ok := set[protocol][port]
+	return ok
+}
@@ -0,0 +1,67 @@
+package intra
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestBlockedPorts(t *testing.T) {
+	SetBlockedPorts([]int{445})
+	defer SetBlockedPorts(nil)
+	SetBlockedProtocolPorts(17, []int{137})
+	defer SetBlockedProtocolPorts(17, nil)
+
+	f := &countingFlow{}
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	th := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(&countingProtector{}), f, mode, newFakeListener())
+	uh := NewUDPHandler(net.UDPAddr{}, time.Minute, f, mode, &net.ListenConfig{}, newFakeListener())
+
+	tcp := func(port int) error {
+		local, app := tcpPair(t)
+		defer app.Close()
+		defer local.Close()
+		return th.Handle(&fakeTCPConn{local}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	}
+	udp := func(port int) error {
+		conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+		return uh.Connect(conn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		connect func(int) error
+		port    int
+		blocked bool
+	}{
+		{"tcp 445", tcp, 445, true},
+		{"udp 445", udp, 445, true},
+		{"udp 137", udp, 137, true},
+		{"tcp 137", tcp, 137, false},
+		{"tcp 80", tcp, 80, false},
+	} {
+		before := atomic.LoadInt32(&f.n)
+		err := tc.connect(tc.port)
+		reached := atomic.LoadInt32(&f.n) != before
+		if tc.blocked && (!errors.Is(err, ErrBlockedPort) || reached) {
+			t.Errorf("%s: got %v, flow called %v; want ErrBlockedPort before the flow", tc.name, err, reached)
+		}
+		if !tc.blocked && (errors.Is(err, ErrBlockedPort) || !reached) {
+			t.Errorf("%s: got %v, flow called %v; want the flow to decide", tc.name, err, reached)
+		}
+	}
+
+	// unblocked
+	SetBlockedPorts(nil)
+	if err := tcp(445); errors.Is(err, ErrBlockedPort) {
+		t.Error("tcp 445 still blocked")
+	}
+	if err := udp(137); !errors.Is(err, ErrBlockedPort) {
+		t.Errorf("udp 137: got %v, want it blocked still", err)
+	}
+}
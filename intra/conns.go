@@ -0,0 +1,33 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+// ConnInfo describes a tcp or udp flow being forwarded.
+type ConnInfo struct {
+	// Uid owns the flow, -1 if unknown.
+	Uid int `json:"uid"`
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol"`
+	// Source is the app's ip:port.
+	Source string `json:"source"`
+	// Target is the ip:port the app connected or sent to, if known.
+	Target string `json:"target"`
+	// NetId is what the flow was decided to, see protect.Flow.
+	NetId string `json:"netid"`
+	// Dialed is the ip:port the flow was dialed to, which is Target as
+	// translated, or a proxy's, if known.
+	Dialed string `json:"dialed"`
+	// RxBytes is how much was downloaded so far.
+	RxBytes int64 `json:"rxBytes"`
+	// TxBytes is how much was uploaded so far.
+	TxBytes int64 `json:"txBytes"`
+	// AgeMs is how long ago the flow started, in milliseconds.
+	AgeMs int64 `json:"ageMs"`
+	// MTU is the max datagram size hinted for the net-id of a udp flow,
+	// see Tunnel.SetMTUHint, for the app to clamp to; 0 if none was.
+	MTU int `json:"mtu,omitempty"`
+}
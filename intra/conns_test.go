@@ -0,0 +1,158 @@
+package intra
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// waitConns polls f until it returns n conns.
+func waitConns(t *testing.T, f func() []ConnInfo, n int) []ConnInfo {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := f()
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d conns, want %d: %+v", len(conns), n, conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPActiveConns(t *testing.T) {
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	go h.forward(newTCPFlow(10, "wg0", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := server.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c := waitConns(t, h.ActiveConns, 1)[0]
+	want := ConnInfo{Uid: 10, Protocol: "tcp", Source: local.LocalAddr().String(), Target: "192.0.2.1:443", NetId: "wg0", Dialed: server.LocalAddr().String(), RxBytes: 2, TxBytes: 5}
+	c.AgeMs = 0
+	if c != want {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	app.Close()
+	server.Close()
+	<-l.tcp
+	waitConns(t, h.ActiveConns, 0)
+}
+
+func TestUDPActiveConns(t *testing.T) {
+	h := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: nonLoopbackIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	target := server.LocalAddr().(*net.UDPAddr)
+	a := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	b := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5001}}
+	for _, conn := range []*fakeUDPConn{a, b} {
+		if err := h.Connect(conn, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer h.Close(b)
+	if err := h.ReceiveTo(a, []byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := h.ActiveConns()
+	if len(conns) != 2 {
+		t.Fatalf("got %d conns, want 2", len(conns))
+	}
+	for _, c := range conns {
+		if c.Protocol != "udp" || c.Target != target.String() || c.NetId != protect.NetIdActive || c.Uid != -1 {
+			t.Errorf("got %+v", c)
+		}
+		if c.Source == a.laddr.String() && c.TxBytes != 4 {
+			t.Errorf("tx %d, want 4", c.TxBytes)
+		}
+	}
+
+	h.Close(a)
+	conns = h.ActiveConns()
+	if len(conns) != 1 || conns[0].Source != b.laddr.String() {
+		t.Errorf("got %+v after close", conns)
+	}
+}
+
+func TestActiveConnectionsJSON(t *testing.T) {
+	udp := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	tun := &intratunnel{tcp: &tcpHandler{listener: newFakeListener()}, udp: udp}
+	if got := tun.ActiveConnections(); got != "[]" {
+		t.Errorf("got %s without conns", got)
+	}
+
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	if err := udp.Connect(conn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close(conn)
+	var conns []ConnInfo
+	if err := json.Unmarshal([]byte(tun.ActiveConnections()), &conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].Source != "10.111.222.1:5000" {
+		t.Errorf("got %+v", conns)
+	}
+}
+
+func TestOpenConns(t *testing.T) {
+	u := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+	var conns []*fakeUDPConn
+	for i := 0; i < 3; i++ {
+		conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000 + i}}
+		if err := u.Connect(conn, target); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		if n := u.OpenConns(); n != i+1 {
+			t.Errorf("%d udp flows open, want %d", n, i+1)
+		}
+	}
+	for i, conn := range conns {
+		u.Close(conn)
+		if n := u.OpenConns(); n != len(conns)-i-1 {
+			t.Errorf("%d udp flows open, want %d", n, len(conns)-i-1)
+		}
+	}
+
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	go h.forward(newTCPFlow(10, "wg0", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+	waitConns(t, h.ActiveConns, 1)
+	if n := h.OpenConns(); n != 1 {
+		t.Errorf("%d tcp flows open, want 1", n)
+	}
+	app.Close()
+	server.Close()
+	<-l.tcp
+	if n := h.OpenConns(); n != 0 {
+		t.Errorf("%d tcp flows open once closed", n)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	"github.com/celzero/firestack/intra/split"
+)
+
+// deadlineConn is the remote conn of a tcp flow whose reads and writes
+// each must complete within read and write of starting, when positive;
+// see protect.Decision.ReadTimeout.
+type deadlineConn struct {
+	split.DuplexConn
+	read, write time.Duration
+}
+
+// withDeadlines returns c with rolling read and write deadlines, or c
+// itself if neither is positive.
+func withDeadlines(c split.DuplexConn, read, write time.Duration) split.DuplexConn {
+	if read <= 0 && write <= 0 {
+		return c
+	}
+	return &deadlineConn{DuplexConn: c, read: read, write: write}
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		c.SetReadDeadline(time.Now().Add(c.read))
+	}
+	n, err := c.DuplexConn.Read(b)
+	c.timedOut("read", err)
+	return n, err
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	n, err := c.DuplexConn.Write(b)
+	c.timedOut("write", err)
+	return n, err
+}
+
+func (c *deadlineConn) ReadFrom(r io.Reader) (int64, error) {
+	if c.write <= 0 {
+		return c.DuplexConn.ReadFrom(r)
+	}
+	// hide ReadFrom from io.Copy, for each write to be timed
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+// timedOut closes c if err is a timeout of op, for the flow not to linger
+// half-open once its upstream is deemed unresponsive.
+func (c *deadlineConn) timedOut(op string, err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Infof("tcp flow to %s: %s timed out", c.RemoteAddr(), op)
+		c.Close()
+	}
+}
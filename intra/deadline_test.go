@@ -0,0 +1,93 @@
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadlineConnReadTimeout(t *testing.T) {
+	remote, server := tcpPair(t)
+	defer server.Close()
+	c := withDeadlines(remote, 100*time.Millisecond, 0)
+	defer c.Close()
+
+	// each read has its own deadline, however long the conn lives
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(60 * time.Millisecond)
+			server.Write([]byte("a"))
+		}
+	}()
+	b := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Read(b); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+
+	start := time.Now()
+	_, err := c.Read(b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("timed out early: %s", elapsed)
+	}
+	// and the conn is closed
+	if _, err := c.Write([]byte("a")); err == nil {
+		t.Error("wrote to a timed out conn")
+	}
+}
+
+func TestDeadlineConnWriteTimeout(t *testing.T) {
+	remote, server := tcpPair(t)
+	defer server.Close()
+	c := withDeadlines(remote, 0, 100*time.Millisecond)
+	defer c.Close()
+
+	// the server never reads, so writes stall once the buffers fill
+	_, err := c.Write(make([]byte, 64<<20))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestDeadlineConnNoTimeouts(t *testing.T) {
+	remote, server := tcpPair(t)
+	defer server.Close()
+	defer remote.Close()
+	if c := withDeadlines(remote, 0, 0); c != remote {
+		t.Errorf("got %T, want the conn itself", c)
+	}
+}
+
+func TestTCPFlowReadTimeout(t *testing.T) {
+	local, app := tcpPair(t)
+	defer app.Close()
+	remote, server := tcpPair(t)
+	defer server.Close()
+
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	go h.forward(newTCPFlow(-1, "", "", &fakeTCPConn{local}, withDeadlines(remote, timeout, 0)), &TCPSocketSummary{}, 0)
+
+	// the server never answers; the app sees the flow end
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := app.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from an unresponsive flow")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("flow not ended at its read timeout")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("flow ended early: %s", elapsed)
+	}
+	app.Close()
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
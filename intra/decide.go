@@ -0,0 +1,51 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"syscall"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// admission is how a flow that passed the rules of its handler is to be
+// forwarded; see tcpHandler.admit.
+type admission struct {
+	uid      int // -1 if unknown
+	decision protect.Decision
+	netid    string // the flow is forwarded to, per routeOf
+	loopback bool   // the flow is to loopback, and wasn't decided
+}
+
+// routeOf returns the net-id a flow decided d is forwarded to: d.NetId,
+// unless it isn't routable and one of d.Fallbacks is, in which case the
+// first of those that is.
+func routeOf(d protect.Decision, routable func(netid string) bool) string {
+	if d.NetId == protect.NetIdBlock || routable(d.NetId) {
+		return d.NetId
+	}
+	for _, netid := range d.Fallbacks {
+		if netid != protect.NetIdBlock && routable(netid) {
+			log.Infof("netid %s unroutable; falling back to %s", d.NetId, netid)
+			return netid
+		}
+	}
+	return d.NetId
+}
+
+// markDSCP marks the packets c sends with dscp, if c is a socket.
+func markDSCP(c interface{}, dscp int) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if err := protect.SetDSCP(sc, dscp); err != nil {
+		log.Warnf("dscp %d not set: %v", dscp, err)
+	}
+}
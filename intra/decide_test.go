@@ -0,0 +1,78 @@
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// structuredFlow decides with d, and never with On.
+type structuredFlow struct {
+	d protect.Decision
+}
+
+func (f *structuredFlow) On(protocol int32, uid int, source, target string) string {
+	return protect.NetIdBlock + "#reason=On called"
+}
+
+func (f *structuredFlow) OnV2(protocol int32, uid int, source, target string) protect.Decision {
+	return f.d
+}
+
+func TestStructuredFlowRoutesAsOn(t *testing.T) {
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	p := &countingProtector{}
+	preview := func(flow protect.Flow, proto int32) *Verdict {
+		tcp := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(p), flow, mode, newFakeListener())
+		udp := NewUDPHandler(net.UDPAddr{}, time.Minute, flow, mode, protect.MakeListenConfig(p), newFakeListener())
+		v, err := wouldBlock(tcp, udp, proto, 10, "192.0.2.1:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, tc := range []struct {
+		on   string
+		d    protect.Decision
+		want Verdict
+	}{
+		{protect.NetIdActive, protect.Decision{NetId: protect.NetIdActive}, Verdict{NetId: protect.NetIdActive}},
+		{"block#reason=ad list", protect.Decision{NetId: protect.NetIdBlock, Reason: "ad list"},
+			Verdict{Blocked: true, NetId: protect.NetIdBlock, Reason: "ad list"}},
+		{"wg9", protect.Decision{NetId: "wg9"},
+			Verdict{Blocked: true, NetId: "wg9", Reason: reasonNoNetId + " wg9"}},
+		{"wg9#fallbacks=wg8,allow", protect.Decision{NetId: "wg9", Fallbacks: []string{"wg8", protect.NetIdActive}},
+			Verdict{NetId: protect.NetIdActive}},
+		{"allow#dscp=46#ttl=1m", protect.Decision{NetId: protect.NetIdActive, DSCP: 46, TTL: time.Minute},
+			Verdict{NetId: protect.NetIdActive}},
+	} {
+		for _, proto := range []int32{6, 17} {
+			parsed := preview(&fakeFlow{tc.on}, proto)
+			structured := preview(&structuredFlow{tc.d}, proto)
+			if *parsed != tc.want || *structured != tc.want {
+				t.Errorf("%d %q: got %+v from On and %+v from OnV2, want %+v", proto, tc.on, parsed, structured, tc.want)
+			}
+		}
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	routable := func(netid string) bool { return netid == protect.NetIdActive || netid == "wg1" }
+	for _, tc := range []struct {
+		d    protect.Decision
+		want string
+	}{
+		{protect.Decision{NetId: "wg1", Fallbacks: []string{protect.NetIdActive}}, "wg1"},
+		{protect.Decision{NetId: "wg9", Fallbacks: []string{"wg8", "wg1"}}, "wg1"},
+		{protect.Decision{NetId: "wg9", Fallbacks: []string{protect.NetIdBlock, "wg8"}}, "wg9"},
+		{protect.Decision{NetId: protect.NetIdBlock, Fallbacks: []string{protect.NetIdActive}}, protect.NetIdBlock},
+	} {
+		if got := routeOf(tc.d, routable); got != tc.want {
+			t.Errorf("%+v: got %s, want %s", tc.d, got, tc.want)
+		}
+	}
+}
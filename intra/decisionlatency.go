@@ -0,0 +1,116 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// defaultSlowDecision is how long Flow.On takes before it is deemed slow.
+const defaultSlowDecision = 100 * time.Millisecond
+
+// decisionBounds are the upper bounds of the buckets of the histogram of
+// Flow.On latencies; the last bucket holds those beyond.
+var decisionBounds = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// decisionCounts counts Flow.On calls by the bucket of decisionBounds their
+// latency falls in.
+var decisionCounts [len(decisionBounds) + 1]int64
+
+// decisionTotal is the sum of the latencies of decisionCounts, in nanos.
+var decisionTotal int64
+
+// LatencyBucket counts Flow.On calls that took up to UpToMs.
+type LatencyBucket struct {
+	// UpToMs is the bucket's upper bound in millis; 0 for the last,
+	// which counts those that took longer than all other bounds.
+	UpToMs int64 `json:"upToMs"`
+	Count  int64 `json:"count"`
+}
+
+var (
+	// slowDecision is the threshold of OnSlowFlowDecision, in nanos.
+	slowDecision = int64(defaultSlowDecision)
+	// slowDecisionObserver holds a slowDecisionFunc; atomic.Value can't
+	// store nil.
+	slowDecisionObserver atomic.Value
+)
+
+type slowDecisionFunc struct {
+	f func(target string, d time.Duration)
+}
+
+// OnSlowFlowDecision sets f to be called with the target of each flow and
+// how long Flow.On took to decide it, whenever that is over the threshold
+// of SetSlowFlowDecisionThreshold. f is called as flows are decided, even
+// those that SetFlowTimeout gave up on, and must not block. A nil f
+// removes the callback.
+func OnSlowFlowDecision(f func(target string, d time.Duration)) {
+	slowDecisionObserver.Store(slowDecisionFunc{f})
+}
+
+// SetSlowFlowDecisionThreshold sets how long Flow.On takes before
+// OnSlowFlowDecision is told of it; 100ms by default.
+func SetSlowFlowDecisionThreshold(d time.Duration) {
+	if d <= 0 {
+		d = defaultSlowDecision
+	}
+	atomic.StoreInt64(&slowDecision, int64(d))
+}
+
+// decisionLatency returns the histogram of Flow.On latencies.
+func decisionLatency() []LatencyBucket {
+	h := make([]LatencyBucket, len(decisionCounts))
+	for i := range h {
+		if i < len(decisionBounds) {
+			h[i].UpToMs = int64(decisionBounds[i] / time.Millisecond)
+		}
+		h[i].Count = atomic.LoadInt64(&decisionCounts[i])
+	}
+	return h
+}
+
+// resetDecisionLatency empties the histogram of Flow.On latencies.
+func resetDecisionLatency() {
+	for i := range decisionCounts {
+		atomic.StoreInt64(&decisionCounts[i], 0)
+	}
+	atomic.StoreInt64(&decisionTotal, 0)
+}
+
+// timedDecision returns what on returns, recording how long it took to
+// decide the flow to target.
+func timedDecision(target string, on func() protect.Decision) protect.Decision {
+	begin := time.Now()
+	d := on()
+	took := time.Since(begin)
+
+	i := 0
+	for i < len(decisionBounds) && took > decisionBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&decisionCounts[i], 1)
+	atomic.AddInt64(&decisionTotal, int64(took))
+	if took > time.Duration(atomic.LoadInt64(&slowDecision)) {
+		if o, _ := slowDecisionObserver.Load().(slowDecisionFunc); o.f != nil {
+			o.f(target, took)
+		}
+	}
+	return d
+}
@@ -0,0 +1,87 @@
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlowFlowDecision(t *testing.T) {
+	defer OnSlowFlowDecision(nil)
+	defer SetSlowFlowDecisionThreshold(0)
+	resetDecisionLatency()
+	defer resetDecisionLatency()
+
+	type slow struct {
+		target string
+		d      time.Duration
+	}
+	slows := make(chan slow, 4)
+	OnSlowFlowDecision(func(target string, d time.Duration) {
+		slows <- slow{target, d}
+	})
+	SetSlowFlowDecisionThreshold(50 * time.Millisecond)
+
+	h := newTestUDPHandler("", newFakeListener())
+	src := &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	h.flow = &slowFlow{"wg0", 100 * time.Millisecond}
+	h.onNewConn(src, dst)
+	select {
+	case s := <-slows:
+		if s.target != dst.String() {
+			t.Errorf("slow decision for %s, want %s", s.target, dst)
+		}
+		if s.d < 100*time.Millisecond {
+			t.Errorf("slow decision took %v, flow took 100ms", s.d)
+		}
+	default:
+		t.Fatal("slow decision not reported")
+	}
+
+	// fast decisions aren't reported, but are counted
+	h.flow = &slowFlow{"wg0", 0}
+	h.onNewConn(src, dst)
+	select {
+	case s := <-slows:
+		t.Errorf("fast decision reported: %+v", s)
+	default:
+	}
+
+	var total, slowest int64
+	for _, b := range decisionLatency() {
+		total += b.Count
+		if b.UpToMs == 500 {
+			slowest = b.Count
+		}
+	}
+	if total != 2 || slowest != 1 {
+		t.Errorf("histogram %+v, want 2 decisions, 1 up to 500ms", decisionLatency())
+	}
+}
+
+func TestSlowFlowDecisionTimedOut(t *testing.T) {
+	defer OnSlowFlowDecision(nil)
+	defer SetFlowTimeout(0, false)
+	slows := make(chan time.Duration, 1)
+	OnSlowFlowDecision(func(target string, d time.Duration) {
+		slows <- d
+	})
+	SetSlowFlowDecisionThreshold(0)
+	SetFlowTimeout(50*time.Millisecond, false)
+
+	h := newTestUDPHandler("", newFakeListener())
+	h.flow = &slowFlow{"wg0", 300 * time.Millisecond}
+	h.onNewConn(&net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+
+	// reported once the flow decides, past the timeout
+	select {
+	case d := <-slows:
+		if d < 300*time.Millisecond {
+			t.Errorf("slow decision took %v, flow took 300ms", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out decision not reported")
+	}
+}
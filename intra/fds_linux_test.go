@@ -0,0 +1,30 @@
+package intra
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOpenFDs(t *testing.T) {
+	before := openFDs()
+	if before <= 0 {
+		t.Fatalf("%d fds open", before)
+	}
+	var files []*os.File
+	for i := 0; i < 5; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	if n := openFDs(); n != before+len(files) {
+		t.Errorf("%d fds open, want %d", n, before+len(files))
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if n := openFDs(); n != before {
+		t.Errorf("%d fds open once closed, want %d", n, before)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// FlowRecordVersion is the version of FlowRecord. Fields are only ever
+// added to it; the version goes up when they are.
+const FlowRecordVersion = 2
+
+// FlowRecord accounts for a tcp or udp flow once it closes, akin to an
+// IPFIX flow record.
+type FlowRecord struct {
+	// Version is the FlowRecordVersion of the record.
+	Version int `json:"version"`
+	// Protocol is 6 for tcp and 17 for udp, as in protect.Flow.
+	Protocol int32 `json:"protocol"`
+	// SrcIP and SrcPort are the app's end of the flow.
+	SrcIP   string `json:"srcIp"`
+	SrcPort int    `json:"srcPort"`
+	// DstIP and DstPort are what the app connected or sent to, if known.
+	DstIP   string `json:"dstIp"`
+	DstPort int    `json:"dstPort"`
+	// Uid owns the flow, -1 if unknown.
+	Uid int `json:"uid"`
+	// NetId is what the flow was decided to, see protect.Flow.
+	NetId string `json:"netid"`
+	// TxBytes and RxBytes are the bytes uploaded and downloaded.
+	TxBytes int64 `json:"txBytes"`
+	RxBytes int64 `json:"rxBytes"`
+	// TxPackets and RxPackets are the datagrams uploaded and downloaded;
+	// -1 for tcp, whose segments aren't seen.
+	TxPackets int64 `json:"txPackets"`
+	RxPackets int64 `json:"rxPackets"`
+	// StartMs and EndMs are when the flow started and closed, in unix millis.
+	StartMs int64 `json:"startMs"`
+	EndMs   int64 `json:"endMs"`
+	// DialedIP and DialedPort are what the flow was dialed to: DstIP and
+	// DstPort as translated, say to a nat64 address, or the proxy's the
+	// flow went over, if any; empty and 0 if unknown. Since version 2.
+	DialedIP   string `json:"dialedIp"`
+	DialedPort int    `json:"dialedPort"`
+}
+
+// flowExporter holds the recordExporter set, nil if none.
+var flowExporter atomic.Value
+
+type recordExporter func(FlowRecord)
+
+// SetFlowExporter sets f to be called with the record of each tcp and udp
+// flow forwarded, once it closes. f is called as flows close and must not
+// block. A nil f removes the exporter.
+func SetFlowExporter(f func(FlowRecord)) {
+	flowExporter.Store(recordExporter(f))
+}
+
+// exportFlow hands r, its version and 5-tuple set from src and dst, and
+// the address dialed, to the exporter, if any.
+func exportFlow(r FlowRecord, src net.Addr, dst, dialed string) {
+	e, _ := flowExporter.Load().(recordExporter)
+	if e == nil {
+		return
+	}
+	r.Version = FlowRecordVersion
+	if src != nil {
+		r.SrcIP, r.SrcPort = splitAddr(src.String())
+	}
+	r.DstIP, r.DstPort = splitAddr(dst)
+	r.DialedIP, r.DialedPort = splitAddr(dialed)
+	e(r)
+}
+
+// splitAddr returns the ip and port of addr, an ip:port, if it is one.
+func splitAddr(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
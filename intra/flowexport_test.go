@@ -0,0 +1,130 @@
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// exportTo sets an exporter that sends records to a channel, until undone.
+func exportTo() (chan FlowRecord, func()) {
+	records := make(chan FlowRecord, 4)
+	SetFlowExporter(func(r FlowRecord) { records <- r })
+	return records, func() { SetFlowExporter(nil) }
+}
+
+func TestTCPFlowRecord(t *testing.T) {
+	records, stop := exportTo()
+	defer stop()
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	begin := time.Now()
+	go h.forward(newTCPFlow(10, "wg0", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := server.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	server.Close()
+	// the close callback has what was dialed, too
+	dialed := server.LocalAddr().(*net.TCPAddr)
+	if s := <-l.tcp; s.RemoteAddr != dialed.String() {
+		t.Errorf("summary has remote addr %q, want %s", s.RemoteAddr, dialed)
+	}
+
+	r := <-records
+	src := local.LocalAddr().(*net.TCPAddr)
+	want := FlowRecord{
+		Version:   FlowRecordVersion,
+		Protocol:  6,
+		SrcIP:     src.IP.String(),
+		SrcPort:   src.Port,
+		DstIP:     "192.0.2.1",
+		DstPort:   443,
+		Uid:       10,
+		NetId:     "wg0",
+		TxBytes:   5,
+		RxBytes:   2,
+		TxPackets: -1,
+		RxPackets: -1,
+		// dialed to another ip than the target's, as with nat64
+		DialedIP:   dialed.IP.String(),
+		DialedPort: dialed.Port,
+	}
+	if r.StartMs < unixMillis(begin) || r.EndMs < r.StartMs || r.EndMs > unixMillis(time.Now()) {
+		t.Errorf("start %d, end %d", r.StartMs, r.EndMs)
+	}
+	r.StartMs, r.EndMs = 0, 0
+	if r != want {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+}
+
+func TestUDPFlowRecord(t *testing.T) {
+	records, stop := exportTo()
+	defer stop()
+	h := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: nonLoopbackIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		b := make([]byte, 64)
+		n, from, err := server.ReadFrom(b)
+		if err == nil {
+			server.WriteTo(b[:n], from)
+		}
+	}()
+	target := server.LocalAddr().(*net.UDPAddr)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the echo
+	deadline := time.Now().Add(5 * time.Second)
+	for h.ActiveConns()[0].RxBytes == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Close(conn)
+
+	r := <-records
+	r.StartMs, r.EndMs = 0, 0
+	want := FlowRecord{
+		Version:   FlowRecordVersion,
+		Protocol:  17,
+		SrcIP:     "10.111.222.1",
+		SrcPort:   5000,
+		DstIP:     target.IP.String(),
+		DstPort:   target.Port,
+		Uid:       -1,
+		NetId:     protect.NetIdActive,
+		TxBytes:   4,
+		RxBytes:   4,
+		TxPackets: 1,
+		RxPackets: 1,
+		// an unconnected socket sends to the target itself
+		DialedIP:   target.IP.String(),
+		DialedPort: target.Port,
+	}
+	if r != want {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// flowDebug is 1 when each flow is logged along with its decision.
+var flowDebug int32
+
+// SetFlowDebugLogging turns on, or off, a debug log line for every tcp and
+// udp flow with its 5-tuple, owner uid, net-id and the address dialed for it.
+func SetFlowDebugLogging(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&flowDebug, v)
+}
+
+func flowDebugOn() bool {
+	return atomic.LoadInt32(&flowDebug) == 1
+}
+
+// logFlow logs a flow from src to dst of proto, owned by uid, which was
+// decided to be sent to netid by dialing dialed, nil if it wasn't dialed.
+func logFlow(proto string, uid int, src, dst net.Addr, netid string, dialed net.Addr) {
+	if !flowDebugOn() {
+		return
+	}
+	d := "none"
+	if dialed != nil {
+		d = dialed.String()
+	}
+	log.Debugf("flow ts=%s proto=%s uid=%d src=%s dst=%s netid=%s dialed=%s",
+		time.Now().Format(time.RFC3339Nano), proto, uid, src, dst, netid, d)
+}
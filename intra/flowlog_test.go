@@ -0,0 +1,114 @@
+package intra
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// captureLogger keeps all debug lines logged.
+type captureLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) SetLevel(level log.LogLevel)            {}
+func (l *captureLogger) Infof(msg string, args ...interface{})  {}
+func (l *captureLogger) Warnf(msg string, args ...interface{})  {}
+func (l *captureLogger) Errorf(msg string, args ...interface{}) {}
+func (l *captureLogger) Fatalf(msg string, args ...interface{}) {}
+
+func (l *captureLogger) Debugf(msg string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(msg, args...))
+	l.Unlock()
+}
+
+// flowLines returns the flow lines logged.
+func (l *captureLogger) flowLines() []string {
+	l.Lock()
+	defer l.Unlock()
+	var flows []string
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "flow ") {
+			flows = append(flows, line)
+		}
+	}
+	return flows
+}
+
+func captureLogs(t *testing.T) *captureLogger {
+	l := &captureLogger{}
+	log.RegisterLogger(l)
+	t.Cleanup(func() { log.RegisterLogger(nil) })
+	return l
+}
+
+func TestLogFlow(t *testing.T) {
+	l := captureLogs(t)
+	src := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 40000}
+	dst := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+
+	logFlow("tcp", 10001, src, dst, "proxyA", nil)
+	if lines := l.flowLines(); len(lines) != 0 {
+		t.Fatalf("logged while off: %v", lines)
+	}
+
+	SetFlowDebugLogging(true)
+	defer SetFlowDebugLogging(false)
+	logFlow("tcp", 10001, src, dst, "proxyA", &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1080})
+
+	lines := l.flowLines()
+	if len(lines) != 1 {
+		t.Fatalf("got %d flow lines, want 1", len(lines))
+	}
+	for _, want := range []string{
+		"ts=", "proto=tcp", "uid=10001", "src=10.111.222.1:40000",
+		"dst=1.2.3.4:443", "netid=proxyA", "dialed=5.6.7.8:1080",
+	} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%q missing from %q", want, lines[0])
+		}
+	}
+}
+
+func TestTCPHandleLogsFlow(t *testing.T) {
+	l := captureLogs(t)
+	SetFlowDebugLogging(true)
+	defer SetFlowDebugLogging(false)
+
+	server, err := net.ListenTCP("tcp", &net.TCPAddr{IP: nonLoopbackIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Accept()
+
+	local, app := tcpPair(t)
+	defer app.Close()
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, &fakeFlow{"allow"}, mode, newFakeListener())
+
+	target := server.Addr().(*net.TCPAddr)
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	lines := l.flowLines()
+	if len(lines) != 1 {
+		t.Fatalf("got %d flow lines, want 1", len(lines))
+	}
+	for _, want := range []string{
+		"proto=tcp", "uid=-1", "src=" + local.LocalAddr().String(),
+		"dst=" + target.String(), "netid=allow", "dialed=" + target.String(),
+	} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%q missing from %q", want, lines[0])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+var (
+	// flowTimeout is how long Flow.On is waited on, in nanos; 0 is forever.
+	flowTimeout int64
+	// flowTimeoutAllow is 1 when flows whose decisions time out are allowed.
+	flowTimeoutAllow int32
+)
+
+// SetFlowTimeout bounds how long the tcp and udp handlers wait on Flow.On,
+// which may hang, say, on a prompt to the user, to d. Flows it doesn't decide
+// within d are forwarded to protect.NetIdActive if allow is set, and blocked
+// otherwise; its decision, once made, is dropped. A d of 0, the default,
+// waits on Flow.On for as long as it takes.
+func SetFlowTimeout(d time.Duration, allow bool) {
+	if d < 0 {
+		d = 0
+	}
+	var v int32
+	if allow {
+		v = 1
+	}
+	atomic.StoreInt32(&flowTimeoutAllow, v)
+	atomic.StoreInt64(&flowTimeout, int64(d))
+}
+
+// decideWithin returns what on returns for the flow to target, or the
+// decision of SetFlowTimeout, and true, if it takes too long to.
+func decideWithin(target string, on func() protect.Decision) (protect.Decision, bool) {
+	d := time.Duration(atomic.LoadInt64(&flowTimeout))
+	if d <= 0 {
+		return timedDecision(target, on), false
+	}
+	decision := make(chan protect.Decision, 1)
+	go func() {
+		decision <- timedDecision(target, on)
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case decided := <-decision:
+		return decided, false
+	case <-timer.C:
+		netid := protect.NetIdBlock
+		if atomic.LoadInt32(&flowTimeoutAllow) == 1 {
+			netid = protect.NetIdActive
+		}
+		log.Warnf("flow undecided after %v; using %s", d, netid)
+		return protect.Decision{NetId: netid}, true
+	}
+}
@@ -0,0 +1,63 @@
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// slowFlow decides netid after delay.
+type slowFlow struct {
+	netid string
+	delay time.Duration
+}
+
+func (f *slowFlow) On(protocol int32, uid int, source, target string) string {
+	time.Sleep(f.delay)
+	return f.netid
+}
+
+// newSlowHandler returns a udp handler whose flow decides netid after delay.
+func newSlowHandler(netid string, delay time.Duration) *udpHandler {
+	h := newTestUDPHandler("", newFakeListener())
+	h.flow = &slowFlow{netid, delay}
+	return h
+}
+
+func TestFlowTimeout(t *testing.T) {
+	defer SetFlowTimeout(0, false)
+	src := &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	for _, tc := range []struct {
+		allow bool
+		want  string
+	}{
+		{false, protect.NetIdBlock},
+		{true, protect.NetIdActive},
+	} {
+		SetFlowTimeout(100*time.Millisecond, tc.allow)
+		h := newSlowHandler("wg0", time.Second)
+		begin := time.Now()
+		_, d := h.onNewConn(src, dst)
+		if d.NetId != tc.want {
+			t.Errorf("allow %v: got %s, want %s", tc.allow, d.NetId, tc.want)
+		}
+		if took := time.Since(begin); took > 500*time.Millisecond {
+			t.Errorf("allow %v: decided after %v", tc.allow, took)
+		}
+	}
+
+	// decisions within the timeout stand
+	if _, d := newSlowHandler("wg0", 0).onNewConn(src, dst); d.NetId != "wg0" {
+		t.Errorf("got %s, want wg0", d.NetId)
+	}
+
+	// no timeout waits on the flow
+	SetFlowTimeout(0, false)
+	if _, d := newSlowHandler("wg0", 200*time.Millisecond).onNewConn(src, dst); d.NetId != "wg0" {
+		t.Errorf("got %s without a timeout, want wg0", d.NetId)
+	}
+}
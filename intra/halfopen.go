@@ -0,0 +1,102 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// halfOpenInterval is how often idle tcp flows are checked, in nanos, or
+// 0 if they aren't; see EnableHalfOpenReaping.
+var halfOpenInterval int64
+
+// EnableHalfOpenReaping has tcp flows begun from now on checked every
+// interval, once they move no bytes over one, and closed if the socket
+// of their remote conn is dead: if it has a pending error (SO_ERROR), or
+// the peer reset it, as a read or a peek at it finds; as of flows the app
+// holds open after their upstream went away. Peers that only closed their
+// end may still read, and so aren't reaped. Peers that vanish silently
+// are caught by tcp keepalives, which the tunnel's dialers enable, and
+// then reaped. Flows over backends, which aren't sockets, aren't checked.
+// An interval of 0 or less turns reaping off; it is off by default. Not
+// supported on windows, where flows are checked but never reaped.
+func EnableHalfOpenReaping(interval time.Duration) {
+	if interval < 0 {
+		interval = 0
+	}
+	atomic.StoreInt64(&halfOpenInterval, int64(interval))
+}
+
+func reapInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&halfOpenInterval))
+}
+
+// reapHalfOpen checks f every interval until stop is called, and closes
+// it once it is idle and its remote socket dead.
+func reapHalfOpen(f *tcpFlow, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		moved := f.moved()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if n := f.moved(); n != moved {
+				moved = n
+				continue
+			}
+			err := peerGone(f.remote)
+			if err == nil && atomic.LoadInt32(&f.reset) == 1 {
+				err = syscall.ECONNRESET
+			}
+			if err != nil {
+				log.Infof("tcp flow to %s half-open (%v); reaped", f.target, err)
+				f.local.Close()
+				f.remote.Close()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// moved returns the bytes f uploaded and downloaded so far.
+func (f *tcpFlow) moved() int64 {
+	return atomic.LoadInt64(&f.tx) + atomic.LoadInt64(&f.rx)
+}
+
+// peerGone returns why the socket of c is dead, or nil if it isn't or c
+// isn't a socket.
+func peerGone(c interface{}) error {
+	if dc, ok := c.(*deadlineConn); ok {
+		c = dc.DuplexConn
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var gone error
+	if err := rc.Control(func(fd uintptr) {
+		gone = socketGone(fd)
+	}); err != nil {
+		// closed already
+		return err
+	}
+	return gone
+}
@@ -0,0 +1,112 @@
+//go:build !windows
+// +build !windows
+
+package intra
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startHalfOpenFlow forwards a flow whose upstream, server, is closed by
+// end, while the app holds its side open; it returns once the app has
+// read the upstream's EOF.
+func startHalfOpenFlow(t *testing.T, end func(server *net.TCPConn)) (*fakeListener, *net.TCPConn) {
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	go h.forward(newTCPFlow(-1, "", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	end(server)
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := app.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("app read %v, want EOF", err)
+	}
+	return l, app
+}
+
+func TestHalfOpenReaped(t *testing.T) {
+	EnableHalfOpenReaping(100 * time.Millisecond)
+	defer EnableHalfOpenReaping(0)
+
+	l, app := startHalfOpenFlow(t, func(server *net.TCPConn) {
+		server.SetLinger(0)
+		server.Close()
+	})
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Error("reset flow not reaped")
+	}
+	app.Close()
+}
+
+func TestHalfClosedNotReaped(t *testing.T) {
+	EnableHalfOpenReaping(50 * time.Millisecond)
+	defer EnableHalfOpenReaping(0)
+
+	// a fin alone doesn't tell a peer that closed from one that may still
+	// read, having only shut down its writes
+	l, app := startHalfOpenFlow(t, func(server *net.TCPConn) { server.Close() })
+	select {
+	case <-l.tcp:
+		t.Fatal("half-closed flow reaped")
+	case <-time.After(300 * time.Millisecond):
+	}
+	app.Close()
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
+
+func TestHalfOpenNotReapedWhenOff(t *testing.T) {
+	l, app := startHalfOpenFlow(t, func(server *net.TCPConn) { server.Close() })
+	select {
+	case <-l.tcp:
+		t.Fatal("half-open flow reaped while reaping is off")
+	case <-time.After(300 * time.Millisecond):
+	}
+	app.Close()
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
+
+func TestIdleFlowNotReaped(t *testing.T) {
+	EnableHalfOpenReaping(50 * time.Millisecond)
+	defer EnableHalfOpenReaping(0)
+
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	go h.forward(newTCPFlow(-1, "", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	// both ends are up, though idle
+	select {
+	case <-l.tcp:
+		t.Fatal("live flow reaped")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if _, err := server.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(app, b); err != nil || string(b) != "hi" {
+		t.Fatalf("download failed: %v %s", err, b)
+	}
+	app.Close()
+	server.Close()
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
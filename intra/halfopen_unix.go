@@ -0,0 +1,30 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package intra
+
+import (
+	"syscall"
+)
+
+// socketGone returns the pending error of socket fd, or, peeking at it
+// without blocking, the error of its reset; nil if neither. Sockets whose
+// peer only closed its end, whose peek reads 0 bytes, aren't gone, as the
+// peer may still read what is sent to it.
+func socketGone(fd uintptr) error {
+	if soerr, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR); err == nil && soerr != 0 {
+		return syscall.Errno(soerr)
+	}
+	var b [1]byte
+	_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	if err == syscall.ECONNRESET || err == syscall.EPIPE {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows
+// +build windows
+
+package intra
+
+// socketGone returns nil; windows sockets can't be peeked at without
+// blocking.
+func socketGone(fd uintptr) error {
+	return nil
+}
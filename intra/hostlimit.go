@@ -0,0 +1,93 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// HostConns is how many tcp flows a uid has open to a host.
+type HostConns struct {
+	Uid   int    `json:"uid"`
+	Host  string `json:"host"`
+	Conns int    `json:"conns"`
+}
+
+type hostKey struct {
+	uid  int
+	host string
+}
+
+// perHostLimit caps the tcp flows per (uid, host); 0 is no cap.
+var perHostLimit int32
+
+// hostLimiter counts the tcp flows open per (uid, host), and caps them at
+// perHostLimit.
+type hostLimiter struct {
+	sync.Mutex
+	conns map[hostKey]int
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{conns: make(map[hostKey]int)}
+}
+
+// SetPerHostConnLimit caps the tcp flows each uid may have open to one
+// destination ip at n; flows over it are rejected, as if firewalled, until
+// some of those open close. An n of 0, the default, sets no cap. Flows open
+// already are left be, and counted against the cap.
+func SetPerHostConnLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&perHostLimit, int32(n))
+}
+
+// acquire counts a flow of uid to host, and returns a func that uncounts
+// it, once; or false if uid has as many flows to host as allowed.
+func (l *hostLimiter) acquire(uid int, host string) (func(), bool) {
+	k := hostKey{uid, host}
+	limit := int(atomic.LoadInt32(&perHostLimit))
+	l.Lock()
+	defer l.Unlock()
+	if limit > 0 && l.conns[k] >= limit {
+		return nil, false
+	}
+	l.conns[k]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			if l.conns[k]--; l.conns[k] <= 0 {
+				delete(l.conns, k)
+			}
+		})
+	}, true
+}
+
+// snapshot returns the flows open per (uid, host), most first.
+func (l *hostLimiter) snapshot() []HostConns {
+	l.Lock()
+	all := make([]HostConns, 0, len(l.conns))
+	for k, n := range l.conns {
+		all = append(all, HostConns{k.uid, k.host, n})
+	}
+	l.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Conns != all[j].Conns {
+			return all[i].Conns > all[j].Conns
+		}
+		if all[i].Uid != all[j].Uid {
+			return all[i].Uid < all[j].Uid
+		}
+		return all[i].Host < all[j].Host
+	})
+	return all
+}
@@ -0,0 +1,118 @@
+package intra
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestPerHostConnLimit(t *testing.T) {
+	SetPerHostConnLimit(2)
+	defer SetPerHostConnLimit(0)
+
+	server, err := net.ListenTCP("tcp", &net.TCPAddr{IP: nonLoopbackIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	target := server.Addr().(*net.TCPAddr)
+
+	l := newFakeListener()
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(&countingProtector{}), &fakeFlow{protect.NetIdActive}, mode, l)
+	handle := func() (*net.TCPConn, error) {
+		local, app := tcpPair(t)
+		if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+			app.Close()
+			local.Close()
+			return nil, err
+		}
+		return app, nil
+	}
+
+	var apps []*net.TCPConn
+	for i := 0; i < 2; i++ {
+		app, err := handle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer app.Close()
+		apps = append(apps, app)
+	}
+	if _, err := handle(); err == nil {
+		t.Fatal("flow over the limit forwarded")
+	}
+	// other hosts, and other uids, have caps of their own
+	release, ok := h.(*tcpHandler).hosts.acquire(-1, "192.0.2.99")
+	if !ok {
+		t.Error("flow to another host over the limit")
+	} else {
+		release()
+	}
+	if release, ok = h.(*tcpHandler).hosts.acquire(10, target.IP.String()); !ok {
+		t.Error("flow of another uid over the limit")
+	} else {
+		release()
+	}
+	if got := h.(*tcpHandler).hosts.snapshot(); len(got) != 1 || got[0].Conns != 2 || got[0].Host != target.IP.String() {
+		t.Errorf("got %v, want 2 flows to %s", got, target.IP)
+	}
+
+	// a closed flow frees its slot
+	apps[0].Close()
+	select {
+	case <-l.tcp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+	app, err := handle()
+	if err != nil {
+		t.Fatalf("flow under the limit rejected: %v", err)
+	}
+	app.Close()
+	<-l.tcp
+	apps[1].Close()
+	<-l.tcp
+	if got := h.(*tcpHandler).hosts.snapshot(); len(got) != 0 {
+		t.Errorf("flows counted after close: %v", got)
+	}
+}
+
+func TestHostLimiterRelease(t *testing.T) {
+	SetPerHostConnLimit(1)
+	defer SetPerHostConnLimit(0)
+	l := newHostLimiter()
+	release, ok := l.acquire(1, "192.0.2.1")
+	if !ok {
+		t.Fatal("first flow rejected")
+	}
+	if _, ok := l.acquire(1, "192.0.2.1"); ok {
+		t.Error("second flow accepted")
+	}
+	// releasing twice frees one slot
+	release()
+	release()
+	if _, ok := l.acquire(1, "192.0.2.1"); !ok {
+		t.Error("flow rejected after release")
+	}
+	if _, ok := l.acquire(1, "192.0.2.1"); ok {
+		t.Error("slot freed twice")
+	}
+}
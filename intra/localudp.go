@@ -0,0 +1,45 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// localUDPDirect is 1 when udp flows to the local network go direct.
+var localUDPDirect int32
+
+// localDecision is that of udp flows to the local network, which are
+// sent out the underlying network on protected sockets.
+var localDecision = protect.Decision{NetId: protect.NetIdActive}
+
+// SetLocalUDPDirect has udp flows to multicast (224.0.0.0/4, ff00::/8),
+// broadcast (255.255.255.255) and link-local addresses, such as of dhcp
+// and mdns, which only make sense on the local network, sent there
+// directly without asking Flow.On; unless the block mode decides all
+// flows, or their port is blocked. Off by default, when they are decided
+// as any other flow.
+func SetLocalUDPDirect(direct bool) {
+	var v int32
+	if direct {
+		v = 1
+	}
+	atomic.StoreInt32(&localUDPDirect, v)
+}
+
+// localUDP returns true if udp flows to ip go direct, per SetLocalUDPDirect.
+func localUDP(ip net.IP) bool {
+	return atomic.LoadInt32(&localUDPDirect) == 1 && isLocal(ip)
+}
+
+// isLocal returns true if ip is multicast, broadcast or link-local.
+func isLocal(ip net.IP) bool {
+	return ip.IsMulticast() || ip.Equal(net.IPv4bcast) || ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// metricsWriter writes metrics in the prometheus text exposition format.
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// family starts the metric name, of type typ, described by help.
+func (w *metricsWriter) family(name, typ, help string) {
+	w.b.WriteString("# HELP " + name + " " + help + "\n")
+	w.b.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes the value v of name, with labels, alternating names
+// and values, if any.
+func (w *metricsWriter) sample(name string, v float64, labels ...string) {
+	w.b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			w.b.WriteByte('{')
+		} else {
+			w.b.WriteByte(',')
+		}
+		w.b.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		if i+2 >= len(labels) {
+			w.b.WriteByte('}')
+		}
+	}
+	w.b.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes v to be quoted as a label value.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// metricsText returns the counters and histograms of the tunnel, its
+// handlers tcp and udp, and the dialers of package protect, in the
+// prometheus text exposition format.
+func metricsText(tcp TCPHandler, udp UDPHandler) string {
+	w := &metricsWriter{}
+
+	w.family("firestack_open_connections", "gauge", "Flows being forwarded, by protocol.")
+	w.sample("firestack_open_connections", float64(openConns(tcp)), "proto", "tcp")
+	w.sample("firestack_open_connections", float64(openConns(udp)), "proto", "udp")
+	if n := openFDs(); n >= 0 {
+		w.family("firestack_open_fds", "gauge", "File descriptors the process has open.")
+		w.sample("firestack_open_fds", float64(n))
+	}
+
+	w.family("firestack_flow_decision_seconds", "histogram", "How long Flow.On took to decide flows.")
+	var count int64
+	for i, b := range decisionLatency() {
+		count += b.Count
+		le := "+Inf"
+		if i < len(decisionBounds) {
+			le = strconv.FormatFloat(decisionBounds[i].Seconds(), 'g', -1, 64)
+		}
+		w.sample("firestack_flow_decision_seconds_bucket", float64(count), "le", le)
+	}
+	total := time.Duration(atomic.LoadInt64(&decisionTotal))
+	w.sample("firestack_flow_decision_seconds_sum", total.Seconds())
+	w.sample("firestack_flow_decision_seconds_count", float64(count))
+
+	rs := rates.rates()
+	netids := make([]string, 0, len(rs))
+	for netid := range rs {
+		netids = append(netids, netid)
+	}
+	sort.Strings(netids)
+	w.family("firestack_receive_bytes_per_second", "gauge", "Bytes downloaded per second over the last few seconds, by net-id.")
+	for _, netid := range netids {
+		w.sample("firestack_receive_bytes_per_second", rs[netid].RxBps, "netid", netid)
+	}
+	w.family("firestack_transmit_bytes_per_second", "gauge", "Bytes uploaded per second over the last few seconds, by net-id.")
+	for _, netid := range netids {
+		w.sample("firestack_transmit_bytes_per_second", rs[netid].TxBps, "netid", netid)
+	}
+
+	cs := protect.CacheStats()
+	w.family("firestack_dns_cache_hits_total", "counter", "Queries answered from the negative dns cache.")
+	w.sample("firestack_dns_cache_hits_total", float64(cs.Hits))
+	w.family("firestack_dns_cache_misses_total", "counter", "Queries sent on for want of a cached negative answer.")
+	w.sample("firestack_dns_cache_misses_total", float64(cs.Misses))
+	w.family("firestack_dns_cache_evictions_total", "counter", "Answers dropped from the negative dns cache once expired.")
+	w.sample("firestack_dns_cache_evictions_total", float64(cs.Evictions))
+	w.family("firestack_dns_cache_entries", "gauge", "Answers in the negative dns cache, some of which may be expired.")
+	w.sample("firestack_dns_cache_entries", float64(cs.Size))
+
+	he := protect.GetHappyEyeballsStats()
+	w.family("firestack_happy_eyeballs_wins_total", "counter", "Dials to hostnames won by an address of each family.")
+	w.sample("firestack_happy_eyeballs_wins_total", float64(he.V4Wins), "family", "4")
+	w.sample("firestack_happy_eyeballs_wins_total", float64(he.V6Wins), "family", "6")
+	w.family("firestack_happy_eyeballs_fallbacks_total", "counter", "Dials to hostnames won by the family not tried first.")
+	w.sample("firestack_happy_eyeballs_fallbacks_total", float64(he.Fallbacks))
+
+	return w.b.String()
+}
@@ -0,0 +1,106 @@
+package intra
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+var (
+	metricName   = `[a-zA-Z_:][a-zA-Z0-9_:]*`
+	helpLine     = regexp.MustCompile(`^# HELP (` + metricName + `) \S.*$`)
+	typeLine     = regexp.MustCompile(`^# TYPE (` + metricName + `) (counter|gauge|histogram)$`)
+	sampleLine   = regexp.MustCompile(`^(` + metricName + `)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+	histSuffixes = []string{"_bucket", "_sum", "_count"}
+)
+
+// checkExposition fails t if text isn't in the prometheus text format:
+// each sample of a family typed and described before it, families not
+// repeated.
+func checkExposition(t *testing.T, text string) {
+	t.Helper()
+	if !strings.HasSuffix(text, "\n") {
+		t.Error("no trailing newline")
+	}
+	types := make(map[string]string)
+	helped := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if m := helpLine.FindStringSubmatch(line); m != nil {
+			if helped[m[1]] {
+				t.Errorf("%s described twice", m[1])
+			}
+			helped[m[1]] = true
+			continue
+		}
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			if _, ok := types[m[1]]; ok {
+				t.Errorf("%s typed twice", m[1])
+			}
+			types[m[1]] = m[2]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("bad line %q", line)
+			continue
+		}
+		name := m[1]
+		if _, ok := types[name]; !ok {
+			for _, suffix := range histSuffixes {
+				if base := strings.TrimSuffix(name, suffix); base != name && types[base] == "histogram" {
+					name = base
+				}
+			}
+		}
+		if _, ok := types[name]; !ok {
+			t.Errorf("%s sampled before its type", m[1])
+		}
+		if !helped[name] {
+			t.Errorf("%s sampled before its help", m[1])
+		}
+	}
+}
+
+func TestMetricsText(t *testing.T) {
+	resetDecisionLatency()
+	defer resetDecisionLatency()
+	protect.ResetHappyEyeballsStats()
+
+	timedDecision("192.0.2.1:443", func() protect.Decision { return protect.Decision{} })
+	timedDecision("192.0.2.1:443", func() protect.Decision {
+		time.Sleep(20 * time.Millisecond)
+		return protect.Decision{}
+	})
+	rates.add(`wg"0`, 500, 100)
+
+	h := &tcpHandler{listener: newFakeListener()}
+	u := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	text := metricsText(h, u)
+	checkExposition(t, text)
+
+	for _, want := range []string{
+		`firestack_open_connections{proto="tcp"} 0`,
+		`firestack_open_connections{proto="udp"} 0`,
+		`firestack_flow_decision_seconds_bucket{le="0.01"} 1`,
+		`firestack_flow_decision_seconds_bucket{le="0.05"} 2`,
+		`firestack_flow_decision_seconds_bucket{le="+Inf"} 2`,
+		`firestack_flow_decision_seconds_count 2`,
+		`firestack_receive_bytes_per_second{netid="wg\"0"} 100`,
+		`firestack_transmit_bytes_per_second{netid="wg\"0"} 20`,
+		`firestack_happy_eyeballs_wins_total{family="4"} 0`,
+		"# TYPE firestack_dns_cache_hits_total counter",
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("no %s in\n%s", want, text)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got, want := escapeLabel("a\\b\"c\nd"), `a\\b\"c\nd`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// pmtuLargeUpload is how much must be sent up, without anything coming
+// down, for a stall to be blamed on packet size; more than fits in one
+// packet on links with the smallest of mtus.
+const pmtuLargeUpload = 1500
+
+// pmtuStall is how long a flow waits for a reply to a large upload, or for
+// the upload to go on, before a black hole is suspected; a var, for tests.
+var pmtuStall = 10 * time.Second
+
+// pmtuWatch suspects a path-mtu black hole on a tcp flow that, after bytes
+// have gone both ways, as in a handshake, sends at least pmtuLargeUpload
+// bytes up but then neither hears anything back nor sends more for
+// pmtuStall, as once a black hole fills its send buffer; flows that stall
+// after small requests, such as long polls, and long uploads answered
+// only at their end, are not suspect.
+type pmtuWatch struct {
+	target   string
+	listener PMTUListener
+
+	down     int64 // atomic; bytes downloaded
+	pending  int64 // atomic; bytes uploaded since the last download
+	largeAt  int64 // atomic; unix nanos when pending last grew while large, or 0
+	reported int32 // atomic; 1 once reported
+
+	mu    sync.Mutex
+	timer *time.Timer // fires pmtuStall after pending becomes large
+	done  bool
+}
+
+// newPMTUWatch returns a watch of the flow to target; nil watches, of flows
+// not watched, note nothing.
+func newPMTUWatch(target string, listener PMTUListener) *pmtuWatch {
+	return &pmtuWatch{target: target, listener: listener}
+}
+
+// received notes n bytes downloaded.
+func (w *pmtuWatch) received(n int) {
+	if w == nil {
+		return
+	}
+	atomic.AddInt64(&w.down, int64(n))
+	atomic.StoreInt64(&w.pending, 0)
+	atomic.StoreInt64(&w.largeAt, 0)
+}
+
+// sent notes n bytes uploaded.
+func (w *pmtuWatch) sent(n int) {
+	if w == nil {
+		return
+	}
+	pending := atomic.AddInt64(&w.pending, int64(n))
+	if pending < pmtuLargeUpload || atomic.LoadInt64(&w.down) == 0 {
+		return
+	}
+	// the stall is timed from the last of the upload
+	atomic.StoreInt64(&w.largeAt, time.Now().UnixNano())
+	w.arm(pmtuStall)
+}
+
+func (w *pmtuWatch) arm(after time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil && !w.done && atomic.LoadInt32(&w.reported) == 0 {
+		w.timer = time.AfterFunc(after, w.check)
+	}
+}
+
+// check reports the flow if nothing came down, nor went up, for pmtuStall
+// since pending became large.
+func (w *pmtuWatch) check() {
+	w.mu.Lock()
+	w.timer = nil
+	done := w.done
+	w.mu.Unlock()
+	if done {
+		return
+	}
+	at := atomic.LoadInt64(&w.largeAt)
+	if at == 0 {
+		// a download since reset pending; the next large upload re-arms
+		return
+	}
+	if wait := pmtuStall - time.Since(time.Unix(0, at)); wait > 0 {
+		w.arm(wait)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&w.reported, 0, 1) {
+		log.Warnf("tcp flow to %s stalled after a large upload; pmtu black hole?", w.target)
+		w.listener.OnPMTUBlackHoleSuspected(w.target)
+	}
+}
+
+// stop ends the watch once the flow closes.
+func (w *pmtuWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
@@ -0,0 +1,187 @@
+package intra
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPMTUFlow forwards a flow whose server answers the app's hello, and
+// then each upload if reply is set, and returns the app's end.
+func startPMTUFlow(t *testing.T, h *tcpHandler, reply bool) (app *net.TCPConn, target string) {
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	go func() {
+		defer server.Close()
+		b := make([]byte, 4096)
+		if _, err := io.ReadFull(server, b[:5]); err != nil {
+			return
+		}
+		server.Write([]byte("hello"))
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			if reply {
+				server.Write(b[:1])
+			}
+		}
+	}()
+	go h.forward(newTCPFlow(-1, "", "", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(app, b); err != nil {
+		t.Fatal(err)
+	}
+	return app, remote.RemoteAddr().String()
+}
+
+// closeFlows closes apps and waits for their flows to end.
+func closeFlows(l *fakeListener, apps ...*net.TCPConn) {
+	for _, app := range apps {
+		app.Close()
+		<-l.tcp
+	}
+}
+
+func setPMTUStall(d time.Duration) func() {
+	stall := pmtuStall
+	pmtuStall = d
+	return func() { pmtuStall = stall }
+}
+
+func TestPMTUBlackHoleSuspected(t *testing.T) {
+	defer setPMTUStall(100 * time.Millisecond)()
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	app, target := startPMTUFlow(t, h, false)
+	defer closeFlows(l, app)
+
+	// a large upload after the handshake goes unanswered
+	if _, err := app.Write(make([]byte, 4*pmtuLargeUpload)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-l.pmtu:
+		if got != target {
+			t.Errorf("suspected %s, want %s", got, target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stall not reported")
+	}
+	// once per flow
+	app.Write(make([]byte, 4*pmtuLargeUpload))
+	select {
+	case <-l.pmtu:
+		t.Error("stall reported twice")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPMTUNotSuspected(t *testing.T) {
+	defer setPMTUStall(100 * time.Millisecond)()
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+
+	// a small request without a reply, as in a long poll
+	poll, _ := startPMTUFlow(t, h, false)
+	defer closeFlows(l, poll)
+	if _, err := poll.Write([]byte("GET /poll")); err != nil {
+		t.Fatal(err)
+	}
+
+	// large uploads that are answered
+	answered, _ := startPMTUFlow(t, h, true)
+	defer closeFlows(l, answered)
+	go io.Copy(ioutil.Discard, answered)
+	for i := 0; i < 5; i++ {
+		if _, err := answered.Write(make([]byte, pmtuLargeUpload)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case got := <-l.pmtu:
+		t.Errorf("suspected %s", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPMTULongUploadNotSuspected(t *testing.T) {
+	defer setPMTUStall(100 * time.Millisecond)()
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	app, _ := startPMTUFlow(t, h, false)
+	defer closeFlows(l, app)
+
+	// an upload, answered only at its end, that goes on past the stall
+	for i := 0; i < 10; i++ {
+		if _, err := app.Write(make([]byte, pmtuLargeUpload)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	select {
+	case got := <-l.pmtu:
+		t.Errorf("suspected %s while uploading", got)
+	default:
+	}
+}
+
+// summaryListener is a TCPListener that isn't a PMTUListener.
+type summaryListener struct {
+	tcp chan *TCPSocketSummary
+}
+
+func (l *summaryListener) OnTCPSocketClosed(s *TCPSocketSummary) { l.tcp <- s }
+
+// addrlessConn is a conn without a remote address, as of some backends.
+type addrlessConn struct {
+	net.Conn
+}
+
+func (c addrlessConn) RemoteAddr() net.Addr { return nil }
+
+func TestPMTUUnwatchedFlows(t *testing.T) {
+	for name, l := range map[string]TCPListener{
+		"no pmtu listener": &summaryListener{tcp: make(chan *TCPSocketSummary, 1)},
+		"no remote addr":   newFakeListener(),
+	} {
+		local, app := tcpPair(t)
+		remote, server := tcpPair(t)
+		var rc net.Conn = remote
+		if name == "no remote addr" {
+			rc = addrlessConn{remote}
+		}
+		h := &tcpHandler{listener: l}
+		go h.forward(newTCPFlow(-1, "", "", &fakeTCPConn{local}, newBackendConn(rc)), &TCPSocketSummary{}, 0)
+
+		if _, err := app.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(server, b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		app.Close()
+		server.Close()
+		var closed <-chan *TCPSocketSummary
+		switch l := l.(type) {
+		case *summaryListener:
+			closed = l.tcp
+		case *fakeListener:
+			closed = l.tcp
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: flow not closed", name)
+		}
+	}
+}
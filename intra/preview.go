@@ -0,0 +1,133 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+var (
+	errBadPreviewProtocol = errors.New("protocol must be 6 (tcp) or 17 (udp)")
+	errNoPreview          = errors.New("handler can't preview flows")
+)
+
+// Verdict is what the tunnel would do with a flow, see Tunnel.WouldBlock.
+type Verdict struct {
+	// Blocked is true if the flow would be blocked.
+	Blocked bool
+	// NetId is the net-id the flow is decided to, which is
+	// protect.NetIdBlock if the flow or the tunnel's rules block it.
+	NetId string
+	// Reason is why the flow would be blocked, as its BlockedError has it;
+	// empty if it wouldn't be.
+	Reason string
+}
+
+// wouldBlock previews the flow of uid to target (ip:port) on protocol;
+// see Tunnel.WouldBlock.
+func wouldBlock(tcp TCPHandler, udp UDPHandler, protocol int32, uid int, target string) (*Verdict, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, &net.AddrError{Err: "not an ip address", Addr: target}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, &net.AddrError{Err: "bad port", Addr: target}
+	}
+
+	var netid string
+	var blocked *BlockedError
+	switch protocol {
+	case 6:
+		h, ok := tcp.(*tcpHandler)
+		if !ok {
+			return nil, errNoPreview
+		}
+		netid, blocked = h.preview(uid, &net.TCPAddr{IP: ip, Port: p})
+	case 17:
+		h, ok := udp.(*udpHandler)
+		if !ok {
+			return nil, errNoPreview
+		}
+		netid, blocked = h.preview(uid, &net.UDPAddr{IP: ip, Port: p})
+	default:
+		return nil, errBadPreviewProtocol
+	}
+	v := &Verdict{NetId: netid}
+	if blocked != nil {
+		v.Blocked = true
+		v.Reason = blocked.Reason
+	}
+	return v, nil
+}
+
+// decideMode returns the decision for flows per the block mode, if it
+// decides them without the flow.
+func decideMode(mode *settings.TunMode) (protect.Decision, bool) {
+	switch mode.BlockMode {
+	case settings.BlockModeSink:
+		return protect.Decision{NetId: protect.NetIdBlock, Reason: reasonSink}, true
+	case settings.BlockModeNone:
+		return protect.Decision{NetId: protect.NetIdActive}, true
+	}
+	return protect.Decision{}, false
+}
+
+// preview returns the net-id a flow of uid to target would be decided to,
+// and the error it would be blocked with, if any, per the rules Handle
+// applies before it dials; see admit. The flow is asked as by Handle, but
+// without a source, and its decisions are cached as usual. Per-host
+// limits, which depend on the flows open at the time, aren't previewed.
+func (h *tcpHandler) preview(uid int, target *net.TCPAddr) (string, *BlockedError) {
+	a, _, err := h.admit(nil, target, func() (int, protect.Decision) {
+		if d, ok := decideMode(h.tunMode); ok {
+			return uid, d
+		}
+		return uid, h.decideFlow(uid, "", target)
+	})
+	return a.netid, err
+}
+
+// routable returns true if flows decided to netid can be forwarded.
+func (h *tcpHandler) routable(netid string) bool {
+	if netid == protect.NetIdActive || netid == protect.NetIdBaseUnprotected {
+		return true
+	}
+	h.RLock()
+	defer h.RUnlock()
+	return h.proxies[netid] != nil || h.backends[netid] != nil
+}
+
+// preview is tcpHandler.preview for udp flows, per the rules of Connect.
+func (h *udpHandler) preview(uid int, target *net.UDPAddr) (string, *BlockedError) {
+	a, _, err := h.admit(nil, target, func() (int, protect.Decision) {
+		if d, ok := decideMode(h.tunMode); ok {
+			return uid, d
+		}
+		return uid, h.decideFlow(uid, "", target)
+	})
+	return a.netid, err
+}
+
+// routable returns true if flows decided to netid can be forwarded.
+func (h *udpHandler) routable(netid string) bool {
+	if netid == protect.NetIdActive || netid == protect.NetIdBaseUnprotected {
+		return true
+	}
+	h.RLock()
+	defer h.RUnlock()
+	return h.proxies[netid] != nil || h.backends[netid] != nil
+}
@@ -0,0 +1,115 @@
+package intra
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestWouldBlockMatchesDial(t *testing.T) {
+	defer SetBlockedPorts(nil)
+	SetBlockedPorts([]int{445})
+
+	handlers := func(flow protect.Flow, blockMode int, p protect.Protector) (TCPHandler, UDPHandler) {
+		mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: blockMode}
+		return NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(p), flow, mode, newFakeListener()),
+			NewUDPHandler(net.UDPAddr{}, time.Minute, flow, mode, protect.MakeListenConfig(p), newFakeListener())
+	}
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	for _, tc := range []struct {
+		name      string
+		netid     string
+		blockMode int
+		port      int
+	}{
+		{"policy", protect.NetIdBlock + "#reason=tracker list", settings.BlockModeFilter, 80},
+		{"policy without a reason", protect.NetIdBlock, settings.BlockModeFilter, 80},
+		{"sink", protect.NetIdActive, settings.BlockModeSink, 80},
+		{"blocked port", protect.NetIdActive, settings.BlockModeFilter, 445},
+		{"no such netid", "wg9", settings.BlockModeFilter, 80},
+		{"unprotected", protect.NetIdBaseUnprotected, settings.BlockModeFilter, 80},
+	} {
+		target.Port = tc.port
+		for _, proto := range []int32{6, 17} {
+			tcp, udp := handlers(&fakeFlow{tc.netid}, tc.blockMode, &countingProtector{})
+			var err error
+			if proto == 6 {
+				local, app := tcpPair(t)
+				err = tcp.Handle(&fakeTCPConn{local}, target)
+				local.Close()
+				app.Close()
+			} else {
+				conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+				err = udp.Connect(conn, &net.UDPAddr{IP: target.IP, Port: target.Port})
+			}
+			var be *BlockedError
+			if !errors.As(err, &be) {
+				t.Fatalf("%d %s: dial got %v, want a BlockedError", proto, tc.name, err)
+			}
+
+			tcp, udp = handlers(&fakeFlow{tc.netid}, tc.blockMode, &countingProtector{})
+			v, err := wouldBlock(tcp, udp, proto, 10, target.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Blocked || v.Reason != be.Reason {
+				t.Errorf("%d %s: got %+v, want blocked for %q", proto, tc.name, v, be.Reason)
+			}
+		}
+	}
+}
+
+func TestWouldBlockAllowed(t *testing.T) {
+	p := &countingProtector{}
+	f := &countingFlow{}
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	tcp := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(p), &fakeFlow{protect.NetIdActive}, mode, newFakeListener())
+	udp := NewUDPHandler(net.UDPAddr{}, time.Minute, f, mode, protect.MakeListenConfig(p), newFakeListener())
+
+	v, err := wouldBlock(tcp, udp, 6, 10, "192.0.2.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Blocked || v.NetId != protect.NetIdActive || len(v.Reason) > 0 {
+		t.Errorf("got %+v, want allowed", v)
+	}
+	// loopback flows are never asked of the flow
+	if v, _ := wouldBlock(tcp, udp, 17, 10, "127.0.0.1:53"); v.Blocked || atomic.LoadInt32(&f.n) != 0 {
+		t.Errorf("got %+v for loopback, flow called %d times", v, atomic.LoadInt32(&f.n))
+	}
+
+	// decisions are cached as those of flows are
+	udp.SetUidRouteCacheSize(8)
+	for i := 0; i < 3; i++ {
+		if v, _ := wouldBlock(tcp, udp, 17, 10, "[2001:db8::1]:443"); !v.Blocked || v.NetId != protect.NetIdBlock {
+			t.Errorf("got %+v, want blocked", v)
+		}
+	}
+	if n := atomic.LoadInt32(&f.n); n != 1 {
+		t.Errorf("flow called %d times, want 1", n)
+	}
+	if n := p.count(); n != 0 {
+		t.Errorf("%d sockets opened to preview flows", n)
+	}
+}
+
+func TestWouldBlockInvalid(t *testing.T) {
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	tcp := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(nil), &fakeFlow{protect.NetIdActive}, mode, newFakeListener())
+	udp := NewUDPHandler(net.UDPAddr{}, time.Minute, &fakeFlow{protect.NetIdActive}, mode, &net.ListenConfig{}, newFakeListener())
+
+	for _, target := range []string{"foo.test:80", "192.0.2.1", "192.0.2.1:x", "192.0.2.1:70000"} {
+		if _, err := wouldBlock(tcp, udp, 6, 10, target); err == nil {
+			t.Errorf("%s: previewed", target)
+		}
+	}
+	if _, err := wouldBlock(tcp, udp, 1, 10, "192.0.2.1:80"); err != errBadPreviewProtocol {
+		t.Errorf("got %v, want errBadPreviewProtocol", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// noAAAA is 1 when AAAA queries are answered locally, with no records.
+var noAAAA int32
+
+// SetDisableAAAA sets whether the resolvers of protected dialers skip AAAA
+// queries, for networks whose middleboxes drop them, so that lookups don't
+// wait on them to time out. When set, AAAA queries are answered with no
+// records without being sent, and DialContext only dials the ipv4 addresses
+// of hostnames. Literal ipv6 targets are dialed as before.
+func SetDisableAAAA(disable bool) {
+	var v int32
+	if disable {
+		v = 1
+	}
+	atomic.StoreInt32(&noAAAA, v)
+}
+
+func aaaaDisabled() bool {
+	return atomic.LoadInt32(&noAAAA) == 1
+}
+
+func init() {
+	// to answer AAAA queries without sending them
+	needDNSConn(func(*dialConfig) bool { return aaaaDisabled() })
+}
+
+// withoutAAAA wraps exchange to answer AAAA queries itself, if disabled.
+func withoutAAAA(exchange func(context.Context, []byte) ([]byte, error)) func(context.Context, []byte) ([]byte, error) {
+	return func(ctx context.Context, q []byte) ([]byte, error) {
+		if aaaaDisabled() {
+			if k, ok := questionOf(q); ok && k.qtype == dnsmessage.TypeAAAA {
+				return noRecords(q)
+			}
+		}
+		return exchange(ctx, q)
+	}
+}
+
+// noRecords returns an answer to q with no records in it.
+func noRecords(q []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.RCode = dnsmessage.RCodeSuccess
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil
+	return msg.Pack()
+}
@@ -0,0 +1,94 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// qtypeRecorder answers queries on a udp port with fooIP, noting their types.
+type qtypeRecorder struct {
+	net.PacketConn
+	mu     sync.Mutex
+	qtypes []dnsmessage.Type
+}
+
+func startQtypeRecorder(t *testing.T) *qtypeRecorder {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &qtypeRecorder{PacketConn: c}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if k, ok := questionOf(b[:n]); ok {
+				r.mu.Lock()
+				r.qtypes = append(r.qtypes, k.qtype)
+				r.mu.Unlock()
+			}
+			c.WriteTo(answer(b[:n]), from)
+		}
+	}()
+	return r
+}
+
+func (r *qtypeRecorder) saw(qtype dnsmessage.Type) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDisableAAAA(t *testing.T) {
+	for _, disable := range []bool{true, false} {
+		r := startQtypeRecorder(t)
+		err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: r.LocalAddr().(*net.UDPAddr).Port}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetDisableAAAA(disable)
+
+		ips, err := MakeDialer(&fakeProtector{}).Resolver.LookupIP(context.Background(), "ip", "foo.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(fooIP) {
+			t.Errorf("disable %v: got %v, want %s", disable, ips, fooIP)
+		}
+		if !r.saw(dnsmessage.TypeA) {
+			t.Errorf("disable %v: A not queried", disable)
+		}
+		if r.saw(dnsmessage.TypeAAAA) == disable {
+			t.Errorf("disable %v: AAAA queried %v", disable, !disable)
+		}
+		r.Close()
+	}
+	SetDNSTransports(nil)
+}
+
+func TestNoRecords(t *testing.T) {
+	q := makeQuery(t, 7, "foo.test.", dnsmessage.TypeAAAA)
+	ans, err := noRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(q, ans); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := parseAddrs("foo.test.", ans)
+	if err != nil || len(ips) != 0 {
+		t.Errorf("got %v, %v; want no records", ips, err)
+	}
+}
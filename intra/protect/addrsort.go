@@ -0,0 +1,416 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// RFC6724 orders addresses per the destination address selection
+// rules of RFC 6724, considering the source address for each, if known.
+const RFC6724 int = 0
+
+// AsReceived keeps addresses in the order the resolver returned them.
+const AsReceived int = 1
+
+// V4First tries ipv4 addresses before ipv6, otherwise as received.
+const V4First int = 2
+
+// V6First tries ipv6 addresses before ipv4, otherwise as received.
+const V6First int = 3
+
+var errBadSortPolicy = errors.New("unknown address sort policy")
+
+// SetAddressSortPolicy sets the order in which DialContext tries the
+// addresses a hostname resolves to.
+func SetAddressSortPolicy(policy int) error {
+	if !validSortPolicy(policy) {
+		return errBadSortPolicy
+	}
+	updateDialConfig(func(c *dialConfig) {
+		c.sortPolicy = policy
+	})
+	return nil
+}
+
+func validSortPolicy(policy int) bool {
+	switch policy {
+	case RFC6724, AsReceived, V4First, V6First:
+		return true
+	}
+	return false
+}
+
+func addressSortPolicy() int {
+	return loadDialConfig().sortPolicy
+}
+
+// sortAddrs sorts ips in-place per policy. srcs holds the source address
+// for each ip in ips, or nil where it couldn't be determined; it is only
+// used by RFC6724.
+func sortAddrs(policy int, ips []net.IP, srcs []net.IP) {
+	switch policy {
+	case RFC6724:
+		sort.Stable(&byRFC6724{ips, srcs})
+	case V4First, V6First:
+		wantV4 := policy == V4First
+		sort.SliceStable(ips, func(i, j int) bool {
+			return (ips[i].To4() != nil) == wantV4 && (ips[j].To4() != nil) != wantV4
+		})
+	}
+}
+
+// srcAddrs returns the source address the os would pick to reach each of
+// ips, by connecting (but not sending on) protected udp sockets.
+func srcAddrs(ctx context.Context, d *net.Dialer, ips []net.IP) []net.IP {
+	direct := bareDialerOf(d)
+	srcs := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		// port 9 is discard; the port doesn't matter as nothing is sent.
+		c, err := direct.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), "9"))
+		if err != nil {
+			continue
+		}
+		srcs[i] = c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+	}
+	return srcs
+}
+
+// resolveAndDial resolves the host in addr with d's Resolver, sorts the
+// answers per the address sort policy and dials them, staggered by
+// d.FallbackDelay, as set from MakeDialerOpts.ConnectionAttemptDelay.
+func resolveAndDial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// resolve and sort with the same config
+	ctx = pinDialConfig(ctx)
+	ctx, cancel := withDialBudget(ctx)
+	defer cancel()
+	trace := connTraceOf(ctx)
+	trace.dnsStart(host)
+	ipaddrs, err := d.Resolver.LookupIPAddr(ctx, host)
+	trace.dnsDone(ipaddrs, err)
+	if err != nil {
+		return nil, err
+	}
+	v4only := network == "tcp4" || network == "udp4" || aaaaDisabled()
+	ips := make([]net.IP, 0, len(ipaddrs))
+	for _, ipaddr := range ipaddrs {
+		if v4only && ipaddr.IP.To4() == nil {
+			continue
+		}
+		if (network == "tcp6" || network == "udp6") && ipaddr.IP.To4() != nil {
+			continue
+		}
+		ips = append(ips, ipaddr.IP)
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	if ips = routable(ctx, d, ips); len(ips) == 0 {
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrNoIPv6)
+	}
+
+	policy := dialConfigOf(ctx).sortPolicy
+	var srcs []net.IP
+	if policy == RFC6724 && len(ips) > 1 {
+		srcs = srcAddrs(ctx, d, ips)
+	}
+	sortAddrs(policy, ips, srcs)
+	if policy == RFC6724 {
+		ips = interleave(ips)
+	}
+
+	direct := *d
+	direct.Resolver = nil
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = defaultConnectionAttemptDelay
+	}
+	return dialStaggered(ctx, addrs, delay, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialTraced(ctx, &direct, network, addr)
+	})
+}
+
+// interleave reorders sorted ips to alternate between families, starting
+// with the family of the first, as per RFC 8305, section 4.
+func interleave(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+type attempt struct {
+	addr string
+	c    net.Conn
+	err  error
+}
+
+// dialStaggered dials addrs in order, starting the next attempt once the
+// previous one fails or hasn't connected within delay (RFC 8305, section 5),
+// and returns the first conn to connect. Attempts still in flight are then
+// canceled. A negative delay starts the next attempt only on failure. With
+// a dial budget, each attempt is also cut off at its share of the budget.
+// Which family wins is counted, see GetHappyEyeballsStats. If all fail, so
+// does dialStaggered, with the errors of each.
+func dialStaggered(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attempt, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		actx, acancel := attemptContext(ctx, len(addrs)-next)
+		next++
+		pending++
+		go func() {
+			defer acancel()
+			c, err := dial(actx, addr)
+			results <- attempt{addr, c, err}
+		}()
+	}
+
+	begin := time.Now()
+	first := familyOf(addrs[0])
+	firstFailed := false
+	var errs multiDialError
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if delay >= 0 && next < len(addrs) {
+			timer = time.NewTimer(delay)
+			fallback = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				stopTimer(timer)
+				go drain(results, pending)
+				recordWin(familyOf(r.addr), first, firstFailed, time.Since(begin))
+				return r.c, nil
+			}
+			errs.add(r.addr, r.err)
+			if familyOf(r.addr) == first {
+				firstFailed = true
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+		stopTimer(timer)
+	}
+	return nil, errs.err()
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// drain closes conns of the n attempts that connect after one already won.
+func drain(results <-chan attempt, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.c != nil {
+			r.c.Close()
+		}
+	}
+}
+
+type byRFC6724 struct {
+	ips  []net.IP
+	srcs []net.IP
+}
+
+func (s *byRFC6724) Len() int { return len(s.ips) }
+
+func (s *byRFC6724) Swap(i, j int) {
+	s.ips[i], s.ips[j] = s.ips[j], s.ips[i]
+	if s.srcs != nil {
+		s.srcs[i], s.srcs[j] = s.srcs[j], s.srcs[i]
+	}
+}
+
+func (s *byRFC6724) src(i int) net.IP {
+	if s.srcs == nil {
+		return nil
+	}
+	return s.srcs[i]
+}
+
+// Less reports whether ips[i] is preferred over ips[j], per the rules of
+// section 6 of RFC 6724. Rules 3, 4 and 7 need info the os doesn't expose
+// and are skipped; rule 10 (otherwise, leave unchanged) is sort.Stable.
+func (s *byRFC6724) Less(i, j int) bool {
+	da, db := s.ips[i], s.ips[j]
+	sa, sb := s.src(i), s.src(j)
+
+	// Rule 1: avoid unusable destinations.
+	if (sa != nil) != (sb != nil) {
+		return sa != nil
+	}
+
+	// Rule 2: prefer matching scope.
+	if sa != nil {
+		ma := classifyScope(da) == classifyScope(sa)
+		mb := classifyScope(db) == classifyScope(sb)
+		if ma != mb {
+			return ma
+		}
+	}
+
+	// Rule 5: prefer matching label.
+	attrda, attrdb := classify(da), classify(db)
+	if sa != nil {
+		ma := attrda.label == classify(sa).label
+		mb := attrdb.label == classify(sb).label
+		if ma != mb {
+			return ma
+		}
+	}
+
+	// Rule 6: prefer higher precedence.
+	if attrda.precedence != attrdb.precedence {
+		return attrda.precedence > attrdb.precedence
+	}
+
+	// Rule 8: prefer smaller scope.
+	if sca, scb := classifyScope(da), classifyScope(db); sca != scb {
+		return sca < scb
+	}
+
+	// Rule 9: use longest matching prefix, between addresses of a family.
+	if sa != nil && (da.To4() != nil) == (db.To4() != nil) {
+		if pa, pb := commonPrefixLen(sa, da), commonPrefixLen(sb, db); pa != pb {
+			return pa > pb
+		}
+	}
+
+	return false
+}
+
+type policyEntry struct {
+	prefix     *net.IPNet
+	precedence uint8
+	label      uint8
+}
+
+// rfc6724policyTable is the default policy table of section 2.1 of
+// RFC 6724, most specific prefix first.
+var rfc6724policyTable = []policyEntry{
+	{mustCIDR("::1/128"), 50, 0},
+	{mustCIDR("::ffff:0:0/96"), 35, 4},
+	{mustCIDR("::/96"), 1, 3},
+	{mustCIDR("2001::/32"), 5, 5},
+	{mustCIDR("2002::/16"), 30, 2},
+	{mustCIDR("3ffe::/16"), 1, 12},
+	{mustCIDR("fec0::/10"), 1, 11},
+	{mustCIDR("fc00::/7"), 3, 13},
+	{mustCIDR("::/0"), 40, 1},
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// classify returns the policy table entry for ip; ipv4 addresses are
+// classified as their ipv4-mapped ipv6 form.
+func classify(ip net.IP) policyEntry {
+	ip = ip.To16()
+	for _, e := range rfc6724policyTable {
+		if e.prefix.Contains(ip) {
+			return e
+		}
+	}
+	return policyEntry{}
+}
+
+// Scopes from section 3.1 of RFC 4291 and section 3.2 of RFC 6724.
+const (
+	scopeInterfaceLocal = 0x1
+	scopeLinkLocal      = 0x2
+	scopeSiteLocal      = 0x5
+	scopeGlobal         = 0xe
+)
+
+func classifyScope(ip net.IP) uint8 {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	if ip.IsInterfaceLocalMulticast() {
+		return scopeInterfaceLocal
+	}
+	ip6 := ip.To16()
+	if ip.To4() == nil && ip6[0] == 0xff {
+		// multicast scope is in the low nibble of the second byte.
+		return ip6[1] & 0xf
+	}
+	if ip.To4() == nil && ip6[0] == 0xfe && ip6[1]&0xc0 == 0xc0 {
+		return scopeSiteLocal
+	}
+	return scopeGlobal
+}
+
+// commonPrefixLen returns the number of leading bits a and b share. ipv6
+// addresses are compared only up to the 64-bit prefix, per rule 9.
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	} else {
+		a, b = a.To16()[:8], b.To16()[:8]
+	}
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
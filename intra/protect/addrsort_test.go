@@ -0,0 +1,236 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func ips(addrs ...string) []net.IP {
+	if addrs == nil {
+		return nil
+	}
+	out := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		out[i] = net.ParseIP(a)
+	}
+	return out
+}
+
+func TestSortRFC6724(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		dsts []net.IP
+		srcs []net.IP
+		want []net.IP
+	}{
+		{
+			// Rule 1: only the v4 address is reachable.
+			name: "avoid unusable",
+			dsts: ips("2001:db8:1::1", "198.51.100.121"),
+			srcs: []net.IP{nil, net.ParseIP("198.51.100.117")},
+			want: ips("198.51.100.121", "2001:db8:1::1"),
+		},
+		{
+			// Rule 2: v4 has only a link-local source.
+			name: "matching scope v6",
+			dsts: ips("198.51.100.121", "2001:db8:1::1"),
+			srcs: ips("169.254.13.78", "2001:db8:1::2"),
+			want: ips("2001:db8:1::1", "198.51.100.121"),
+		},
+		{
+			// Rule 2: v6 has only a link-local source.
+			name: "matching scope v4",
+			dsts: ips("2001:db8:1::1", "198.51.100.121"),
+			srcs: ips("fe80::1", "198.51.100.117"),
+			want: ips("198.51.100.121", "2001:db8:1::1"),
+		},
+		{
+			// Rule 6: native v6 outranks v4.
+			name: "higher precedence",
+			dsts: ips("10.1.2.3", "2001:db8:1::1"),
+			srcs: ips("10.1.2.4", "2001:db8:1::2"),
+			want: ips("2001:db8:1::1", "10.1.2.3"),
+		},
+		{
+			// Rule 6: ULAs rank below v4.
+			name: "ula below v4",
+			dsts: ips("fd00::1", "198.51.100.121"),
+			srcs: ips("fd00::2", "198.51.100.117"),
+			want: ips("198.51.100.121", "fd00::1"),
+		},
+		{
+			// Rule 8: link-local before global.
+			name: "smaller scope",
+			dsts: ips("2001:db8:1::1", "fe80::1"),
+			srcs: ips("2001:db8:1::2", "fe80::2"),
+			want: ips("fe80::1", "2001:db8:1::1"),
+		},
+		{
+			// Rule 9: the address sharing a longer prefix with its source.
+			name: "longest matching prefix",
+			dsts: ips("2001:db8:2::1", "2001:db8:1::1"),
+			srcs: ips("2001:db8:3::2", "2001:db8:1::2"),
+			want: ips("2001:db8:1::1", "2001:db8:2::1"),
+		},
+		{
+			// Rule 10: ties keep their order.
+			name: "stable",
+			dsts: ips("2001:db8:1::1", "2001:db8:1::2"),
+			srcs: ips("2001:db8:1::3", "2001:db8:1::3"),
+			want: ips("2001:db8:1::1", "2001:db8:1::2"),
+		},
+		{
+			name: "unknown sources",
+			dsts: ips("1.2.3.4", "2001:db8::1", "5.6.7.8"),
+			srcs: nil,
+			want: ips("2001:db8::1", "1.2.3.4", "5.6.7.8"),
+		},
+	} {
+		sortAddrs(RFC6724, tc.dsts, tc.srcs)
+		if !reflect.DeepEqual(tc.dsts, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.dsts, tc.want)
+		}
+	}
+}
+
+func TestSortPolicies(t *testing.T) {
+	received := []string{"2001:db8::1", "1.2.3.4", "2001:db8::2", "5.6.7.8"}
+	for policy, want := range map[int][]net.IP{
+		AsReceived: ips(received...),
+		V4First:    ips("1.2.3.4", "5.6.7.8", "2001:db8::1", "2001:db8::2"),
+		V6First:    ips("2001:db8::1", "2001:db8::2", "1.2.3.4", "5.6.7.8"),
+	} {
+		got := ips(received...)
+		sortAddrs(policy, got, nil)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("policy %d: got %v, want %v", policy, got, want)
+		}
+	}
+}
+
+func TestSetAddressSortPolicy(t *testing.T) {
+	defer SetAddressSortPolicy(RFC6724)
+	if err := SetAddressSortPolicy(V4First); err != nil {
+		t.Fatal(err)
+	}
+	if p := addressSortPolicy(); p != V4First {
+		t.Errorf("policy not set: %d", p)
+	}
+	if err := SetAddressSortPolicy(42); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	if p := addressSortPolicy(); p != V4First {
+		t.Errorf("policy changed by unknown policy: %d", p)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	got := interleave(ips("2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"))
+	want := ips("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// stagger dials the v6 address, which never connects, and then the v4
+// one, with delay in between; it returns when the v4 attempt started.
+func stagger(t *testing.T, delay time.Duration) time.Duration {
+	var mu sync.Mutex
+	var started time.Duration
+	begin := time.Now()
+	addrs := []string{"[2001:db8::1]:443", "192.0.2.1:443"}
+	c, err := dialStaggered(context.Background(), addrs, delay, func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr == addrs[0] {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		mu.Lock()
+		started = time.Since(begin)
+		mu.Unlock()
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	return started
+}
+
+func TestConnectionAttemptDelay(t *testing.T) {
+	for _, delay := range []time.Duration{50 * time.Millisecond, 300 * time.Millisecond} {
+		started := stagger(t, delay)
+		if started < delay {
+			t.Errorf("delay %v: second family started after %v", delay, started)
+		}
+		if started > delay+200*time.Millisecond {
+			t.Errorf("delay %v: second family started late, after %v", delay, started)
+		}
+	}
+}
+
+func TestConnectionAttemptAfterFailure(t *testing.T) {
+	begin := time.Now()
+	var started time.Duration
+	c, err := dialStaggered(context.Background(), []string{"a", "b"}, time.Hour, func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr == "a" {
+			return nil, errors.New("refused")
+		}
+		started = time.Since(begin)
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if started > time.Second {
+		t.Errorf("next attempt waited %v after a failure", started)
+	}
+}
+
+func TestConnectionAttemptDelayDefault(t *testing.T) {
+	if d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{}); d.FallbackDelay != defaultConnectionAttemptDelay {
+		t.Errorf("default delay %v, want %v", d.FallbackDelay, defaultConnectionAttemptDelay)
+	}
+	opts := MakeDialerOpts{ConnectionAttemptDelay: 100 * time.Millisecond}
+	if d := MakeDialerWithOpts(&fakeProtector{}, opts); d.FallbackDelay != opts.ConnectionAttemptDelay {
+		t.Errorf("delay %v, want %v", d.FallbackDelay, opts.ConnectionAttemptDelay)
+	}
+}
+
+func TestSrcAddrsWithoutHooks(t *testing.T) {
+	p := &fakeProtector{}
+	var hooked, reported int32
+	d := MakeDialerWithOpts(p, MakeDialerOpts{
+		ControlHooks: []func(string, string, uintptr) error{func(string, string, uintptr) error {
+			atomic.AddInt32(&hooked, 1)
+			return errors.New("hooked")
+		}},
+		OnLocalAddr: func(string, net.Addr) { atomic.AddInt32(&reported, 1) },
+		LocalAddr:   net.IPv4(192, 0, 2, 1),
+	})
+	srcs := srcAddrs(context.Background(), d, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)})
+	for i, src := range srcs {
+		if src == nil {
+			t.Errorf("no source for address %d", i)
+		}
+	}
+	if n := atomic.LoadInt32(&hooked) + atomic.LoadInt32(&reported); n != 0 {
+		t.Errorf("hooks ran %d times on probe sockets", n)
+	}
+	// the probe sockets are protected all the same
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.fds) != 2 {
+		t.Errorf("%d sockets protected, want 2", len(p.fds))
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// bareDialerKey is the context key with which the Resolver of a dialer
+// from MakeDialerWithOpts is asked for its bare dialer; see bareDialerOf.
+type bareDialerKey struct{}
+
+var errBareDialerOnly = errors.New("asked for the bare dialer")
+
+// withBareDialer returns r, answering asks for its dialer's bare dialer
+// with bare.
+func withBareDialer(r *net.Resolver, bare *net.Dialer) *net.Resolver {
+	dial := r.Dial
+	return &net.Resolver{
+		PreferGo:     r.PreferGo,
+		StrictErrors: r.StrictErrors,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if out, ok := ctx.Value(bareDialerKey{}).(**net.Dialer); ok {
+				*out = bare
+				return nil, errBareDialerOnly
+			}
+			return dial(ctx, network, address)
+		},
+	}
+}
+
+// bareDialerOf returns a dialer of sockets protected as those of d are,
+// but without its hooks, local address and resolver, for the sockets
+// dials probe with, such as for source addresses, on d's behalf: those
+// aren't the caller's to see or set up. Dialers not from MakeDialer are
+// copied without their local address and resolver.
+func bareDialerOf(d *net.Dialer) *net.Dialer {
+	var bare *net.Dialer
+	if d.Resolver != nil && d.Resolver.Dial != nil {
+		ctx := context.WithValue(context.Background(), bareDialerKey{}, &bare)
+		d.Resolver.Dial(ctx, "", "")
+	}
+	if bare == nil {
+		direct := *d
+		direct.LocalAddr = nil
+		direct.Resolver = nil
+		bare = &direct
+	}
+	return bare
+}
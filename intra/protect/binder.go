@@ -0,0 +1,64 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// resolverBinder holds the networkBinder set, nil if none.
+var resolverBinder atomic.Value
+
+type networkBinder func(fd uintptr) error
+
+// SetResolverNetworkBinder sets f to be called on each socket dialed to
+// send dns queries, to the system's resolvers or DNSTransports, after it
+// is protected, to bind it to a network, as with Android's
+// Network.bindSocket, so queries don't leave over another network as
+// networks change. Dials fail with the error f returns. A nil f removes it.
+func SetResolverNetworkBinder(f func(fd uintptr) error) {
+	resolverBinder.Store(networkBinder(f))
+}
+
+// boundToResolverNetwork returns d, or a copy of it that binds sockets
+// with the resolver binder, if any, after they're protected.
+func boundToResolverNetwork(d *net.Dialer) *net.Dialer {
+	b, _ := resolverBinder.Load().(networkBinder)
+	if b == nil {
+		return d
+	}
+	bound := *d
+	bound.Control = withHooks(d.Control, []func(string, string, uintptr) error{
+		func(network, address string, fd uintptr) error {
+			return b(fd)
+		},
+	})
+	return &bound
+}
+
+// resolverBypass is 1 while resolvers dial only over the base network.
+var resolverBypass int32
+
+// SetResolverBypass has the resolvers of protected dialers, while bypass
+// is set, send queries only over the base network, as they must while the
+// vpn comes up lest they loop into it: over sockets that are protected,
+// and bound per SetResolverNetworkBinder, but otherwise set up as by
+// MakeDialer regardless of the opts of their dialer, and never over the
+// routes of SetDNSRoute, which may be through tunnels not yet up. Unset it
+// once the tunnel is ready.
+func SetResolverBypass(bypass bool) {
+	var v int32
+	if bypass {
+		v = 1
+	}
+	atomic.StoreInt32(&resolverBypass, v)
+}
+
+func bypassingResolver() bool {
+	return atomic.LoadInt32(&resolverBypass) == 1
+}
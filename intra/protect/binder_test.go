@@ -0,0 +1,129 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolverNetworkBinder(t *testing.T) {
+	dns, port := startTCPDNS(t, fooIP)
+	defer dns.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	var bound, gone int32
+	SetResolverNetworkBinder(func(fd uintptr) error {
+		atomic.AddInt32(&bound, 1)
+		if atomic.LoadInt32(&gone) == 1 {
+			return errors.New("network gone")
+		}
+		return nil
+	})
+	defer SetResolverNetworkBinder(nil)
+
+	d := MakeDialer(&fakeProtector{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(fooIP) {
+		t.Errorf("got %v, want %s", ips, fooIP)
+	}
+	if atomic.LoadInt32(&bound) == 0 {
+		t.Error("resolver socket not bound")
+	}
+
+	// other dials aren't bound
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+	before := atomic.LoadInt32(&bound)
+	c, err := DialContext(ctx, d, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := atomic.LoadInt32(&bound); n != before {
+		t.Errorf("%d non-resolver sockets bound", n-before)
+	}
+
+	// lookups fail when sockets can't be bound
+	atomic.StoreInt32(&gone, 1)
+	if _, err := d.Resolver.LookupIP(ctx, "ip4", "bar.test"); err == nil {
+		t.Error("lookup succeeded over an unbound socket")
+	}
+}
+
+func TestResolverBypass(t *testing.T) {
+	dns, port := startTCPDNS(t, fooIP)
+	defer dns.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	corp, corpPort := startTCPDNS(t, net.IPv4(10, 0, 0, 2))
+	defer corp.Close()
+	tunnel := &recordingDialer{}
+	if err := SetDNSRoute("test", "wg0", tunnel, net.JoinHostPort("127.0.0.1", strconv.Itoa(corpPort))); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSRoute("test", "", nil, "")
+
+	// sockets of the dialer itself are set up to go over the tunnel
+	var tunneled int32
+	p := &fakeProtector{}
+	d := MakeDialerWithOpts(p, MakeDialerOpts{ControlHooks: []func(string, string, uintptr) error{
+		func(network, address string, fd uintptr) error {
+			atomic.AddInt32(&tunneled, 1)
+			return errors.New("tunnel not up")
+		},
+	}})
+
+	SetResolverBypass(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(fooIP) {
+		t.Errorf("got %v, want %s from the base network", ips, fooIP)
+	}
+	if n := atomic.LoadInt32(&tunneled); n != 0 {
+		t.Errorf("%d resolver sockets set up per the dialer's opts", n)
+	}
+	if dials := tunnel.dials(); len(dials) != 0 {
+		t.Errorf("queries routed over the tunnel: %v", dials)
+	}
+	p.mu.Lock()
+	protected := len(p.fds)
+	p.mu.Unlock()
+	if protected == 0 {
+		t.Error("resolver sockets not protected")
+	}
+
+	// the tunnel is up
+	SetResolverBypass(false)
+	ips, err = d.Resolver.LookupIP(ctx, "ip4", "foo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("got %v, want the answer routed over the tunnel", ips)
+	}
+	if len(tunnel.dials()) == 0 {
+		t.Error("query not routed over the tunnel")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTooManyConns is returned by bounded dialers with as many conns
+	// open as they allow, and as many dials queued.
+	ErrTooManyConns = errors.New("too many conns")
+	// ErrQueueTimeout is returned by bounded dialers when a queued dial
+	// waited too long for a conn to close.
+	ErrQueueTimeout = errors.New("timed out queued for a conn")
+)
+
+// BoundedDialerOpts configures MakeBoundedDialer.
+type BoundedDialerOpts struct {
+	// MaxConns is the most conns open at once.
+	MaxConns int
+	// MaxQueue is the most dials waiting for a conn to close, once MaxConns
+	// are open; dials beyond fail with ErrTooManyConns. If zero, no dial
+	// waits.
+	MaxQueue int
+	// QueueTimeout is how long a queued dial waits before it fails with
+	// ErrQueueTimeout; zero waits for as long as its context allows.
+	QueueTimeout time.Duration
+}
+
+// boundedDialer dials with d while it has a slot for the conn.
+type boundedDialer struct {
+	d      ContextDialer
+	slots  chan struct{} // one per open conn
+	queued int32         // atomic; dials waiting for a slot
+	opts   BoundedDialerOpts
+}
+
+// MakeBoundedDialer returns a dialer that dials with d, but has no more
+// than opts.MaxConns of its conns open at once. Further dials queue, in
+// order, until a conn closes, or fail, per opts. A MaxConns of 0 or less
+// leaves dials unbounded.
+func MakeBoundedDialer(d ContextDialer, opts BoundedDialerOpts) ContextDialer {
+	if opts.MaxConns <= 0 {
+		return d
+	}
+	return &boundedDialer{d: d, slots: make(chan struct{}, opts.MaxConns), opts: opts}
+}
+
+func (b *boundedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	c, err := b.d.DialContext(ctx, network, addr)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	bc := &boundedConn{Conn: c, release: b.release}
+	if pc, ok := c.(net.PacketConn); ok {
+		return &boundedPacketConn{bc, pc}, nil
+	}
+	return bc, nil
+}
+
+// acquire takes a slot, queueing for one if there are none free.
+func (b *boundedDialer) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.AddInt32(&b.queued, 1) > int32(b.opts.MaxQueue) {
+		atomic.AddInt32(&b.queued, -1)
+		return ErrTooManyConns
+	}
+	defer atomic.AddInt32(&b.queued, -1)
+
+	var timeout <-chan time.Time
+	if b.opts.QueueTimeout > 0 {
+		timer := time.NewTimer(b.opts.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *boundedDialer) release() {
+	<-b.slots
+}
+
+// boundedConn frees its slot once closed.
+type boundedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *boundedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// boundedPacketConn is a boundedConn of a conn that is a net.PacketConn.
+type boundedPacketConn struct {
+	*boundedConn
+	pc net.PacketConn
+}
+
+func (c *boundedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.pc.ReadFrom(b)
+}
+
+func (c *boundedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
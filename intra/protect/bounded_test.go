@@ -0,0 +1,137 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startSink accepts tcp conns on localhost until closed.
+func startSink(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return l
+}
+
+func TestBoundedDialerQueues(t *testing.T) {
+	l := startSink(t)
+	defer l.Close()
+	d := MakeBoundedDialer(&net.Dialer{}, BoundedDialerOpts{MaxConns: 2, MaxQueue: 2, QueueTimeout: 5 * time.Second})
+
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, c)
+	}
+
+	// two dials queue; a third fails
+	admitted := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				c = nil
+			}
+			admitted <- c
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&d.(*boundedDialer).queued) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrTooManyConns) {
+		t.Errorf("got %v, want ErrTooManyConns", err)
+	}
+
+	// each close admits a queued dial
+	for i, c := range open {
+		select {
+		case <-admitted:
+			t.Fatal("admitted with no slot free")
+		case <-time.After(50 * time.Millisecond):
+		}
+		c.Close()
+		c.Close() // frees its slot once
+		select {
+		case q := <-admitted:
+			if q != nil {
+				defer q.Close()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("close %d admitted no dial", i)
+		}
+	}
+}
+
+func TestBoundedDialerQueueTimeout(t *testing.T) {
+	l := startSink(t)
+	defer l.Close()
+	d := MakeBoundedDialer(&net.Dialer{}, BoundedDialerOpts{MaxConns: 1, MaxQueue: 1, QueueTimeout: 100 * time.Millisecond})
+
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	begin := time.Now()
+	if _, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("got %v, want ErrQueueTimeout", err)
+	}
+	if took := time.Since(begin); took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("timed out after %v", took)
+	}
+
+	// failed dials free their slots
+	c.Close()
+	if _, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(deadTCPPort(t)))); err == nil {
+		t.Fatal("dialed a dead port")
+	}
+	c, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestBoundedDialerNoQueue(t *testing.T) {
+	l := startSink(t)
+	defer l.Close()
+	d := MakeBoundedDialer(&net.Dialer{}, BoundedDialerOpts{MaxConns: 1})
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrTooManyConns) {
+		t.Errorf("got %v, want ErrTooManyConns", err)
+	}
+
+	// udp conns stay packet conns
+	u, err := MakeBoundedDialer(&net.Dialer{}, BoundedDialerOpts{MaxConns: 1}).DialContext(context.Background(), "udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if _, ok := u.(net.PacketConn); !ok {
+		t.Error("udp conn is not a PacketConn")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"time"
+)
+
+type dialBudgetKey struct{}
+
+// SetDialBudget bounds how long DialContext takes to dial a hostname, its
+// resolution and the attempts to each of its addresses included, to budget.
+// Each attempt is given an even share of what is left of the budget when it
+// starts, so that an address that never answers doesn't use up the time of
+// those after it. A budget of 0, the default, sets no bound; dials are then
+// bounded only by their contexts.
+func SetDialBudget(budget time.Duration) {
+	if budget < 0 {
+		budget = 0
+	}
+	updateDialConfig(func(c *dialConfig) {
+		c.budget = budget
+	})
+}
+
+// withDialBudget returns ctx cut off at the dial budget of its config, if
+// any, and marked for attempts to share it.
+func withDialBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	budget := dialConfigOf(ctx).budget
+	if budget <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	return context.WithValue(ctx, dialBudgetKey{}, budget), cancel
+}
+
+// attemptContext returns the context of an attempt, with left attempts,
+// this one included, yet to be made: on a budget, it is cut off at its
+// share of the time left; otherwise, it is ctx.
+func attemptContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if ctx.Value(dialBudgetKey{}) == nil || !ok || left <= 1 {
+		return ctx, func() {}
+	}
+	share := time.Until(deadline) / time.Duration(left)
+	return context.WithTimeout(ctx, share)
+}
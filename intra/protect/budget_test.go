@@ -0,0 +1,80 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialBlackholes dials three addresses that never answer, one after
+// another, within the dial budget, and returns how long each attempt had.
+func dialBlackholes(t *testing.T) (total time.Duration, shares []time.Duration) {
+	var mu sync.Mutex
+	addrs := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443"}
+	ctx, cancel := withDialBudget(pinDialConfig(context.Background()))
+	defer cancel()
+	begin := time.Now()
+	c, err := dialStaggered(ctx, addrs, -1, func(ctx context.Context, addr string) (net.Conn, error) {
+		start := time.Now()
+		err := errors.New("no answer")
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		mu.Lock()
+		shares = append(shares, time.Since(start))
+		mu.Unlock()
+		return nil, err
+	})
+	if err == nil {
+		c.Close()
+		t.Fatal("dialed a blackhole")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return time.Since(begin), shares
+}
+
+func TestDialBudget(t *testing.T) {
+	budget := 600 * time.Millisecond
+	SetDialBudget(budget)
+	defer SetDialBudget(0)
+
+	total, shares := dialBlackholes(t)
+	if total > budget+200*time.Millisecond {
+		t.Errorf("dials took %v, over the budget of %v", total, budget)
+	}
+	if len(shares) != 3 {
+		t.Fatalf("%d attempts, want 3", len(shares))
+	}
+	// the first attempt doesn't starve the others
+	for i, share := range shares {
+		if share > budget/3+100*time.Millisecond {
+			t.Errorf("attempt %d had %v, more than its share of %v", i, share, budget/3)
+		}
+	}
+}
+
+func TestNoDialBudget(t *testing.T) {
+	SetDialBudget(-time.Second)
+	if budget := loadDialConfig().budget; budget != 0 {
+		t.Errorf("negative budget set as %v", budget)
+	}
+	ctx, cancel := withDialBudget(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline without a budget")
+	}
+	// attempts are not cut off on a caller's deadline alone
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	actx, acancel := attemptContext(ctx, 3)
+	defer acancel()
+	if actx != ctx {
+		t.Error("attempt cut off without a budget")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrByteLimitExceeded is returned by conns of byte limited dialers once
+// they have transferred as many bytes as they may.
+var ErrByteLimitExceeded = errors.New("connection byte limit exceeded")
+
+// MakeByteLimitedDialer returns a dialer that dials with inner and caps
+// each conn to maxBytes read and written, both directions counted
+// together. Reads and writes beyond the cap are cut short, and the conn
+// closed, with ErrByteLimitExceeded; those of datagram conns are refused
+// whole rather than cut short, as datagrams can't be split. The count is
+// exact under concurrent reads and writes.
+func MakeByteLimitedDialer(inner ContextDialer, maxBytes int64) ContextDialer {
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := inner.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &byteLimitedConn{Conn: c, max: maxBytes, datagram: strings.HasPrefix(network, "udp")}, nil
+	})
+}
+
+// byteLimitedConn is a conn that transfers at most max bytes.
+type byteLimitedConn struct {
+	net.Conn
+	max      int64
+	used     int64 // bytes transferred, or being written
+	datagram bool
+}
+
+// add counts up to n more bytes against what is left under max, and
+// returns how many; none, if all of n is needed and isn't left.
+func (c *byteLimitedConn) add(n int64, whole bool) int64 {
+	for {
+		used := atomic.LoadInt64(&c.used)
+		m := c.max - used
+		if m > n {
+			m = n
+		}
+		if m <= 0 || (whole && m < n) {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&c.used, used, used+m) {
+			return m
+		}
+	}
+}
+
+// release uncounts n bytes that were added but not written.
+func (c *byteLimitedConn) release(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&c.used, -n)
+	}
+}
+
+// exceeded closes c, which went over its limit.
+func (c *byteLimitedConn) exceeded() error {
+	c.Conn.Close()
+	return ErrByteLimitExceeded
+}
+
+// Read counts the bytes it reads only once they are read, so that a read
+// blocked on a large buffer doesn't hold back writes meanwhile; bytes read
+// past the limit, as concurrent writes took what was left, are dropped.
+func (c *byteLimitedConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	left := c.max - atomic.LoadInt64(&c.used)
+	if left <= 0 {
+		return 0, c.exceeded()
+	}
+	if !c.datagram && int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := c.Conn.Read(b)
+	if n <= 0 {
+		return n, err
+	}
+	// datagrams are counted whole, as they can't be cut short
+	if m := c.add(int64(n), c.datagram); m < int64(n) {
+		return int(m), c.exceeded()
+	}
+	return n, err
+}
+
+// Write counts the bytes of b before writing them, so that concurrent
+// writes can't together send more than the limit; those not written are
+// uncounted.
+func (c *byteLimitedConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return c.Conn.Write(b)
+	}
+	allowed := c.add(int64(len(b)), c.datagram)
+	if allowed == 0 {
+		return 0, c.exceeded()
+	}
+	n, err := c.Conn.Write(b[:allowed])
+	c.release(allowed - int64(n))
+	if err == nil && int64(n) < int64(len(b)) {
+		return n, c.exceeded()
+	}
+	return n, err
+}
@@ -0,0 +1,169 @@
+package protect
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// dialPiped returns a conn of d whose peer is the other end of a pipe.
+func dialPiped(t *testing.T, d func(ContextDialer) ContextDialer, network string) (c, peer net.Conn) {
+	client, server := net.Pipe()
+	inner := contextDialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return client, nil
+	})
+	c, err := d(inner).DialContext(context.Background(), network, "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, server
+}
+
+func limitedTo(max int64) func(ContextDialer) ContextDialer {
+	return func(inner ContextDialer) ContextDialer {
+		return MakeByteLimitedDialer(inner, max)
+	}
+}
+
+func TestByteLimitUnder(t *testing.T) {
+	c, peer := dialPiped(t, limitedTo(10), "tcp")
+	defer c.Close()
+	go func() {
+		b := make([]byte, 6)
+		io.ReadFull(peer, b)
+		peer.Write([]byte("pong"))
+	}()
+	// 6 written and 4 read are just at the limit
+	if n, err := c.Write([]byte("ping!!")); n != 6 || err != nil {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pong" {
+		t.Errorf("read %q", b)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrByteLimitExceeded {
+		t.Errorf("write past the limit: got %v, want ErrByteLimitExceeded", err)
+	}
+	// the conn is closed
+	if _, err := peer.Read(b); err != io.EOF {
+		t.Errorf("peer read %v, want EOF", err)
+	}
+}
+
+func TestByteLimitOver(t *testing.T) {
+	c, peer := dialPiped(t, limitedTo(10), "tcp")
+	defer c.Close()
+	var got bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&got, peer)
+		close(done)
+	}()
+	n, err := c.Write([]byte("0123456789A"))
+	if n != 10 || err != ErrByteLimitExceeded {
+		t.Errorf("write of 11: %d, %v; want 10, ErrByteLimitExceeded", n, err)
+	}
+	<-done
+	if got.String() != "0123456789" {
+		t.Errorf("peer got %q", got.String())
+	}
+}
+
+func TestByteLimitDatagram(t *testing.T) {
+	c, peer := dialPiped(t, limitedTo(10), "udp")
+	defer c.Close()
+	go io.Copy(ioutil.Discard, peer)
+	if _, err := c.Write([]byte("01234567")); err != nil {
+		t.Fatal(err)
+	}
+	// a datagram that doesn't fit isn't cut short
+	if n, err := c.Write([]byte("89A")); n != 0 || err != ErrByteLimitExceeded {
+		t.Errorf("got %d, %v; want 0, ErrByteLimitExceeded", n, err)
+	}
+}
+
+func TestByteLimitBlockedRead(t *testing.T) {
+	c, peer := dialPiped(t, limitedTo(100), "tcp")
+	defer c.Close()
+	type result struct {
+		n   int
+		err error
+	}
+	rc := make(chan result, 1)
+	go func() {
+		// blocks until the peer writes, with a buffer well over the limit
+		n, err := c.Read(make([]byte, 4096))
+		rc <- result{n, err}
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 5)
+		io.ReadFull(peer, b)
+		got <- b
+	}()
+	if n, err := c.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("write while a read is blocked: %d, %v", n, err)
+	}
+	if b := <-got; string(b) != "hello" {
+		t.Errorf("peer got %q", b)
+	}
+	peer.Write([]byte("world"))
+	if r := <-rc; r.n != 5 || r.err != nil {
+		t.Errorf("read: %d, %v", r.n, r.err)
+	}
+	if used := atomic.LoadInt64(&c.(*byteLimitedConn).used); used != 10 {
+		t.Errorf("counted %d, want 10", used)
+	}
+}
+
+func TestByteLimitConcurrent(t *testing.T) {
+	const max = 100000
+	c, peer := dialPiped(t, limitedTo(max), "tcp")
+	var wg sync.WaitGroup
+	var read, written int64
+	var mu sync.Mutex
+	// the peer echoes all it gets
+	go io.Copy(peer, peer)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 7)
+		for {
+			n, err := c.Write(b)
+			mu.Lock()
+			written += int64(n)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 13)
+		for {
+			n, err := c.Read(b)
+			mu.Lock()
+			read += int64(n)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	// the conn is closed once either side hits the limit, which may
+	// leave echoes unread
+	used := atomic.LoadInt64(&c.(*byteLimitedConn).used)
+	if read+written != used || used > max || used < max-13 {
+		t.Errorf("transferred %d (%d read, %d written), counted %d, limit %d", read+written, read, written, used, max)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileVersion heads cache files; files of other versions aren't loaded.
+const cacheFileVersion byte = 1
+
+var errBadCacheFile = errors.New("not a dns cache file")
+
+// SaveCache writes the unexpired answers in the dns cache to the file at
+// path, replacing it, for LoadCache to restore them from, say, once the app
+// restarts. Each answer takes its length, plus 10 bytes. That cache holds
+// only negative answers, see SetNegativeCacheTTL; a Resolver's answers are
+// saved with Resolver.SaveCache.
+func SaveCache(path string) error {
+	now := time.Now()
+	negative.Lock()
+	var entries []cacheFileEntry
+	for _, e := range negative.entries {
+		if e.expiry.After(now) {
+			entries = append(entries, cacheFileEntry{e.ans, e.expiry})
+		}
+	}
+	negative.Unlock()
+	return writeCacheFile(path, entries)
+}
+
+// LoadCache adds the answers in the file at path, as written by SaveCache,
+// to the dns cache, dropping those that expired since, and returns how many
+// it added. Answers are cached only while caching is on, and for no longer
+// than it allows; see SetNegativeCacheTTL, which also empties the cache.
+func LoadCache(path string) (int, error) {
+	return readCacheFile(path, restoreNegative)
+}
+
+// SaveCache writes the unexpired answers r caches to the file at path,
+// replacing it, for r.LoadCache to restore them from, as SaveCache does
+// for negative answers; so that lookups of the hosts first connected to
+// after a restart are answered at once.
+func (r *Resolver) SaveCache(path string) error {
+	now := time.Now()
+	r.mu.Lock()
+	var entries []cacheFileEntry
+	for _, e := range r.answers {
+		if e.expiry.After(now) {
+			entries = append(entries, cacheFileEntry{e.ans, e.expiry})
+		}
+	}
+	r.mu.Unlock()
+	return writeCacheFile(path, entries)
+}
+
+// LoadCache adds the answers in the file at path, as written by
+// r.SaveCache, to those r caches, dropping those that expired since, and
+// returns how many it added; as many as its cache has room for, and for no
+// longer than its MaxTTL.
+func (r *Resolver) LoadCache(path string) (int, error) {
+	return readCacheFile(path, r.restore)
+}
+
+// cacheFileEntry is an answer in a cache file, and when it expires.
+type cacheFileEntry struct {
+	ans    []byte
+	expiry time.Time
+}
+
+// writeCacheFile writes entries to the file at path, replacing it.
+func writeCacheFile(path string, entries []cacheFileEntry) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	w.WriteByte(cacheFileVersion)
+	for _, e := range entries {
+		// expiry in unix seconds, the answer's length, and the answer
+		var hdr [10]byte
+		binary.BigEndian.PutUint64(hdr[:], uint64(e.expiry.Unix()))
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(e.ans)))
+		w.Write(hdr[:])
+		w.Write(e.ans)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readCacheFile calls restore with each unexpired answer in the file at
+// path, its question and what is left of its ttl, and returns how many
+// answers restore took.
+func readCacheFile(path string, restore func(k questionKey, ans []byte, ttl time.Duration) bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if v, err := r.ReadByte(); err != nil || v != cacheFileVersion {
+		return 0, errBadCacheFile
+	}
+
+	now := time.Now()
+	n := 0
+	for {
+		var hdr [10]byte
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		ans := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+		if _, err := io.ReadFull(r, ans); err != nil {
+			return n, err
+		}
+		ttl := time.Unix(int64(binary.BigEndian.Uint64(hdr[:])), 0).Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		k, ok := questionOf(ans)
+		if !ok {
+			return n, errBadCacheFile
+		}
+		if restore(k, ans, ttl) {
+			n++
+		}
+	}
+}
+
+// restoreNegative caches ans for k for ttl, capped at the ttlcap, as is;
+// the ttl was clamped when ans was first cached.
+func restoreNegative(k questionKey, ans []byte, ttl time.Duration) bool {
+	negative.Lock()
+	defer negative.Unlock()
+	if negative.ttlcap <= 0 || len(negative.entries) >= maxNegativeEntries {
+		return false
+	}
+	if ttl > negative.ttlcap {
+		ttl = negative.ttlcap
+	}
+	negative.entries[k] = &negativeEntry{ans: ans, expiry: time.Now().Add(ttl)}
+	return true
+}
@@ -0,0 +1,76 @@
+package protect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCacheFile(t *testing.T) {
+	SetNegativeCacheTTL(time.Hour)
+	defer SetNegativeCacheTTL(0)
+
+	valid := makeQuery(t, 1, "valid.test.", dnsmessage.TypeA)
+	expired := makeQuery(t, 2, "expired.test.", dnsmessage.TypeA)
+	vk, _ := questionOf(valid)
+	ek, _ := questionOf(expired)
+	cacheNegative(vk, nxAnswer(valid, 600, 600), 10*time.Minute)
+	cacheNegative(ek, nxAnswer(expired, 600, 600), 2*time.Second)
+
+	dir, err := ioutil.TempDir("", "dnscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+	if err := SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart, once the second entry has expired
+	time.Sleep(2100 * time.Millisecond)
+	SetNegativeCacheTTL(time.Hour)
+	n, err := LoadCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("loaded %d entries, want 1", n)
+	}
+	if ans := cachedNegative(vk); ans == nil {
+		t.Error("valid entry not loaded")
+	} else if negativeTTL(ans) == 0 {
+		t.Error("loaded entry is not the answer saved")
+	}
+	if cachedNegative(ek) != nil {
+		t.Error("expired entry loaded")
+	}
+	negative.Lock()
+	left := negative.entries[vk].expiry.Sub(time.Now())
+	negative.Unlock()
+	if left > 10*time.Minute || left < 9*time.Minute {
+		t.Errorf("loaded entry expires in %v", left)
+	}
+}
+
+func TestLoadCacheInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+	if err := ioutil.WriteFile(path, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCache(path); err != errBadCacheFile {
+		t.Errorf("got %v, want errBadCacheFile", err)
+	}
+	if _, err := LoadCache(filepath.Join(dir, "none")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
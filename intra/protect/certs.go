@@ -0,0 +1,32 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+)
+
+// certsObserver holds the peerCertsObserver set, nil if none.
+var certsObserver atomic.Value
+
+type peerCertsObserver func(host string, certs []*x509.Certificate)
+
+// OnPeerCertificates sets f to be called with the server name and the
+// certificate chain the peer presented, leaf first, each time DialTLS
+// completes a handshake; the chain is also in the ConnectionState of the
+// conn it returns. Dials that don't go through DialTLS aren't seen. f is
+// called in the path of dials and must not block. A nil f removes it.
+func OnPeerCertificates(f func(host string, certs []*x509.Certificate)) {
+	certsObserver.Store(peerCertsObserver(f))
+}
+
+func observePeerCertificates(host string, certs []*x509.Certificate) {
+	if o, _ := certsObserver.Load().(peerCertsObserver); o != nil {
+		o(host, certs)
+	}
+}
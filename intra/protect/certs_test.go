@@ -0,0 +1,51 @@
+package protect
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestOnPeerCertificates(t *testing.T) {
+	cert := selfSigned(t, "foo.test")
+	defer func() { rootCAs = nil }()
+	l := startTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+
+	type seen struct {
+		host  string
+		certs []*x509.Certificate
+	}
+	observed := make(chan seen, 1)
+	OnPeerCertificates(func(host string, certs []*x509.Certificate) {
+		observed <- seen{host, certs}
+	})
+	defer OnPeerCertificates(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialTLS(ctx, MakeDialer(&fakeProtector{}), "tcp", l.Addr().String(), &TLSDialConfig{ServerName: "foo.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	chain := c.ConnectionState().PeerCertificates
+	if len(chain) != 1 || !bytes.Equal(chain[0].Raw, cert.Certificate[0]) {
+		t.Errorf("conn has chain %v, want the server's certificate", chain)
+	}
+	select {
+	case got := <-observed:
+		if got.host != "foo.test" {
+			t.Errorf("observed host %q, want foo.test", got.host)
+		}
+		if len(got.certs) != 1 || !bytes.Equal(got.certs[0].Raw, cert.Certificate[0]) {
+			t.Errorf("observed chain %v, want the server's certificate", got.certs)
+		}
+	default:
+		t.Error("chain not observed")
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"time"
+)
+
+var errBadTimeout = errors.New("resolver timeout must not be negative")
+
+// ResolverSpec is a step of a resolver chain.
+type ResolverSpec struct {
+	DNSTransport
+	// Timeout is how long the resolver is given to answer before the next
+	// one in the chain is tried; 0 is 3s.
+	Timeout time.Duration
+}
+
+// SetResolverChain is SetDNSTransports with a timeout for each transport:
+// queries go to the resolvers of chain in order, each tried once the one
+// before fails or doesn't answer within its timeout, as in DoH, then DoT,
+// then plaintext udp, for the most private transport that works. A query
+// walks the chain for no longer than the timeouts of all of its steps. A
+// nil or empty chain reverts to the system resolvers.
+func SetResolverChain(chain []ResolverSpec) error {
+	ts := make([]DNSTransport, len(chain))
+	for i, r := range chain {
+		if r.Timeout < 0 {
+			return errBadTimeout
+		}
+		ts[i] = r.DNSTransport
+		ts[i].timeout = r.Timeout
+	}
+	return SetDNSTransports(ts)
+}
@@ -0,0 +1,115 @@
+package protect
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startUDPDNS answers queries on a udp port with fooIP.
+func startUDPDNS(t *testing.T) (net.PacketConn, int) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			c.WriteTo(answer(b[:n]), from)
+		}
+	}()
+	return c, c.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startHangingDoH starts a doh server that never answers, trusted by
+// rootCAs, and returns its port and a func to stop it.
+func startHangingDoH(t *testing.T) (int, func()) {
+	stop := make(chan struct{})
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(s.Certificate())
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return port, func() {
+		close(stop)
+		s.Close()
+		rootCAs = nil
+	}
+}
+
+func TestResolverChain(t *testing.T) {
+	dohPort, stop := startHangingDoH(t)
+	defer stop()
+	udp, udpPort := startUDPDNS(t)
+	defer udp.Close()
+
+	step := 300 * time.Millisecond
+	err := SetResolverChain([]ResolverSpec{
+		{DNSTransport{Scheme: DNSSchemeDoH, Host: "127.0.0.1", Port: dohPort}, step},
+		{DNSTransport{Scheme: DNSSchemeDoT, Host: "127.0.0.1", Port: deadTCPPort(t)}, step},
+		{DNSTransport{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: udpPort}, step},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetResolverChain(nil)
+
+	begin := time.Now()
+	lookupFoo(t, MakeDialer(&fakeProtector{}))
+	if took := time.Since(begin); took > 3*step+time.Second {
+		t.Errorf("lookup took %v", took)
+	}
+}
+
+func TestResolverChainDeadline(t *testing.T) {
+	var chain []ResolverSpec
+	for i := 0; i < 3; i++ {
+		port, stop := startHangingDoH(t)
+		defer stop()
+		chain = append(chain, ResolverSpec{DNSTransport{Scheme: DNSSchemeDoH, Host: "127.0.0.1", Port: port}, 200 * time.Millisecond})
+	}
+	if err := SetResolverChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	defer SetResolverChain(nil)
+
+	begin := time.Now()
+	q := makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)
+	if _, err := exchangeAny(context.Background(), MakeDialer(&fakeProtector{}), dnsTransports(), q); err == nil {
+		t.Fatal("answered by hanging resolvers")
+	}
+	if took := time.Since(begin); took > 600*time.Millisecond+500*time.Millisecond {
+		t.Errorf("walk took %v, over its deadline", took)
+	}
+}
+
+func TestSetResolverChainInvalid(t *testing.T) {
+	for _, chain := range [][]ResolverSpec{
+		{{DNSTransport{Scheme: DNSSchemeUDP, Host: "127.0.0.1"}, -time.Second}},
+		{{DNSTransport{Scheme: DNSSchemeUDP, Host: "dns.test"}, time.Second}},
+	} {
+		if err := SetResolverChain(chain); err == nil {
+			t.Errorf("%v: set", chain)
+		}
+	}
+	if ts := dnsTransports(); len(ts) != 0 {
+		t.Errorf("invalid chain set: %v", ts)
+	}
+}
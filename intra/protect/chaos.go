@@ -0,0 +1,105 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBadChaosConfig = errors.New("chaos: latency and jitter must not be negative, loss must be in [0, 1]")
+
+// ChaosConfig is the bad network a chaos dialer simulates; see
+// MakeChaosDialer.
+type ChaosConfig struct {
+	// Latency delays each dial and each write.
+	Latency time.Duration
+	// Jitter adds up to as much again, at random, to each delay.
+	Jitter time.Duration
+	// Loss is the fraction of writes to udp conns dropped, from 0 to 1.
+	Loss float64
+	// Seed seeds the randomness of jitter and loss, so that runs with the
+	// same seed delay and drop alike.
+	Seed int64
+}
+
+// chaos draws the delays and drops of a chaos dialer.
+type chaos struct {
+	cfg ChaosConfig
+
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// MakeChaosDialer returns a dialer that dials with inner over the bad
+// network cfg describes: dials and writes are delayed by cfg.Latency and
+// cfg.Jitter, and writes to udp conns are dropped at cfg.Loss, though
+// reported as written. It is for testing how apps fare on bad networks,
+// and never for real flows.
+func MakeChaosDialer(inner ContextDialer, cfg ChaosConfig) (ContextDialer, error) {
+	if cfg.Latency < 0 || cfg.Jitter < 0 || cfg.Loss < 0 || cfg.Loss > 1 {
+		return nil, errBadChaosConfig
+	}
+	ch := &chaos{cfg: cfg, r: rand.New(rand.NewSource(cfg.Seed))}
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t := time.NewTimer(ch.delay())
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		c, err := inner.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &chaosConn{Conn: c, ch: ch, lossy: strings.HasPrefix(network, "udp")}, nil
+	}), nil
+}
+
+// delay returns the latency plus a random jitter.
+func (ch *chaos) delay() time.Duration {
+	d := ch.cfg.Latency
+	if ch.cfg.Jitter > 0 {
+		ch.mu.Lock()
+		d += time.Duration(ch.r.Int63n(int64(ch.cfg.Jitter) + 1))
+		ch.mu.Unlock()
+	}
+	return d
+}
+
+// lost returns true, at the loss rate, for a write to be dropped.
+func (ch *chaos) lost() bool {
+	if ch.cfg.Loss <= 0 {
+		return false
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.r.Float64() < ch.cfg.Loss
+}
+
+// chaosConn delays its writes, and drops them if lossy.
+type chaosConn struct {
+	net.Conn
+	ch    *chaos
+	lossy bool
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	if d := c.ch.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	if c.lossy && c.ch.lost() {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,120 @@
+package protect
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCounter is a conn that counts the writes made to it.
+type writeCounter struct {
+	net.Conn
+	n int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.n, 1)
+	return len(b), nil
+}
+
+func TestChaosLatency(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	const latency = 50 * time.Millisecond
+	d, err := MakeChaosDialer(&net.Dialer{}, ChaosConfig{Latency: latency, Jitter: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if took := time.Since(start); took < latency {
+		t.Errorf("dial took %s, want at least %s", took, latency)
+	}
+
+	start = time.Now()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < latency {
+		t.Errorf("round trip took %s, want at least %s", took, latency)
+	}
+}
+
+func TestChaosDialCanceled(t *testing.T) {
+	d, err := MakeChaosDialer(&net.Dialer{}, ChaosConfig{Latency: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:1"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestChaosLoss(t *testing.T) {
+	const writes, loss = 2000, 0.3
+	delivered := func(network string, seed int64) int32 {
+		wc := &writeCounter{}
+		inner := contextDialerFunc(func(context.Context, string, string) (net.Conn, error) {
+			return wc, nil
+		})
+		d, err := MakeChaosDialer(inner, ChaosConfig{Loss: loss, Seed: seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.DialContext(context.Background(), network, "127.0.0.1:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < writes; i++ {
+			if n, err := c.Write([]byte{1}); n != 1 || err != nil {
+				t.Fatalf("write %d: %d, %v", i, n, err)
+			}
+		}
+		return atomic.LoadInt32(&wc.n)
+	}
+
+	n := delivered("udp", 1)
+	if rate := 1 - float64(n)/writes; math.Abs(rate-loss) > 0.05 {
+		t.Errorf("lost %.3f of writes, want about %.3f", rate, loss)
+	}
+	if again := delivered("udp", 1); again != n {
+		t.Errorf("same seed delivered %d, then %d", n, again)
+	}
+	if n := delivered("tcp", 1); n != writes {
+		t.Errorf("tcp delivered %d of %d writes", n, writes)
+	}
+}
+
+func TestChaosBadConfig(t *testing.T) {
+	for _, cfg := range []ChaosConfig{{Latency: -1}, {Jitter: -1}, {Loss: -0.1}, {Loss: 1.1}} {
+		if _, err := MakeChaosDialer(&net.Dialer{}, cfg); err != errBadChaosConfig {
+			t.Errorf("%+v: got %v, want %v", cfg, err, errBadChaosConfig)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// coalesce is 1 when identical queries in flight share one exchange.
+var coalesce int32
+
+// flightKey identifies queries that may share an answer: those for the
+// same question, sent as per the same dial config.
+type flightKey struct {
+	questionKey
+	cfg *dialConfig
+}
+
+// flight is an exchange others wait on the answer of.
+type flight struct {
+	done chan struct{}
+	ans  []byte
+	err  error
+	// abandoned is set if the exchange failed once its ctx was done; those
+	// waiting on it, whose own ctxs may not be, then send the query again.
+	abandoned bool
+}
+
+var flights struct {
+	sync.Mutex
+	m map[flightKey]*flight
+}
+
+// SetCoalesceQueries sets whether the resolvers of protected dialers send
+// queries for a question (name, type, class) already in flight, as they
+// are when many connections to a host are made at once, or wait on the
+// answer to the one sent and answer with it. Off by default.
+func SetCoalesceQueries(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&coalesce, v)
+}
+
+func coalescing() bool {
+	return atomic.LoadInt32(&coalesce) == 1
+}
+
+func init() {
+	// to be coalesced
+	needDNSConn(func(*dialConfig) bool { return coalescing() })
+}
+
+// coalesced wraps exchange, as set up for cfg, to share answers between
+// identical queries in flight, if set.
+func coalesced(cfg *dialConfig, exchange func(context.Context, []byte) ([]byte, error)) func(context.Context, []byte) ([]byte, error) {
+	return func(ctx context.Context, q []byte) ([]byte, error) {
+		if !coalescing() {
+			return exchange(ctx, q)
+		}
+		k, ok := questionOf(q)
+		if !ok {
+			return exchange(ctx, q)
+		}
+		fk := flightKey{k, cfg}
+
+		for {
+			flights.Lock()
+			if f, ok := flights.m[fk]; ok {
+				flights.Unlock()
+				select {
+				case <-f.done:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if f.abandoned {
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if f.err != nil {
+					return nil, f.err
+				}
+				// answer with the id of this query
+				ans := append([]byte{}, f.ans...)
+				copy(ans, q[:2])
+				return ans, nil
+			}
+			if flights.m == nil {
+				flights.m = make(map[flightKey]*flight)
+			}
+			f := &flight{done: make(chan struct{})}
+			flights.m[fk] = f
+			flights.Unlock()
+
+			f.ans, f.err = exchange(ctx, q)
+			f.abandoned = f.err != nil && ctx.Err() != nil
+
+			flights.Lock()
+			delete(flights.m, fk)
+			flights.Unlock()
+			close(f.done)
+			return f.ans, f.err
+		}
+	}
+}
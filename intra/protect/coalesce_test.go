@@ -0,0 +1,157 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startSlowUDPDNS answers queries after delay, counting them in queries.
+func startSlowUDPDNS(t *testing.T, delay time.Duration, queries *int32) (net.PacketConn, int) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			q := append([]byte{}, b[:n]...)
+			time.AfterFunc(delay, func() { c.WriteTo(answer(q), from) })
+		}
+	}()
+	return c, c.LocalAddr().(*net.UDPAddr).Port
+}
+
+// lookupConcurrently looks up foo.test. n times at once, each with its own
+// dialer, as net.Resolver already coalesces its own lookups.
+func lookupConcurrently(t *testing.T, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := MakeDialer(&fakeProtector{})
+			ips, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(ips) != 1 || !ips[0].Equal(fooIP) {
+				t.Errorf("got %v, want %v", ips, fooIP)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCoalesceQueries(t *testing.T) {
+	var queries int32
+	c, port := startSlowUDPDNS(t, 200*time.Millisecond, &queries)
+	defer c.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	SetCoalesceQueries(true)
+	lookupConcurrently(t, 20)
+	SetCoalesceQueries(false)
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d queries sent for 20 lookups, want 1", n)
+	}
+	flights.Lock()
+	inflight := len(flights.m)
+	flights.Unlock()
+	if inflight != 0 {
+		t.Errorf("%d flights left over", inflight)
+	}
+
+	// without coalescing, each lookup sends its own query
+	atomic.StoreInt32(&queries, 0)
+	lookupConcurrently(t, 20)
+	if n := atomic.LoadInt32(&queries); n < 2 {
+		t.Errorf("%d queries sent for 20 lookups without coalescing", n)
+	}
+}
+
+func TestCoalesceQueriesSharesErrors(t *testing.T) {
+	SetCoalesceQueries(true)
+	defer SetCoalesceQueries(false)
+
+	var calls int32
+	release := make(chan struct{})
+	exchange := coalesced(loadDialConfig(), func(ctx context.Context, q []byte) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil, errNoTransport
+	})
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func(id uint16) {
+			_, err := exchange(context.Background(), makeQuery(t, id, "foo.test.", dnsmessage.TypeA))
+			errs <- err
+		}(uint16(i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != errNoTransport {
+			t.Errorf("got %v, want errNoTransport", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d exchanges, want 1", n)
+	}
+}
+
+func TestCoalesceQueriesLeaderCancelled(t *testing.T) {
+	SetCoalesceQueries(true)
+	defer SetCoalesceQueries(false)
+
+	var calls int32
+	exchange := coalesced(loadDialConfig(), func(ctx context.Context, q []byte) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return answer(q), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := exchange(ctx, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA))
+		leader <- err
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	follower := make(chan error, 1)
+	go func() {
+		_, err := exchange(context.Background(), makeQuery(t, 2, "foo.test.", dnsmessage.TypeA))
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-leader; err != context.Canceled {
+		t.Errorf("leader: got %v, want context.Canceled", err)
+	}
+	// the follower asks again, rather than fail as the leader gave up
+	if err := <-follower; err != nil {
+		t.Errorf("follower: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("%d exchanges, want 2", n)
+	}
+}
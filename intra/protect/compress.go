@@ -0,0 +1,109 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+var errBadCompressionLevel = errors.New("compression level out of range")
+
+// CompressedConn deflates (RFC 1951) the bytes written to it and inflates
+// those read from it, for upstreams that compress streams likewise, as
+// some proxies do. Each write is flushed as it is made, so interactive
+// flows aren't held up for a block to fill.
+type CompressedConn struct {
+	net.Conn
+	r io.ReadCloser
+
+	wmu     sync.Mutex
+	w       *flate.Writer
+	wclosed bool
+}
+
+// NewCompressedConn returns c compressing at level, one of compress/flate's
+// levels from flate.HuffmanOnly to flate.BestCompression.
+func NewCompressedConn(c net.Conn, level int) (*CompressedConn, error) {
+	w, err := flate.NewWriter(c, level)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedConn{Conn: c, r: flate.NewReader(c), w: w}, nil
+}
+
+func (c *CompressedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *CompressedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wclosed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return n, err
+}
+
+// finish ends the compressed stream written, for the upstream to see EOF.
+func (c *CompressedConn) finish() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wclosed {
+		return nil
+	}
+	c.wclosed = true
+	return c.w.Close()
+}
+
+// CloseWrite ends the compressed stream written, and then shuts the
+// write half of the conn underneath, if it can be.
+func (c *CompressedConn) CloseWrite() error {
+	err := c.finish()
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return err
+}
+
+// Close closes the conn without ending the compressed stream, as writes
+// to end it may block on a peer gone; CloseWrite ends it cleanly.
+func (c *CompressedConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
+
+// MakeCompressingDialer returns a dialer that dials with d and wraps each
+// stream conn in a CompressedConn at level, for backends whose upstreams
+// compress, and so is opted into as they are registered. Datagram conns
+// are left as they are. It fails for levels NewCompressedConn fails for.
+func MakeCompressingDialer(d ContextDialer, level int) (ContextDialer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, errBadCompressionLevel
+	}
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil || strings.HasPrefix(network, "udp") {
+			return c, err
+		}
+		cc, err := NewCompressedConn(c, level)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return cc, nil
+	}), nil
+}
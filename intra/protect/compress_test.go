@@ -0,0 +1,155 @@
+package protect
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wireCountingConn counts the bytes read off the wire.
+type wireCountingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *wireCountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// compressedEchoListener echoes the streams of compressed conns, counting
+// the compressed bytes it reads to wire.
+func compressedEchoListener(t *testing.T, wire *int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				cc, _ := NewCompressedConn(&wireCountingConn{c, wire}, flate.BestSpeed)
+				io.Copy(cc, cc)
+				cc.CloseWrite()
+				cc.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestCompressedConnRoundTrip(t *testing.T) {
+	var wire int64
+	l := compressedEchoListener(t, &wire)
+	defer l.Close()
+	d, err := MakeCompressingDialer(&net.Dialer{}, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// compressible, with some noise
+	var sent bytes.Buffer
+	rnd := rand.New(rand.NewSource(1))
+	for sent.Len() < 1<<20 {
+		sent.WriteString("GET /index.html HTTP/1.1\r\nHost: foo.test\r\n\r\n")
+		sent.WriteByte(byte(rnd.Intn(256)))
+	}
+	go func() {
+		// in writes of assorted sizes
+		b := sent.Bytes()
+		for len(b) > 0 {
+			n := 1 + rnd.Intn(8192)
+			if n > len(b) {
+				n = len(b)
+			}
+			c.Write(b[:n])
+			b = b[n:]
+		}
+		c.(*CompressedConn).CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent.Bytes()) {
+		t.Fatalf("got %d bytes back, not the %d sent", len(got), sent.Len())
+	}
+	if n := atomic.LoadInt64(&wire); n == 0 || n >= int64(sent.Len())/2 {
+		t.Errorf("%d bytes on the wire for %d sent", n, sent.Len())
+	}
+}
+
+func TestCompressedConnFlushes(t *testing.T) {
+	var wire int64
+	l := compressedEchoListener(t, &wire)
+	defer l.Close()
+	d, err := MakeCompressingDialer(&net.Dialer{}, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// each write is echoed without more being written
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong", "a longer interactive line"} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+		if string(b) != msg {
+			t.Errorf("got %q, want %q", b, msg)
+		}
+	}
+}
+
+func TestCompressingDialerLeavesDatagrams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	d, err := MakeCompressingDialer(&net.Dialer{}, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*CompressedConn); ok {
+		t.Error("datagram conn compressed")
+	}
+}
+
+func TestCompressingDialerBadLevel(t *testing.T) {
+	for _, level := range []int{flate.HuffmanOnly - 1, flate.BestCompression + 1} {
+		if _, err := MakeCompressingDialer(&net.Dialer{}, level); err != errBadCompressionLevel {
+			t.Errorf("level %d: got %v, want errBadCompressionLevel", level, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the configuration of resolution and dialing, which
+// Reconfigure sets all at once.
+type Config struct {
+	// DNSTransports are as for SetDNSTransports.
+	DNSTransports []DNSTransport
+	// BootstrapResolvers are as for SetBootstrapResolvers.
+	BootstrapResolvers string
+	// AddressSortPolicy is as for SetAddressSortPolicy.
+	AddressSortPolicy int
+}
+
+// dialConfig is an immutable snapshot of the configuration; setters
+// replace it with an updated copy.
+type dialConfig struct {
+	transports []DNSTransport
+	bootstrap  []string
+	sortPolicy int
+	routes     []*dnsRoute   // by suffix length, longest first
+	budget     time.Duration // of each dial of a hostname; 0 is none
+	attempt    time.Duration // of each resolver of a query; 0 is none
+}
+
+var dialConfigs struct {
+	sync.Mutex // serializes updates
+	current    atomic.Value
+}
+
+func init() {
+	dialConfigs.current.Store(&dialConfig{sortPolicy: RFC6724})
+}
+
+func loadDialConfig() *dialConfig {
+	return dialConfigs.current.Load().(*dialConfig)
+}
+
+// updateDialConfig stores a copy of the current config as modified by f.
+func updateDialConfig(f func(c *dialConfig)) {
+	dialConfigs.Lock()
+	defer dialConfigs.Unlock()
+	c := *loadDialConfig()
+	f(&c)
+	dialConfigs.current.Store(&c)
+}
+
+// Reconfigure replaces the dns transports, bootstrap resolvers and address
+// sort policy at once; a dial sees either the old config or the new one,
+// never a mix. Conns already dialed are left as is. cfg is validated as
+// by the respective setters; if invalid, nothing changes.
+func Reconfigure(cfg Config) error {
+	ts, err := validTransports(cfg.DNSTransports)
+	if err != nil {
+		return err
+	}
+	ips, err := bootstrapResolvers(cfg.BootstrapResolvers)
+	if err != nil {
+		return err
+	}
+	if !validSortPolicy(cfg.AddressSortPolicy) {
+		return errBadSortPolicy
+	}
+	updateDialConfig(func(c *dialConfig) {
+		c.transports = ts
+		c.bootstrap = ips
+		c.sortPolicy = cfg.AddressSortPolicy
+	})
+	return nil
+}
+
+type dialConfigKey struct{}
+
+// pinDialConfig returns ctx with the current config, unless it has one,
+// for use by everything that dials with ctx, the resolver included.
+func pinDialConfig(ctx context.Context) context.Context {
+	if ctx.Value(dialConfigKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, dialConfigKey{}, loadDialConfig())
+}
+
+// dialConfigOf returns the config pinned to ctx, if any, or the current one.
+func dialConfigOf(ctx context.Context) *dialConfig {
+	if c, ok := ctx.Value(dialConfigKey{}).(*dialConfig); ok {
+		return c
+	}
+	return loadDialConfig()
+}
@@ -0,0 +1,195 @@
+package protect
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDualDNS answers A queries with 127.0.0.1 and AAAA with ::1 over
+// tcp, calling onQuery before each answer.
+func serveDualDNS(l net.Listener, onQuery func()) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			for {
+				var n [2]byte
+				if _, err := io.ReadFull(c, n[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(n[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				onQuery()
+				var msg dnsmessage.Message
+				if err := msg.Unpack(q); err != nil {
+					return
+				}
+				msg.Response = true
+				msg.Additionals = nil
+				for _, question := range msg.Questions {
+					h := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60}
+					switch question.Type {
+					case dnsmessage.TypeA:
+						msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}})
+					case dnsmessage.TypeAAAA:
+						var aaaa [16]byte
+						copy(aaaa[:], net.IPv6loopback)
+						msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+					}
+				}
+				ans, _ := msg.Pack()
+				binary.BigEndian.PutUint16(n[:], uint16(len(ans)))
+				c.Write(append(n[:], ans...))
+			}
+		}(c)
+	}
+}
+
+func TestReconfigureInvalid(t *testing.T) {
+	defer Reconfigure(Config{})
+	want := Config{BootstrapResolvers: "192.0.2.1", AddressSortPolicy: V4First}
+	if err := Reconfigure(want); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []Config{
+		{AddressSortPolicy: 42},
+		{BootstrapResolvers: "dns.test"},
+		{DNSTransports: []DNSTransport{{Scheme: "smoke-signals", Host: "127.0.0.1"}}},
+	} {
+		if err := Reconfigure(cfg); err == nil {
+			t.Errorf("%+v: accepted", cfg)
+		}
+	}
+	c := loadDialConfig()
+	if c.sortPolicy != V4First || len(c.bootstrap) != 1 || c.bootstrap[0] != "192.0.2.1" {
+		t.Errorf("invalid config partly applied: %+v", c)
+	}
+}
+
+func TestReconfigureCoherent(t *testing.T) {
+	defer Reconfigure(Config{})
+	// the port of the transport pairs with the policy and the bootstrap
+	configs := []Config{
+		{
+			DNSTransports:      []DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: 1}},
+			BootstrapResolvers: "192.0.2.1",
+			AddressSortPolicy:  V4First,
+		},
+		{
+			DNSTransports:      []DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: 2}, {Scheme: DNSSchemeUDP, Host: "::1"}},
+			BootstrapResolvers: "192.0.2.2,2001:db8::2",
+			AddressSortPolicy:  V6First,
+		},
+	}
+	coherent := func(c *dialConfig) bool {
+		switch c.transports[0].Port {
+		case 1:
+			return len(c.transports) == 1 && len(c.bootstrap) == 1 && c.sortPolicy == V4First
+		case 2:
+			return len(c.transports) == 2 && len(c.bootstrap) == 2 && c.sortPolicy == V6First
+		}
+		return false
+	}
+	if err := Reconfigure(configs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				if c := dialConfigOf(pinDialConfig(context.Background())); !coherent(c) {
+					t.Errorf("incoherent config %+v", c)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		if err := Reconfigure(configs[i%2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+func TestReconfigureDuringDial(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("no dual-stack listener: %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if c, err := net.Dial("tcp6", net.JoinHostPort("::1", port)); err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	} else {
+		c.Close()
+		c, _ := l.Accept()
+		c.Close()
+	}
+
+	var queriesB int32
+	dnsB, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsB.Close()
+	go serveDualDNS(dnsB, func() { atomic.AddInt32(&queriesB, 1) })
+	cfgB := Config{
+		DNSTransports:     []DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: dnsB.Addr().(*net.TCPAddr).Port}},
+		AddressSortPolicy: V4First,
+	}
+
+	// the first query to resolver a switches the config to b
+	dnsA, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsA.Close()
+	var once sync.Once
+	go serveDualDNS(dnsA, func() {
+		once.Do(func() {
+			if err := Reconfigure(cfgB); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	defer Reconfigure(Config{})
+	if err := Reconfigure(Config{
+		DNSTransports:     []DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: dnsA.Addr().(*net.TCPAddr).Port}},
+		AddressSortPolicy: V6First,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := DialContext(context.Background(), MakeDialer(&fakeProtector{}), "tcp", net.JoinHostPort("foo.test.", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := atomic.LoadInt32(&queriesB); n != 0 {
+		t.Errorf("%d queries sent to the new resolver mid-dial", n)
+	}
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("dialed %s, want ::1 first, per the old policy", ip)
+	}
+	if loadDialConfig().sortPolicy != V4First {
+		t.Error("config not switched")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// transportDump is a DNSTransport as ResolverConfigDump reports it.
+type transportDump struct {
+	Scheme     string `json:"scheme"`
+	Addr       string `json:"addr"`
+	ServerName string `json:"serverName,omitempty"`
+	// TimeoutMs is the timeout of the transport, as set by
+	// SetResolverChain, in milliseconds; 0 if it has none of its own.
+	TimeoutMs int64 `json:"timeoutMs,omitempty"`
+}
+
+// routeDump is a route of SetDNSRoute as ResolverConfigDump reports it.
+type routeDump struct {
+	Suffix   string `json:"suffix"`
+	NetId    string `json:"netid"`
+	Resolver string `json:"resolver"`
+}
+
+// resolverConfigDump is what ResolverConfigDump reports.
+type resolverConfigDump struct {
+	BootstrapV4 []string        `json:"bootstrapV4"`
+	BootstrapV6 []string        `json:"bootstrapV6"`
+	Transports  []transportDump `json:"transports"`
+	Routes      []routeDump     `json:"routes"`
+	// Pins are the hosts of PinHostIP, with their ips.
+	Pins             map[string]string `json:"pins"`
+	SortPolicy       int               `json:"sortPolicy"`
+	DialBudgetMs     int64             `json:"dialBudgetMs"`
+	AttemptTimeoutMs int64             `json:"attemptTimeoutMs"`
+	MaxResponseSize  int               `json:"maxResponseSize"`
+	AAAADisabled     bool              `json:"aaaaDisabled"`
+	ResolverBypass   bool              `json:"resolverBypass"`
+	LatencyAware     bool              `json:"latencyAware"`
+	CoalesceQueries  bool              `json:"coalesceQueries"`
+	Cookies          bool              `json:"cookies"`
+	NegativeCaching  bool              `json:"negativeCaching"`
+	StrictValidation bool              `json:"strictValidation"`
+}
+
+// ResolverConfigDump returns, as indented json, the resolver configuration
+// protected dialers use for lookups begun now: the bootstrap resolvers by
+// ip family, the dns transports in the order they are tried, the dns
+// routes, longest suffix first, the pinned hosts and the settings of the
+// resolver path. It is for support, to compare against what the embedder
+// meant to set. The system's resolvers, which are read from the Protector
+// of each dialer as it looks up, aren't part of it.
+func ResolverConfigDump() string {
+	c := loadDialConfig()
+	d := resolverConfigDump{
+		BootstrapV4:      []string{},
+		BootstrapV6:      []string{},
+		Transports:       make([]transportDump, len(c.transports)),
+		Routes:           make([]routeDump, len(c.routes)),
+		Pins:             make(map[string]string),
+		SortPolicy:       c.sortPolicy,
+		DialBudgetMs:     c.budget.Milliseconds(),
+		AttemptTimeoutMs: c.attempt.Milliseconds(),
+		MaxResponseSize:  maxResponseSize(),
+		AAAADisabled:     aaaaDisabled(),
+		ResolverBypass:   bypassingResolver(),
+		LatencyAware:     latencyAwareSelection(),
+		CoalesceQueries:  coalescing(),
+		Cookies:          cookiesEnabled(),
+		NegativeCaching:  negativeCaching(),
+		StrictValidation: atomic.LoadInt32(&strict) == 1,
+	}
+	for _, ip := range c.bootstrap {
+		if ipFamily(ip) == 4 {
+			d.BootstrapV4 = append(d.BootstrapV4, ip)
+		} else {
+			d.BootstrapV6 = append(d.BootstrapV6, ip)
+		}
+	}
+	for i, t := range c.transports {
+		d.Transports[i] = transportDump{t.Scheme, t.addr(), t.ServerName, t.timeout.Milliseconds()}
+	}
+	for i, r := range c.routes {
+		d.Routes[i] = routeDump{r.suffix, r.netid, r.resolver}
+	}
+	pins.RLock()
+	for host, ip := range pins.host {
+		d.Pins[host] = ip.String()
+	}
+	pins.RUnlock()
+	b, _ := json.MarshalIndent(d, "", "  ")
+	return string(b)
+}
@@ -0,0 +1,69 @@
+package protect
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolverConfigDump(t *testing.T) {
+	if err := SetBootstrapResolvers("10.0.0.53, 2001:db8::53, 10.0.0.54"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetBootstrapResolvers("")
+	err := SetResolverChain([]ResolverSpec{
+		{DNSTransport: DNSTransport{Scheme: DNSSchemeDoH, Host: "1.1.1.1", ServerName: "cloudflare-dns.com"}, Timeout: time.Second},
+		{DNSTransport: DNSTransport{Scheme: DNSSchemeUDP, Host: "9.9.9.9"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	if err := SetDNSRoute("corp.example", "wg0", &net.Dialer{}, "10.1.0.53:53"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSRoute("corp.example", "", nil, "")
+	PinHostIP("Proxy.Example.", net.IPv4(192, 0, 2, 7))
+	defer PinHostIP("proxy.example", nil)
+	SetResolverAttemptTimeout(400 * time.Millisecond)
+	defer SetResolverAttemptTimeout(0)
+	SetMaxDNSResponseSize(4096)
+	defer SetMaxDNSResponseSize(0)
+
+	var got resolverConfigDump
+	if err := json.Unmarshal([]byte(ResolverConfigDump()), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := resolverConfigDump{
+		BootstrapV4: []string{"10.0.0.53", "10.0.0.54"},
+		BootstrapV6: []string{"2001:db8::53"},
+		Transports: []transportDump{
+			{DNSSchemeDoH, "1.1.1.1:443", "cloudflare-dns.com", 1000},
+			{DNSSchemeUDP, "9.9.9.9:53", "", 0},
+		},
+		Routes:           []routeDump{{"corp.example.", "wg0", "10.1.0.53:53"}},
+		Pins:             map[string]string{"proxy.example": "192.0.2.7"},
+		SortPolicy:       RFC6724,
+		AttemptTimeoutMs: 400,
+		MaxResponseSize:  4096,
+		StrictValidation: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestResolverConfigDumpEmpty(t *testing.T) {
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(ResolverConfigDump()), &got); err != nil {
+		t.Fatal(err)
+	}
+	// empty lists are reported as such, not as null
+	for _, k := range []string{"bootstrapV4", "bootstrapV6", "transports", "routes", "pins"} {
+		if got[k] == nil {
+			t.Errorf("%s is null", k)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package protect
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// getCongestion returns the congestion control algorithm of tcp socket fd.
+func getCongestion(fd uintptr) (string, error) {
+	algo, err := unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	// the name is nul-padded
+	return strings.TrimRight(algo, "\x00"), err
+}
+
+func TestCongestionControl(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dial := func(algo string) string {
+		var got string
+		var gerr error
+		read := func(network, address string, fd uintptr) error {
+			got, gerr = getCongestion(fd)
+			return nil
+		}
+		d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+			ControlHooks:      []func(string, string, uintptr) error{read},
+			CongestionControl: algo,
+		})
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		conn.Close()
+		if gerr != nil {
+			t.Fatal(gerr)
+		}
+		return got
+	}
+
+	if got := dial("cubic"); got != "cubic" {
+		t.Skipf("cubic unavailable: congestion control is %q", got)
+	}
+	// unknown algorithms leave the default be, and don't fail the dial
+	def := dial("")
+	if got := dial("nosuchcc"); got != def {
+		t.Errorf("congestion control is %q, want the default %q", got, def)
+	}
+}
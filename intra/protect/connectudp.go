@@ -0,0 +1,457 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// connectUDPTemplate is the path of the well-known udp proxying uri
+	// template, used when the proxy url has no path of its own.
+	connectUDPTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	// capsuleDatagram is the type of DATAGRAM capsules, RFC 9297.
+	capsuleDatagram = 0x00
+	// max size of a capsule read; larger ones, with no udp payload in
+	// them, fail the conn.
+	maxCapsuleSize = 1 << 16
+)
+
+var (
+	errBadConnectUDPURL = errors.New("connect-udp proxy url must be http or https")
+	errBadCapsule       = errors.New("capsule too large")
+)
+
+// MakeConnectUDPDialer returns a dialer that proxies udp through the http
+// proxy at proxyURL with CONNECT-UDP (RFC 9298), over http/1.1 upgraded
+// conns, and tls for https urls, dialed with sockets protected by p. The
+// path and query of proxyURL, if any, are the uri template with
+// {target_host} and {target_port}; else the well-known one is used. Dials
+// to "udp" return conns that are also net.PacketConns, connected to the
+// target: each write sends one datagram to it and each read returns one
+// from it.
+//
+// This is not MASQUE over http/3: firestack has no quic stack, so the
+// datagrams go in capsules on a tcp stream (RFC 9298, section 3.2), and
+// are delivered reliably and in order, head-of-line blocking included.
+// Proxies that only speak http/3 can't be used.
+func MakeConnectUDPDialer(p Protector, proxyURL string) (ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+		return nil, errBadConnectUDPURL
+	}
+	proxyAddr := u.Host
+	if len(u.Port()) == 0 {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+	template := u.EscapedPath()
+	if len(u.RawQuery) > 0 {
+		template += "?" + u.RawQuery
+	}
+	if len(template) == 0 || template == "/" {
+		template = connectUDPTemplate
+	}
+	// braces are escaped by url.Parse
+	template = strings.NewReplacer("%7B", "{", "%7D", "}", "%7b", "{", "%7d", "}").Replace(template)
+
+	d := MakeDialer(p)
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "udp", "udp4", "udp6":
+		default:
+			return nil, fmt.Errorf("connect-udp: network %s: %w", network, errBadProxyProto)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var c net.Conn
+		if u.Scheme == "https" {
+			c, err = DialTLS(ctx, d, "tcp", proxyAddr, &TLSDialConfig{NextProtos: []string{"http/1.1"}})
+		} else {
+			c, err = DialContext(ctx, d, "tcp", proxyAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		path := strings.NewReplacer(
+			"{target_host}", strings.ReplaceAll(url.PathEscape(host), ":", "%3A"),
+			"{target_port}", port,
+		).Replace(template)
+		mc, err := connectUDP(ctx, c, u.Host, path, addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return mc, nil
+	}), nil
+}
+
+// MakeMasqueUDPDialer returns a net.PacketConn whose datagrams, written to
+// any udp target, are proxied through the http proxy at proxyURL with
+// CONNECT-UDP, over a tunnel per target dialed as by MakeConnectUDPDialer
+// on the first write to it; reads return datagrams from all targets. A
+// tunnel that fails is dialed anew on the next write to its target. Write
+// deadlines bound the dials of tunnels too.
+//
+// As with MakeConnectUDPDialer, tunnels are http/1.1 streams, not http/3
+// over quic, for which firestack has no stack.
+func MakeMasqueUDPDialer(p Protector, proxyURL string) (net.PacketConn, error) {
+	d, err := MakeConnectUDPDialer(p, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return &masqueConn{
+		d:       d,
+		tunnels: make(map[string]*masqueTunnel),
+		in:      make(chan masqueDatagram),
+		done:    make(chan struct{}),
+		wake:    make(chan struct{}),
+	}, nil
+}
+
+// masqueTunnel is the tunnel of a masqueConn to a target, usable once
+// ready is closed, unless err is set.
+type masqueTunnel struct {
+	ready chan struct{}
+	c     net.Conn
+	err   error
+}
+
+type masqueDatagram struct {
+	b    []byte
+	from net.Addr
+}
+
+// masqueConn multiplexes datagrams to many targets over their tunnels.
+type masqueConn struct {
+	d ContextDialer
+
+	mu      sync.Mutex
+	tunnels map[string]*masqueTunnel // by target
+	rd, wd  time.Time                // deadlines
+	wake    chan struct{}            // closed, and replaced, as rd is set
+	closed  bool
+	in      chan masqueDatagram // from the tunnels' readers
+	done    chan struct{}       // closed on Close
+}
+
+// tunnel returns the tunnel to addr, dialing it if there's none.
+func (c *masqueConn) tunnel(addr net.Addr) (*masqueTunnel, error) {
+	target := addr.String()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	t := c.tunnels[target]
+	if t != nil {
+		c.mu.Unlock()
+		<-t.ready
+		return t, t.err
+	}
+	t = &masqueTunnel{ready: make(chan struct{})}
+	c.tunnels[target] = t
+	wd := c.wd
+	c.mu.Unlock()
+
+	ctx := context.Background()
+	if !wd.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, wd)
+		defer cancel()
+	}
+	t.c, t.err = c.d.DialContext(ctx, "udp", target)
+	close(t.ready)
+	if t.err != nil {
+		c.forget(target, t)
+		return t, t.err
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		t.c.Close()
+		return nil, errConnClosed
+	}
+	go c.pump(target, addr, t)
+	return t, nil
+}
+
+// forget drops t, the tunnel to target, so that the next write dials anew.
+func (c *masqueConn) forget(target string, t *masqueTunnel) {
+	c.mu.Lock()
+	if c.tunnels[target] == t {
+		delete(c.tunnels, target)
+	}
+	c.mu.Unlock()
+}
+
+// pump hands the datagrams of t, from addr, to ReadFrom until t fails.
+func (c *masqueConn) pump(target string, addr net.Addr, t *masqueTunnel) {
+	defer c.forget(target, t)
+	defer t.c.Close()
+	b := make([]byte, maxCapsuleSize)
+	for {
+		n, err := t.c.Read(b)
+		if err != nil {
+			return
+		}
+		select {
+		case c.in <- masqueDatagram{append([]byte(nil), b[:n]...), addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *masqueConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	t, err := c.tunnel(addr)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	t.c.SetWriteDeadline(c.wd)
+	c.mu.Unlock()
+	return t.c.Write(b)
+}
+
+func (c *masqueConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		rd, wake := c.rd, c.wake
+		c.mu.Unlock()
+		var expired <-chan time.Time
+		if !rd.IsZero() {
+			left := time.Until(rd)
+			if left <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(left)
+			expired = timer.C
+			defer timer.Stop()
+		}
+		select {
+		case d := <-c.in:
+			return copy(b, d.b), d.from, nil
+		case <-c.done:
+			return 0, nil, errConnClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			// the deadline changed; its timer, if any, stops on return
+		}
+	}
+}
+
+func (c *masqueConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	tunnels := c.tunnels
+	c.tunnels = nil
+	c.mu.Unlock()
+	for _, t := range tunnels {
+		select {
+		case <-t.ready:
+			if t.c != nil {
+				t.c.Close()
+			}
+		default:
+			// closed by tunnel once dialed
+		}
+	}
+	return nil
+}
+
+func (c *masqueConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+func (c *masqueConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *masqueConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rd = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline bounds writes, and dials of tunnels, from now on.
+func (c *masqueConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wd = t
+	c.mu.Unlock()
+	return nil
+}
+
+// connectUDP asks the proxy on c to proxy udp to target, with path.
+func connectUDP(ctx context.Context, c net.Conn, host, path, target string) (*capsuleConn, error) {
+	setDeadline(ctx, c)
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", path, host)
+	if _, err := c.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(res.Header.Get("Upgrade"), "connect-udp") {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %s: %s", errProxyRefused, target, res.Status)
+	}
+	c.SetDeadline(time.Time{})
+	return &capsuleConn{Conn: c, r: br, raddr: udpTarget(target)}, nil
+}
+
+// udpTarget is the address of a udp target, which may be a hostname.
+type udpTarget string
+
+func (a udpTarget) Network() string { return "udp" }
+func (a udpTarget) String() string  { return string(a) }
+
+// capsuleConn carries datagrams in DATAGRAM capsules on an upgraded conn.
+type capsuleConn struct {
+	net.Conn
+	r     *bufio.Reader
+	raddr net.Addr
+
+	wmu sync.Mutex // serializes capsules written
+}
+
+func (c *capsuleConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *capsuleConn) Write(b []byte) (int, error) {
+	// context id 0 is that of udp payloads, RFC 9298 section 4
+	capsule := appendVarint(make([]byte, 0, len(b)+10), capsuleDatagram)
+	capsule = appendVarint(capsule, uint64(len(b)+1))
+	capsule = append(capsule, 0)
+	capsule = append(capsule, b...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(capsule); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the payload of the next datagram, truncated to fit b;
+// capsules of other types, and datagrams of other contexts, are skipped.
+func (c *capsuleConn) Read(b []byte) (int, error) {
+	for {
+		typ, err := readVarint(c.r)
+		if err != nil {
+			return 0, err
+		}
+		n, err := readVarint(c.r)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if n > maxCapsuleSize {
+			return 0, errBadCapsule
+		}
+		body := io.LimitReader(c.r, int64(n))
+		if typ != capsuleDatagram {
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		br := bufio.NewReaderSize(body, 16)
+		ctxid, err := readVarint(br)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		payload, err := ioutil.ReadAll(br)
+		if err != nil {
+			return 0, err
+		}
+		if ctxid != 0 {
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+func (c *capsuleConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.raddr, err
+}
+
+func (c *capsuleConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// noEOF returns io.ErrUnexpectedEOF for io.EOF mid-capsule.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendVarint appends v as a quic variable-length integer, RFC 9000.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
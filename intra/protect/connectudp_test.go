@@ -0,0 +1,243 @@
+package protect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUDPEcho echoes datagrams until closed.
+func startUDPEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func writeCapsule(w io.Writer, typ uint64, value []byte) error {
+	b := appendVarint(appendVarint(nil, typ), uint64(len(value)))
+	_, err := w.Write(append(b, value...))
+	return err
+}
+
+// startConnectUDP serves connect-udp on the well-known path, relaying
+// datagrams to and from targets; with status other than 101, it refuses.
+func startConnectUDP(t *testing.T, status int) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(chan string, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConnectUDP(c, status, paths)
+		}
+	}()
+	return l, paths
+}
+
+func serveConnectUDP(c net.Conn, status int, paths chan string) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	paths <- req.RequestURI
+	if status != http.StatusSwitchingProtocols || req.Header.Get("Upgrade") != "connect-udp" {
+		fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/.well-known/masque/udp/"), "/")
+	if len(parts) < 2 {
+		return
+	}
+	udp, err := net.Dial("udp", net.JoinHostPort(parts[0], parts[1]))
+	if err != nil {
+		return
+	}
+	defer udp.Close()
+	io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	// capsules of unknown types are to be skipped
+	writeCapsule(c, 0x2a, []byte("ignore me"))
+
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, err := udp.Read(b)
+			if err != nil {
+				return
+			}
+			writeCapsule(c, capsuleDatagram, append([]byte{0}, b[:n]...))
+		}
+	}()
+	for {
+		typ, err := readVarint(br)
+		if err != nil {
+			return
+		}
+		n, err := readVarint(br)
+		if err != nil {
+			return
+		}
+		v := make([]byte, n)
+		if _, err := io.ReadFull(br, v); err != nil {
+			return
+		}
+		if typ == capsuleDatagram && len(v) > 0 && v[0] == 0 {
+			udp.Write(v[1:])
+		}
+	}
+}
+
+func TestConnectUDP(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	l, paths := startConnectUDP(t, http.StatusSwitchingProtocols)
+	defer l.Close()
+
+	p := &fakeProtector{}
+	d, err := MakeConnectUDPDialer(p, "http://"+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if len(p.fds) == 0 {
+		t.Error("socket to the proxy not protected")
+	}
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+	if got, want := <-paths, fmt.Sprintf("/.well-known/masque/udp/127.0.0.1/%d/", port); got != want {
+		t.Errorf("requested %s, want %s", got, want)
+	}
+
+	pc, ok := c.(net.PacketConn)
+	if !ok {
+		t.Fatal("conn is not a PacketConn")
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2048)
+	for _, msg := range []string{"ping", "pong", strings.Repeat("x", 1200)} {
+		if _, err := pc.WriteTo([]byte(msg), c.RemoteAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg {
+			t.Errorf("got %q, want %q", b[:n], msg)
+		}
+		if from.String() != echo.LocalAddr().String() {
+			t.Errorf("from %s, want %s", from, echo.LocalAddr())
+		}
+	}
+}
+
+func TestConnectUDPTemplate(t *testing.T) {
+	l, paths := startConnectUDP(t, http.StatusForbidden)
+	defer l.Close()
+	d, err := MakeConnectUDPDialer(&fakeProtector{}, "http://"+l.Addr().String()+"/masque?h={target_host}&p={target_port}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.DialContext(context.Background(), "udp", "[2001:db8::1]:443")
+	if !errors.Is(err, errProxyRefused) {
+		t.Errorf("got %v, want errProxyRefused", err)
+	}
+	if got := <-paths; got != "/masque?h=2001%3Adb8%3A%3A1&p=443" {
+		t.Errorf("requested %s", got)
+	}
+}
+
+func TestConnectUDPInvalid(t *testing.T) {
+	for _, u := range []string{"socks5://127.0.0.1:1080", "https://", "://"} {
+		if _, err := MakeConnectUDPDialer(&fakeProtector{}, u); err == nil {
+			t.Errorf("%s: accepted", u)
+		}
+	}
+	d, _ := MakeConnectUDPDialer(&fakeProtector{}, "http://127.0.0.1:1")
+	if _, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:80"); !errors.Is(err, errBadProxyProto) {
+		t.Errorf("tcp: got %v, want errBadProxyProto", err)
+	}
+}
+
+func TestMasqueUDPDialer(t *testing.T) {
+	l, _ := startConnectUDP(t, http.StatusSwitchingProtocols)
+	defer l.Close()
+	p := &fakeProtector{}
+	pc, err := MakeMasqueUDPDialer(p, "http://"+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// one conn, a tunnel to each target
+	b := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		echo := startUDPEcho(t)
+		defer echo.Close()
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := fmt.Sprintf("ping %d", i)
+		if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg || from.String() != echo.LocalAddr().String() {
+			t.Errorf("got %q from %s, want %q from %s", b[:n], from, msg, echo.LocalAddr())
+		}
+	}
+	if len(p.fds) < 2 {
+		t.Errorf("%d sockets to the proxy protected, want 2", len(p.fds))
+	}
+
+	pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read past the deadline: %v", err)
+	}
+	pc.Close()
+	if _, err := pc.WriteTo([]byte("x"), l.Addr()); err == nil {
+		t.Error("write after close")
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		got, err := readVarint(bufio.NewReader(strings.NewReader(string(b))))
+		if err != nil || got != v {
+			t.Errorf("%d: got %d %v from %x", v, got, err, b)
+		}
+	}
+}
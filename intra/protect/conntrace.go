@@ -0,0 +1,103 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ConnTrace is a set of hooks run as DialContext dials, as
+// httptrace.ClientTrace's are for http requests; any of them may be nil.
+// The hooks of attempts raced to the addresses of a hostname may run
+// concurrently.
+type ConnTrace struct {
+	// DNSStart and DNSDone run around the lookup of the host dialed, if
+	// it is a hostname.
+	DNSStart func(host string)
+	DNSDone  func(ips []net.IP, err error)
+	// ConnectStart and ConnectDone run around each attempt to connect to
+	// an address.
+	ConnectStart func(network, addr string)
+	ConnectDone  func(network, addr string, err error)
+	// ProtectStart and ProtectDone run around the protection of the socket
+	// of each attempt, along with the rest of its control hooks; err is
+	// that of the hook that failed, if any.
+	ProtectStart func(network, addr string)
+	ProtectDone  func(network, addr string, err error)
+	// GotConn runs with the conn dialed, once it is validated.
+	GotConn func(c net.Conn)
+}
+
+// connTraceKey is the context key of a *ConnTrace.
+type connTraceKey struct{}
+
+// WithConnTrace returns ctx with t, whose hooks are run by DialContext,
+// and the dialers built on it, as they dial with ctx.
+func WithConnTrace(ctx context.Context, t *ConnTrace) context.Context {
+	return context.WithValue(ctx, connTraceKey{}, t)
+}
+
+// connTraceOf returns the trace of ctx, if any.
+func connTraceOf(ctx context.Context) *ConnTrace {
+	t, _ := ctx.Value(connTraceKey{}).(*ConnTrace)
+	return t
+}
+
+func (t *ConnTrace) dnsStart(host string) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(host)
+	}
+}
+
+func (t *ConnTrace) dnsDone(ipaddrs []net.IPAddr, err error) {
+	if t == nil || t.DNSDone == nil {
+		return
+	}
+	ips := make([]net.IP, len(ipaddrs))
+	for i, ipaddr := range ipaddrs {
+		ips[i] = ipaddr.IP
+	}
+	t.DNSDone(ips, err)
+}
+
+func (t *ConnTrace) gotConn(c net.Conn) {
+	if t != nil && t.GotConn != nil {
+		t.GotConn(c)
+	}
+}
+
+// dialTraced dials addr, which is an ip address unless d has no Resolver,
+// with d, running the connect and protect hooks of the trace of ctx.
+func dialTraced(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	t := connTraceOf(ctx)
+	if t == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	traced := *d
+	if d.Control != nil && (t.ProtectStart != nil || t.ProtectDone != nil) {
+		traced.Control = func(network, address string, c syscall.RawConn) error {
+			if t.ProtectStart != nil {
+				t.ProtectStart(network, address)
+			}
+			err := d.Control(network, address, c)
+			if t.ProtectDone != nil {
+				t.ProtectDone(network, address, err)
+			}
+			return err
+		}
+	}
+	if t.ConnectStart != nil {
+		t.ConnectStart(network, addr)
+	}
+	c, err := traced.DialContext(ctx, network, addr)
+	if t.ConnectDone != nil {
+		t.ConnectDone(network, addr, err)
+	}
+	return c, err
+}
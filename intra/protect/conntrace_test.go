@@ -0,0 +1,159 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceRecorder notes the hooks of a ConnTrace that run, and when.
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+	times  []time.Time
+}
+
+func (r *traceRecorder) note(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	r.times = append(r.times, time.Now())
+}
+
+func (r *traceRecorder) trace() *ConnTrace {
+	return &ConnTrace{
+		DNSStart: func(host string) { r.note("DNSStart " + host) },
+		DNSDone: func(ips []net.IP, err error) {
+			if err != nil {
+				r.note("DNSDone " + err.Error())
+			} else {
+				r.note("DNSDone " + ips[0].String())
+			}
+		},
+		ConnectStart: func(network, addr string) { r.note("ConnectStart") },
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				r.note("ConnectDone failed")
+			} else {
+				r.note("ConnectDone")
+			}
+		},
+		ProtectStart: func(network, addr string) { r.note("ProtectStart") },
+		ProtectDone: func(network, addr string, err error) {
+			if err != nil {
+				r.note("ProtectDone failed")
+			} else {
+				r.note("ProtectDone")
+			}
+		},
+		GotConn: func(c net.Conn) { r.note("GotConn") },
+	}
+}
+
+// check fails t unless the events noted are want, in order and in time.
+func (r *traceRecorder) check(t *testing.T, start time.Time, want ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != len(want) {
+		t.Fatalf("got %q, want %q", r.events, want)
+	}
+	for i, e := range r.events {
+		if e != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, e, want[i])
+		}
+		prev := start
+		if i > 0 {
+			prev = r.times[i-1]
+		}
+		if r.times[i].Before(prev) {
+			t.Errorf("%s ran before %s", e, want[i-1])
+		}
+		if d := r.times[i].Sub(start); d > 5*time.Second {
+			t.Errorf("%s ran %s after the dial began", e, d)
+		}
+	}
+}
+
+func TestConnTraceLiteralIP(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	r := &traceRecorder{}
+	start := time.Now()
+	c, err := DialContext(WithConnTrace(context.Background(), r.trace()), MakeDialer(&fakeProtector{}), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	r.check(t, start, "ConnectStart", "ProtectStart", "ProtectDone", "ConnectDone", "GotConn")
+}
+
+func TestConnTraceHostname(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+	dns, port := startTCPDNS(t, net.IPv4(127, 0, 0, 1))
+	defer dns.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := &traceRecorder{}
+	start := time.Now()
+	addr := net.JoinHostPort("foo.test", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	c, err := DialContext(WithConnTrace(context.Background(), r.trace()), MakeDialer(&fakeProtector{}), "tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// the lookup's own dials to the resolver aren't traced
+	r.check(t, start, "DNSStart foo.test", "DNSDone 127.0.0.1",
+		"ConnectStart", "ProtectStart", "ProtectDone", "ConnectDone", "GotConn")
+}
+
+func TestConnTraceProtectFails(t *testing.T) {
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{ControlHooks: []func(string, string, uintptr) error{
+		func(string, string, uintptr) error { return errors.New("hook failed") },
+	}})
+	r := &traceRecorder{}
+	start := time.Now()
+	if _, err := DialContext(WithConnTrace(context.Background(), r.trace()), d, "tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "1")); err == nil {
+		t.Fatal("dial succeeded despite a failing hook")
+	}
+	r.check(t, start, "ConnectStart", "ProtectStart", "ProtectDone failed", "ConnectDone failed")
+}
+
+func TestConnTraceOptional(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	// hooks left nil, and no trace at all
+	var got int
+	ctx := WithConnTrace(context.Background(), &ConnTrace{GotConn: func(net.Conn) { got++ }})
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		c, err := DialContext(ctx, MakeDialer(&fakeProtector{}), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if got != 1 {
+		t.Errorf("GotConn ran %d times, want 1", got)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// ednsCookie is the code of the EDNS(0) cookie option, RFC 7873.
+	ednsCookie = 10
+	// size of client cookies, and the min and max of server cookies.
+	clientCookieSize    = 8
+	minServerCookieSize = 8
+	maxServerCookieSize = 32
+	// rcodeBadCookie is the extended rcode of answers to queries with
+	// server cookies that are missing or stale.
+	rcodeBadCookie dnsmessage.RCode = 23
+	// max servers whose cookies are kept.
+	maxCookieServers = 64
+)
+
+var errBadCookie = errors.New("dns cookie mismatch")
+
+// cookiesOn is 1 when queries over udp and tcp carry dns cookies.
+var cookiesOn int32
+
+// cookie is what is known of a server's cookies.
+type cookie struct {
+	client [clientCookieSize]byte
+	server []byte // learned from its answers, if any
+}
+
+var cookies struct {
+	sync.Mutex
+	servers map[string]*cookie
+}
+
+// SetDNSCookies has queries sent over udp and tcp DNSTransports carry dns
+// cookies (RFC 7873): a random client cookie for each server and the
+// server cookie learned from its last answer. Answers with the cookie of
+// another client, as forged by off-path attackers, are dropped; queries
+// refused for a stale server cookie are sent again once with a fresh one.
+// Answers without cookies, from servers that don't support them, are
+// taken as they are. Turning cookies on or off forgets those known.
+func SetDNSCookies(enable bool) {
+	cookies.Lock()
+	cookies.servers = make(map[string]*cookie)
+	cookies.Unlock()
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&cookiesOn, v)
+}
+
+func cookiesEnabled() bool {
+	return atomic.LoadInt32(&cookiesOn) == 1
+}
+
+// cookieFor returns the cookie of server, making one up if there's none.
+func cookieFor(server string) cookie {
+	cookies.Lock()
+	defer cookies.Unlock()
+	if c, ok := cookies.servers[server]; ok {
+		return *c
+	}
+	if len(cookies.servers) >= maxCookieServers {
+		cookies.servers = make(map[string]*cookie)
+	}
+	c := &cookie{}
+	rand.Read(c.client[:])
+	cookies.servers[server] = c
+	return *c
+}
+
+// learnCookie keeps the server cookie of server from ans, if it has one
+// to the client cookie of c.
+func learnCookie(server string, c cookie, ans []byte) {
+	client, sc, ok := cookieOf(ans)
+	if !ok || !bytes.Equal(client, c.client[:]) {
+		return
+	}
+	if len(sc) < minServerCookieSize || len(sc) > maxServerCookieSize {
+		return
+	}
+	cookies.Lock()
+	defer cookies.Unlock()
+	if known, ok := cookies.servers[server]; ok && known.client == c.client {
+		known.server = append([]byte{}, sc...)
+	}
+}
+
+// withCookie adds the cookie c to q.
+func withCookie(q []byte, c cookie) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	opt, err := optOf(&msg)
+	if err != nil {
+		return nil, err
+	}
+	data := append(append([]byte{}, c.client[:]...), c.server...)
+	options := opt.Options[:0]
+	for _, o := range opt.Options {
+		if o.Code != ednsCookie {
+			options = append(options, o)
+		}
+	}
+	opt.Options = append(options, dnsmessage.Option{Code: ednsCookie, Data: data})
+	return msg.Pack()
+}
+
+// cookieOf returns the client and server cookies of msg, if it has any.
+func cookieOf(msg []byte) (client, server []byte, ok bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, nil, false
+	}
+	for _, r := range m.Additionals {
+		opt, isOPT := r.Body.(*dnsmessage.OPTResource)
+		if !isOPT {
+			continue
+		}
+		for _, o := range opt.Options {
+			if o.Code == ednsCookie && len(o.Data) >= clientCookieSize {
+				return o.Data[:clientCookieSize], o.Data[clientCookieSize:], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// checkCookie returns errBadCookie if ans has a client cookie other than
+// that of q, if q has one.
+func checkCookie(q, ans []byte) error {
+	client, _, ok := cookieOf(q)
+	if !ok {
+		return nil
+	}
+	if aclient, _, ok := cookieOf(ans); ok && !bytes.Equal(client, aclient) {
+		return errBadCookie
+	}
+	return nil
+}
+
+// badCookie returns true if ans refuses a query for its server cookie.
+func badCookie(ans []byte) bool {
+	var m dnsmessage.Message
+	if err := m.Unpack(ans); err != nil {
+		return false
+	}
+	for _, r := range m.Additionals {
+		if _, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			return r.Header.ExtendedRCode(m.RCode) == rcodeBadCookie
+		}
+	}
+	return false
+}
+
+// cookieExchange sends q to server with exchange, with cookies if on.
+func cookieExchange(server string, q []byte, exchange func([]byte) ([]byte, error)) ([]byte, error) {
+	if !cookiesEnabled() {
+		return exchange(q)
+	}
+	for retried := false; ; retried = true {
+		c := cookieFor(server)
+		cq, err := withCookie(q, c)
+		if err != nil {
+			log.Warnf("dns: query to %s without a cookie: %v", server, err)
+			return exchange(q)
+		}
+		ans, err := exchange(cq)
+		if err != nil {
+			return nil, err
+		}
+		learnCookie(server, c, ans)
+		if !retried && badCookie(ans) {
+			continue
+		}
+		return ans, nil
+	}
+}
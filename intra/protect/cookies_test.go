@@ -0,0 +1,178 @@
+package protect
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cookieServer is a stub udp dns server that hands out serverCookie and
+// records the cookies of the queries it gets.
+type cookieServer struct {
+	net.PacketConn
+	// strict refuses queries without its server cookie with BADCOOKIE.
+	strict bool
+	// forge sends an answer with some other client cookie first.
+	forge bool
+
+	mu      sync.Mutex
+	queries [][]byte // cookie option data, nil if none
+}
+
+var serverCookie = []byte("srvcookie0123456")
+
+func startCookieServer(t *testing.T, strict, forge bool) (*cookieServer, int) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &cookieServer{PacketConn: c, strict: strict, forge: forge}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := append([]byte{}, b[:n]...)
+			client, server, ok := cookieOf(q)
+			s.mu.Lock()
+			if ok {
+				s.queries = append(s.queries, append(append([]byte{}, client...), server...))
+			} else {
+				s.queries = append(s.queries, nil)
+			}
+			s.mu.Unlock()
+			if !ok {
+				c.WriteTo(answer(q), from)
+				continue
+			}
+			if s.forge {
+				forged := append([]byte{}, client...)
+				forged[0] ^= 0xff
+				c.WriteTo(withCookieAnswer(t, answer(q), forged, dnsmessage.RCodeSuccess), from)
+			}
+			rcode := dnsmessage.RCodeSuccess
+			if s.strict && !bytes.Equal(server, serverCookie) {
+				rcode = rcodeBadCookie
+			}
+			c.WriteTo(withCookieAnswer(t, answer(q), client, rcode), from)
+		}
+	}()
+	return s, c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (s *cookieServer) cookies() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.queries...)
+}
+
+// withCookieAnswer adds client and serverCookie to ans, with rcode.
+func withCookieAnswer(t *testing.T, ans, client []byte, rcode dnsmessage.RCode) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(ans); err != nil {
+		t.Error(err)
+		return nil
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(queryPayload, rcode, false); err != nil {
+		t.Error(err)
+		return nil
+	}
+	msg.RCode = rcode & 0xf
+	data := append(append([]byte{}, client...), serverCookie...)
+	msg.Additionals = []dnsmessage.Resource{{
+		Header: h,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: ednsCookie, Data: data}}},
+	}}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+func cookieQuery(t *testing.T, tr DNSTransport, id uint16) *dnsmessage.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ans, err := tr.exchange(ctx, MakeDialer(&fakeProtector{}), makeQuery(t, id, "foo.test.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(ans); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestDNSCookies(t *testing.T) {
+	SetDNSCookies(true)
+	defer SetDNSCookies(false)
+	s, port := startCookieServer(t, false, true)
+	defer s.Close()
+	tr := DNSTransport{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: port}
+
+	for id := uint16(1); id <= 2; id++ {
+		msg := cookieQuery(t, tr, id)
+		client, _, ok := cookieOf(mustPack(t, msg))
+		if !ok || len(msg.Answers) == 0 {
+			t.Fatalf("query %d: forged or cookieless answer accepted: %+v", id, msg)
+		}
+		if sent := s.cookies()[id-1]; !bytes.Equal(client, sent[:clientCookieSize]) {
+			t.Fatalf("query %d: answer with another client cookie accepted", id)
+		}
+	}
+
+	qs := s.cookies()
+	if len(qs[0]) != clientCookieSize {
+		t.Errorf("first query: cookie %x, want only a client cookie", qs[0])
+	}
+	if !bytes.Equal(qs[1][:clientCookieSize], qs[0]) {
+		t.Errorf("client cookie changed: %x, then %x", qs[0], qs[1][:clientCookieSize])
+	}
+	if !bytes.Equal(qs[1][clientCookieSize:], serverCookie) {
+		t.Errorf("second query: server cookie %x, want %x", qs[1][clientCookieSize:], serverCookie)
+	}
+}
+
+func TestDNSCookiesRetryBadCookie(t *testing.T) {
+	SetDNSCookies(true)
+	defer SetDNSCookies(false)
+	s, port := startCookieServer(t, true, false)
+	defer s.Close()
+	tr := DNSTransport{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: port}
+
+	msg := cookieQuery(t, tr, 1)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) == 0 {
+		t.Fatalf("not retried with the server cookie: %+v", msg.Header)
+	}
+	if qs := s.cookies(); len(qs) != 2 {
+		t.Errorf("%d queries sent, want 2", len(qs))
+	}
+}
+
+func TestDNSCookiesOff(t *testing.T) {
+	s, port := startCookieServer(t, false, false)
+	defer s.Close()
+	tr := DNSTransport{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: port}
+
+	cookieQuery(t, tr, 1)
+	if qs := s.cookies(); len(qs) != 1 || qs[0] != nil {
+		t.Errorf("cookie sent with cookies off: %x", qs)
+	}
+}
+
+func mustPack(t *testing.T, msg *dnsmessage.Message) []byte {
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
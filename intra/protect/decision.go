@@ -0,0 +1,130 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// annotations follow the net-id, as in "proxyA#ttl=60s"
+	annotationSep = "#"
+	// max lifetime of a flow, as a time.Duration string
+	annotationTTL = "ttl"
+	// why a flow is blocked, as in "block#reason=tracker list"
+	annotationReason = "reason"
+	// dscp of the flow's packets, from 0 to 63, as in "allow#dscp=46"
+	annotationDSCP = "dscp"
+	// net-ids tried in order if the net-id isn't routable, as in
+	// "proxyA#fallbacks=proxyB,allow"
+	annotationFallbacks = "fallbacks"
+	// how long each read or write on the flow's conn may take, as
+	// time.Duration strings, as in "proxyA#readtimeout=30s"
+	annotationReadTimeout  = "readtimeout"
+	annotationWriteTimeout = "writetimeout"
+)
+
+// Decision is the verdict of a Flow on a new connection.
+type Decision struct {
+	// NetId is the network the flow is forwarded to, or NetIdBlock.
+	NetId string
+	// TTL caps the lifetime of the flow; zero means no cap. Unlike
+	// an idle timeout, the flow is closed after TTL regardless of activity.
+	TTL time.Duration
+	// Reason is why the flow is blocked, if it is and a reason was given.
+	Reason string
+	// DSCP, if positive, is the differentiated services code point, from
+	// 0 to 63, of the flow's packets on direct sockets; see SetDSCP.
+	DSCP int
+	// Fallbacks are the net-ids the flow is forwarded to, the first that
+	// is routable, if NetId isn't; as when its proxy isn't up.
+	Fallbacks []string
+	// ReadTimeout and WriteTimeout, if positive, are how long each read
+	// from and write to the remote conn of a tcp flow may take; an op
+	// that takes longer times out and ends the flow. Unlike TTL and the
+	// idle timeout, the deadline rolls over with each op, for net-ids
+	// known to be slow or flows that must stay responsive. udp flows
+	// are bounded by the udp handler's nat timeout instead.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// StructuredFlow may be implemented by a Flow to decide flows with a
+// Decision, in place of the annotated string On returns; the tcp and udp
+// handlers then call OnV2 and not On. Its arguments are those of On.
+type StructuredFlow interface {
+	OnV2(protocol int32, uid int, source string, target string) Decision
+}
+
+// Decide returns the decision of f on a flow: that of OnV2 if f is a
+// StructuredFlow, or else that On returns, parsed by ParseDecision.
+func Decide(f Flow, protocol int32, uid int, source, target string) Decision {
+	if sf, ok := f.(StructuredFlow); ok {
+		return sf.OnV2(protocol, uid, source, target)
+	}
+	return ParseDecision(f.On(protocol, uid, source, target))
+}
+
+// ParseDecision parses the string returned by Flow.On, which is a net-id
+// optionally followed by #key=value annotations, for example:
+// "proxyA#ttl=60s", "block#reason=tracker list",
+// "proxyA#dscp=46#fallbacks=proxyB,allow" or "allow#readtimeout=30s".
+// Malformed and unknown annotations are ignored.
+func ParseDecision(s string) Decision {
+	parts := strings.Split(s, annotationSep)
+	d := Decision{NetId: parts[0]}
+	for _, kv := range parts[1:] {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			log.Warnf("decision %s: malformed annotation %s", s, kv)
+			continue
+		}
+		k, v := kv[:i], kv[i+1:]
+		switch k {
+		case annotationTTL:
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl < 0 {
+				log.Warnf("decision %s: bad ttl %s", s, v)
+				continue
+			}
+			d.TTL = ttl
+		case annotationReason:
+			d.Reason = v
+		case annotationDSCP:
+			dscp, err := strconv.Atoi(v)
+			if err != nil || dscp < 0 || dscp > maxDSCP {
+				log.Warnf("decision %s: bad dscp %s", s, v)
+				continue
+			}
+			d.DSCP = dscp
+		case annotationReadTimeout, annotationWriteTimeout:
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout < 0 {
+				log.Warnf("decision %s: bad %s %s", s, k, v)
+				continue
+			}
+			if k == annotationReadTimeout {
+				d.ReadTimeout = timeout
+			} else {
+				d.WriteTimeout = timeout
+			}
+		case annotationFallbacks:
+			for _, netid := range strings.Split(v, ",") {
+				if netid != "" {
+					d.Fallbacks = append(d.Fallbacks, netid)
+				}
+			}
+		default:
+			log.Debugf("decision %s: unknown annotation %s", s, k)
+		}
+	}
+	return d
+}
@@ -0,0 +1,63 @@
+package protect
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDecision(t *testing.T) {
+	for s, want := range map[string]Decision{
+		"":                               {NetId: ""},
+		NetIdActive:                      {NetId: NetIdActive},
+		NetIdBlock:                       {NetId: NetIdBlock},
+		"proxyA#ttl=60s":                 {NetId: "proxyA", TTL: 60 * time.Second},
+		"allow#ttl=1m30s#foo=bar":        {NetId: NetIdActive, TTL: 90 * time.Second},
+		"proxyB#ttl=soon":                {NetId: "proxyB"},
+		"proxyC#ttl=-1s":                 {NetId: "proxyC"},
+		"proxyD#ttl":                     {NetId: "proxyD"},
+		"block#reason=ad list":           {NetId: NetIdBlock, Reason: "ad list"},
+		"block#ttl=1s#reason=":           {NetId: NetIdBlock, TTL: time.Second},
+		"allow#dscp=46":                  {NetId: NetIdActive, DSCP: 46},
+		"allow#dscp=64":                  {NetId: NetIdActive},
+		"allow#dscp=ef":                  {NetId: NetIdActive},
+		"proxyA#fallbacks=proxyB,,allow": {NetId: "proxyA", Fallbacks: []string{"proxyB", NetIdActive}},
+		"allow#readtimeout=30s":          {NetId: NetIdActive, ReadTimeout: 30 * time.Second},
+		"allow#writetimeout=1m#ttl=1h":   {NetId: NetIdActive, WriteTimeout: time.Minute, TTL: time.Hour},
+		"allow#readtimeout=-1s":          {NetId: NetIdActive},
+		"allow#writetimeout=slow":        {NetId: NetIdActive},
+	} {
+		if got := ParseDecision(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v, want %+v", s, got, want)
+		}
+	}
+}
+
+// structuredFlow decides with a Decision, and fails the test if asked On.
+type structuredFlow struct {
+	t *testing.T
+	d Decision
+}
+
+func (f *structuredFlow) On(int32, int, string, string) string {
+	f.t.Error("On called on a StructuredFlow")
+	return NetIdBlock
+}
+
+func (f *structuredFlow) OnV2(int32, int, string, string) Decision {
+	return f.d
+}
+
+// stringFlow decides with s.
+type stringFlow string
+
+func (f stringFlow) On(int32, int, string, string) string { return string(f) }
+
+func TestDecide(t *testing.T) {
+	want := Decision{NetId: "proxyA", TTL: time.Minute, DSCP: 46, Fallbacks: []string{"proxyB", NetIdActive}}
+	structured := Decide(&structuredFlow{t, want}, 6, 10, "10.111.222.1:5000", "192.0.2.1:443")
+	parsed := Decide(stringFlow("proxyA#ttl=1m#dscp=46#fallbacks=proxyB,allow"), 6, 10, "10.111.222.1:5000", "192.0.2.1:443")
+	if !reflect.DeepEqual(structured, want) || !reflect.DeepEqual(parsed, want) {
+		t.Errorf("got %+v from OnV2 and %+v from On, want %+v", structured, parsed, want)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// max negative answers cached; beyond this, new ones are not cached
+// until the expired ones are dropped.
+const maxNegativeEntries = 1024
+
+type questionKey struct {
+	name  string // lowercase
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type negativeEntry struct {
+	ans    []byte
+	expiry time.Time
+}
+
+// negative caches answers for names that don't exist (NXDOMAIN) or have
+// no records of the type asked (NODATA), as per RFC 2308.
+var negative struct {
+	sync.Mutex
+	ttlcap  time.Duration
+	minTTL  time.Duration // clamps, see SetDNSTTLClamp
+	maxTTL  time.Duration
+	entries map[questionKey]*negativeEntry
+}
+
+var (
+	errBadFamily   = errors.New("family must be 0, 4 or 6")
+	errBadTTLClamp = errors.New("ttl clamp must be non-negative, with min <= max")
+)
+
+// counts of lookups in and drops from the cache, see CacheStats; atomic.
+var cacheHits, cacheMisses, cacheEvictions int64
+
+// CacheStatsSnapshot counts the lookups answered by a dns cache: that of
+// negative answers, see CacheStats, or that of a Resolver.
+type CacheStatsSnapshot struct {
+	// Hits and Misses count queries answered from the cache, and those
+	// sent on for want of an unexpired answer.
+	Hits   int64
+	Misses int64
+	// Evictions counts answers dropped once expired.
+	Evictions int64
+	// Size is the number of answers cached, some of which may be expired.
+	Size int64
+	// HitRatio is Hits over Hits and Misses, or 0 without lookups.
+	HitRatio float64
+}
+
+// CacheStats returns the counts of the cache of negative answers since it
+// was last emptied by SetNegativeCacheTTL. Positive answers are cached
+// only by Resolvers, which count theirs, see Resolver.CacheStats.
+func CacheStats() *CacheStatsSnapshot {
+	s := &CacheStatsSnapshot{
+		Hits:      atomic.LoadInt64(&cacheHits),
+		Misses:    atomic.LoadInt64(&cacheMisses),
+		Evictions: atomic.LoadInt64(&cacheEvictions),
+	}
+	if n := s.Hits + s.Misses; n > 0 {
+		s.HitRatio = float64(s.Hits) / float64(n)
+	}
+	negative.Lock()
+	s.Size = int64(len(negative.entries))
+	negative.Unlock()
+	return s
+}
+
+// noCacheRead is the context key of lookups that skip the cache.
+type noCacheRead struct{}
+
+// noCache is the context key of lookups that neither read nor add to the
+// caches, as their answers aren't those of the configured resolvers; see
+// WithResolverOverride.
+type noCache struct{}
+
+// SetNegativeCacheTTL caches NXDOMAIN and NODATA answers for the TTL
+// their SOA record sets (RFC 2308, section 5), but no longer than ttlcap.
+// A ttlcap of 0, the default, turns off negative caching.
+func SetNegativeCacheTTL(ttlcap time.Duration) {
+	if ttlcap < 0 {
+		ttlcap = 0
+	}
+	negative.Lock()
+	negative.ttlcap = ttlcap
+	negative.entries = make(map[questionKey]*negativeEntry)
+	negative.Unlock()
+	atomic.StoreInt64(&cacheHits, 0)
+	atomic.StoreInt64(&cacheMisses, 0)
+	atomic.StoreInt64(&cacheEvictions, 0)
+}
+
+// SetDNSTTLClamp overrides the ttls of answers as they are cached: those
+// shorter than min are kept for min, those longer than max for max. This
+// holds for negative answers, still kept no longer than the ttlcap of
+// SetNegativeCacheTTL, and for those a Resolver caches, still kept no
+// longer than its MaxTTL. A zero min or max leaves that bound unset.
+// Entries already cached keep their expiry.
+func SetDNSTTLClamp(min, max time.Duration) error {
+	if min < 0 || max < 0 || (max > 0 && min > max) {
+		return errBadTTLClamp
+	}
+	negative.Lock()
+	negative.minTTL = min
+	negative.maxTTL = max
+	negative.Unlock()
+	return nil
+}
+
+// clampTTL returns ttl within the bounds of SetDNSTTLClamp.
+func clampTTL(ttl time.Duration) time.Duration {
+	negative.Lock()
+	defer negative.Unlock()
+	return clampTTLLocked(ttl)
+}
+
+func clampTTLLocked(ttl time.Duration) time.Duration {
+	if min := negative.minTTL; min > 0 && ttl < min {
+		ttl = min
+	}
+	if max := negative.maxTTL; max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+func negativeCaching() bool {
+	negative.Lock()
+	defer negative.Unlock()
+	return negative.ttlcap > 0
+}
+
+func init() {
+	// to be cached
+	needDNSConn(func(*dialConfig) bool { return negativeCaching() })
+}
+
+// cachedExchange wraps exchange to answer from and add to the negative cache.
+func cachedExchange(exchange func(context.Context, []byte) ([]byte, error)) func(context.Context, []byte) ([]byte, error) {
+	return func(ctx context.Context, q []byte) ([]byte, error) {
+		if !negativeCaching() || ctx.Value(noCache{}) != nil {
+			return exchange(ctx, q)
+		}
+		k, ok := questionOf(q)
+		if !ok {
+			return exchange(ctx, q)
+		}
+		if ctx.Value(noCacheRead{}) == nil {
+			if ans := cachedNegative(k); ans != nil {
+				atomic.AddInt64(&cacheHits, 1)
+				// answer with the id of this query
+				copy(ans, q[:2])
+				return ans, nil
+			}
+			atomic.AddInt64(&cacheMisses, 1)
+		}
+		ans, err := exchange(ctx, q)
+		if err == nil {
+			if ttl := negativeTTL(ans); ttl > 0 {
+				cacheNegative(k, ans, ttl)
+			} else {
+				uncacheNegative(k)
+			}
+		}
+		return ans, err
+	}
+}
+
+func questionOf(q []byte) (k questionKey, ok bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err != nil {
+		return k, false
+	}
+	question, err := p.Question()
+	if err != nil {
+		return k, false
+	}
+	return questionKey{
+		name:  strings.ToLower(question.Name.String()),
+		qtype: question.Type,
+		class: question.Class,
+	}, true
+}
+
+// cachedNegative returns a copy of the unexpired negative answer for k, if any.
+func cachedNegative(k questionKey) []byte {
+	negative.Lock()
+	defer negative.Unlock()
+	e, ok := negative.entries[k]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expiry) {
+		delete(negative.entries, k)
+		atomic.AddInt64(&cacheEvictions, 1)
+		return nil
+	}
+	return append([]byte{}, e.ans...)
+}
+
+func cacheNegative(k questionKey, ans []byte, ttl time.Duration) {
+	negative.Lock()
+	defer negative.Unlock()
+	if negative.ttlcap <= 0 {
+		return
+	}
+	ttl = clampTTLLocked(ttl)
+	if ttl > negative.ttlcap {
+		ttl = negative.ttlcap
+	}
+	now := time.Now()
+	if len(negative.entries) >= maxNegativeEntries {
+		for ek, e := range negative.entries {
+			if now.After(e.expiry) {
+				delete(negative.entries, ek)
+				atomic.AddInt64(&cacheEvictions, 1)
+			}
+		}
+		if len(negative.entries) >= maxNegativeEntries {
+			return
+		}
+	}
+	negative.entries[k] = &negativeEntry{
+		ans:    append([]byte{}, ans...),
+		expiry: now.Add(ttl),
+	}
+}
+
+// uncacheNegative drops the negative answer for k, which no longer holds.
+func uncacheNegative(k questionKey) {
+	negative.Lock()
+	defer negative.Unlock()
+	delete(negative.entries, k)
+}
+
+// negativeTTL returns how long ans may be cached if it is a negative
+// answer, or 0 if it isn't one or lacks the SOA that dictates its ttl.
+func negativeTTL(ans []byte) time.Duration {
+	var p dnsmessage.Parser
+	h, err := p.Start(ans)
+	if err != nil || h.Truncated {
+		return 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeNameError:
+		if err := p.SkipAllAnswers(); err != nil {
+			return 0
+		}
+	case dnsmessage.RCodeSuccess:
+		// NODATA has no answers, not even a cname
+		if _, err := p.AnswerHeader(); err != dnsmessage.ErrSectionDone {
+			return 0
+		}
+	default:
+		return 0
+	}
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0
+		}
+		// RFC 2308, section 5: the lesser of the soa's ttl and its minimum
+		ttl := rh.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+}
+
+// LookupNoCache looks up the addresses of name like the Resolver of d,
+// which must be from MakeDialer, does; except that queries are always sent,
+// even if answers to them are cached. Their answers are cached as usual.
+// family is 4 or 6 for addresses of only that family, or 0 for both.
+func LookupNoCache(ctx context.Context, d *net.Dialer, name string, family int) ([]net.IP, error) {
+	if d.Resolver == nil || d.Resolver.Dial == nil {
+		return nil, errNoResolver
+	}
+	var qtypes []dnsmessage.Type
+	switch family {
+	case 0:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case 4:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case 6:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, errBadFamily
+	}
+
+	ctx = context.WithValue(ctx, noCacheRead{}, true)
+	var ips []net.IP
+	for _, qtype := range qtypes {
+		q, err := newQuery(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		ans, err := resolve(ctx, d.Resolver, q)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: name}
+		}
+		found, err := parseAddrs(name, ans)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, found...)
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// parseAddrs returns the addresses in the A and AAAA records of ans.
+func parseAddrs(name string, ans []byte) ([]net.IP, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(ans)
+	if err != nil {
+		return nil, err
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: h.RCode.String(), Name: name}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(append([]byte{}, r.A[:]...)))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(append([]byte{}, r.AAAA[:]...)))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
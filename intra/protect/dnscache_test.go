@@ -0,0 +1,348 @@
+package protect
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// nxAnswer answers q with NXDOMAIN and an SOA with the given ttl and minimum.
+func nxAnswer(q []byte, ttl, minTTL uint32) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.RCode = dnsmessage.RCodeNameError
+	msg.Additionals = nil
+	msg.Authorities = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("test."),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.test."),
+			MBox:   dnsmessage.MustNewName("admin.test."),
+			MinTTL: minTTL,
+		},
+	}}
+	ans, _ := msg.Pack()
+	return ans
+}
+
+// startNXDNS serves NXDOMAIN over tcp and counts the queries it answers.
+func startNXDNS(t *testing.T, queries *int32) (net.Listener, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					var n [2]byte
+					if _, err := io.ReadFull(c, n[:]); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(n[:]))
+					if _, err := io.ReadFull(c, q); err != nil {
+						return
+					}
+					atomic.AddInt32(queries, 1)
+					ans := nxAnswer(q, 300, 60)
+					binary.BigEndian.PutUint16(n[:], uint16(len(ans)))
+					c.Write(append(n[:], ans...))
+				}
+			}(c)
+		}
+	}()
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestNegativeCache(t *testing.T) {
+	var queries int32
+	l, port := startNXDNS(t, &queries)
+	defer l.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetNegativeCacheTTL(time.Minute)
+	defer SetNegativeCacheTTL(0)
+
+	r := MakeDialer(&fakeProtector{}).Resolver
+	_, err1 := r.LookupIPAddr(context.Background(), "nx.test.")
+	dnserr, ok := err1.(*net.DNSError)
+	if !ok || !dnserr.IsNotFound {
+		t.Fatalf("got %v, want not found", err1)
+	}
+	n := atomic.LoadInt32(&queries)
+	if n == 0 {
+		t.Fatal("no queries sent")
+	}
+
+	_, err2 := r.LookupIPAddr(context.Background(), "nx.test.")
+	// names are cached case-insensitively
+	r.LookupIPAddr(context.Background(), "NX.test.")
+	if atomic.LoadInt32(&queries) != n {
+		t.Errorf("negative answer not cached: %d queries, want %d", atomic.LoadInt32(&queries), n)
+	}
+	if err2 == nil || err2.Error() != err1.Error() {
+		t.Errorf("cached error %v, want %v", err2, err1)
+	}
+	if dnserr, ok := err2.(*net.DNSError); !ok || !dnserr.IsNotFound {
+		t.Errorf("cached error %#v is not a not-found DNSError", err2)
+	}
+}
+
+func TestNegativeCacheOff(t *testing.T) {
+	var queries int32
+	l, port := startNXDNS(t, &queries)
+	defer l.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := MakeDialer(&fakeProtector{}).Resolver
+	r.LookupIPAddr(context.Background(), "nx.test.")
+	n := atomic.LoadInt32(&queries)
+	r.LookupIPAddr(context.Background(), "nx.test.")
+	if atomic.LoadInt32(&queries) == n {
+		t.Error("negative answer cached while caching is off")
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	q := makeQuery(t, 1, "nx.test.", dnsmessage.TypeA)
+	if ttl := negativeTTL(nxAnswer(q, 300, 60)); ttl != time.Minute {
+		t.Errorf("got %s, want the soa minimum", ttl)
+	}
+	if ttl := negativeTTL(nxAnswer(q, 30, 60)); ttl != 30*time.Second {
+		t.Errorf("got %s, want the soa ttl", ttl)
+	}
+	if ttl := negativeTTL(answer(q)); ttl != 0 {
+		t.Errorf("positive answer has a negative ttl %s", ttl)
+	}
+	// without an soa, negative answers are not cached
+	var msg dnsmessage.Message
+	msg.Unpack(nxAnswer(q, 300, 60))
+	msg.Authorities = nil
+	nosoa, _ := msg.Pack()
+	if ttl := negativeTTL(nosoa); ttl != 0 {
+		t.Errorf("answer without soa has a negative ttl %s", ttl)
+	}
+	// nodata
+	msg.Unpack(nxAnswer(q, 300, 60))
+	msg.RCode = dnsmessage.RCodeSuccess
+	nodata, _ := msg.Pack()
+	if ttl := negativeTTL(nodata); ttl != time.Minute {
+		t.Errorf("got %s for nodata, want the soa minimum", ttl)
+	}
+}
+
+func TestNegativeCacheTTLCap(t *testing.T) {
+	SetNegativeCacheTTL(time.Second)
+	defer SetNegativeCacheTTL(0)
+
+	q := makeQuery(t, 1, "nx.test.", dnsmessage.TypeA)
+	k, _ := questionOf(q)
+	cacheNegative(k, nxAnswer(q, 300, 300), 300*time.Second)
+	negative.Lock()
+	expiry := negative.entries[k].expiry
+	negative.Unlock()
+	if d := time.Until(expiry); d > time.Second {
+		t.Errorf("cached for %s, beyond the cap", d)
+	}
+}
+
+func TestLookupNoCache(t *testing.T) {
+	var queries int32
+	l, port := startNXDNS(t, &queries)
+	defer l.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetNegativeCacheTTL(time.Minute)
+	defer SetNegativeCacheTTL(0)
+
+	d := MakeDialer(&fakeProtector{})
+	ctx := context.Background()
+	d.Resolver.LookupIP(ctx, "ip4", "nx.test.")
+	if atomic.LoadInt32(&queries) != 1 {
+		t.Fatalf("%d queries, want 1", atomic.LoadInt32(&queries))
+	}
+
+	// sent though the answer is cached
+	_, err := LookupNoCache(ctx, d, "nx.test.", 4)
+	if dnserr, ok := err.(*net.DNSError); !ok || !dnserr.IsNotFound {
+		t.Errorf("got %v, want not found", err)
+	}
+	if atomic.LoadInt32(&queries) != 2 {
+		t.Fatalf("%d queries, want 2", atomic.LoadInt32(&queries))
+	}
+
+	// and its answer is cached; resetting the ttl empties the cache
+	SetNegativeCacheTTL(time.Minute)
+	if _, err := LookupNoCache(ctx, d, "nx.test.", 4); err == nil {
+		t.Fatal("nx.test. found")
+	}
+	d.Resolver.LookupIP(ctx, "ip4", "nx.test.")
+	if atomic.LoadInt32(&queries) != 3 {
+		t.Errorf("%d queries, want 3", atomic.LoadInt32(&queries))
+	}
+}
+
+func TestLookupNoCacheUpdatesCache(t *testing.T) {
+	var queries int32
+	nx, port := startNXDNS(t, &queries)
+	defer nx.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetNegativeCacheTTL(time.Minute)
+	defer SetNegativeCacheTTL(0)
+
+	d := MakeDialer(&fakeProtector{})
+	ctx := context.Background()
+	if _, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test."); err == nil {
+		t.Fatal("foo.test. found")
+	}
+
+	// foo.test. now exists
+	dns, port := startTCPDNS(t, fooIP)
+	defer dns.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test."); err == nil {
+		t.Fatal("negative answer not cached")
+	}
+	ips, err := LookupNoCache(ctx, d, "foo.test.", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(fooIP) {
+		t.Errorf("got %v, want %s", ips, fooIP)
+	}
+	ips, err = d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if err != nil {
+		t.Fatalf("stale negative answer still cached: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(fooIP) {
+		t.Errorf("got %v, want %s", ips, fooIP)
+	}
+}
+
+func TestLookupNoCacheBadFamily(t *testing.T) {
+	if _, err := LookupNoCache(context.Background(), MakeDialer(&fakeProtector{}), "foo.test.", 5); err != errBadFamily {
+		t.Errorf("got %v, want errBadFamily", err)
+	}
+}
+
+func TestDNSTTLClamp(t *testing.T) {
+	SetNegativeCacheTTL(48 * time.Hour)
+	defer SetNegativeCacheTTL(0)
+	if err := SetDNSTTLClamp(30*time.Second, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTTLClamp(0, 0)
+
+	expiry := func(name string, ttl time.Duration) time.Duration {
+		k := questionKey{name: name, qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+		cacheNegative(k, []byte{0, 1}, ttl)
+		negative.Lock()
+		defer negative.Unlock()
+		return time.Until(negative.entries[k].expiry)
+	}
+	if got := expiry("short.test.", 5*time.Second); got < 29*time.Second || got > 30*time.Second {
+		t.Errorf("5s ttl stored for %s, want 30s", got)
+	}
+	if got := expiry("long.test.", 24*time.Hour); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("1d ttl stored for %s, want 1h", got)
+	}
+	if got := expiry("within.test.", 10*time.Minute); got < 9*time.Minute || got > 10*time.Minute {
+		t.Errorf("10m ttl stored for %s, want it as is", got)
+	}
+
+	// zero bounds are unset
+	if err := SetDNSTTLClamp(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := expiry("unclamped.test.", 5*time.Second); got > 5*time.Second {
+		t.Errorf("5s ttl stored for %s without a clamp", got)
+	}
+	// the cap of the negative cache still applies
+	SetNegativeCacheTTL(time.Minute)
+	SetDNSTTLClamp(time.Hour, 0)
+	if got := expiry("capped.test.", 5*time.Second); got > time.Minute {
+		t.Errorf("5s ttl stored for %s, beyond the cap", got)
+	}
+}
+
+func TestSetDNSTTLClampInvalid(t *testing.T) {
+	for _, c := range [][2]time.Duration{{-time.Second, 0}, {0, -time.Second}, {time.Hour, time.Minute}} {
+		if err := SetDNSTTLClamp(c[0], c[1]); err != errBadTTLClamp {
+			t.Errorf("%v: got %v, want errBadTTLClamp", c, err)
+		}
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	var queries int32
+	l, port := startNXDNS(t, &queries)
+	defer l.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetNegativeCacheTTL(time.Minute)
+	defer SetNegativeCacheTTL(0)
+
+	r := MakeDialer(&fakeProtector{}).Resolver
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		r.LookupIP(ctx, "ip4", "nx.test.")
+	}
+	r.LookupIP(ctx, "ip4", "nx2.test.")
+	s := CacheStats()
+	if s.Hits != 3 || s.Misses != 2 || s.Size != 2 || s.Evictions != 0 {
+		t.Errorf("got %+v, want 3 hits, 2 misses, 2 cached", s)
+	}
+	if s.HitRatio != 0.6 {
+		t.Errorf("hit ratio %f, want 0.6", s.HitRatio)
+	}
+
+	// expired answers are evicted as they are looked up
+	k := questionKey{name: "old.test.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	cacheNegative(k, []byte{0, 1}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if ans := cachedNegative(k); ans != nil {
+		t.Fatal("expired answer returned")
+	}
+	if s := CacheStats(); s.Evictions != 1 || s.Size != 2 {
+		t.Errorf("got %+v, want 1 eviction, 2 cached", s)
+	}
+
+	// emptying the cache restarts its counts
+	SetNegativeCacheTTL(time.Minute)
+	if s := CacheStats(); *s != (CacheStatsSnapshot{}) {
+		t.Errorf("got %+v after emptying the cache", s)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+var (
+	errBadSuffix   = errors.New("dns route suffix must be a domain")
+	errBadResolver = errors.New("dns route resolver must be ip:port")
+)
+
+// dnsRoute sends queries for names under suffix to resolver, over tcp
+// dialed with d, the dialer of net-id netid.
+type dnsRoute struct {
+	suffix   string // lowercase and fully qualified
+	netid    string
+	d        ContextDialer
+	resolver string
+}
+
+// SetDNSRoute has the resolvers of protected dialers send queries for
+// suffix, and names under it, to resolver (ip:port) over tcp dialed with
+// d, the dialer of net-id netid, such as a proxy or a tunnel to a private
+// network. Of all routes, the one with the longest matching suffix is
+// taken; names matching none are resolved as before. A nil d removes the
+// route of suffix.
+func SetDNSRoute(suffix, netid string, d ContextDialer, resolver string) error {
+	suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+	if len(suffix) == 0 {
+		return errBadSuffix
+	}
+	suffix += "."
+	if d != nil && !isLiteralIP(resolver) {
+		return errBadResolver
+	}
+	updateDialConfig(func(c *dialConfig) {
+		routes := make([]*dnsRoute, 0, len(c.routes)+1)
+		for _, r := range c.routes {
+			if r.suffix != suffix {
+				routes = append(routes, r)
+			}
+		}
+		if d != nil {
+			routes = append(routes, &dnsRoute{suffix, netid, d, resolver})
+		}
+		// longest suffixes first, for the first match to be the longest
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].suffix) > len(routes[j].suffix)
+		})
+		c.routes = routes
+	})
+	return nil
+}
+
+// routeOf returns the route of the longest suffix of name, if any.
+func routeOf(routes []*dnsRoute, name string) *dnsRoute {
+	for _, r := range routes {
+		if name == r.suffix || strings.HasSuffix(name, "."+r.suffix) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *dnsRoute) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	c, err := r.d.DialContext(ctx, "tcp", r.resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	return streamExchange(c, q)
+}
+
+func init() {
+	// to be routed, unless resolvers are bypassed, which skips routes
+	needDNSConn(func(cfg *dialConfig) bool { return len(cfg.routes) > 0 && !bypassingResolver() })
+}
+
+// routed wraps exchange to send queries with a route over it instead.
+func routed(routes []*dnsRoute, exchange func(context.Context, []byte) ([]byte, error)) func(context.Context, []byte) ([]byte, error) {
+	if len(routes) == 0 {
+		return exchange
+	}
+	return func(ctx context.Context, q []byte) ([]byte, error) {
+		if k, ok := questionOf(q); ok {
+			if r := routeOf(routes, k.name); r != nil {
+				log.Debugf("dns: %s routed over %s to %s", k.name, r.netid, r.resolver)
+				return r.exchange(ctx, q)
+			}
+		}
+		return exchange(ctx, q)
+	}
+}
@@ -0,0 +1,117 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDialer dials as its Dialer, noting each address dialed.
+type recordingDialer struct {
+	net.Dialer
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, network+" "+addr)
+	d.mu.Unlock()
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func (d *recordingDialer) dials() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.dialed...)
+}
+
+func TestDNSRoute(t *testing.T) {
+	public, port := startTCPDNS(t, fooIP)
+	defer public.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	corpIP := net.IPv4(10, 0, 0, 1)
+	engIP := net.IPv4(10, 0, 0, 2)
+	corp, corpPort := startTCPDNS(t, corpIP)
+	defer corp.Close()
+	eng, engPort := startTCPDNS(t, engIP)
+	defer eng.Close()
+	proxy := &recordingDialer{}
+	corpAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(corpPort))
+	engAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(engPort))
+	if err := SetDNSRoute(".corp", "proxy0", proxy, corpAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSRoute("corp", "", nil, "")
+	if err := SetDNSRoute("Eng.Corp.", "proxy0", proxy, engAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSRoute("eng.corp", "", nil, "")
+
+	d := MakeDialer(&fakeProtector{})
+	for _, tc := range []struct {
+		name string
+		want net.IP
+		dial string
+	}{
+		{"foo.test", fooIP, ""},
+		{"host.corp", corpIP, "tcp " + corpAddr},
+		{"corp", corpIP, "tcp " + corpAddr},
+		{"host.eng.corp", engIP, "tcp " + engAddr},
+		{"notcorp", fooIP, ""},
+	} {
+		before := len(proxy.dials())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ips, err := d.Resolver.LookupIP(ctx, "ip4", tc.name)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(tc.want) {
+			t.Errorf("%s: got %v, want %s", tc.name, ips, tc.want)
+		}
+		dials := proxy.dials()[before:]
+		if len(tc.dial) == 0 && len(dials) > 0 {
+			t.Errorf("%s: public name dialed over the proxy: %v", tc.name, dials)
+		}
+		if len(tc.dial) > 0 && (len(dials) == 0 || dials[0] != tc.dial) {
+			t.Errorf("%s: dialed %v over the proxy, want %s", tc.name, dials, tc.dial)
+		}
+	}
+
+	// removing the longer suffix falls back to the shorter one
+	SetDNSRoute("eng.corp", "", nil, "")
+	ips, err := d.Resolver.LookupIP(context.Background(), "ip4", "host.eng.corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(corpIP) {
+		t.Errorf("got %v, want %s", ips, corpIP)
+	}
+}
+
+func TestSetDNSRouteInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		suffix, resolver string
+		want             error
+	}{
+		{"", "127.0.0.1:53", errBadSuffix},
+		{" . ", "127.0.0.1:53", errBadSuffix},
+		{"corp", "dns.corp:53", errBadResolver},
+		{"corp", "127.0.0.1", errBadResolver},
+	} {
+		if err := SetDNSRoute(tc.suffix, "proxy0", &net.Dialer{}, tc.resolver); err != tc.want {
+			t.Errorf("%q %q: got %v, want %v", tc.suffix, tc.resolver, err, tc.want)
+		}
+	}
+	if routes := loadDialConfig().routes; len(routes) != 0 {
+		t.Errorf("invalid routes set: %v", routes)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"syscall"
+)
+
+// dscp takes the upper 6 bits of the ipv4 tos and ipv6 traffic class.
+const maxDSCP = 63
+
+var errBadDSCP = errors.New("dscp must be from 0 to 63")
+
+// SetDSCP marks the packets c sends from now on with dscp, the
+// differentiated services code point (RFC 2474), as the flow's Decision
+// asks; packets already sent aren't. It is a no-op on windows, where
+// sockets can't set it.
+func SetDSCP(c syscall.Conn, dscp int) error {
+	if dscp < 0 || dscp > maxDSCP {
+		return errBadDSCP
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = setTOS(fd, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,23 @@
+package protect
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetDSCP(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	uc := c.(*net.UDPConn)
+	if err := SetDSCP(uc, 46); err != nil {
+		t.Error(err)
+	}
+	for _, dscp := range []int{-1, 64} {
+		if err := SetDSCP(uc, dscp); err != errBadDSCP {
+			t.Errorf("dscp %d: got %v, want %v", dscp, err, errBadDSCP)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEgressEndpoint answers with, among others, an "ip=" line; its
+	// host is an ip, so that no lookup is needed to reach it.
+	defaultEgressEndpoint = "https://1.1.1.1/cdn-cgi/trace"
+	// egressTimeout bounds EgressIP when ctx has no deadline.
+	egressTimeout = 10 * time.Second
+	// max size of answers of egress endpoints.
+	maxEgressAnswer = 4096
+)
+
+// egressTTL is how long the ip EgressIP observes is reused; a var, for tests.
+var egressTTL = time.Minute
+
+var (
+	errBadEgressEndpoint = errors.New("egress endpoint must be an http or https url")
+	errNoEgressIP        = errors.New("no ip in answer of egress endpoint")
+	errEgressStatus      = errors.New("egress endpoint status")
+)
+
+// observedIP is an ip EgressIP observed, reused until expiry.
+type observedIP struct {
+	ip     net.IP
+	expiry time.Time
+}
+
+var egress struct {
+	sync.Mutex
+	endpoint string
+	ips      map[Protector]*observedIP // last observed, by protector
+}
+
+// SetEgressEndpoint sets the url EgressIP fetches, whose answer is either
+// the client's ip alone or has it in a line of its own as "ip=<ip>". An
+// empty url reverts to the default, which is cloudflare's trace endpoint.
+func SetEgressEndpoint(endpoint string) error {
+	if len(endpoint) > 0 {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errBadEgressEndpoint
+		}
+	}
+	egress.Lock()
+	egress.endpoint = endpoint
+	egress.ips = nil
+	egress.Unlock()
+	return nil
+}
+
+// EgressIP returns the public ip that connections protected by p egress
+// from, as seen by the endpoint of SetEgressEndpoint; say, to check that
+// traffic leaves over the expected network. The ip is reused, for calls
+// with the same p, for a minute and until OnNetworkChanged is called, after
+// which it is fetched again. EgressIP gives up once ctx is done.
+func EgressIP(ctx context.Context, p Protector) (net.IP, error) {
+	// protectors that can't be map keys are never reused for
+	reuse := p == nil || reflect.TypeOf(p).Comparable()
+	egress.Lock()
+	set := egress.endpoint
+	if reuse {
+		if o := egress.ips[p]; o != nil && time.Now().Before(o.expiry) {
+			egress.Unlock()
+			return o.ip, nil
+		}
+	}
+	egress.Unlock()
+	endpoint := set
+	if len(endpoint) == 0 {
+		endpoint = defaultEgressEndpoint
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, egressTimeout)
+		defer cancel()
+	}
+	ip, err := fetchEgressIP(ctx, p, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	egress.Lock()
+	// unless the endpoint changed meanwhile
+	if reuse && egress.endpoint == set {
+		now := time.Now()
+		if egress.ips == nil {
+			egress.ips = make(map[Protector]*observedIP)
+		}
+		for k, o := range egress.ips {
+			if now.After(o.expiry) {
+				delete(egress.ips, k)
+			}
+		}
+		egress.ips[p] = &observedIP{ip: ip, expiry: now.Add(egressTTL)}
+	}
+	egress.Unlock()
+	return ip, nil
+}
+
+// forgetEgressIP drops the ips last observed by EgressIP.
+func forgetEgressIP() {
+	egress.Lock()
+	egress.ips = nil
+	egress.Unlock()
+}
+
+func fetchEgressIP(ctx context.Context, p Protector, endpoint string) (net.IP, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "")
+
+	tr := &http.Transport{
+		DialContext:     ProtectedDialContext(p),
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", errEgressStatus, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxEgressAnswer))
+	if err != nil {
+		return nil, err
+	}
+	return parseEgressIP(body)
+}
+
+// parseEgressIP returns the ip in body, which is either the ip alone or
+// has it in an "ip=" line.
+func parseEgressIP(body []byte) (net.IP, error) {
+	if ip := net.ParseIP(string(bytes.TrimSpace(body))); ip != nil {
+		return ip, nil
+	}
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "ip=") {
+			if ip := net.ParseIP(strings.TrimPrefix(line, "ip=")); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, errNoEgressIP
+}
@@ -0,0 +1,182 @@
+package protect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEgressIP(t *testing.T) {
+	defer SetEgressEndpoint("")
+	var hits int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "fl=1\nh=example\nip=203.0.113.7\nts=1\n")
+	}))
+	listenNonLoopback(t, s)
+	s.Start()
+	defer s.Close()
+	if err := SetEgressEndpoint(s.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeProtector{}
+	ip, err := EgressIP(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("got %s, want 203.0.113.7", ip)
+	}
+	p.mu.Lock()
+	protected := len(p.fds)
+	p.mu.Unlock()
+	if protected == 0 {
+		t.Error("egress endpoint not dialed with a protected socket")
+	}
+
+	// reused, until the network changes
+	if _, err := EgressIP(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+	OnNetworkChanged()
+	if _, err := EgressIP(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("%d fetches after the network changed, want 2", n)
+	}
+}
+
+func TestEgressIPExpires(t *testing.T) {
+	defer SetEgressEndpoint("")
+	defer func(ttl time.Duration) { egressTTL = ttl }(egressTTL)
+	egressTTL = 50 * time.Millisecond
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "2001:db8::7\n")
+	}))
+	defer s.Close()
+	SetEgressEndpoint(s.URL)
+
+	for i := 0; i < 2; i++ {
+		ip, err := EgressIP(context.Background(), &fakeProtector{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(net.ParseIP("2001:db8::7")) {
+			t.Errorf("got %s, want 2001:db8::7", ip)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("%d fetches, want 2 once expired", n)
+	}
+}
+
+func TestEgressIPContext(t *testing.T) {
+	defer SetEgressEndpoint("")
+	stop := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer s.Close()
+	defer close(stop)
+	SetEgressEndpoint(s.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if _, err := EgressIP(ctx, &fakeProtector{}); err == nil {
+		t.Fatal("no error from a hanging endpoint")
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("gave up after %v", took)
+	}
+}
+
+func TestEgressIPBadAnswers(t *testing.T) {
+	defer SetEgressEndpoint("")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer s.Close()
+	SetEgressEndpoint(s.URL)
+	if _, err := EgressIP(context.Background(), &fakeProtector{}); err != errNoEgressIP {
+		t.Errorf("got %v, want errNoEgressIP", err)
+	}
+
+	for _, endpoint := range []string{"ftp://example.com/", "example.com", "https://"} {
+		if err := SetEgressEndpoint(endpoint); err != errBadEgressEndpoint {
+			t.Errorf("%s: got %v, want errBadEgressEndpoint", endpoint, err)
+		}
+	}
+}
+
+func TestEgressIPByProtector(t *testing.T) {
+	defer SetEgressEndpoint("")
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "192.0.2.%d\n", atomic.AddInt32(&hits, 1))
+	}))
+	defer s.Close()
+	SetEgressEndpoint(s.URL)
+
+	a, b := &fakeProtector{}, &fakeProtector{}
+	ipa, err := EgressIP(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each protector's sockets may egress from networks of their own
+	ipb, err := EgressIP(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipa.Equal(ipb) {
+		t.Errorf("ip observed for one protector reused for another: %s", ipb)
+	}
+	if ip, _ := EgressIP(context.Background(), a); !ip.Equal(ipa) {
+		t.Errorf("got %s, want %s reused", ip, ipa)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+}
+
+// sliceProtector is a Protector of a type that can't be a map key.
+type sliceProtector []int32
+
+func (p sliceProtector) Protect(fd int32) bool { return true }
+func (p sliceProtector) GetResolvers() string  { return "" }
+
+func TestEgressIPUncomparableProtector(t *testing.T) {
+	defer SetEgressEndpoint("")
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "192.0.2.%d\n", atomic.AddInt32(&hits, 1))
+	}))
+	defer s.Close()
+	SetEgressEndpoint(s.URL)
+
+	// fetched each time, as its ip can't be kept by it
+	for i := 0; i < 2; i++ {
+		if _, err := EgressIP(context.Background(), sliceProtector{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// HappyEyeballsStats counts the outcomes of dials to hostnames, which race
+// the addresses they resolve to, ordered per the address sort policy.
+type HappyEyeballsStats struct {
+	// V4Wins and V6Wins count dials won by an address of each family.
+	V4Wins int64
+	V6Wins int64
+	// Fallbacks counts dials won by the family not tried first, after
+	// an address of the family tried first failed.
+	Fallbacks int64
+	// V4AvgMs and V6AvgMs are how long, on average, dials won by each
+	// family took to connect, from the first attempt; 0 if none won.
+	V4AvgMs int64
+	V6AvgMs int64
+}
+
+var eyeballs struct {
+	sync.Mutex
+	stats        HappyEyeballsStats
+	v4ms, v6ms   int64 // sums of the times to connect
+	v4won, v6won int64 // wins timed
+}
+
+// GetHappyEyeballsStats returns the outcomes of dials since the last reset.
+func GetHappyEyeballsStats() *HappyEyeballsStats {
+	eyeballs.Lock()
+	defer eyeballs.Unlock()
+	s := eyeballs.stats
+	if eyeballs.v4won > 0 {
+		s.V4AvgMs = eyeballs.v4ms / eyeballs.v4won
+	}
+	if eyeballs.v6won > 0 {
+		s.V6AvgMs = eyeballs.v6ms / eyeballs.v6won
+	}
+	return &s
+}
+
+// ResetHappyEyeballsStats zeroes the counts of GetHappyEyeballsStats, as
+// on network changes.
+func ResetHappyEyeballsStats() {
+	eyeballs.Lock()
+	defer eyeballs.Unlock()
+	eyeballs.stats = HappyEyeballsStats{}
+	eyeballs.v4ms, eyeballs.v6ms = 0, 0
+	eyeballs.v4won, eyeballs.v6won = 0, 0
+}
+
+// familyOf returns 4 or 6 for the ip in hostport, or 0 if it isn't one.
+func familyOf(hostport string) int {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return 0
+	}
+	return ipFamily(host)
+}
+
+// recordWin notes a race won by an address of family after took, where
+// first is the family tried first, and firstFailed whether an address of
+// it failed before the win.
+func recordWin(family, first int, firstFailed bool, took time.Duration) {
+	if family == 0 {
+		return
+	}
+	ms := took.Milliseconds()
+	eyeballs.Lock()
+	defer eyeballs.Unlock()
+	if family == 4 {
+		eyeballs.stats.V4Wins++
+		eyeballs.v4ms += ms
+		eyeballs.v4won++
+	} else {
+		eyeballs.stats.V6Wins++
+		eyeballs.v6ms += ms
+		eyeballs.v6won++
+	}
+	if family != first && firstFailed {
+		eyeballs.stats.Fallbacks++
+	}
+}
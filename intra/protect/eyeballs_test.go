@@ -0,0 +1,67 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// race dials addrs staggered by delay, each connecting after the time, or
+// failing if negative, in outcomes.
+func race(t *testing.T, addrs []string, delay time.Duration, outcomes map[string]time.Duration) {
+	c, err := dialStaggered(context.Background(), addrs, delay, func(ctx context.Context, addr string) (net.Conn, error) {
+		after := outcomes[addr]
+		if after < 0 {
+			return nil, errors.New("refused")
+		}
+		select {
+		case <-time.After(after):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestHappyEyeballsStats(t *testing.T) {
+	ResetHappyEyeballsStats()
+	defer ResetHappyEyeballsStats()
+	v6, v4 := "[2001:db8::1]:443", "192.0.2.1:443"
+	dual := []string{v6, v4}
+
+	// v6 connects first
+	race(t, dual, 200*time.Millisecond, map[string]time.Duration{v6: 0, v4: 0})
+	// v6 is slow, and v4 wins the race without v6 failing
+	race(t, dual, 10*time.Millisecond, map[string]time.Duration{v6: time.Second, v4: 0})
+	// v6 fails, and v4 is fallen back to
+	race(t, dual, time.Hour, map[string]time.Duration{v6: -1, v4: 100 * time.Millisecond})
+	// v4 only
+	race(t, []string{v4}, 0, map[string]time.Duration{v4: 0})
+
+	s := GetHappyEyeballsStats()
+	if s.V6Wins != 1 || s.V4Wins != 3 {
+		t.Errorf("wins: v6 %d, v4 %d; want 1, 3", s.V6Wins, s.V4Wins)
+	}
+	if s.Fallbacks != 1 {
+		t.Errorf("fallbacks: %d, want 1", s.Fallbacks)
+	}
+	// the v4 wins took ~10ms, ~100ms and ~0ms
+	if s.V4AvgMs < 30 || s.V4AvgMs > 300 {
+		t.Errorf("v4 average %dms, want ~36ms", s.V4AvgMs)
+	}
+	if s.V6AvgMs > 100 {
+		t.Errorf("v6 average %dms, want ~0ms", s.V6AvgMs)
+	}
+
+	ResetHappyEyeballsStats()
+	if s := GetHappyEyeballsStats(); *s != (HappyEyeballsStats{}) {
+		t.Errorf("stats after reset: %+v", s)
+	}
+}
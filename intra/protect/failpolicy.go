@@ -0,0 +1,67 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// FailOpen dials sockets that Protector.Protect fails to protect anyway,
+// as some devices report failures of protects that worked.
+const FailOpen int = 0
+
+// FailClosed fails dials of sockets that Protector.Protect fails to
+// protect, with ErrNotProtected.
+const FailClosed int = 1
+
+// Retry calls Protector.Protect up to protectAttempts times on a socket
+// before failing its dial, as FailClosed does.
+const Retry int = 2
+
+// protectAttempts is how many times Retry calls Protector.Protect.
+const protectAttempts = 3
+
+var errBadProtectPolicy = errors.New("unknown protect failure policy")
+
+// protectPolicy is what is done when Protector.Protect fails.
+var protectPolicy int32 = int32(FailOpen)
+
+// SetProtectFailurePolicy sets what protected dialers and listeners, and
+// ProtectAccepted, do with sockets that Protector.Protect returns false
+// for: FailOpen, the default, FailClosed or Retry.
+func SetProtectFailurePolicy(policy int) error {
+	switch policy {
+	case FailOpen, FailClosed, Retry:
+	default:
+		return errBadProtectPolicy
+	}
+	atomic.StoreInt32(&protectPolicy, int32(policy))
+	return nil
+}
+
+// protectFD protects fd with p per the protect failure policy, and returns
+// false if the socket must not be used.
+func protectFD(p Protector, fd uintptr) bool {
+	policy := int(atomic.LoadInt32(&protectPolicy))
+	attempts := 1
+	if policy == Retry {
+		attempts = protectAttempts
+	}
+	for i := 0; i < attempts; i++ {
+		if p.Protect(int32(fd)) {
+			return true
+		}
+	}
+	if policy == FailOpen {
+		log.Warnf("socket %d not protected; using it anyway", fd)
+		return true
+	}
+	return false
+}
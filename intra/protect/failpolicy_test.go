@@ -0,0 +1,82 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyProtector fails the first fails calls to Protect.
+type flakyProtector struct {
+	fails int32
+	calls int32
+}
+
+func (p *flakyProtector) Protect(fd int32) bool {
+	return atomic.AddInt32(&p.calls, 1) > p.fails
+}
+
+func (p *flakyProtector) GetResolvers() string { return "" }
+
+func TestProtectFailurePolicy(t *testing.T) {
+	defer SetProtectFailurePolicy(FailOpen)
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		policy int
+		fails  int32
+		ok     bool
+		calls  int32
+	}{
+		{"fail open", FailOpen, 1, true, 1},
+		{"fail closed", FailClosed, 1, false, 1},
+		{"retry until protected", Retry, 2, true, 3},
+		{"retry until out of attempts", Retry, 5, false, protectAttempts},
+	} {
+		if err := SetProtectFailurePolicy(tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		p := &flakyProtector{fails: tc.fails}
+		c, err := DialContext(context.Background(), MakeDialer(p), "tcp", l.Addr().String())
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrNotProtected) {
+			t.Errorf("%s: got %v, want ErrNotProtected", tc.name, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+		if n := atomic.LoadInt32(&p.calls); n != tc.calls {
+			t.Errorf("%s: Protect called %d times, want %d", tc.name, n, tc.calls)
+		}
+	}
+
+	// listeners too
+	SetProtectFailurePolicy(FailClosed)
+	if _, err := MakeListenConfig(&flakyProtector{fails: 1}).ListenPacket(context.Background(), "udp", "127.0.0.1:0"); !errors.Is(err, ErrNotProtected) {
+		t.Errorf("listen: got %v, want ErrNotProtected", err)
+	}
+}
+
+func TestSetProtectFailurePolicyInvalid(t *testing.T) {
+	if err := SetProtectFailurePolicy(7); err != errBadProtectPolicy {
+		t.Errorf("got %v, want errBadProtectPolicy", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ErrBlocked is returned by flow dialers for dials their flow blocks.
+var ErrBlocked = errors.New("blocked by flow")
+
+// blockAsRefused is 1 when flow dialers return refused conns for blocked
+// dials instead of ErrBlocked.
+var blockAsRefused int32
+
+// SetBlockAsRefusedConn has flow dialers, see MakeFlowDialer, return a conn
+// for dials their flow blocks whose reads and writes fail with
+// ECONNREFUSED, as a conn to a closed port would, in place of ErrBlocked,
+// for callers written against net.Conn to handle blocks as they would
+// any refused conn.
+func SetBlockAsRefusedConn(refused bool) {
+	var v int32
+	if refused {
+		v = 1
+	}
+	atomic.StoreInt32(&blockAsRefused, v)
+}
+
+func blockingAsRefused() bool {
+	return atomic.LoadInt32(&blockAsRefused) == 1
+}
+
+// flowDialer dials with d the targets flow doesn't block.
+type flowDialer struct {
+	flow Flow
+	uid  int
+	d    ContextDialer
+}
+
+// MakeFlowDialer returns a dialer that asks flow, as the tunnel does of
+// its flows, for the net-id of each dial, as if by uid and from no source.
+// Dials decided NetIdBlock fail, per SetBlockAsRefusedConn; all others
+// are dialed with d, for flow is only consulted to block.
+func MakeFlowDialer(flow Flow, uid int, d ContextDialer) ContextDialer {
+	return &flowDialer{flow: flow, uid: uid, d: d}
+}
+
+func (f *flowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proto := int32(6) // TCP
+	if strings.HasPrefix(network, "udp") {
+		proto = 17 // UDP
+	}
+	d := Decide(f.flow, proto, f.uid, "", addr)
+	if d.NetId != NetIdBlock {
+		return f.d.DialContext(ctx, network, addr)
+	}
+	log.Infof("flow dialer: %s %s blocked", network, addr)
+	if blockingAsRefused() {
+		return &refusedConn{raddr: dnsAddr{network, addr}}, nil
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Addr: dnsAddr{network, addr}, Err: ErrBlocked}
+}
+
+// refusedConn stands in for a conn to a blocked target: its reads and
+// writes fail as if the target refused it.
+type refusedConn struct {
+	raddr dnsAddr
+}
+
+func (c *refusedConn) refused(op string) error {
+	return &net.OpError{Op: op, Net: c.raddr.network, Addr: c.raddr, Err: os.NewSyscallError(op, syscall.ECONNREFUSED)}
+}
+
+func (c *refusedConn) Read(b []byte) (int, error)  { return 0, c.refused("read") }
+func (c *refusedConn) Write(b []byte) (int, error) { return 0, c.refused("write") }
+func (c *refusedConn) Close() error                { return nil }
+func (c *refusedConn) LocalAddr() net.Addr         { return dnsAddr{c.raddr.network, ""} }
+func (c *refusedConn) RemoteAddr() net.Addr        { return c.raddr }
+
+func (c *refusedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *refusedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *refusedConn) SetWriteDeadline(t time.Time) error { return nil }
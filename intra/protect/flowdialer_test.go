@@ -0,0 +1,64 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// blockingFlow blocks flows to target and allows all others.
+type blockingFlow struct {
+	target string
+}
+
+func (f *blockingFlow) On(protocol int32, uid int, source, target string) string {
+	if target == f.target {
+		return NetIdBlock + "#reason=test"
+	}
+	return NetIdActive
+}
+
+func TestFlowDialerBlocks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	open := l.Addr().String()
+	d := MakeFlowDialer(&blockingFlow{"192.0.2.1:80"}, 10, &net.Dialer{})
+
+	c, err := d.DialContext(context.Background(), "tcp", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:80"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("got %v, want ErrBlocked", err)
+	}
+}
+
+func TestBlockAsRefusedConn(t *testing.T) {
+	SetBlockAsRefusedConn(true)
+	defer SetBlockAsRefusedConn(false)
+	d := MakeFlowDialer(&blockingFlow{"192.0.2.1:80"}, 10, &net.Dialer{})
+
+	for _, network := range []string{"tcp", "udp"} {
+		c, err := d.DialContext(context.Background(), network, "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("%s: read got %v, want ECONNREFUSED", network, err)
+		}
+		if _, err := c.Write([]byte("hi")); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("%s: write got %v, want ECONNREFUSED", network, err)
+		}
+		if a := c.RemoteAddr(); a.Network() != network || a.String() != "192.0.2.1:80" {
+			t.Errorf("%s: remote addr %s %s", network, a.Network(), a)
+		}
+		c.Close()
+	}
+}
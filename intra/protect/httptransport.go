@@ -0,0 +1,123 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// transports holds the ProtectedTransports that are open.
+var transports struct {
+	sync.Mutex
+	m map[*ProtectedTransport]struct{}
+}
+
+// ProtectedTransport is an http.Transport over conns protected by p, as
+// dialed by ProtectedDialContext, that it keeps track of so as to close
+// them once the network changes; pooled conns would otherwise stall
+// requests on the network no longer underlying the tunnel.
+type ProtectedTransport struct {
+	*http.Transport
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// NewProtectedTransport returns a ProtectedTransport over sockets protected
+// by p, which Invalidate, or OnNetworkChanged, resets until it is closed.
+func NewProtectedTransport(p Protector) *ProtectedTransport {
+	t := &ProtectedTransport{conns: make(map[*trackedConn]struct{})}
+	dial := ProtectedDialContext(p)
+	t.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tc := &trackedConn{Conn: c, t: t}
+			t.mu.Lock()
+			t.conns[tc] = struct{}{}
+			t.mu.Unlock()
+			return tc, nil
+		},
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+	}
+	transports.Lock()
+	if transports.m == nil {
+		transports.m = make(map[*ProtectedTransport]struct{})
+	}
+	transports.m[t] = struct{}{}
+	transports.Unlock()
+	return t
+}
+
+// Invalidate closes the conns of t, idle and in use, so that requests from
+// then on are sent over conns freshly dialed, and returns how many it closed.
+// Requests in flight over them fail.
+func (t *ProtectedTransport) Invalidate() int {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	// idle conns are dropped from the pool, and the rest closed
+	t.Transport.CloseIdleConnections()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// Close closes the conns of t, which OnNetworkChanged no longer resets.
+func (t *ProtectedTransport) Close() {
+	transports.Lock()
+	delete(transports.m, t)
+	transports.Unlock()
+	t.Invalidate()
+}
+
+// activeConns returns how many conns of t are open.
+func (t *ProtectedTransport) activeConns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// invalidateTransports resets all open ProtectedTransports.
+func invalidateTransports() {
+	transports.Lock()
+	ts := make([]*ProtectedTransport, 0, len(transports.m))
+	for t := range transports.m {
+		ts = append(ts, t)
+	}
+	transports.Unlock()
+	for _, t := range ts {
+		t.Invalidate()
+	}
+}
+
+// trackedConn is a conn of a ProtectedTransport.
+type trackedConn struct {
+	net.Conn
+	t    *ProtectedTransport
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, c)
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,81 @@
+package protect
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProtectedTransport(t *testing.T) {
+	var dialed int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&dialed, 1)
+		}
+	}
+	listenNonLoopback(t, s)
+	s.Start()
+	defer s.Close()
+
+	p := &fakeProtector{}
+	tr := NewProtectedTransport(p)
+	defer tr.Close()
+	client := &http.Client{Transport: tr}
+	get := func() {
+		res, err := client.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	get()
+	get()
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("%d conns for 2 requests, want 1 reused", n)
+	}
+	p.mu.Lock()
+	protected := len(p.fds)
+	p.mu.Unlock()
+	if protected != 1 {
+		t.Errorf("%d sockets protected, want 1", protected)
+	}
+
+	if n := tr.Invalidate(); n != 1 {
+		t.Errorf("invalidated %d conns, want 1", n)
+	}
+	if n := tr.activeConns(); n != 0 {
+		t.Errorf("%d conns left open", n)
+	}
+	get()
+	if n := atomic.LoadInt32(&dialed); n != 2 {
+		t.Errorf("%d conns after invalidation, want a fresh one", n)
+	}
+
+	// as on network changes
+	OnNetworkChanged()
+	if n := tr.activeConns(); n != 0 {
+		t.Errorf("%d conns open after the network changed", n)
+	}
+	get()
+	if n := atomic.LoadInt32(&dialed); n != 3 {
+		t.Errorf("%d conns after the network changed, want a fresh one", n)
+	}
+
+	// closed transports are no longer reset
+	tr.Close()
+	transports.Lock()
+	_, tracked := transports.m[tr]
+	transports.Unlock()
+	if tracked {
+		t.Error("closed transport still tracked")
+	}
+}
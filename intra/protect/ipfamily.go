@@ -0,0 +1,151 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import "strings"
+
+// ipFamily returns 4 or 6 for the family of ip, as net.ParseIP(ip).To4()
+// tells it, or 0 if ip isn't an ip address. ipv4-mapped ipv6 addresses are
+// of family 4. Unlike net.ParseIP, it doesn't allocate, for it is called
+// for every resolver on every lookup.
+func ipFamily(ip string) int {
+	if strings.IndexByte(ip, ':') < 0 {
+		if _, ok := parseV4(ip); ok {
+			return 4
+		}
+		return 0
+	}
+	a, ok := parseV6(ip)
+	if !ok {
+		return 0
+	}
+	for _, b := range a[:10] {
+		if b != 0 {
+			return 6
+		}
+	}
+	if a[10] == 0xff && a[11] == 0xff {
+		return 4
+	}
+	return 6
+}
+
+// parseV4 parses s, in dotted decimal, into a. Octets with leading zeros,
+// which some take for octal, are rejected, as net.ParseIP does since go1.17.
+func parseV4(s string) (a [4]byte, ok bool) {
+	for i := range a {
+		if i > 0 {
+			if len(s) == 0 || s[0] != '.' {
+				return a, false
+			}
+			s = s[1:]
+		}
+		n, digits := 0, 0
+		for ; digits < len(s) && '0' <= s[digits] && s[digits] <= '9'; digits++ {
+			if n = n*10 + int(s[digits]-'0'); n > 0xff {
+				return a, false
+			}
+		}
+		if digits == 0 || (digits > 1 && s[0] == '0') {
+			return a, false
+		}
+		a[i] = byte(n)
+		s = s[digits:]
+	}
+	return a, len(s) == 0
+}
+
+// parseV6 parses s, in the text form of RFC 4291 section 2.2, with its
+// last 32 bits perhaps in dotted decimal, into a; as net.ParseIP does.
+func parseV6(s string) (a [16]byte, ok bool) {
+	ellipsis := -1 // index of the bytes "::" stands in for
+	if len(s) >= 2 && s[0] == ':' && s[1] == ':' {
+		ellipsis = 0
+		if s = s[2:]; len(s) == 0 {
+			return a, true
+		}
+	}
+	i := 0
+	for i < len(a) {
+		n, digits := 0, 0
+		for ; digits < len(s) && digits <= 4; digits++ {
+			v := unhex(s[digits])
+			if v < 0 {
+				break
+			}
+			n = n<<4 | v
+		}
+		if digits == 0 || digits > 4 {
+			return a, false
+		}
+		if digits < len(s) && s[digits] == '.' {
+			// the rest is an ipv4 address
+			if (ellipsis < 0 && i != 12) || i+4 > len(a) {
+				return a, false
+			}
+			v4, ok := parseV4(s)
+			if !ok {
+				return a, false
+			}
+			copy(a[i:], v4[:])
+			i += 4
+			s = ""
+			break
+		}
+		a[i], a[i+1] = byte(n>>8), byte(n)
+		i += 2
+		if s = s[digits:]; len(s) == 0 {
+			break
+		}
+		if s[0] != ':' || len(s) == 1 {
+			return a, false
+		}
+		s = s[1:]
+		if s[0] == ':' {
+			if ellipsis >= 0 {
+				return a, false
+			}
+			ellipsis = i
+			if s = s[1:]; len(s) == 0 {
+				break
+			}
+		}
+	}
+	if len(s) != 0 {
+		return a, false
+	}
+	if i < len(a) {
+		if ellipsis < 0 {
+			return a, false
+		}
+		// move the bytes after "::" to the end, zeroing those in between
+		n := len(a) - i
+		for j := i - 1; j >= ellipsis; j-- {
+			a[j+n] = a[j]
+		}
+		for j := ellipsis + n - 1; j >= ellipsis; j-- {
+			a[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		// "::" must stand in for at least one group
+		return a, false
+	}
+	return a, true
+}
+
+// unhex returns the value of the hex digit c, or -1 if it isn't one.
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c-'a') + 10
+	case 'A' <= c && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
@@ -0,0 +1,91 @@
+package protect
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFamily(t *testing.T) {
+	for ip, want := range map[string]int{
+		"1.1.1.1":                 4,
+		"0.0.0.0":                 4,
+		"255.255.255.255":         4,
+		"2001:db8::1":             6,
+		"::":                      6,
+		"::1":                     6,
+		"1::":                     6,
+		"fe80::1:2":               6,
+		"2001:DB8:0:0:0:0:0:1":    6,
+		"64:ff9b::192.0.2.1":      6,
+		"::ffff:1.2.3.4":          4,
+		"0:0:0:0:0:ffff:1.2.3.4":  4,
+		"::ffff:102:304":          4,
+		"::1.2.3.4":               6,
+		"":                        0,
+		"foo.test":                0,
+		"1.1.1":                   0,
+		"1.1.1.1.":                0,
+		"1.1.1.256":               0,
+		"1..1.1":                  0,
+		"01.2.3.4":                0,
+		"1.2.3.010":               0,
+		"::ffff:1.2.03.4":         0,
+		"[::1]":                   0,
+		"::1%eth0":                0,
+		"1:2:3:4:5:6:7:8:9":       0,
+		"1:2:3:4:5:6:7":           0,
+		"1::2::3":                 0,
+		"12345::":                 0,
+		"1:2:3:4:5:6:7::8":        0,
+		"1:":                      0,
+		":1":                      0,
+		"::ffff:1.2.3":            0,
+		"1:2:3:4:5:6:7:1.2.3.4":   0,
+		"1:2:3:4:5:6:1.2.3.4":     6,
+		"1:2:3:4:5:6:7:8::":       0,
+		"1:2:3:4:5:6:1.2.3.4:1:2": 0,
+	} {
+		if got := ipFamily(ip); got != want {
+			t.Errorf("%q: got %d, want %d", ip, got, want)
+		}
+		// as net.ParseIP tells it
+		parsed, got := net.ParseIP(ip), 0
+		if parsed != nil {
+			got = 6
+			if parsed.To4() != nil {
+				got = 4
+			}
+		}
+		if got != want {
+			t.Errorf("%q: net.ParseIP gives family %d, want %d", ip, got, want)
+		}
+	}
+}
+
+func TestScanSkipsInvalid(t *testing.T) {
+	ips := []string{"foo", "2001:db8::1", "::ffff:8.8.8.8", "1.1.1.1"}
+	if got := scan(ips, true); got != "::ffff:8.8.8.8" {
+		t.Errorf("got %q for v4", got)
+	}
+	if got := scan(ips, false); got != "2001:db8::1" {
+		t.Errorf("got %q for v6", got)
+	}
+	if got := scan([]string{"foo", "1.1.1"}, true); got != "" {
+		t.Errorf("got %q from invalid ips", got)
+	}
+}
+
+var benchIPs = []string{"2001:db8::1", "2001:db8::2", "8.8.8.8", "1.1.1.1"}
+
+func BenchmarkScan(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		scan(benchIPs, true)
+	}
+}
+
+func TestScanDoesNotAllocate(t *testing.T) {
+	if n := testing.AllocsPerRun(100, func() { scan(benchIPs, true) }); n != 0 {
+		t.Errorf("%v allocs per scan", n)
+	}
+}
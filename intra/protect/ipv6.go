@@ -0,0 +1,157 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// how long the result of a probe for ipv6 connectivity is reused.
+	v6ProbeTTL = 30 * time.Second
+	// a global ipv6 address, of a public resolver, that is routable on
+	// networks with ipv6 connectivity; the port doesn't matter as nothing
+	// is sent to it.
+	v6ProbeAddr = "[2001:4860:4860::8888]:9"
+)
+
+var errBadNAT64Prefix = errors.New("nat64 prefix must be an ipv6 /96")
+
+var v6 struct {
+	sync.Mutex
+	nat64     *net.IPNet
+	reachable bool
+	probed    time.Time
+}
+
+// probeV6 returns true if there's a route to global ipv6 addresses, by
+// connecting (but not sending on) a udp socket of d's bare dialer, see
+// bareDialerOf; ok is false if the probe failed short of the network, as
+// when the socket isn't protected or ctx is done, which says nothing of
+// ipv6 connectivity. A var, for tests.
+var probeV6 = func(ctx context.Context, d *net.Dialer) (reachable, ok bool) {
+	c, err := bareDialerOf(d).DialContext(ctx, "udp6", v6ProbeAddr)
+	if err != nil {
+		var serr *os.SyscallError
+		return false, errors.As(err, &serr)
+	}
+	defer c.Close()
+	src := c.LocalAddr().(*net.UDPAddr).IP
+	return !src.IsLinkLocalUnicast(), true
+}
+
+// SetNAT64Prefix sets the /96 prefix, such as "64:ff9b::/96", of ipv6
+// addresses a NAT64 synthesizes from ipv4 ones (RFC 6052); without ipv6
+// connectivity, such addresses are dialed at the ipv4 address in them. An
+// empty prefix clears it.
+func SetNAT64Prefix(prefix string) error {
+	var nat64 *net.IPNet
+	if len(prefix) > 0 {
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return err
+		}
+		if ones, bits := ipnet.Mask.Size(); ipnet.IP.To4() != nil || bits != 128 || ones != 96 {
+			return errBadNAT64Prefix
+		}
+		nat64 = ipnet
+	}
+	v6.Lock()
+	v6.nat64 = nat64
+	v6.Unlock()
+	return nil
+}
+
+// needsV6 returns true if dialing ip needs ipv6 connectivity, which
+// loopback, link-local and unique local addresses may well not.
+func needsV6(ip net.IP) bool {
+	if ip.To4() != nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	return ip[0]&0xfe != 0xfc
+}
+
+// v6Reachable returns the result of the last probe for ipv6 connectivity,
+// probing again with d if it is older than v6ProbeTTL. Probes that fail
+// short of the network aren't kept, and ipv6 is then taken as reachable,
+// for the dial itself to fail if it isn't.
+func v6Reachable(ctx context.Context, d *net.Dialer) bool {
+	v6.Lock()
+	defer v6.Unlock()
+	if time.Since(v6.probed) > v6ProbeTTL {
+		reachable, ok := probeV6(ctx, d)
+		if !ok {
+			return true
+		}
+		v6.reachable = reachable
+		v6.probed = time.Now()
+		if !v6.reachable {
+			log.Infof("no ipv6 connectivity")
+		}
+	}
+	return v6.reachable
+}
+
+// routable returns ips without those that need ipv6 connectivity if there
+// is none, except those of the nat64 prefix, which are replaced by the
+// ipv4 addresses in them.
+func routable(ctx context.Context, d *net.Dialer, ips []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	probed, reachable := false, true
+	for _, ip := range ips {
+		if !needsV6(ip) {
+			out = append(out, ip)
+			continue
+		}
+		if !probed {
+			probed, reachable = true, v6Reachable(ctx, d)
+		}
+		if reachable {
+			out = append(out, ip)
+		} else if ip4 := fromNAT64(ip); ip4 != nil {
+			out = append(out, ip4)
+		}
+	}
+	return out
+}
+
+// fromNAT64 returns the ipv4 address in ip, if ip is of the nat64 prefix.
+func fromNAT64(ip net.IP) net.IP {
+	v6.Lock()
+	nat64 := v6.nat64
+	v6.Unlock()
+	if nat64 == nil || !nat64.Contains(ip) {
+		return nil
+	}
+	return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+}
+
+// routableAddr is addr, a literal ip:port, made routable as by routable,
+// or ErrNoIPv6 if it can't be.
+func routableAddr(ctx context.Context, d *net.Dialer, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if !needsV6(ip) {
+		return addr, nil
+	}
+	ips := routable(ctx, d, []net.IP{ip})
+	if len(ips) == 0 {
+		return "", fmt.Errorf("dial %s: %w", addr, ErrNoIPv6)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,184 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubV6 has probes for ipv6 connectivity return reachable until undone.
+func stubV6(reachable bool) func() {
+	probe := probeV6
+	probeV6 = func(context.Context, *net.Dialer) (bool, bool) { return reachable, true }
+	v6.Lock()
+	v6.probed = time.Time{}
+	v6.Unlock()
+	return func() {
+		probeV6 = probe
+		v6.Lock()
+		v6.probed = time.Time{}
+		v6.Unlock()
+	}
+}
+
+// startAAAADNS answers AAAA queries on a udp port with ip, and A queries
+// with no records.
+func startAAAADNS(t *testing.T, ip net.IP) (net.PacketConn, int) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(b[:n]); err != nil {
+				continue
+			}
+			msg.Response = true
+			msg.Additionals = nil
+			for _, q := range msg.Questions {
+				if q.Type != dnsmessage.TypeAAAA {
+					continue
+				}
+				var aaaa [16]byte
+				copy(aaaa[:], ip.To16())
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AAAAResource{AAAA: aaaa},
+				})
+			}
+			ans, _ := msg.Pack()
+			c.WriteTo(ans, from)
+		}
+	}()
+	return c, c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestNoIPv6FailsFast(t *testing.T) {
+	defer stubV6(false)()
+	d := MakeDialer(&fakeProtector{})
+
+	begin := time.Now()
+	_, err := DialContext(context.Background(), d, "tcp", "[2001:db8::1]:443")
+	if !errors.Is(err, ErrNoIPv6) {
+		t.Errorf("got %v, want ErrNoIPv6", err)
+	}
+
+	// a v6-only name
+	dns, port := startAAAADNS(t, net.ParseIP("2001:db8::1"))
+	defer dns.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	_, err = DialContext(context.Background(), d, "tcp", "v6only.test:443")
+	if !errors.Is(err, ErrNoIPv6) {
+		t.Errorf("got %v, want ErrNoIPv6", err)
+	}
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Errorf("failed after %v", took)
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	defer stubV6(false)()
+	if err := SetNAT64Prefix("64:ff9b::/96"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetNAT64Prefix("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	d := MakeDialer(&fakeProtector{})
+
+	c, err := DialContext(context.Background(), d, "tcp", net.JoinHostPort("64:ff9b::7f00:1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("dialed %s, want 127.0.0.1", got)
+	}
+	c.Close()
+
+	// outside the prefix
+	if _, err := DialContext(context.Background(), d, "tcp", net.JoinHostPort("2001:db8::7f00:1", port)); !errors.Is(err, ErrNoIPv6) {
+		t.Errorf("got %v, want ErrNoIPv6", err)
+	}
+}
+
+func TestIPv6Reachable(t *testing.T) {
+	defer stubV6(true)()
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	if got := routable(context.Background(), MakeDialer(&fakeProtector{}), ips); len(got) != 2 {
+		t.Errorf("got %v, want %v", got, ips)
+	}
+	// local addresses need no probe
+	for _, s := range []string{"::1", "fe80::1", "fd00::1", "192.0.2.1"} {
+		if needsV6(net.ParseIP(s)) {
+			t.Errorf("%s needs ipv6 connectivity", s)
+		}
+	}
+}
+
+func TestSetNAT64PrefixInvalid(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/64", "192.0.2.0/24", "64:ff9b::"} {
+		if err := SetNAT64Prefix(prefix); err == nil {
+			t.Errorf("%s set", prefix)
+		}
+	}
+}
+
+func TestIPv6ProbeWithoutHooks(t *testing.T) {
+	var hooked int32
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{ControlHooks: []func(string, string, uintptr) error{
+		func(string, string, uintptr) error {
+			atomic.AddInt32(&hooked, 1)
+			return errors.New("hook failed")
+		},
+	}})
+	// an ipv4 source the probe's udp6 socket could never bind to
+	d.LocalAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	if _, ok := probeV6(context.Background(), d); !ok {
+		t.Error("probe failed with the dialer's hooks or local address")
+	}
+	if n := atomic.LoadInt32(&hooked); n != 0 {
+		t.Errorf("probe ran the dialer's hooks %d times", n)
+	}
+}
+
+func TestIPv6ProbeNotProtected(t *testing.T) {
+	defer SetProtectFailurePolicy(FailOpen)
+	SetProtectFailurePolicy(FailClosed)
+	reset := func() {
+		v6.Lock()
+		v6.probed = time.Time{}
+		v6.Unlock()
+	}
+	reset()
+	defer reset()
+
+	d := MakeDialer(&flakyProtector{fails: 100})
+	if !v6Reachable(context.Background(), d) {
+		t.Error("ipv6 unreachable as a probe wasn't protected")
+	}
+	v6.Lock()
+	probed := v6.probed
+	v6.Unlock()
+	if !probed.IsZero() {
+		t.Error("probe that wasn't protected kept")
+	}
+}
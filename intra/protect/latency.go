@@ -0,0 +1,193 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// max resolvers whose latency is tracked; the least recently
+	// measured is forgotten to make room for another.
+	maxTrackedResolvers = 64
+	// one in every probeEvery picks is of a resolver other than the fastest.
+	probeEvery = 10
+)
+
+// latencyAware is 1 when resolvers are picked by their latency.
+var latencyAware int32
+
+type resolverLatency struct {
+	ewma time.Duration
+	seen time.Time
+}
+
+var latencies struct {
+	sync.Mutex
+	picks    uint32
+	resolver map[string]*resolverLatency
+}
+
+// EnableLatencyAwareResolverSelection has queries to the system's resolvers
+// sent to the one of the wanted ip family that has been answering fastest,
+// by an exponentially weighted moving average of its response times. Now
+// and then, and until each has answered once, others are picked instead,
+// so that a resolver that got faster is found out.
+func EnableLatencyAwareResolverSelection() {
+	latencies.Lock()
+	if latencies.resolver == nil {
+		latencies.resolver = make(map[string]*resolverLatency)
+	}
+	latencies.Unlock()
+	atomic.StoreInt32(&latencyAware, 1)
+}
+
+func latencyAwareSelection() bool {
+	return atomic.LoadInt32(&latencyAware) == 1
+}
+
+// fastest returns the fastest of ips of the wanted family, an unmeasured
+// one if any, or, on every probeEvery-th pick, the next of the rest in turn.
+func fastest(ips []string, wantV4 bool) string {
+	var family []string
+	for _, ip := range ips {
+		if f := ipFamily(ip); f != 0 && (f == 4) == wantV4 {
+			family = append(family, ip)
+		}
+	}
+	if len(family) == 0 {
+		return ""
+	}
+
+	latencies.Lock()
+	defer latencies.Unlock()
+	latencies.picks++
+	best := -1
+	var bestLatency time.Duration
+	for i, ip := range family {
+		l, ok := latencies.resolver[ip]
+		if !ok {
+			return ip
+		}
+		if best < 0 || l.ewma < bestLatency {
+			best, bestLatency = i, l.ewma
+		}
+	}
+	if len(family) > 1 && latencies.picks%probeEvery == 0 {
+		// skip over best to probe the others in turn
+		n := int(latencies.picks/probeEvery) % (len(family) - 1)
+		if n >= best {
+			n++
+		}
+		return family[n]
+	}
+	return family[best]
+}
+
+// recordLatency folds rtt into the moving average of resolver ip.
+func recordLatency(ip string, rtt time.Duration) {
+	latencies.Lock()
+	defer latencies.Unlock()
+	now := time.Now()
+	l, ok := latencies.resolver[ip]
+	if !ok {
+		if len(latencies.resolver) >= maxTrackedResolvers {
+			evictStalestLatency()
+		}
+		latencies.resolver[ip] = &resolverLatency{ewma: rtt, seen: now}
+		return
+	}
+	// an alpha of 1/4 weighs recent answers while smoothing out outliers
+	l.ewma += (rtt - l.ewma) / 4
+	l.seen = now
+}
+
+func evictStalestLatency() {
+	var stalest string
+	var seen time.Time
+	for ip, l := range latencies.resolver {
+		if len(stalest) == 0 || l.seen.Before(seen) {
+			stalest, seen = ip, l.seen
+		}
+	}
+	delete(latencies.resolver, stalest)
+}
+
+// unreachableLatency is what resolvers that can't be dialed are taken to take.
+const unreachableLatency = transportTimeout
+
+// timedFailure records the resolver at addr as failing to be dialed.
+func timedFailure(addr string) {
+	if latencyAwareSelection() {
+		ip, _, _ := net.SplitHostPort(addr)
+		recordLatency(ip, unreachableLatency)
+	}
+}
+
+// timedConn records the time from each query written to c, a conn to
+// resolver ip, to the first read of its answer.
+type timedConn struct {
+	net.Conn
+	ip string
+
+	mu   sync.Mutex
+	sent time.Time
+}
+
+// timedPacketConn is a timedConn that keeps its datagram-ness, which is
+// what the go resolver looks for to decide how to frame queries.
+type timedPacketConn struct {
+	*timedConn
+}
+
+// timed returns c, dialed to the resolver at addr, as a timedConn if
+// resolvers are picked by their latency.
+func timed(c net.Conn, addr string) net.Conn {
+	if !latencyAwareSelection() {
+		return c
+	}
+	ip, _, _ := net.SplitHostPort(addr)
+	tc := &timedConn{Conn: c, ip: ip}
+	if _, ok := c.(net.PacketConn); ok {
+		return &timedPacketConn{tc}
+	}
+	return tc
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.sent = time.Now()
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	// a read that fails, say on timeout, counts against the resolver too
+	if n > 0 || err != nil {
+		c.mu.Lock()
+		sent := c.sent
+		c.sent = time.Time{}
+		c.mu.Unlock()
+		if !sent.IsZero() {
+			recordLatency(c.ip, time.Since(sent))
+		}
+	}
+	return n, err
+}
+
+func (c *timedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *timedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
@@ -0,0 +1,147 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resetLatencies turns latency-aware selection off and forgets all latencies.
+func resetLatencies() {
+	atomic.StoreInt32(&latencyAware, 0)
+	latencies.Lock()
+	latencies.resolver = nil
+	latencies.picks = 0
+	latencies.Unlock()
+}
+
+func TestFastestPrefersLowestLatency(t *testing.T) {
+	EnableLatencyAwareResolverSelection()
+	defer resetLatencies()
+
+	ips := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3"}
+	// unmeasured resolvers are tried first
+	if got := fastest(ips, true); got != "192.0.2.1" {
+		t.Errorf("picked %s, want the first unmeasured", got)
+	}
+	recordLatency("192.0.2.1", 80*time.Millisecond)
+	recordLatency("192.0.2.2", 5*time.Millisecond)
+	if got := fastest(ips, true); got != "192.0.2.3" {
+		t.Errorf("picked %s, want the unmeasured", got)
+	}
+	recordLatency("192.0.2.3", 40*time.Millisecond)
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picks[fastest(ips, true)]++
+	}
+	if picks["192.0.2.2"] < 85 {
+		t.Errorf("fastest picked %d times of 100: %v", picks["192.0.2.2"], picks)
+	}
+	if picks["192.0.2.1"] == 0 || picks["192.0.2.3"] == 0 {
+		t.Errorf("slower resolvers never probed: %v", picks)
+	}
+	if picks["2001:db8::1"] != 0 {
+		t.Errorf("picked a resolver of the wrong family: %v", picks)
+	}
+	if got := fastest(ips, false); got != "2001:db8::1" {
+		t.Errorf("picked %s, want the only v6 resolver", got)
+	}
+	if got := fastest([]string{"192.0.2.1"}, false); got != "" {
+		t.Errorf("picked %s, want none", got)
+	}
+}
+
+func TestRecordLatencyMovingAverage(t *testing.T) {
+	EnableLatencyAwareResolverSelection()
+	defer resetLatencies()
+
+	recordLatency("192.0.2.1", 100*time.Millisecond)
+	recordLatency("192.0.2.1", 20*time.Millisecond)
+	latencies.Lock()
+	got := latencies.resolver["192.0.2.1"].ewma
+	latencies.Unlock()
+	if got != 80*time.Millisecond {
+		t.Errorf("ewma %s, want 80ms", got)
+	}
+}
+
+func TestLatenciesBounded(t *testing.T) {
+	EnableLatencyAwareResolverSelection()
+	defer resetLatencies()
+
+	for i := 0; i < 2*maxTrackedResolvers; i++ {
+		recordLatency(net.IPv4(10, 0, byte(i>>8), byte(i)).String(), time.Millisecond)
+	}
+	latencies.Lock()
+	n := len(latencies.resolver)
+	latencies.Unlock()
+	if n != maxTrackedResolvers {
+		t.Errorf("tracking %d resolvers, want %d", n, maxTrackedResolvers)
+	}
+}
+
+// slowListener delays each write to conns it accepts.
+type slowListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (l *slowListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &slowConn{c, l.delay}, nil
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestLatencyAwareResolverSelection(t *testing.T) {
+	fast, port := startTCPDNS(t, fooIP)
+	defer fast.Close()
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	slow := &slowListener{l, 20 * time.Millisecond}
+	defer slow.Close()
+	go serveTCPDNS(slow, fooIP)
+
+	EnableLatencyAwareResolverSelection()
+	defer resetLatencies()
+
+	// the slow resolver is listed first, and so is the one scan picks
+	d := MakeDialer(&resolversProtector{csv: "127.0.0.2,127.0.0.1"})
+	picks := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		c, err := d.Resolver.Dial(context.Background(), "tcp", net.JoinHostPort("192.0.2.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := streamExchange(c, makeQuery(t, uint16(i), "foo.test.", dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		picks[c.RemoteAddr().(*net.TCPAddr).IP.String()]++
+		c.Close()
+	}
+	if picks["127.0.0.1"] < 30 {
+		t.Errorf("faster resolver picked %d times of 40: %v", picks["127.0.0.1"], picks)
+	}
+	if picks["127.0.0.2"] < 2 {
+		t.Errorf("slower resolver not probed: %v", picks)
+	}
+}
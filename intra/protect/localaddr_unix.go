@@ -0,0 +1,88 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package protect
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+// localAddr returns the address socket fd of network is bound to. Dialed
+// sockets are bound only on connect, which is after Control returns, and
+// so unbound sockets are bound here to an ephemeral port on the wildcard
+// address of their family; the ip is then only known after connect.
+func localAddr(network string, fd uintptr) (net.Addr, error) {
+	sa, err := syscall.Getsockname(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	if sockaddrPort(sa) == 0 {
+		switch sa.(type) {
+		case *syscall.SockaddrInet4:
+			err = syscall.Bind(int(fd), &syscall.SockaddrInet4{})
+		case *syscall.SockaddrInet6:
+			err = syscall.Bind(int(fd), &syscall.SockaddrInet6{})
+		default:
+			return nil, syscall.EAFNOSUPPORT
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sa, err = syscall.Getsockname(int(fd)); err != nil {
+			return nil, err
+		}
+	}
+
+	var ip net.IP
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		ip = net.IP(append([]byte{}, a.Addr[:]...))
+	case *syscall.SockaddrInet6:
+		ip = net.IP(append([]byte{}, a.Addr[:]...))
+	}
+	port := sockaddrPort(sa)
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func sockaddrPort(sa syscall.Sockaddr) int {
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return a.Port
+	case *syscall.SockaddrInet6:
+		return a.Port
+	}
+	return 0
+}
+
+// bindLocal binds socket fd to ip, on an ephemeral port.
+func bindLocal(fd uintptr, ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+		return syscall.Bind(int(fd), sa)
+	}
+	sa := &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], ip.To16())
+	return syscall.Bind(int(fd), sa)
+}
+
+// setNoDelay turns off Nagle's algorithm on tcp socket fd.
+func setNoDelay(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+}
+
+// setMSS caps the mss of tcp socket fd at mss.
+func setMSS(fd uintptr, mss int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows
+// +build windows
+
+package protect
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func localAddr(network string, fd uintptr) (net.Addr, error) {
+	return nil, errors.New("local addr unsupported on windows")
+}
+
+func bindLocal(fd uintptr, ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+		return syscall.Bind(syscall.Handle(fd), sa)
+	}
+	sa := &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], ip.To16())
+	return syscall.Bind(syscall.Handle(fd), sa)
+}
+
+func setNoDelay(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+}
+
+// setMSS is a no-op; windows has no TCP_MAXSEG to set.
+func setMSS(fd uintptr, mss int) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// loopbackAddr returns addr, with localhost and names under it (RFC 6761,
+// section 6.3) replaced by the loopback ip of network's family, if its
+// host is on loopback; or "" if it isn't.
+func loopbackAddr(network, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return addr
+		}
+		return ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host != "localhost" && !strings.HasSuffix(host, ".localhost") {
+		return ""
+	}
+	if strings.HasSuffix(network, "6") {
+		return net.JoinHostPort(net.IPv6loopback.String(), port)
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// dialLoopback dials addr, on loopback, with neither d's Control, as such
+// conns never leave the device and need no protection, nor its Resolver.
+func dialLoopback(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	local := &net.Dialer{Timeout: d.Timeout, Deadline: d.Deadline, KeepAlive: d.KeepAlive}
+	return local.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,72 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDialLoopback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var lookups int32
+	p := &fakeProtector{}
+	d := MakeDialer(p)
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			atomic.AddInt32(&lookups, 1)
+			return nil, errors.New("looked up")
+		},
+	}
+	for _, host := range []string{"127.0.0.1", "localhost", "LocalHost.", "app.localhost"} {
+		c, err := DialContext(context.Background(), d, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		c.Close()
+	}
+	if len(p.fds) != 0 {
+		t.Errorf("%d loopback sockets protected", len(p.fds))
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Errorf("%d lookups for localhost", n)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for _, tc := range []struct {
+		network, addr, want string
+	}{
+		{"tcp", "127.0.0.1:80", "127.0.0.1:80"},
+		{"tcp", "127.1.2.3:80", "127.1.2.3:80"},
+		{"udp", "[::1]:53", "[::1]:53"},
+		{"tcp", "localhost:80", "127.0.0.1:80"},
+		{"tcp4", "a.localhost.:80", "127.0.0.1:80"},
+		{"tcp6", "localhost:80", "[::1]:80"},
+		{"tcp", "192.0.2.1:80", ""},
+		{"tcp", "localhost.example:80", ""},
+		{"tcp", "notlocalhost:80", ""},
+		{"tcp", "localhost", ""},
+	} {
+		if got := loopbackAddr(tc.network, tc.addr); got != tc.want {
+			t.Errorf("%s %s: got %q, want %q", tc.network, tc.addr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// migrating holds the conns of ListenMigratingUDP that are open.
+var migrating struct {
+	sync.Mutex
+	conns map[*migratingConn]struct{}
+}
+
+// ListenMigratingUDP returns an unconnected udp socket, protected by p,
+// for quic transports, which is replaced by a new protected socket on
+// OnNetworkChanged. As the socket's address changes, quic connections over
+// it migrate, as if through a nat rebinding, instead of timing out on the
+// old network. Reads blocked on the old socket go on on the new one.
+func ListenMigratingUDP(p Protector) (net.PacketConn, error) {
+	lc := MakeListenConfig(p)
+	pc, err := lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	c := &migratingConn{lc: lc, pc: pc}
+	migrating.Lock()
+	if migrating.conns == nil {
+		migrating.conns = make(map[*migratingConn]struct{})
+	}
+	migrating.conns[c] = struct{}{}
+	migrating.Unlock()
+	return c, nil
+}
+
+// OnNetworkChanged replaces the sockets of ListenMigratingUDP, protected
+// anew, so they are of the network now underlying the tunnel, resets the
+// conns of ProtectedTransports and has EgressIP observe its ip anew. Call
+// it once the device switches networks, as between wifi and cellular.
+func OnNetworkChanged() {
+	forgetEgressIP()
+	invalidateTransports()
+	migrating.Lock()
+	conns := make([]*migratingConn, 0, len(migrating.conns))
+	for c := range migrating.conns {
+		conns = append(conns, c)
+	}
+	migrating.Unlock()
+	for _, c := range conns {
+		if err := c.rebind(); err != nil {
+			log.Warnf("udp socket %s not rebound: %v", c.LocalAddr(), err)
+		}
+	}
+}
+
+// migratingConn is a net.PacketConn over a socket that may be replaced.
+type migratingConn struct {
+	lc *net.ListenConfig
+
+	mu     sync.RWMutex
+	pc     net.PacketConn // the current socket
+	closed bool
+	rd, wd time.Time // deadlines, set on each new socket too
+}
+
+func (c *migratingConn) current() net.PacketConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pc
+}
+
+// replaced returns true if pc was replaced by a socket still open.
+func (c *migratingConn) replaced(pc net.PacketConn) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.closed && c.pc != pc
+}
+
+// rebind replaces the socket with a new protected one, and closes the old.
+func (c *migratingConn) rebind() error {
+	pc, err := c.lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return pc.Close()
+	}
+	old := c.pc
+	pc.SetReadDeadline(c.rd)
+	pc.SetWriteDeadline(c.wd)
+	c.pc = pc
+	c.mu.Unlock()
+	log.Infof("udp socket %s rebound to %s", old.LocalAddr(), pc.LocalAddr())
+	// unblocks reads on old, which go on on pc
+	return old.Close()
+}
+
+func (c *migratingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pc := c.current()
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil && c.replaced(pc) {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c *migratingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for {
+		pc := c.current()
+		n, err := pc.WriteTo(b, addr)
+		if err != nil && c.replaced(pc) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *migratingConn) Close() error {
+	migrating.Lock()
+	delete(migrating.conns, c)
+	migrating.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.pc.Close()
+}
+
+func (c *migratingConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *migratingConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd, c.wd = t, t
+	return c.pc.SetDeadline(t)
+}
+
+func (c *migratingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd = t
+	return c.pc.SetReadDeadline(t)
+}
+
+func (c *migratingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	return c.pc.SetWriteDeadline(t)
+}
@@ -0,0 +1,80 @@
+package protect
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMigratingUDP(t *testing.T) {
+	// echoes datagrams back to where they came from
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, from, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			server.WriteTo(b[:n], from)
+		}
+	}()
+
+	p := &fakeProtector{}
+	c, err := ListenMigratingUDP(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	before := c.LocalAddr().String()
+	protected := len(p.fds)
+
+	// a read blocked across the change gets the echo on the new socket
+	got := make(chan string, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(b[:n])
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	OnNetworkChanged()
+	if after := c.LocalAddr().String(); after == before {
+		t.Errorf("socket %s not replaced", after)
+	}
+	p.mu.Lock()
+	if n := len(p.fds); n != protected+1 {
+		t.Errorf("%d sockets protected on rebind, want 1", n-protected)
+	}
+	p.mu.Unlock()
+
+	if _, err := c.WriteTo([]byte("ping"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-got:
+		if s != "ping" {
+			t.Errorf("read %q, want ping", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo after the network changed")
+	}
+
+	// closed conns aren't rebound
+	c.Close()
+	OnNetworkChanged()
+	migrating.Lock()
+	n := len(migrating.conns)
+	migrating.Unlock()
+	if n != 0 {
+		t.Errorf("%d closed conns still tracked", n)
+	}
+}
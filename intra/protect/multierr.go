@@ -0,0 +1,80 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// multiDialError is the failure of each of the targets tried in turn, as
+// when all the addresses of a host or all dns transports fail. errors.Is
+// and errors.As see the error of each; Unwrap returns the first.
+type multiDialError struct {
+	targets []string
+	errs    []error
+}
+
+// add records that the dial to target failed with err.
+func (e *multiDialError) add(target string, err error) {
+	e.targets = append(e.targets, target)
+	e.errs = append(e.errs, err)
+}
+
+// err returns nil if nothing failed, the error of the sole target tried,
+// or e if more than one was.
+func (e *multiDialError) err() error {
+	switch len(e.errs) {
+	case 0:
+		return nil
+	case 1:
+		return e.errs[0]
+	}
+	return e
+}
+
+func (e *multiDialError) Error() string {
+	var b strings.Builder
+	b.WriteString("all ")
+	b.WriteString(strconv.Itoa(len(e.errs)))
+	b.WriteString(" failed: ")
+	for i, err := range e.errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(e.targets[i])
+		b.WriteString(": ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (e *multiDialError) Unwrap() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return e.errs[0]
+}
+
+func (e *multiDialError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *multiDialError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMultiDialError(t *testing.T) {
+	errA := errors.New("a failed")
+	errB := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	errC := context.DeadlineExceeded
+	fails := map[string]error{"a:1": errA, "b:1": errB, "c:1": errC}
+
+	_, err := dialStaggered(context.Background(), []string{"a:1", "b:1", "c:1"}, -1, func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, fails[addr]
+	})
+	var multi *multiDialError
+	if !errors.As(err, &multi) {
+		t.Fatalf("got %v, want a multiDialError", err)
+	}
+	if len(multi.errs) != 3 {
+		t.Errorf("%d errors, want 3", len(multi.errs))
+	}
+	for addr, want := range fails {
+		if !errors.Is(err, want) {
+			t.Errorf("%s: %v not in %v", addr, want, err)
+		}
+		if !strings.Contains(err.Error(), addr+": "+want.Error()) {
+			t.Errorf("%s not in %q", addr, err)
+		}
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr != errB {
+		t.Errorf("net.OpError not found in %v", err)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("ECONNREFUSED not found in %v", err)
+	}
+	if errors.Is(err, errNoTransport) {
+		t.Error("unrelated error found")
+	}
+	if errors.Unwrap(err) != errA {
+		t.Errorf("unwrapped %v, want the first error", errors.Unwrap(err))
+	}
+
+	// a sole failure is returned as is
+	_, err = dialStaggered(context.Background(), []string{"a:1"}, -1, func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errA
+	})
+	if err != errA {
+		t.Errorf("got %v, want %v", err, errA)
+	}
+}
+
+func TestExchangeAnyErrors(t *testing.T) {
+	ts := []DNSTransport{
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: deadTCPPort(t), timeout: time.Second},
+		{Scheme: DNSSchemeDoT, Host: "127.0.0.1", Port: deadTCPPort(t), timeout: time.Second},
+	}
+	q := makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)
+	_, err := exchangeAny(context.Background(), MakeDialer(&fakeProtector{}), ts, q)
+	var multi *multiDialError
+	if !errors.As(err, &multi) || len(multi.errs) != 2 {
+		t.Fatalf("got %v, want the errors of both transports", err)
+	}
+	for _, tr := range ts {
+		if !strings.Contains(err.Error(), tr.String()) {
+			t.Errorf("%s not in %q", tr, err)
+		}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("ECONNREFUSED not found in %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"sync/atomic"
+)
+
+// selectionObserver holds the resolverObserver set, nil if none.
+var selectionObserver atomic.Value
+
+type resolverObserver func(query string, candidates []string, chosen string)
+
+// SetResolverSelectionObserver sets f to be called each time a resolver
+// is picked to send a query to, with the name queried, the resolvers it
+// was picked from (ips of the system's resolvers, or DNSTransports) and
+// the one picked. f is called in the path of queries and must not block.
+// A nil f removes the observer.
+func SetResolverSelectionObserver(f func(query string, candidates []string, chosen string)) {
+	selectionObserver.Store(resolverObserver(f))
+}
+
+func observingSelection() bool {
+	o, _ := selectionObserver.Load().(resolverObserver)
+	return o != nil
+}
+
+func init() {
+	// to be observed
+	needDNSConn(func(*dialConfig) bool { return observingSelection() })
+}
+
+// observeSelection reports chosen, picked from candidates for q, which may
+// be nil if the query isn't known at the time, to the observer, if any.
+func observeSelection(q []byte, candidates func() []string, chosen string) {
+	o, _ := selectionObserver.Load().(resolverObserver)
+	if o == nil {
+		return
+	}
+	var name string
+	if k, ok := questionOf(q); ok {
+		name = k.name
+	}
+	o(name, candidates(), chosen)
+}
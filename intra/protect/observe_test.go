@@ -0,0 +1,88 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type selection struct {
+	query      string
+	candidates []string
+	chosen     string
+}
+
+// observeSelections records selections until the returned func is called.
+func observeSelections() (*[]selection, func()) {
+	var mu sync.Mutex
+	var seen []selection
+	SetResolverSelectionObserver(func(query string, candidates []string, chosen string) {
+		mu.Lock()
+		seen = append(seen, selection{query, candidates, chosen})
+		mu.Unlock()
+	})
+	return &seen, func() { SetResolverSelectionObserver(nil) }
+}
+
+func TestObserveSystemResolverSelection(t *testing.T) {
+	l, port := startTCPDNS(t, fooIP)
+	defer l.Close()
+	seen, stop := observeSelections()
+	defer stop()
+
+	d := MakeDialer(&resolversProtector{csv: "127.0.0.1,::1"})
+	c, err := d.Resolver.Dial(context.Background(), "tcp", net.JoinHostPort("192.0.2.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := streamExchange(c, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []selection{{"foo.test.", []string{"127.0.0.1", "::1"}, "127.0.0.1"}}
+	if !reflect.DeepEqual(*seen, want) {
+		t.Errorf("observed %v, want %v", *seen, want)
+	}
+}
+
+func TestObserveTransportSelection(t *testing.T) {
+	l, port := startTCPDNS(t, fooIP)
+	defer l.Close()
+	dead := DNSTransport{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: deadTCPPort(t)}
+	live := DNSTransport{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}
+	if err := SetDNSTransports([]DNSTransport{dead, live}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	seen, stop := observeSelections()
+	defer stop()
+
+	q := makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)
+	if _, err := exchangeAny(context.Background(), MakeDialer(&fakeProtector{}), dnsTransports(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := []string{dead.String(), live.String()}
+	want := []selection{
+		{"foo.test.", candidates, dead.String()},
+		{"foo.test.", candidates, live.String()},
+	}
+	if !reflect.DeepEqual(*seen, want) {
+		t.Errorf("observed %v, want %v", *seen, want)
+	}
+}
+
+func TestNoSelectionObserver(t *testing.T) {
+	SetResolverSelectionObserver(nil)
+	if observingSelection() {
+		t.Fatal("observing without an observer")
+	}
+	// must not panic
+	observeSelection(nil, func() []string { return nil }, "127.0.0.1")
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNoOnionProxy is returned for dials to .onion targets without an
+// onion proxy, see SetOnionProxy.
+var ErrNoOnionProxy = errors.New("no onion proxy for .onion targets")
+
+// onionProxy holds the ip:port of the socks5 proxy .onion targets are
+// dialed through, or "" if there is none.
+var onionProxy atomic.Value
+
+// SetOnionProxy has DialContext, and the dialers built on it, dial .onion
+// targets (RFC 7686) through the socks5 proxy at socksAddr, an ip:port,
+// such as a local tor's; the proxy is sent the hostname as-is, for it to
+// resolve, and so it is never looked up locally. An empty socksAddr
+// removes the proxy, after which such dials fail with ErrNoOnionProxy,
+// as they do by default.
+func SetOnionProxy(socksAddr string) {
+	onionProxy.Store(socksAddr)
+}
+
+// isOnion returns true if the host of addr is under .onion.
+func isOnion(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.HasSuffix(host, ".onion")
+}
+
+// dialOnion asks the onion proxy, dialed with d, to connect to addr.
+func dialOnion(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	proxy, _ := onionProxy.Load().(string)
+	if len(proxy) == 0 {
+		return nil, fmt.Errorf("%s: %w", addr, ErrNoOnionProxy)
+	}
+	// the proxy itself is dialed as any literal ip is, without d's Resolver
+	direct := *d
+	direct.Resolver = nil
+	return socks5Over("tcp", proxy, &direct).DialContext(ctx, network, addr)
+}
@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package protect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+const onionHost = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion"
+
+// noLookupDialer returns a dialer whose Resolver counts its lookups in
+// lookups, and fails them.
+func noLookupDialer(lookups *int32) *net.Dialer {
+	d := MakeDialer(&fakeProtector{})
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			atomic.AddInt32(lookups, 1)
+			return nil, errors.New("looked up")
+		},
+	}
+	return d
+}
+
+// startOnionProxy serves socks5 on tcp, relaying all conns to echo and
+// sending the targets asked for on targets.
+func startOnionProxy(t *testing.T, echo string, targets chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveProxy(l, func(c net.Conn, r *bufio.Reader) (string, error) {
+		target, err := socks5Handshake(c, r)
+		if err != nil {
+			return "", err
+		}
+		targets <- target
+		return echo, nil
+	})
+	return l.Addr().String()
+}
+
+func TestOnionProxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	targets := make(chan string, 2)
+	SetOnionProxy(startOnionProxy(t, echo.Addr().String(), targets))
+	defer SetOnionProxy("")
+
+	var lookups int32
+	d := noLookupDialer(&lookups)
+	for _, addr := range []string{onionHost + ":80", "Sub." + onionHost[:len(onionHost)-5] + "ONION.:443"} {
+		c, err := DialContext(context.Background(), d, "tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if got := <-targets; got != addr {
+			t.Errorf("proxy asked for %s, want %s", got, addr)
+		}
+		if _, err := c.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hi" {
+			t.Errorf("%s: echoed %q, %v", addr, b, err)
+		}
+		c.Close()
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Errorf("%d lookups for .onion targets", n)
+	}
+}
+
+func TestNoOnionProxy(t *testing.T) {
+	SetOnionProxy("")
+	var lookups int32
+	d := noLookupDialer(&lookups)
+	_, err := DialContext(context.Background(), d, "tcp", onionHost+":80")
+	if !errors.Is(err, ErrNoOnionProxy) {
+		t.Errorf("got %v, want %v", err, ErrNoOnionProxy)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Errorf("%d lookups for a .onion target", n)
+	}
+
+	// other hostnames are resolved as ever
+	DialContext(context.Background(), d, "tcp", "onion.example:80")
+	if n := atomic.LoadInt32(&lookups); n == 0 {
+		t.Error("onion.example not looked up")
+	}
+}
+
+func TestIsOnion(t *testing.T) {
+	for addr, want := range map[string]bool{
+		onionHost + ":80":     true,
+		"a.b.onion.:443":      true,
+		"A.ONION:443":         true,
+		"onion:80":            false,
+		"onion.example:80":    false,
+		"notonion:80":         false,
+		"192.0.2.1:80":        false,
+		"[2001:db8::1]:80":    false,
+		onionHost:             false, // no port
+		"x.onion.example:443": false,
+	} {
+		if got := isOnion(addr); got != want {
+			t.Errorf("isOnion(%s): %t, want %t", addr, got, want)
+		}
+	}
+}
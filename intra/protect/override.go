@@ -0,0 +1,38 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+)
+
+// overridePort is the port of override resolvers; 0 is the scheme's
+// default. A var, for tests.
+var overridePort = 0
+
+// WithResolverOverride returns ctx for lookups and dials with it, by the
+// Resolver of protected dialers and DialContext, to query resolvers, over
+// udp on port 53 and tried in order, in place of the configured dns
+// transports, system resolvers and dns routes; for instance, to resolve a
+// proxy's name with a trusted server. Their answers are neither cached nor
+// answered from the cache. Other lookups are left as they are. An empty
+// resolvers returns ctx as is.
+func WithResolverOverride(ctx context.Context, resolvers []net.IP) context.Context {
+	if len(resolvers) == 0 {
+		return ctx
+	}
+	ts := make([]DNSTransport, len(resolvers))
+	for i, ip := range resolvers {
+		ts[i] = DNSTransport{Scheme: DNSSchemeUDP, Host: ip.String(), Port: overridePort}
+	}
+	c := *dialConfigOf(ctx)
+	c.transports = ts
+	c.routes = nil
+	ctx = context.WithValue(ctx, noCache{}, true)
+	return context.WithValue(ctx, dialConfigKey{}, &c)
+}
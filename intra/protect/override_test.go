@@ -0,0 +1,106 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var trustedIP = net.IPv4(10, 0, 0, 9)
+
+// startOverrideDNS has override resolvers answer with trustedIP, until
+// undone.
+func startOverrideDNS(t *testing.T) func() {
+	trusted, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := trusted.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			trusted.WriteTo(answerWith(b[:n], trustedIP), from)
+		}
+	}()
+	overridePort = trusted.LocalAddr().(*net.UDPAddr).Port
+	return func() {
+		overridePort = 0
+		trusted.Close()
+	}
+}
+
+func lookupProxy(ctx context.Context, d *net.Dialer) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return d.Resolver.LookupIP(ctx, "ip4", "proxy.test")
+}
+
+func TestResolverOverride(t *testing.T) {
+	configured, port := startTCPDNS(t, fooIP)
+	defer configured.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	defer startOverrideDNS(t)()
+
+	d := MakeDialer(&fakeProtector{})
+	lookup := func(ctx context.Context) net.IP {
+		ips, err := lookupProxy(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 {
+			t.Fatalf("got %v", ips)
+		}
+		return ips[0]
+	}
+
+	if ip := lookup(context.Background()); !ip.Equal(fooIP) {
+		t.Errorf("before: got %s, want %s", ip, fooIP)
+	}
+	ctx := WithResolverOverride(context.Background(), []net.IP{net.IPv4(127, 0, 0, 1)})
+	if ip := lookup(ctx); !ip.Equal(trustedIP) {
+		t.Errorf("override: got %s, want %s", ip, trustedIP)
+	}
+	if ip := lookup(context.Background()); !ip.Equal(fooIP) {
+		t.Errorf("after: got %s, want %s", ip, fooIP)
+	}
+	if got := WithResolverOverride(context.Background(), nil); got != context.Background() {
+		t.Error("empty override changed ctx")
+	}
+}
+
+func TestResolverOverrideUncached(t *testing.T) {
+	var queries int32
+	configured, port := startNXDNS(t, &queries)
+	defer configured.Close()
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetNegativeCacheTTL(time.Hour)
+	defer SetNegativeCacheTTL(0)
+	defer startOverrideDNS(t)()
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{})
+	override := WithResolverOverride(context.Background(), []net.IP{net.IPv4(127, 0, 0, 1)})
+	for _, d := range []*net.Dialer{MakeDialer(&fakeProtector{}), MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{Resolver: r})} {
+		// the override's answer is neither cached for other lookups
+		if ips, err := lookupProxy(override, d); err != nil || len(ips) != 1 || !ips[0].Equal(trustedIP) {
+			t.Errorf("override: got %v, %v", ips, err)
+		}
+		if _, err := lookupProxy(context.Background(), d); err == nil {
+			t.Error("lookup answered with the override's answer")
+		}
+		// nor are theirs for the override
+		if ips, err := lookupProxy(override, d); err != nil || len(ips) != 1 || !ips[0].Equal(trustedIP) {
+			t.Errorf("override after nxdomain: got %v, %v", ips, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsPadding is the code of the EDNS(0) padding option, RFC 7830.
+const ednsPadding = 12
+
+// padBlock is the size queries over encrypted transports are padded to a
+// multiple of, or 0 for no padding.
+var padBlock int32
+
+// SetDNSPadding pads queries sent over DoT and DoH to a multiple of
+// blockSize bytes with the EDNS(0) padding option (RFC 7830), to hide
+// their length from observers; RFC 8467 recommends a blockSize of 128.
+// A blockSize of 0, the default, turns off padding. Queries that are
+// already padded are sent as they are.
+func SetDNSPadding(blockSize int) {
+	if blockSize < 0 {
+		blockSize = 0
+	}
+	if blockSize > maxDNSMessageSize {
+		blockSize = maxDNSMessageSize
+	}
+	atomic.StoreInt32(&padBlock, int32(blockSize))
+}
+
+// padded returns q padded per SetDNSPadding, or q if it can't be.
+func padded(q []byte) []byte {
+	block := int(atomic.LoadInt32(&padBlock))
+	if block <= 0 {
+		return q
+	}
+	p, err := pad(q, block)
+	if err != nil {
+		log.Warnf("dns: query not padded: %v", err)
+		return q
+	}
+	return p
+}
+
+// pad adds a padding option to the OPT record of q, adding one if q has
+// none, for q to be a multiple of block bytes long.
+func pad(q []byte, block int) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	opt, err := optOf(&msg)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range opt.Options {
+		if o.Code == ednsPadding {
+			return q, nil
+		}
+	}
+	// the option's own header counts towards the length
+	opt.Options = append(opt.Options, dnsmessage.Option{Code: ednsPadding})
+	unpadded, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	n := (block - len(unpadded)%block) % block
+	opt.Options[len(opt.Options)-1].Data = make([]byte, n)
+	return msg.Pack()
+}
+
+// optOf returns the OPT record of msg, adding one if msg has none.
+func optOf(msg *dnsmessage.Message) (*dnsmessage.OPTResource, error) {
+	for _, r := range msg.Additionals {
+		if o, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			return o, nil
+		}
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(queryPayload, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	opt := &dnsmessage.OPTResource{}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: h, Body: opt})
+	return opt, nil
+}
@@ -0,0 +1,144 @@
+package protect
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// paddingOf returns the length of the padding option of q, or -1.
+func paddingOf(t *testing.T, q []byte) int {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range msg.Additionals {
+		if opt, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			for _, o := range opt.Options {
+				if o.Code == ednsPadding {
+					return len(o.Data)
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func TestPad(t *testing.T) {
+	withOPT := func(t *testing.T, name string) []byte {
+		var h dnsmessage.ResourceHeader
+		h.SetEDNS0(queryPayload, dnsmessage.RCodeSuccess, false)
+		msg := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			}},
+			Additionals: []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}},
+		}
+		q, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	long := "a-rather-long-label-to-need-more-than-one-block.example.com."
+	for _, block := range []int{16, 128, 468} {
+		for _, q := range [][]byte{
+			makeQuery(t, 1, "foo.test.", dnsmessage.TypeA),
+			makeQuery(t, 1, long, dnsmessage.TypeAAAA),
+			withOPT(t, "foo.test."),
+			withOPT(t, long),
+		} {
+			p, err := pad(q, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p)%block != 0 {
+				t.Errorf("block %d: padded %d bytes to %d", block, len(q), len(p))
+			}
+			if paddingOf(t, p) < 0 {
+				t.Errorf("block %d: no padding option", block)
+			}
+			if err := validate(p, answer(p)); err != nil {
+				t.Errorf("block %d: padded query not answered: %v", block, err)
+			}
+		}
+	}
+}
+
+func TestPadOnce(t *testing.T) {
+	q, err := pad(makeQuery(t, 1, "foo.test.", dnsmessage.TypeA), 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// already padded, though not to 468
+	p, err := pad(q, 468)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != len(q) {
+		t.Errorf("padded twice, to %d from %d", len(p), len(q))
+	}
+}
+
+func TestDNSPaddingDoH(t *testing.T) {
+	var mu sync.Mutex
+	var got [][]byte
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, q)
+		mu.Unlock()
+		w.Write(answer(q))
+	}))
+	defer s.Close()
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(s.Certificate())
+	defer func() { rootCAs = nil }()
+
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeDoH, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetDNSPadding(128)
+	defer SetDNSPadding(0)
+
+	d := MakeDialer(&fakeProtector{})
+	ips, err := d.Resolver.LookupIP(context.Background(), "ip4", "foo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(fooIP) {
+		t.Errorf("got %v, want %s", ips, fooIP)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) == 0 {
+		t.Fatal("no queries")
+	}
+	for _, q := range got {
+		if len(q)%128 != 0 || paddingOf(t, q) < 0 {
+			t.Errorf("query of %d bytes not padded", len(q))
+		}
+	}
+}
+
+func TestDNSPaddingOff(t *testing.T) {
+	SetDNSPadding(-1)
+	q := makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)
+	if p := padded(q); len(p) != len(q) {
+		t.Errorf("padded to %d with padding off", len(p))
+	}
+}
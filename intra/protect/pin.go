@@ -0,0 +1,56 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+var pins struct {
+	sync.RWMutex
+	host map[string]net.IP
+}
+
+// PinHostIP has DialContext connect to ip, still protected, whenever it
+// dials host, which is then never resolved; the dial's hostname is kept
+// as is for everything above the connect, such as the SNI of DialTLS. A
+// nil ip unpins host.
+func PinHostIP(host string, ip net.IP) {
+	host = pinKey(host)
+	pins.Lock()
+	defer pins.Unlock()
+	if ip == nil {
+		delete(pins.host, host)
+		return
+	}
+	if pins.host == nil {
+		pins.host = make(map[string]net.IP)
+	}
+	pins.host[host] = append(net.IP{}, ip...)
+}
+
+// pinned returns addr with its host replaced by the ip it is pinned to,
+// if any, or addr as is.
+func pinned(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	pins.RLock()
+	ip, ok := pins.host[pinKey(host)]
+	pins.RUnlock()
+	if !ok {
+		return addr
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func pinKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
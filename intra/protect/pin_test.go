@@ -0,0 +1,63 @@
+package protect
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPinHostIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	PinHostIP("Pinned.Test.", net.IPv4(127, 0, 0, 1))
+	defer PinHostIP("pinned.test", nil)
+
+	// the resolver knows nothing of pinned.test
+	d := MakeDialer(&resolversProtector{csv: "127.0.0.1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialContext(ctx, d, "tcp", net.JoinHostPort("pinned.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("dialed %s, want the pinned ip", got)
+	}
+
+	PinHostIP("pinned.test", nil)
+	if c, err := DialContext(ctx, d, "tcp", net.JoinHostPort("pinned.test", port)); err == nil {
+		c.Close()
+		t.Error("unpinned host dialed without resolving")
+	}
+}
+
+func TestPinHostIPKeepsServerName(t *testing.T) {
+	cert := selfSigned(t, "foo.test")
+	defer func() { rootCAs = nil }()
+	l := startTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	PinHostIP("foo.test", net.IPv4(127, 0, 0, 1))
+	defer PinHostIP("foo.test", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialTLS(ctx, MakeDialer(&fakeProtector{}), "tcp", net.JoinHostPort("foo.test", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !l.sawName("foo.test") {
+		t.Error("sni is not the pinned host's name")
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package protect
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketPriority(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		network, addr string
+	}{
+		{"tcp", l.Addr().String()},
+		{"udp", "127.0.0.1:9"},
+	} {
+		for _, prio := range []int{0, 5} {
+			var got int
+			var gerr error
+			read := func(network, address string, fd uintptr) error {
+				got, gerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PRIORITY)
+				return nil
+			}
+			d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+				ControlHooks:   []func(string, string, uintptr) error{read},
+				SocketPriority: prio,
+			})
+			conn, err := d.Dial(tc.network, tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if gerr != nil {
+				t.Fatal(gerr)
+			}
+			if got != prio {
+				t.Errorf("%s: SocketPriority %d, SO_PRIORITY is %d", tc.network, prio, got)
+			}
+		}
+	}
+}
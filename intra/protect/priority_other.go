@@ -0,0 +1,15 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package protect
+
+// setPriority is a no-op; only linux has socket priorities.
+func setPriority(fd uintptr, prio int) error {
+	return nil
+}
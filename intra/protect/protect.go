@@ -29,7 +29,9 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
@@ -43,14 +45,122 @@ type Flow interface {
 	// depending on the protocol. Note: IPv4 and IPv6 have a very different string
 	// representations: https://stackoverflow.com/a/48519490
 	// uid is -1 in case owner-uid of the connection couldn't be determined
+	// The returned net-id may carry #key=value annotations, see ParseDecision.
+	// Flows may decide with a Decision instead, see StructuredFlow.
 	On(protocol int32, uid int, source string, target string) string
 }
 
 const (
 	NetIdBlock  = "block"
 	NetIdActive = "allow"
+	// NetIdBaseUnprotected sends flows out the underlying network without
+	// protecting their sockets. This is dangerous: unless the VPN excludes
+	// the destination, such flows loop back into the tunnel. Flows with
+	// this net-id are blocked unless SetAllowUnprotected(true).
+	NetIdBaseUnprotected = "base-unprotected"
 )
 
+// allowUnprotected is 1 when NetIdBaseUnprotected flows may be dialed.
+var allowUnprotected int32
+
+// SetAllowUnprotected gates flows decided to be NetIdBaseUnprotected;
+// they are blocked until allowed.
+func SetAllowUnprotected(allow bool) {
+	var v int32
+	if allow {
+		v = 1
+	}
+	atomic.StoreInt32(&allowUnprotected, v)
+}
+
+// UnprotectedAllowed returns true if NetIdBaseUnprotected flows may be dialed.
+func UnprotectedAllowed() bool {
+	return atomic.LoadInt32(&allowUnprotected) == 1
+}
+
+// requireLiteral is 1 when DialContext refuses to resolve hostnames.
+var requireLiteral int32
+
+// SetRequireLiteralTargets has DialContext, and the dialers built on it,
+// fail dials to hostnames, other than those pinned, with ErrDNSDisabled,
+// instead of resolving them, for no dns query to leave the dial path;
+// targets must then be resolved by the caller beforehand.
+func SetRequireLiteralTargets(require bool) {
+	var v int32
+	if require {
+		v = 1
+	}
+	atomic.StoreInt32(&requireLiteral, v)
+}
+
+var (
+	// ErrNoRawConn is returned for conns that do not expose their socket.
+	ErrNoRawConn = errors.New("conn does not expose a raw socket")
+	// ErrNotProtected is returned when Protector.Protect fails.
+	ErrNotProtected = errors.New("socket not protected")
+	// ErrNoResolvers is returned when there are neither system nor
+	// bootstrap resolvers to send dns queries to.
+	ErrNoResolvers = errors.New("no resolvers")
+	// ErrLocalAddrFamily is returned when dialing an address of a family
+	// other than that of MakeDialerOpts.LocalAddr.
+	ErrLocalAddrFamily = errors.New("local and remote addresses of different families")
+	// ErrNoIPv6 is returned when dialing ipv6 addresses without ipv6
+	// connectivity, instead of waiting for the dial to time out.
+	ErrNoIPv6 = errors.New("no ipv6 connectivity")
+	// ErrDNSDisabled is returned when dialing a hostname while literal
+	// targets are required, see SetRequireLiteralTargets.
+	ErrDNSDisabled = errors.New("dns disabled; target must be an ip address")
+)
+
+// SetBootstrapResolvers sets the resolvers, a csv of ip addresses, that
+// are queried when the system has none; for instance, in the middle of
+// switching networks. An empty csv removes them.
+func SetBootstrapResolvers(csv string) error {
+	ips, err := bootstrapResolvers(csv)
+	if err != nil {
+		return err
+	}
+	updateDialConfig(func(c *dialConfig) {
+		c.bootstrap = ips
+	})
+	return nil
+}
+
+func bootstrapResolvers(csv string) ([]string, error) {
+	ips := splitResolvers(csv)
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("bootstrap resolver %s: %w", ip, errBadHost)
+		}
+	}
+	return ips, nil
+}
+
+// splitResolvers splits csv into its non-blank, trimmed elements.
+func splitResolvers(csv string) []string {
+	var ips []string
+	for _, ip := range strings.Split(csv, ",") {
+		if ip = strings.TrimSpace(ip); len(ip) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// resolvers returns the system's resolvers from p, or else the bootstrap
+// ones in the config of ctx.
+func resolvers(ctx context.Context, p Protector) ([]string, error) {
+	if ips := splitResolvers(p.GetResolvers()); len(ips) > 0 {
+		return ips, nil
+	}
+	ips := dialConfigOf(ctx).bootstrap
+	if len(ips) == 0 {
+		return nil, ErrNoResolvers
+	}
+	log.Debugf("no system resolvers, using bootstrap %v", ips)
+	return ips, nil
+}
+
 // Protector provides the ability to bypass a VPN on Android, pre-Lollipop.
 type Protector interface {
 	// Protect a socket, i.e. exclude it from the VPN.
@@ -66,27 +176,34 @@ type Protector interface {
 	GetResolvers() string
 }
 
+// makeControl returns a Control that protects sockets with p, and fails
+// those it can't protect per the protect failure policy.
 func makeControl(p Protector) func(string, string, syscall.RawConn) error {
 	return func(network, address string, c syscall.RawConn) error {
-		return c.Control(func(fd uintptr) {
-			if !p.Protect(int32(fd)) {
-				// TODO: Record and report these errors.
-				log.Errorf("Failed to protect a %s socket", network)
-			}
+		protected := true
+		err := c.Control(func(fd uintptr) {
+			protected = protectFD(p, fd)
 		})
+		if err != nil {
+			return err
+		}
+		if !protected {
+			log.Errorf("Failed to protect a %s socket to %s", network, address)
+			return fmt.Errorf("%w: %s %s", ErrNotProtected, network, address)
+		}
+		return nil
 	}
 }
 
 // Returns the first IP address that is of the desired family.
 func scan(ips []string, wantV4 bool) string {
 	for _, ip := range ips {
-		parsed := net.ParseIP(ip)
-		if parsed == nil {
+		family := ipFamily(ip)
+		if family == 0 {
 			// `ip` failed to parse.  Skip it.
 			continue
 		}
-		isV4 := parsed.To4() != nil
-		if isV4 == wantV4 {
+		if (family == 4) == wantV4 {
 			return ip
 		}
 	}
@@ -96,20 +213,26 @@ func scan(ips []string, wantV4 bool) string {
 // Given a slice of IP addresses, and a transport address, return a transport
 // address with the IP replaced by the first IP of the same family in `ips`, or
 // by the first address of a different family if there are none of the same.
+// With latency-aware selection, the fastest IP of the family replaces it.
 func replaceIP(addr string, ips []string) (string, error) {
 	if len(ips) == 0 {
-		return "", errors.New("no resolvers")
+		return "", ErrNoResolvers
 	}
 	orighost, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return "", err
 	}
-	origip := net.ParseIP(orighost)
-	if origip == nil {
+	family := ipFamily(orighost)
+	if family == 0 {
 		return "", fmt.Errorf("cannot parse resolver-ip: %s", orighost)
 	}
-	isV4 := origip.To4() != nil
-	newIP := scan(ips, isV4)
+	isV4 := family == 4
+	var newIP string
+	if latencyAwareSelection() {
+		newIP = fastest(ips, isV4)
+	} else {
+		newIP = scan(ips, isV4)
+	}
 	if newIP == "" {
 		// There are no IPs of the desired address family.  Use a different family.
 		newIP = ips[0]
@@ -117,22 +240,314 @@ func replaceIP(addr string, ips []string) (string, error) {
 	return net.JoinHostPort(newIP, port), nil
 }
 
+// unreachable returns true if err is the network or the host refusing
+// or failing to route a dial, rather than, say, a timeout.
+func unreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// otherFamily returns addr with its ip replaced by the first of ips that
+// is of the other ip family, or "" if there is none.
+func otherFamily(addr string, ips []string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	alt := scan(ips, ip.To4() == nil)
+	if len(alt) == 0 {
+		return ""
+	}
+	return net.JoinHostPort(alt, port)
+}
+
+// MakeDialerOpts are the options for MakeDialerWithOpts.
+type MakeDialerOpts struct {
+	// ControlHooks run, in order, on each socket after it is protected
+	// and before it connects; for instance, to set socket options. An
+	// error from a hook aborts the dial, and the remaining hooks are
+	// not run.
+	ControlHooks []func(network, address string, fd uintptr) error
+	// OnLocalAddr, if set, is called with the local address of each socket
+	// after ControlHooks run. As dialed sockets aren't bound until they
+	// connect, unbound sockets are first bound to an ephemeral port on the
+	// wildcard address; the local ip is then unspecified. Sockets that fail
+	// to bind are dialed anyway, but not reported.
+	OnLocalAddr func(network string, laddr net.Addr)
+	// ConnectionAttemptDelay is how long to wait on a connection attempt
+	// before racing it with one to the next address of a name, as in
+	// happy eyeballs (RFC 8305, section 5). If zero, it is 250ms, as
+	// recommended; if negative, addresses are tried one after another.
+	ConnectionAttemptDelay time.Duration
+	// LocalAddr, if set, is the source ip of dialed sockets, on an ephemeral
+	// port. Dials to addresses of the other family fail with
+	// ErrLocalAddrFamily. Sockets are bound after ControlHooks run.
+	LocalAddr net.IP
+	// NoDelay sets TCP_NODELAY on tcp sockets before ControlHooks run, to
+	// turn off Nagle's algorithm for latency-sensitive flows from the
+	// start, whatever wraps the conns dialed.
+	NoDelay bool
+	// MSSClamp, if positive, caps the mss of tcp sockets (TCP_MAXSEG)
+	// before ControlHooks run, so that segments fit paths of reduced mtu,
+	// as through tunnels, without fragmenting; see MSSForMTU. It is not
+	// supported on windows, where it is ignored.
+	MSSClamp int
+	// CongestionControl, if set, is the congestion control algorithm of
+	// tcp sockets (TCP_CONGESTION), such as "bbr" or "cubic", set before
+	// ControlHooks run. Sockets are dialed anyway, with the os's default,
+	// if the kernel lacks the algorithm. Only supported on linux and
+	// android; ignored elsewhere.
+	CongestionControl string
+	// SocketPriority, if positive, is the priority (SO_PRIORITY) of tcp
+	// and udp sockets, set before ControlHooks run, by which the local
+	// qdiscs queue their packets; unlike dscp, it isn't seen on the wire.
+	// Priorities beyond 6 need CAP_NET_ADMIN; sockets are dialed anyway,
+	// with the default priority, if they can't be set. Only supported on
+	// linux and android; ignored elsewhere.
+	SocketPriority int
+	// Resolve, if set, resolves hostnames in place of the dialer's own
+	// Resolver, such as with the app's dns engine; SetDNSTransports and
+	// the system's resolvers are then not used, nor the negative cache.
+	// The addresses it returns are sorted and raced as any others. The
+	// dialer's Resolver answers lookups with them, as well; calls for a
+	// host within a second of each other are shared.
+	Resolve ResolveFunc
+	// Resolver, if set and Resolve isn't, resolves hostnames in place of
+	// the dialer's own Resolver, so that dialers passed the same one share
+	// its cache; see NewResolver.
+	Resolver *Resolver
+}
+
+// defaultConnectionAttemptDelay is recommended by RFC 8305, section 8.
+const defaultConnectionAttemptDelay = 250 * time.Millisecond
+
+// noDelayHook is a control hook that sets TCP_NODELAY on tcp sockets.
+func noDelayHook(network, address string, fd uintptr) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	return setNoDelay(fd)
+}
+
+// MSSForMTU returns the mss of tcp segments that fill, but do not exceed,
+// packets of size mtu, over ipv6 if set or ipv4 otherwise, without options.
+func MSSForMTU(mtu int, ipv6 bool) int {
+	// tcp header, and ip header
+	overhead := 20 + 20
+	if ipv6 {
+		overhead = 20 + 40
+	}
+	if mtu <= overhead {
+		return 0
+	}
+	return mtu - overhead
+}
+
+// mssHook returns a control hook that caps the mss of tcp sockets.
+func mssHook(mss int) func(string, string, uintptr) error {
+	return func(network, address string, fd uintptr) error {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		return setMSS(fd, mss)
+	}
+}
+
+// congestionHook returns a control hook that sets the congestion control
+// algorithm of tcp sockets, if the kernel has it.
+func congestionHook(algo string) func(string, string, uintptr) error {
+	return func(network, address string, fd uintptr) error {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		// best-effort; the os's default is used otherwise
+		if err := setCongestion(fd, algo); err != nil {
+			log.Warnf("congestion control %s of socket to %s: %v", algo, address, err)
+		}
+		return nil
+	}
+}
+
+// priorityHook returns a control hook that sets the priority of sockets,
+// if permitted.
+func priorityHook(prio int) func(string, string, uintptr) error {
+	return func(network, address string, fd uintptr) error {
+		// best-effort; the default priority is used otherwise
+		if err := setPriority(fd, prio); err != nil {
+			log.Warnf("priority %d of %s socket to %s: %v", prio, network, address, err)
+		}
+		return nil
+	}
+}
+
+// bindHook returns a control hook that binds sockets to ip.
+func bindHook(ip net.IP) func(string, string, uintptr) error {
+	v4 := ip.To4() != nil
+	return func(network, address string, fd uintptr) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if rip := net.ParseIP(host); rip != nil && (rip.To4() != nil) != v4 {
+			return fmt.Errorf("bind %s to dial %s: %w", ip, address, ErrLocalAddrFamily)
+		}
+		return bindLocal(fd, ip)
+	}
+}
+
+// localAddrHook returns a control hook that reports the local address of
+// a socket to f.
+func localAddrHook(f func(string, net.Addr)) func(string, string, uintptr) error {
+	return func(network, address string, fd uintptr) error {
+		laddr, err := localAddr(network, fd)
+		if err != nil {
+			log.Warnf("local addr of %s socket to %s: %v", network, address, err)
+			return nil
+		}
+		f(network, laddr)
+		return nil
+	}
+}
+
+// withHooks wraps control, which may be nil, to run hooks after it.
+func withHooks(control func(string, string, syscall.RawConn) error, hooks []func(string, string, uintptr) error) func(string, string, syscall.RawConn) error {
+	if len(hooks) == 0 {
+		return control
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var herr error
+		err := c.Control(func(fd uintptr) {
+			for _, hook := range hooks {
+				if herr = hook(network, address, fd); herr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return herr
+	}
+}
+
 // MakeDialer creates a new Dialer.  Recipients can safely mutate
 // any public field except Control and Resolver, which are both populated.
 func MakeDialer(p Protector) *net.Dialer {
+	return MakeDialerWithOpts(p, MakeDialerOpts{})
+}
+
+// MakeDialerWithOpts is MakeDialer with sockets further set up per opts.
+// The socket is protected first, and then passed to opts.ControlHooks.
+// Sockets to ipv6 addresses prefer sources as set by SetPreferTemporaryV6.
+func MakeDialerWithOpts(p Protector, opts MakeDialerOpts) *net.Dialer {
+	d := makeDialer(p, opts)
+	if d.Resolver != nil {
+		bare := &net.Dialer{}
+		if p != nil {
+			bare.Control = makeControl(p)
+		}
+		d.Resolver = withBareDialer(d.Resolver, bare)
+	}
+	return d
+}
+
+func makeDialer(p Protector, opts MakeDialerOpts) *net.Dialer {
+	hooks := append([]func(string, string, uintptr) error{srcPrefHook}, opts.ControlHooks...)
+	if opts.SocketPriority > 0 {
+		hooks = append([]func(string, string, uintptr) error{priorityHook(opts.SocketPriority)}, hooks...)
+	}
+	if len(opts.CongestionControl) > 0 {
+		hooks = append([]func(string, string, uintptr) error{congestionHook(opts.CongestionControl)}, hooks...)
+	}
+	if opts.MSSClamp > 0 {
+		hooks = append([]func(string, string, uintptr) error{mssHook(opts.MSSClamp)}, hooks...)
+	}
+	if opts.NoDelay {
+		hooks = append([]func(string, string, uintptr) error{noDelayHook}, hooks...)
+	}
+	if opts.LocalAddr != nil {
+		hooks = append(hooks[:len(hooks):len(hooks)], bindHook(opts.LocalAddr))
+	}
+	if opts.OnLocalAddr != nil {
+		hooks = append(hooks[:len(hooks):len(hooks)], localAddrHook(opts.OnLocalAddr))
+	}
+	delay := opts.ConnectionAttemptDelay
+	if delay == 0 {
+		delay = defaultConnectionAttemptDelay
+	}
 	if p == nil {
-		return &net.Dialer{}
+		d := &net.Dialer{
+			Control:       withHooks(nil, hooks),
+			FallbackDelay: delay,
+		}
+		if opts.Resolve != nil {
+			d.Resolver = resolverOf(opts.Resolve)
+		} else if opts.Resolver != nil {
+			d.Resolver = opts.Resolver.r
+		}
+		return d
 	}
 	d := &net.Dialer{
-		Control: makeControl(p),
+		Control:       withHooks(makeControl(p), hooks),
+		FallbackDelay: delay,
+	}
+	if opts.Resolve != nil {
+		d.Resolver = resolverOf(opts.Resolve)
+		return d
+	}
+	if opts.Resolver != nil {
+		d.Resolver = opts.Resolver.r
+		return d
 	}
+	// dials resolvers while SetResolverBypass is set
+	bypass := &net.Dialer{Control: makeControl(p)}
 	resolverDialer := func(ctx context.Context, network, address string) (net.Conn, error) {
-		resolvers := strings.Split(p.GetResolvers(), ",")
-		newAddress, err := replaceIP(address, resolvers)
-		if err != nil {
-			return nil, err
+		cfg := dialConfigOf(ctx)
+		rd := boundToResolverNetwork(d)
+		routes := cfg.routes
+		if bypassingResolver() {
+			rd = boundToResolverNetwork(bypass)
+			routes = nil
 		}
-		return d.DialContext(ctx, network, newAddress)
+		ts := cfg.transports
+		if len(ts) == 0 {
+			// system resolvers annotated with their transports
+			var err error
+			if ts, err = systemTransports(p); err != nil {
+				return nil, err
+			}
+		}
+		if len(ts) > 0 {
+			return newDNSConn(ctx, network, address, withoutAAAA(cachedExchange(coalesced(cfg, routed(routes, func(ctx context.Context, q []byte) ([]byte, error) {
+				return exchangeAny(ctx, rd, ts, q)
+			}))))), nil
+		}
+		// queries to the system's resolvers go through a dnsConn only when
+		// a feature needs them, as to cache, route or observe them
+		if !needsDNSConn(cfg) {
+			return dialSystemResolver(ctx, rd, p, network, address, nil)
+		}
+		return newDNSConn(ctx, network, address, withoutAAAA(cachedExchange(coalesced(cfg, routed(routes, func(ctx context.Context, q []byte) ([]byte, error) {
+			if cfg.attempt > 0 {
+				return exchangeSystemResolvers(ctx, rd, p, network, address, q, cfg.attempt)
+			}
+			c, err := dialSystemResolver(ctx, rd, p, network, address, q)
+			if err != nil {
+				return nil, err
+			}
+			defer c.Close()
+			setDeadline(ctx, c)
+			return connExchange(c, q)
+		}))))), nil
 	}
 	d.Resolver = &net.Resolver{
 		PreferGo: true,
@@ -141,6 +556,115 @@ func MakeDialer(p Protector) *net.Dialer {
 	return d
 }
 
+// dialSystemResolver dials one of the system's resolvers, from p, in
+// place of the resolver at address, to send q, if known, to.
+func dialSystemResolver(ctx context.Context, d *net.Dialer, p Protector, network, address string, q []byte) (net.Conn, error) {
+	ips, err := resolvers(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	candidates := func() []string { return ips }
+	newAddress, err := replaceIP(address, ips)
+	if err != nil {
+		return nil, err
+	}
+	if observingSelection() {
+		chosen, _, _ := net.SplitHostPort(newAddress)
+		observeSelection(q, candidates, chosen)
+	}
+	c, err := d.DialContext(ctx, network, newAddress)
+	if err == nil {
+		return timed(c, newAddress), nil
+	}
+	if !unreachable(err) {
+		return nil, err
+	}
+	timedFailure(newAddress)
+	// as a last resort, try a resolver of the other ip family
+	if alt := otherFamily(newAddress, ips); len(alt) > 0 {
+		log.Warnf("resolver %s unreachable (%v), trying %s", newAddress, err, alt)
+		if observingSelection() {
+			chosen, _, _ := net.SplitHostPort(alt)
+			observeSelection(q, candidates, chosen)
+		}
+		c, aerr := d.DialContext(ctx, network, alt)
+		if aerr == nil {
+			return timed(c, alt), nil
+		}
+		if unreachable(aerr) {
+			timedFailure(alt)
+		}
+	}
+	return nil, err
+}
+
+// DialContext dials addr over network using d. Literal-ip targets, which
+// are the bulk of connections through the tunnel as apps have resolved them
+// already, are dialed with just d's Control and never touch its Resolver,
+// and so never call Protector.GetResolvers either. Hostnames are resolved
+// and their addresses tried in the order set by SetAddressSortPolicy,
+// unless pinned to an ip with PinHostIP. Without ipv6 connectivity, ipv6
+// addresses fail fast with ErrNoIPv6, see SetNAT64Prefix. .onion targets
+// are never resolved, but dialed through the proxy of SetOnionProxy. Conns
+// are returned once the validator of SetPreConnectValidator, if any,
+// passes them.
+func DialContext(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	c, err := dial(ctx, d, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = validated(ctx, c, addr); err != nil {
+		return nil, err
+	}
+	connTraceOf(ctx).gotConn(c)
+	return c, nil
+}
+
+func dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if isOnion(addr) {
+		return dialOnion(ctx, d, network, addr)
+	}
+	if local := loopbackAddr(network, addr); len(local) > 0 {
+		return dialLoopback(ctx, d, network, local)
+	}
+	addr = pinned(addr)
+	if atomic.LoadInt32(&requireLiteral) == 1 && !isLiteralIP(addr) {
+		return nil, fmt.Errorf("%s: %w", addr, ErrDNSDisabled)
+	}
+	if d.Resolver == nil {
+		return dialTraced(ctx, d, network, addr)
+	}
+	if isLiteralIP(addr) {
+		addr, err := routableAddr(ctx, d, addr)
+		if err != nil {
+			return nil, err
+		}
+		direct := *d
+		direct.Resolver = nil
+		return dialTraced(ctx, &direct, network, addr)
+	}
+	return resolveAndDial(ctx, d, network, addr)
+}
+
+// ProtectedDialContext returns a DialContext func for libraries that dial
+// their own sockets, such as http.Transport, to dial protected sockets
+// that resolve hostnames as MakeDialer's Resolver does.
+func ProtectedDialContext(p Protector) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := MakeDialer(p)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return DialContext(ctx, d, network, addr)
+	}
+}
+
+// isLiteralIP returns true if the host in hostport is an ip address.
+func isLiteralIP(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host) != nil
+}
+
 // MakeListenConfig returns a new ListenConfig that creates protected
 // listener sockets.
 func MakeListenConfig(p Protector) *net.ListenConfig {
@@ -151,3 +675,28 @@ func MakeListenConfig(p Protector) *net.ListenConfig {
 		Control: makeControl(p),
 	}
 }
+
+// ProtectAccepted protects the socket underneath c, for conns accepted by
+// listeners that weren't created by MakeListenConfig; as with those, if
+// Protect fails, SetProtectFailurePolicy decides whether c may be used.
+func ProtectAccepted(p Protector, c net.Conn) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return ErrNoRawConn
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	protected := false
+	err = raw.Control(func(fd uintptr) {
+		protected = protectFD(p, fd)
+	})
+	if err != nil {
+		return err
+	}
+	if !protected {
+		return fmt.Errorf("%w: %s", ErrNotProtected, c.LocalAddr())
+	}
+	return nil
+}
@@ -2,16 +2,25 @@ package protect
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"sync"
 	"syscall"
 	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // The fake protector just records the file descriptors it was given.
 type fakeProtector struct {
-	mu  sync.Mutex
-	fds []int32
+	mu        sync.Mutex
+	fds       []int32
+	resolvers int // number of calls to GetResolvers
 }
 
 func (p *fakeProtector) Protect(fd int32) bool {
@@ -22,6 +31,9 @@ func (p *fakeProtector) Protect(fd int32) bool {
 }
 
 func (p *fakeProtector) GetResolvers() string {
+	p.mu.Lock()
+	p.resolvers++
+	p.mu.Unlock()
 	return "8.8.8.8,2001:4860:4860::8888"
 }
 
@@ -31,6 +43,33 @@ type hasSyscallConn interface {
 	SyscallConn() (syscall.RawConn, error)
 }
 
+// nonLoopbackIP returns an ipv4 address of this host other than loopback,
+// for servers whose conns must be dialed with protected sockets, as those
+// to loopback aren't.
+func nonLoopbackIP(t testing.TB) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			return ipnet.IP
+		}
+	}
+	t.Skip("no non-loopback address")
+	return nil
+}
+
+// listenNonLoopback has s, not yet started, listen on nonLoopbackIP.
+func listenNonLoopback(t *testing.T, s *httptest.Server) {
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Listener.Close()
+	s.Listener = l
+}
+
 func verifyMatch(t *testing.T, conn hasSyscallConn, p *fakeProtector) {
 	rawconn, err := conn.SyscallConn()
 	if err != nil {
@@ -126,3 +165,296 @@ func TestNilListener(t *testing.T) {
 
 	conn.Close()
 }
+
+func TestDialLiteralIPSkipsResolver(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	p := &fakeProtector{}
+	d := MakeDialer(p)
+	conn, err := DialContext(context.Background(), d, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	verifyMatch(t, conn.(*net.TCPConn), p)
+	if p.resolvers != 0 {
+		t.Errorf("GetResolvers called %d times for a literal ip", p.resolvers)
+	}
+	if d.Resolver == nil {
+		t.Errorf("dialer's resolver was mutated")
+	}
+}
+
+func TestDialHostnameUsesResolver(t *testing.T) {
+	p := &fakeProtector{}
+	d := MakeDialer(p)
+	DialContext(context.Background(), d, "tcp", "foo.test.:80")
+	if p.resolvers == 0 {
+		t.Errorf("GetResolvers not called for a hostname")
+	}
+}
+
+func TestRequireLiteralTargets(t *testing.T) {
+	SetRequireLiteralTargets(true)
+	defer SetRequireLiteralTargets(false)
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	p := &fakeProtector{}
+	d := MakeDialer(p)
+	if _, err := DialContext(context.Background(), d, "tcp", net.JoinHostPort("foo.test.", port)); !errors.Is(err, ErrDNSDisabled) {
+		t.Errorf("hostname: got %v, want ErrDNSDisabled", err)
+	}
+	if _, err := DialContext(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort("foo.test.", port)); !errors.Is(err, ErrDNSDisabled) {
+		t.Errorf("hostname without a resolver: got %v, want ErrDNSDisabled", err)
+	}
+	if p.resolvers != 0 {
+		t.Errorf("GetResolvers called %d times", p.resolvers)
+	}
+	conn, err := DialContext(context.Background(), d, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// benchmarkDial dials host, or a literal ip if it is empty.
+func benchmarkDial(b *testing.B, host string) {
+	ip := nonLoopbackIP(b)
+	l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dns, port := startTCPDNS(b, ip)
+	defer dns.Close()
+	SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}})
+	defer SetDNSTransports(nil)
+
+	d := MakeDialer(&fakeProtector{})
+	_, lport, _ := net.SplitHostPort(l.Addr().String())
+	if len(host) == 0 {
+		host = ip.String()
+	}
+	addr := net.JoinHostPort(host, lport)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := DialContext(context.Background(), d, "tcp4", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkDialLiteralIP(b *testing.B) {
+	benchmarkDial(b, "")
+}
+
+func BenchmarkDialHostname(b *testing.B) {
+	benchmarkDial(b, "foo.test.")
+}
+
+func TestProtectAcceptedNoRawConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := ProtectAccepted(&fakeProtector{}, c1); !errors.Is(err, ErrNoRawConn) {
+		t.Fatalf("got %v, want ErrNoRawConn", err)
+	}
+}
+
+func TestControlHookAbortsDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errHook := errors.New("hook failed")
+	ran := false
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+		ControlHooks: []func(string, string, uintptr) error{
+			func(string, string, uintptr) error { return errHook },
+			func(string, string, uintptr) error { ran = true; return nil },
+		},
+	})
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded despite a failing hook")
+	}
+	if !errors.Is(err, errHook) {
+		t.Errorf("got %v, want %v", err, errHook)
+	}
+	if ran {
+		t.Error("hook ran after a failing hook")
+	}
+}
+
+// resolversProtector reports csv as the system's resolvers.
+type resolversProtector struct {
+	fakeProtector
+	csv string
+}
+
+func (p *resolversProtector) GetResolvers() string {
+	return p.csv
+}
+
+func TestNoResolvers(t *testing.T) {
+	for _, csv := range []string{"", " ", ",,", " , "} {
+		d := MakeDialer(&resolversProtector{csv: csv})
+		_, err := d.Resolver.Dial(context.Background(), "udp", "192.0.2.1:53")
+		if !errors.Is(err, ErrNoResolvers) {
+			t.Errorf("%q: got %v, want ErrNoResolvers", csv, err)
+		}
+	}
+}
+
+func TestBootstrapResolvers(t *testing.T) {
+	if err := SetBootstrapResolvers("127.0.0.1, ::1"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetBootstrapResolvers("")
+
+	for _, csv := range []string{"", " ", ",,"} {
+		d := MakeDialer(&resolversProtector{csv: csv})
+		c, err := d.Resolver.Dial(context.Background(), "udp", "192.0.2.1:53")
+		if err != nil {
+			t.Fatalf("%q: %v", csv, err)
+		}
+		if got := c.RemoteAddr().String(); got != "127.0.0.1:53" {
+			t.Errorf("%q: dialed %s, want the bootstrap resolver", csv, got)
+		}
+		c.Close()
+	}
+
+	// system resolvers, when present, take precedence
+	d := MakeDialer(&resolversProtector{csv: " 127.0.0.2 ,"})
+	c, err := d.Resolver.Dial(context.Background(), "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "127.0.0.2:53" {
+		t.Errorf("dialed %s, want the system resolver", got)
+	}
+}
+
+func TestSetBootstrapResolversInvalid(t *testing.T) {
+	if err := SetBootstrapResolvers("127.0.0.1,dns.google"); err == nil {
+		t.Error("hostname accepted as a bootstrap resolver")
+	}
+}
+
+func TestResolverFallsBackAcrossFamilies(t *testing.T) {
+	v6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	}
+	defer v6.Close()
+	go serveTCPDNS(v6, fooIP)
+	port := strconv.Itoa(v6.Addr().(*net.TCPAddr).Port)
+	if c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+		c.Close()
+		t.Skip("v4 port in use")
+	}
+
+	// the v4 resolver refuses connections
+	d := MakeDialer(&resolversProtector{csv: "127.0.0.1,::1"})
+	c, err := d.Resolver.Dial(context.Background(), "tcp", net.JoinHostPort("192.0.2.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv6loopback) {
+		t.Fatalf("dialed %s, want the v6 resolver", got)
+	}
+	if _, err := streamExchange(c, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolverWithoutOtherFamily(t *testing.T) {
+	port := strconv.Itoa(deadTCPPort(t))
+	d := MakeDialer(&resolversProtector{csv: "127.0.0.1"})
+	_, err := d.Resolver.Dial(context.Background(), "tcp", net.JoinHostPort("192.0.2.1", port))
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("got %v, want ECONNREFUSED", err)
+	}
+}
+
+func TestProtectedDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	dns, port := startTCPDNS(t, net.IPv4(127, 0, 0, 1))
+	defer dns.Close()
+	SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}})
+	defer SetDNSTransports(nil)
+
+	p := &fakeProtector{}
+	client := &http.Client{Transport: &http.Transport{DialContext: ProtectedDialContext(p)}}
+	defer client.CloseIdleConnections()
+
+	_, sport, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for _, host := range []string{"127.0.0.1", "foo.test"} {
+		res, err := client.Get("http://" + net.JoinHostPort(host, sport) + "/")
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("%s: got %q", host, body)
+		}
+		client.CloseIdleConnections()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.fds) == 0 {
+		t.Error("no sockets protected")
+	}
+}
+
+func TestMSSForMTU(t *testing.T) {
+	for _, tc := range []struct {
+		mtu  int
+		ipv6 bool
+		want int
+	}{
+		{1500, false, 1460},
+		{1500, true, 1440},
+		{1280, true, 1220},
+		{40, false, 0},
+	} {
+		if got := MSSForMTU(tc.mtu, tc.ipv6); got != tc.want {
+			t.Errorf("MSSForMTU(%d, %v) = %d, want %d", tc.mtu, tc.ipv6, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+//go:build !windows
+// +build !windows
+
+package protect
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// failingProtector fails to protect any socket.
+type failingProtector struct {
+	fakeProtector
+}
+
+func (p *failingProtector) Protect(fd int32) bool {
+	p.fakeProtector.Protect(fd)
+	return false
+}
+
+func acceptLoopback(t *testing.T) (accepted, dialed net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestProtectAccepted(t *testing.T) {
+	accepted, dialed := acceptLoopback(t)
+	defer accepted.Close()
+	defer dialed.Close()
+
+	p := &fakeProtector{}
+	if err := ProtectAccepted(p, accepted); err != nil {
+		t.Fatal(err)
+	}
+	verifyMatch(t, accepted.(*net.TCPConn), p)
+}
+
+func TestProtectAcceptedFails(t *testing.T) {
+	accepted, dialed := acceptLoopback(t)
+	defer accepted.Close()
+	defer dialed.Close()
+	defer SetProtectFailurePolicy(FailOpen)
+
+	// per the protect failure policy
+	if err := ProtectAccepted(&failingProtector{}, accepted); err != nil {
+		t.Errorf("fail open: %v", err)
+	}
+	SetProtectFailurePolicy(FailClosed)
+	if err := ProtectAccepted(&failingProtector{}, accepted); !errors.Is(err, ErrNotProtected) {
+		t.Errorf("fail closed: got %v, want ErrNotProtected", err)
+	}
+	SetProtectFailurePolicy(Retry)
+	p := &flakyProtector{fails: 2}
+	if err := ProtectAccepted(p, accepted); err != nil {
+		t.Errorf("retry: %v", err)
+	}
+	if n := atomic.LoadInt32(&p.calls); n != 3 {
+		t.Errorf("retry: Protect called %d times, want 3", n)
+	}
+}
+
+func TestControlHookSetsOption(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	p := &fakeProtector{}
+	hook := func(network, address string, fd uintptr) error {
+		p.mu.Lock()
+		protected := len(p.fds) == 1 && p.fds[0] == int32(fd)
+		p.mu.Unlock()
+		if !protected {
+			return errors.New("hook ran before protect")
+		}
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}
+	d := MakeDialerWithOpts(p, MakeDialerOpts{
+		ControlHooks: []func(string, string, uintptr) error{hook},
+	})
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == 0 {
+		t.Error("option not set by hook")
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, noDelay := range []bool{true, false} {
+		// read back in a hook, as the os would have it before go sets
+		// TCP_NODELAY itself on connect
+		var v int
+		var verr error
+		read := func(network, address string, fd uintptr) error {
+			v, verr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			return nil
+		}
+		d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+			ControlHooks: []func(string, string, uintptr) error{read},
+			NoDelay:      noDelay,
+		})
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if verr != nil {
+			t.Fatal(verr)
+		}
+		if (v != 0) != noDelay {
+			t.Errorf("NoDelay %v: TCP_NODELAY is %d", noDelay, v)
+		}
+	}
+
+	// udp sockets are left as is
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{NoDelay: true})
+	conn, err := d.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestMSSClamp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, clamp := range []int{0, 1200} {
+		var mss int
+		var merr error
+		read := func(network, address string, fd uintptr) error {
+			mss, merr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+			return nil
+		}
+		d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+			ControlHooks: []func(string, string, uintptr) error{read},
+			MSSClamp:     clamp,
+		})
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if merr != nil {
+			t.Fatal(merr)
+		}
+		if clamp > 0 && mss != clamp {
+			t.Errorf("MSSClamp %d: TCP_MAXSEG is %d", clamp, mss)
+		}
+		if clamp == 0 && mss == 1200 {
+			t.Errorf("TCP_MAXSEG clamped without MSSClamp")
+		}
+	}
+
+	// udp sockets are left as is
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{MSSClamp: 1200})
+	conn, err := d.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestOnLocalAddr(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		var laddr net.Addr
+		d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+			OnLocalAddr: func(network string, a net.Addr) { laddr = a },
+		})
+
+		var target string
+		if network == "tcp" {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go l.Accept()
+			target = l.Addr().String()
+		} else {
+			target = net.JoinHostPort("127.0.0.1", "9")
+		}
+
+		conn, err := d.Dial(network, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if laddr == nil {
+			t.Fatalf("%s: local addr not reported", network)
+		}
+		if laddr.Network() != network {
+			t.Errorf("%s: reported a %s addr", network, laddr.Network())
+		}
+		got, err := net.ResolveTCPAddr("tcp", laddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := net.ResolveTCPAddr("tcp", conn.LocalAddr().String())
+		if got.Port == 0 || got.Port != want.Port {
+			t.Errorf("%s: reported port %d, bound to %d", network, got.Port, want.Port)
+		}
+		if !got.IP.IsUnspecified() && !got.IP.Equal(want.IP) {
+			t.Errorf("%s: reported ip %s, bound to %s", network, got.IP, want.IP)
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// all of 127/8 is on loopback, so 127.0.0.2 needs no alias on linux.
+	src := net.ParseIP("127.0.0.2")
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{LocalAddr: src})
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skipf("dial from %s: %v", src, err)
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if got := accepted.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(src) {
+		t.Errorf("accepted from %s, want %s", got, src)
+	}
+}
+
+func TestLocalAddrFamily(t *testing.T) {
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{LocalAddr: net.IPv6loopback})
+	_, err := d.Dial("udp", "127.0.0.1:9")
+	if !errors.Is(err, ErrLocalAddrFamily) {
+		t.Errorf("got %v, want ErrLocalAddrFamily", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errNoHops = errors.New("proxy chain has no hops")
+
+// ProxySpec is a hop of a proxy chain.
+type ProxySpec struct {
+	// Proto is the protocol spoken to the proxy.
+	Proto ProxyProto
+	// Addr is the proxy's host:port.
+	Addr string
+	// KeepAliveInterval, if positive, is how long the conn to the hop may
+	// go without data before tcp keepalive probes are sent on it, to keep
+	// the proxy and nats on the way from dropping idle tunnels; if zero,
+	// it is go's default of 15s. None of the proxy protocols has a
+	// keepalive of its own, and probes carry no data, so only the socket
+	// to the first hop, which is the client's, can send them: the interval
+	// of the hops after it is ignored.
+	KeepAliveInterval time.Duration
+}
+
+// MakeChainedDialer returns a dialer that tunnels tcp connections through
+// each of hops in turn: it dials the first hop with a socket protected by
+// p, asks it to connect to the second, and so on, until the last hop is
+// asked to connect to the target. Errors name the hop that failed, from 1.
+func MakeChainedDialer(p Protector, hops []ProxySpec) ContextDialer {
+	if len(hops) == 0 {
+		return contextDialerFunc(func(context.Context, string, string) (net.Conn, error) {
+			return nil, errNoHops
+		})
+	}
+	d := MakeDialer(p)
+	if hops[0].KeepAliveInterval > 0 {
+		d.KeepAlive = hops[0].KeepAliveInterval
+	}
+	var prev ContextDialer = contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := DialContext(ctx, d, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy hop 1 (%s): %w", addr, err)
+		}
+		return c, nil
+	})
+	for i, hop := range hops {
+		prev = chainHop(i+1, hop, prev)
+	}
+	return prev
+}
+
+// chainHop returns a dialer that asks hop n, reached with prev, to connect.
+func chainHop(n int, hop ProxySpec, prev ContextDialer) ContextDialer {
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// errors reaching hop are attributed by prev
+		c, err := prev.DialContext(ctx, "tcp", hop.Addr)
+		if err != nil {
+			return nil, err
+		}
+		tc, err := proxyOver(hop.Proto, "tcp", hop.Addr, &connDialer{c}).DialContext(ctx, network, addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("proxy hop %d (%s): %w", n, hop.Addr, err)
+		}
+		return tc, nil
+	})
+}
+
+// connDialer hands out c, a conn to a proxy, whatever it is asked to dial.
+type connDialer struct {
+	c net.Conn
+}
+
+func (d *connDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.c, nil
+}
+
+func (d *connDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.c, nil
+}
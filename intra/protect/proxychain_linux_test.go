@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package protect
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChainedDialerKeepAlive(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveProxy(l, socks5Handshake)
+
+	for _, tc := range []struct {
+		interval time.Duration
+		want     int // keepalive idle of the socket, in secs
+	}{
+		{7 * time.Second, 7},
+		{0, 15}, // go's default
+	} {
+		hops := []ProxySpec{{Proto: ProxyProtoSOCKS5, Addr: l.Addr().String(), KeepAliveInterval: tc.interval}}
+		c, err := MakeChainedDialer(&fakeProtector{}, hops).DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := c.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var on, idle int
+		var serr error
+		rc.Control(func(fd uintptr) {
+			if on, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+				return
+			}
+			idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		})
+		c.Close()
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		if on != 1 || idle != tc.want {
+			t.Errorf("%s: keepalive %d, idle %ds; want on, after %ds", tc.interval, on, idle, tc.want)
+		}
+	}
+}
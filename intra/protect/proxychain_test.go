@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package protect
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChainedDialer(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	var hops []ProxySpec
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveProxy(l, socks5Handshake)
+		hops = append(hops, ProxySpec{Proto: ProxyProtoSOCKS5, Addr: l.Addr().String()})
+	}
+
+	p := &fakeProtector{}
+	echoThrough(t, MakeChainedDialer(p, hops), echo.Addr().String())
+	// only the socket to the first hop is the client's
+	p.mu.Lock()
+	protected := len(p.fds)
+	p.mu.Unlock()
+	if protected != 1 {
+		t.Errorf("%d sockets protected, want 1", protected)
+	}
+
+	// mixed protocols
+	h, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	go serveProxy(h, httpConnectHandshake)
+	echoThrough(t, MakeChainedDialer(&fakeProtector{}, []ProxySpec{hops[0], {Proto: ProxyProtoHTTP, Addr: h.Addr().String()}}), echo.Addr().String())
+}
+
+func TestChainedDialerHopFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveProxy(l, socks5Handshake)
+	dead := net.JoinHostPort("127.0.0.1", strconv.Itoa(deadTCPPort(t)))
+
+	for _, tc := range []struct {
+		hops []ProxySpec
+		want string
+	}{
+		{[]ProxySpec{{Proto: ProxyProtoSOCKS5, Addr: dead}, {Proto: ProxyProtoSOCKS5, Addr: l.Addr().String()}}, "hop 1"},
+		{[]ProxySpec{{Proto: ProxyProtoSOCKS5, Addr: l.Addr().String()}, {Proto: ProxyProtoSOCKS5, Addr: dead}}, "hop 2"},
+	} {
+		_, err := MakeChainedDialer(&fakeProtector{}, tc.hops).DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("got %v, want an error of %s", err, tc.want)
+		}
+	}
+	if _, err := MakeChainedDialer(&fakeProtector{}, nil).DialContext(context.Background(), "tcp", "192.0.2.1:80"); err != errNoHops {
+		t.Errorf("got %v, want errNoHops", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolveReuse is how long the addresses a ResolveFunc returns answer
+// queries for the same host, so that the A and AAAA queries of a lookup
+// share one call.
+const resolveReuse = time.Second
+
+// ResolveFunc returns the ipv4 and ipv6 addresses of host.
+type ResolveFunc func(ctx context.Context, host string) (v4, v6 []net.IP, err error)
+
+// resolveCall is a call to a ResolveFunc that queries may share.
+type resolveCall struct {
+	done   chan struct{}
+	v4, v6 []net.IP
+	err    error
+	at     time.Time // when done
+	// abandoned is set if the call failed once its ctx was done; queries
+	// waiting on it, whose own ctxs may not be, then call again.
+	abandoned bool
+}
+
+// resolverOf returns a Resolver that answers lookups with resolve.
+func resolverOf(resolve ResolveFunc) *net.Resolver {
+	exchange := resolvedExchange(resolve)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return newDNSConn(ctx, network, address, exchange), nil
+		},
+	}
+}
+
+// resolvedExchange returns an exchange that answers A and AAAA queries with
+// the addresses resolve returns, and other queries with no records.
+func resolvedExchange(resolve ResolveFunc) func(context.Context, []byte) ([]byte, error) {
+	var calls struct {
+		sync.Mutex
+		m map[string]*resolveCall
+	}
+	call := func(ctx context.Context, host string) *resolveCall {
+		calls.Lock()
+		now := time.Now()
+		for h, c := range calls.m {
+			select {
+			case <-c.done:
+				if now.Sub(c.at) > resolveReuse {
+					delete(calls.m, h)
+				}
+			default:
+			}
+		}
+		if c, ok := calls.m[host]; ok {
+			calls.Unlock()
+			return c
+		}
+		if calls.m == nil {
+			calls.m = make(map[string]*resolveCall)
+		}
+		c := &resolveCall{done: make(chan struct{})}
+		calls.m[host] = c
+		calls.Unlock()
+
+		c.v4, c.v6, c.err = resolve(ctx, host)
+		c.abandoned = c.err != nil && ctx.Err() != nil
+		calls.Lock()
+		c.at = time.Now()
+		if c.err != nil {
+			// errors aren't shared beyond the queries already waiting
+			delete(calls.m, host)
+		}
+		calls.Unlock()
+		close(c.done)
+		return c
+	}
+
+	return func(ctx context.Context, q []byte) ([]byte, error) {
+		k, ok := questionOf(q)
+		if !ok || k.class != dnsmessage.ClassINET || (k.qtype != dnsmessage.TypeA && k.qtype != dnsmessage.TypeAAAA) {
+			return noRecords(q)
+		}
+		host := strings.TrimSuffix(k.name, ".")
+		c := call(ctx, host)
+		for {
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if !c.abandoned {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			c = call(ctx, host)
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		if k.qtype == dnsmessage.TypeA {
+			return answerWithIPs(q, c.v4)
+		}
+		return answerWithIPs(q, c.v6)
+	}
+}
+
+// answerWithIPs returns an answer to q with the ips of its type in it.
+func answerWithIPs(q []byte, ips []net.IP) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.RCode = dnsmessage.RCodeSuccess
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil
+	question := msg.Questions[0]
+	h := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case question.Type == dnsmessage.TypeA && ip4 != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &a})
+		case question.Type == dnsmessage.TypeAAAA && ip4 == nil && len(ip) == net.IPv6len:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &aaaa})
+		}
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,152 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubResolver returns v4 and v6 for any host, and records the hosts.
+type stubResolver struct {
+	mu     sync.Mutex
+	hosts  []string
+	v4, v6 []net.IP
+	err    error
+}
+
+func (r *stubResolver) resolve(ctx context.Context, host string) ([]net.IP, []net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+	return r.v4, r.v6, r.err
+}
+
+func (r *stubResolver) calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.hosts...)
+}
+
+func TestResolveFunc(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	// nothing listens on 127.0.0.2, and so the race is won by ::1
+	r := &stubResolver{v4: []net.IP{net.ParseIP("127.0.0.2")}, v6: []net.IP{net.IPv6loopback}}
+	p := &fakeProtector{}
+	d := MakeDialerWithOpts(p, MakeDialerOpts{Resolve: r.resolve})
+	c, err := DialContext(context.Background(), d, "tcp", net.JoinHostPort("mirror.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("connected to %s, want ::1", ip)
+	}
+	if hosts := r.calls(); len(hosts) != 1 || hosts[0] != "mirror.test" {
+		t.Errorf("resolved %v, want mirror.test once", hosts)
+	}
+	p.mu.Lock()
+	protected := len(p.fds)
+	p.mu.Unlock()
+	if protected == 0 {
+		t.Error("sockets not protected")
+	}
+
+	// lookups are answered with them too
+	ips, err := d.Resolver.LookupIPAddr(context.Background(), "other.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Errorf("looked up %v, want 127.0.0.2 and ::1", ips)
+	}
+}
+
+func TestResolveFuncFamilies(t *testing.T) {
+	r := &stubResolver{v4: []net.IP{net.ParseIP("192.0.2.1")}}
+	d := MakeDialerWithOpts(nil, MakeDialerOpts{Resolve: r.resolve})
+	ips, err := d.Resolver.LookupIP(context.Background(), "ip6", "v4only.test")
+	if err == nil {
+		t.Errorf("got %v for ipv6 addresses of a host with none", ips)
+	}
+	ips, err = d.Resolver.LookupIP(context.Background(), "ip4", "v4only.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v, want 192.0.2.1", ips)
+	}
+}
+
+func TestResolveFuncError(t *testing.T) {
+	r := &stubResolver{err: errors.New("no")}
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{Resolve: r.resolve})
+	if _, err := DialContext(context.Background(), d, "tcp", "fail.test:80"); err == nil {
+		t.Fatal("dialed a host that failed to resolve")
+	}
+	// errors aren't reused
+	r.err = nil
+	r.v4 = []net.IP{net.ParseIP("192.0.2.1")}
+	if _, err := d.Resolver.LookupIP(context.Background(), "ip4", "fail.test"); err != nil {
+		t.Errorf("error reused: %v", err)
+	}
+}
+
+func TestResolveFuncCallerCancelled(t *testing.T) {
+	var calls int32
+	exchange := resolvedExchange(func(ctx context.Context, host string) ([]net.IP, []net.IP, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := exchange(ctx, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA))
+		first <- err
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, err := exchange(context.Background(), makeQuery(t, 2, "foo.test.", dnsmessage.TypeAAAA))
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("first: got %v, want context.Canceled", err)
+	}
+	// the query sharing the call calls again, rather than fail as the
+	// first gave up
+	if err := <-second; err != nil {
+		t.Errorf("second: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("%d calls, want 2", n)
+	}
+}
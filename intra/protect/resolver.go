@@ -0,0 +1,226 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// default max answers a Resolver caches, see ResolverOpts.
+const defaultResolverCacheSize = 256
+
+// ResolverOpts are the options for NewResolver.
+type ResolverOpts struct {
+	// CacheSize is the most answers the resolver caches; beyond it, new
+	// ones are not cached until the expired ones are dropped. If zero, it
+	// is 256; if negative, answers are not cached.
+	CacheSize int
+	// MaxTTL, if positive, caps how long answers are cached, which is
+	// otherwise the least ttl of their records, as SetDNSTTLClamp bounds it.
+	MaxTTL time.Duration
+}
+
+type resolverEntry struct {
+	ans    []byte
+	expiry time.Time
+}
+
+// Resolver resolves hostnames for the dialers it is passed to, see
+// MakeDialerOpts.Resolver, as the Resolver of MakeDialer(p) would; and
+// caches the addresses it finds, so that dialers sharing it share their
+// lookups. Negative answers are cached as for any dialer, per
+// SetNegativeCacheTTL.
+type Resolver struct {
+	// counts of lookups in and drops from answers, see CacheStats; atomic,
+	// and first for their 64-bit alignment.
+	hits, misses, evictions int64
+
+	r      *net.Resolver
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	size   int
+	maxTTL time.Duration
+
+	mu      sync.Mutex
+	answers map[questionKey]*resolverEntry
+}
+
+// NewResolver returns a Resolver that sends queries over sockets protected
+// by p, to the resolvers MakeDialer(p) sends them to; or, if p is nil,
+// unprotected to the system's resolvers.
+func NewResolver(p Protector, opts ResolverOpts) *Resolver {
+	size := opts.CacheSize
+	if size == 0 {
+		size = defaultResolverCacheSize
+	}
+	r := &Resolver{
+		size:    size,
+		maxTTL:  opts.MaxTTL,
+		answers: make(map[questionKey]*resolverEntry),
+	}
+	if d := MakeDialer(p); d.Resolver != nil {
+		r.dial = d.Resolver.Dial
+	} else {
+		r.dial = d.DialContext
+	}
+	r.r = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return newDNSConn(ctx, network, address, func(ctx context.Context, q []byte) ([]byte, error) {
+				return r.exchange(ctx, network, address, q)
+			}), nil
+		},
+	}
+	return r
+}
+
+// exchange answers q from the cache, if it can, or else sends it to address.
+func (r *Resolver) exchange(ctx context.Context, network, address string, q []byte) ([]byte, error) {
+	k, ok := questionOf(q)
+	ok = ok && ctx.Value(noCache{}) == nil
+	if ok && ctx.Value(noCacheRead{}) == nil {
+		if ans := r.cached(k); ans != nil {
+			// answer with the id of this query
+			copy(ans, q[:2])
+			return ans, nil
+		}
+	}
+	c, err := r.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	ans, err := connExchange(c, q)
+	if err == nil && ok {
+		r.cache(k, ans)
+	}
+	return ans, err
+}
+
+// cached returns a copy of the unexpired answer for k, if any.
+func (r *Resolver) cached(k questionKey) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.answers[k]
+	if !ok {
+		atomic.AddInt64(&r.misses, 1)
+		return nil
+	}
+	if time.Now().After(e.expiry) {
+		delete(r.answers, k)
+		atomic.AddInt64(&r.evictions, 1)
+		atomic.AddInt64(&r.misses, 1)
+		return nil
+	}
+	atomic.AddInt64(&r.hits, 1)
+	return append([]byte{}, e.ans...)
+}
+
+// CacheStats returns the counts of the answers r caches since it was made.
+// Unlike those of the package's CacheStats, they count positive answers.
+func (r *Resolver) CacheStats() *CacheStatsSnapshot {
+	s := &CacheStatsSnapshot{
+		Hits:      atomic.LoadInt64(&r.hits),
+		Misses:    atomic.LoadInt64(&r.misses),
+		Evictions: atomic.LoadInt64(&r.evictions),
+	}
+	if n := s.Hits + s.Misses; n > 0 {
+		s.HitRatio = float64(s.Hits) / float64(n)
+	}
+	r.mu.Lock()
+	s.Size = int64(len(r.answers))
+	r.mu.Unlock()
+	return s
+}
+
+// cache adds ans, the answer for k, if it has records to cache.
+func (r *Resolver) cache(k questionKey, ans []byte) {
+	ttl := answerTTL(ans)
+	if ttl > 0 {
+		ttl = clampTTL(ttl)
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ttl <= 0 || r.size < 0 {
+		delete(r.answers, k)
+		return
+	}
+	now := time.Now()
+	if _, ok := r.answers[k]; !ok && len(r.answers) >= r.size {
+		for ek, e := range r.answers {
+			if now.After(e.expiry) {
+				delete(r.answers, ek)
+				atomic.AddInt64(&r.evictions, 1)
+			}
+		}
+		if len(r.answers) >= r.size {
+			return
+		}
+	}
+	r.answers[k] = &resolverEntry{
+		ans:    append([]byte{}, ans...),
+		expiry: now.Add(ttl),
+	}
+}
+
+// restore caches ans for k for ttl, capped at r's MaxTTL, if r has room
+// for it; the ttl was clamped when ans was first cached.
+func (r *Resolver) restore(k questionKey, ans []byte, ttl time.Duration) bool {
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.answers[k]; r.size < 0 || (!ok && len(r.answers) >= r.size) {
+		return false
+	}
+	r.answers[k] = &resolverEntry{ans: ans, expiry: time.Now().Add(ttl)}
+	return true
+}
+
+// answerTTL returns the least ttl of the answers in ans, or 0 if it has
+// none or isn't a successful, complete answer.
+func answerTTL(ans []byte) time.Duration {
+	var p dnsmessage.Parser
+	h, err := p.Start(ans)
+	if err != nil || h.Truncated || h.RCode != dnsmessage.RCodeSuccess {
+		return 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+	var ttl uint32
+	n := 0
+	for ; ; n++ {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0
+		}
+		if n == 0 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,213 @@
+package protect
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func startCountingDNS(t *testing.T, queries *int32) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveDualDNS(l, func() { atomic.AddInt32(queries, 1) })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSharedResolver(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{})
+	d1 := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{Resolver: r})
+	d2 := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{Resolver: r})
+	ctx := context.Background()
+	ips, err := d1.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+	// answered from the cache d1 filled
+	ips, err = d2.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d queries, want 1", n)
+	}
+
+	// dialers with resolvers of their own each send theirs
+	d3 := MakeDialer(&fakeProtector{})
+	if _, err := d3.Resolver.LookupIP(ctx, "ip4", "foo.test."); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+}
+
+func TestSharedResolverNoCache(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{CacheSize: -1})
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{Resolver: r})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+}
+
+func TestSharedResolverMaxTTL(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{MaxTTL: 50 * time.Millisecond})
+	d := MakeDialerWithOpts(nil, MakeDialerOpts{Resolver: r})
+	ctx := context.Background()
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("%d queries, want 1", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("%d queries after the ttl, want 2", n)
+	}
+}
+
+func TestSharedResolverTTLClamp(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	if err := SetDNSTTLClamp(0, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTTLClamp(0, 0)
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{})
+	d := MakeDialerWithOpts(nil, MakeDialerOpts{Resolver: r})
+	ctx := context.Background()
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("%d queries, want 1", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("%d queries past the clamped ttl, want 2", n)
+	}
+}
+
+func TestResolverCacheFile(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	dir, err := ioutil.TempDir("", "dnscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	ctx := context.Background()
+	r := NewResolver(&fakeProtector{}, ResolverOpts{})
+	d := MakeDialerWithOpts(nil, MakeDialerOpts{Resolver: r})
+	if _, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test."); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	r = NewResolver(&fakeProtector{}, ResolverOpts{})
+	if n, err := r.LoadCache(path); err != nil || n != 1 {
+		t.Fatalf("loaded %d, %v; want 1", n, err)
+	}
+	d = MakeDialerWithOpts(nil, MakeDialerOpts{Resolver: r})
+	ips, err := d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d queries, want 1 before the restart", n)
+	}
+
+	// expired answers are dropped
+	q := makeQuery(t, 1, "bar.test.", dnsmessage.TypeA)
+	if err := writeCacheFile(path, []cacheFileEntry{{answer(q), time.Now().Add(-time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := NewResolver(nil, ResolverOpts{}).LoadCache(path); err != nil || n != 0 {
+		t.Errorf("loaded %d expired, %v", n, err)
+	}
+}
+
+func TestResolverCacheStats(t *testing.T) {
+	var queries int32
+	port := startCountingDNS(t, &queries)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	r := NewResolver(&fakeProtector{}, ResolverOpts{MaxTTL: 50 * time.Millisecond})
+	d := MakeDialerWithOpts(nil, MakeDialerOpts{Resolver: r})
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	}
+	d.Resolver.LookupIP(ctx, "ip4", "bar.test.")
+	s := r.CacheStats()
+	if s.Hits != 3 || s.Misses != 2 || s.Size != 2 || s.Evictions != 0 {
+		t.Errorf("got %+v, want 3 hits, 2 misses, 2 cached", s)
+	}
+	if s.HitRatio != 0.6 {
+		t.Errorf("hit ratio %f, want 0.6", s.HitRatio)
+	}
+
+	// expired answers are evicted as they are looked up, and cached anew
+	time.Sleep(100 * time.Millisecond)
+	d.Resolver.LookupIP(ctx, "ip4", "foo.test.")
+	if s := r.CacheStats(); s.Hits != 3 || s.Misses != 3 || s.Evictions != 1 || s.Size != 2 {
+		t.Errorf("got %+v, want 3 hits, 3 misses, 1 eviction, 2 cached", s)
+	}
+	// the negative cache counts none of these
+	if s := CacheStats(); s.Hits != 0 || s.Size != 0 {
+		t.Errorf("negative cache got %+v", s)
+	}
+}
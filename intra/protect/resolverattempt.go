@@ -0,0 +1,110 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// SetResolverAttemptTimeout bounds how long each resolver is given to
+// answer a query to d, after which the next one is tried: of the system's
+// resolvers, first the one scan picks, then the rest of its ip family in
+// order and, as a last resort, those of the other family; of the
+// transports of SetDNSTransports, the next in order, unless given a
+// timeout of their own. All are tried within the time the lookup has
+// left, which SetDialBudget may bound. A d of 0, the default, leaves
+// queries to the system's resolvers to the one scan picks, and gives each
+// transport 3s.
+func SetResolverAttemptTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	updateDialConfig(func(c *dialConfig) {
+		c.attempt = d
+	})
+}
+
+func init() {
+	// to be sent to each resolver in turn
+	needDNSConn(func(cfg *dialConfig) bool { return cfg.attempt > 0 })
+}
+
+// candidateResolvers returns the resolvers of ips, on the port of
+// address, in the order exchangeSystemResolvers tries them.
+func candidateResolvers(address string, ips []string) ([]string, error) {
+	first, err := replaceIP(address, ips)
+	if err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(first)
+	family := ipFamily(host)
+	addrs := []string{first}
+	var others []string
+	for _, ip := range ips {
+		f := ipFamily(ip)
+		if f == 0 || ip == host {
+			continue
+		}
+		if f == family {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		} else {
+			others = append(others, net.JoinHostPort(ip, port))
+		}
+	}
+	return append(addrs, others...), nil
+}
+
+// exchangeSystemResolvers sends q to the system's resolvers, from p, in
+// place of the resolver at address, one after another, giving each up to
+// attempt to answer, until one does or ctx is done.
+func exchangeSystemResolvers(ctx context.Context, d *net.Dialer, p Protector, network, address string, q []byte, attempt time.Duration) ([]byte, error) {
+	ips, err := resolvers(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := candidateResolvers(address, ips)
+	if err != nil {
+		return nil, err
+	}
+	candidates := func() []string { return ips }
+	var errs multiDialError
+	for _, addr := range addrs {
+		if observingSelection() {
+			chosen, _, _ := net.SplitHostPort(addr)
+			observeSelection(q, candidates, chosen)
+		}
+		actx, cancel := context.WithTimeout(ctx, attempt)
+		ans, err := exchangeResolver(actx, d, network, addr, q)
+		cancel()
+		if err == nil {
+			return ans, nil
+		}
+		log.Warnf("resolver %s failed: %v", addr, err)
+		timedFailure(addr)
+		errs.add(addr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errs.err()
+}
+
+// exchangeResolver sends q to the resolver at addr over network.
+func exchangeResolver(ctx context.Context, d *net.Dialer, network, addr string, q []byte) ([]byte, error) {
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c = timed(c, addr)
+	defer c.Close()
+	setDeadline(ctx, c)
+	return connExchange(c, q)
+}
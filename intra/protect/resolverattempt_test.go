@@ -0,0 +1,109 @@
+package protect
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCandidateResolvers(t *testing.T) {
+	got, err := candidateResolvers("192.0.2.1:53", []string{"::1", "10.0.0.2", "bad", "10.0.0.3", "fe80::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.2:53", "10.0.0.3:53", "[::1]:53", "[fe80::1]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// slowResolver listens for tcp on ip:port and answers queries with fooIP
+// after delay.
+func slowResolver(t *testing.T, ip string, port int, delay time.Duration) net.Listener {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", ip, err)
+	}
+	go serveTCPDNS(&slowListener{l, delay}, fooIP)
+	return l
+}
+
+func TestResolverAttemptTimeout(t *testing.T) {
+	const attempt = 200 * time.Millisecond
+	SetResolverAttemptTimeout(attempt)
+	defer SetResolverAttemptTimeout(0)
+
+	for _, tc := range []struct {
+		name string
+		csv  string
+		slow string
+	}{
+		{"same family", "127.0.0.2,127.0.0.1", "127.0.0.2"},
+		{"other family", "127.0.0.1,::1", "127.0.0.1"},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		slow := slowResolver(t, tc.slow, port, 5*time.Second)
+		defer slow.Close()
+		fastIP := "127.0.0.1"
+		if tc.slow == fastIP {
+			fastIP = "::1"
+		}
+		fast := slowResolver(t, fastIP, port, 0)
+		defer fast.Close()
+
+		// the lookup's budget allows for two attempts, not for the slow one
+		ctx, cancel := context.WithTimeout(context.Background(), 3*attempt)
+		defer cancel()
+		start := time.Now()
+		d := MakeDialer(&resolversProtector{csv: tc.csv})
+		c, err := d.Resolver.Dial(ctx, "tcp", net.JoinHostPort("192.0.2.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := streamExchange(c, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA))
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(ans) == 0 {
+			t.Errorf("%s: empty answer", tc.name)
+		}
+		if took := time.Since(start); took < attempt || took > 3*attempt {
+			t.Errorf("%s: answered in %s, want after the slow resolver's %s", tc.name, took, attempt)
+		}
+	}
+}
+
+func TestResolverAttemptTimeoutOfTransports(t *testing.T) {
+	const attempt = 200 * time.Millisecond
+	SetResolverAttemptTimeout(attempt)
+	defer SetResolverAttemptTimeout(0)
+
+	fast, port := startTCPDNS(t, fooIP)
+	defer fast.Close()
+	slow := slowResolver(t, "127.0.0.2", port, 5*time.Second)
+	defer slow.Close()
+	ts := []DNSTransport{
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.2", Port: port},
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*attempt)
+	defer cancel()
+	start := time.Now()
+	if _, err := exchangeAny(ctx, &net.Dialer{}, ts, makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 3*attempt {
+		t.Errorf("answered in %s, want within %s", took, 3*attempt)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// schemes of the resolvers of Protector.GetResolvers, by their transport's.
+var resolverSchemes = map[string]string{
+	"udp": DNSSchemeUDP,
+	"tcp": DNSSchemeTCP,
+	"tls": DNSSchemeDoT,
+}
+
+// parseResolver parses an entry of Protector.GetResolvers, which is an ip
+// address, sent to over udp on port 53, or is annotated with its transport
+// as in "udp://8.8.8.8:53", "tcp://[2001:db8::1]" or, with the name its
+// certificate is for, "tls://1.1.1.1@one.one.one.one". Ports default to
+// those of the scheme.
+func parseResolver(entry string) (t DNSTransport, err error) {
+	t.Scheme = DNSSchemeUDP
+	rest := entry
+	if i := strings.Index(entry, "://"); i >= 0 {
+		scheme, ok := resolverSchemes[strings.ToLower(entry[:i])]
+		if !ok {
+			return t, fmt.Errorf("resolver %s: %w", entry, errBadScheme)
+		}
+		t.Scheme = scheme
+		rest = entry[i+len("://"):]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		if t.Scheme != DNSSchemeDoT {
+			return t, fmt.Errorf("resolver %s: server name without tls", entry)
+		}
+		t.ServerName = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	// an ip, bracketed or not if ipv6, with an optional port
+	host := rest
+	if h, port, err := net.SplitHostPort(rest); err == nil {
+		host = h
+		if t.Port, err = strconv.Atoi(port); err != nil {
+			return t, fmt.Errorf("resolver %s: bad port %s", entry, port)
+		}
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	t.Host = host
+	if err := t.validate(); err != nil {
+		return t, fmt.Errorf("resolver %s: %w", entry, err)
+	}
+	return t, nil
+}
+
+// annotated returns true if entry, of Protector.GetResolvers, has a scheme.
+func annotated(entry string) bool {
+	return strings.Contains(entry, "://")
+}
+
+// parsedResolvers holds the transports last parsed from the system's
+// resolvers, for as long as Protector.GetResolvers returns the same.
+var parsedResolvers struct {
+	sync.Mutex
+	parsed bool
+	raw    string
+	ts     []DNSTransport
+	err    error
+}
+
+// systemTransports returns the transports of the system's resolvers from
+// p if any is annotated with a scheme, and nil if all are plain ips, which
+// are sent to as they always were. Entries that don't parse are skipped,
+// and if none do, ErrNoResolvers is returned.
+func systemTransports(p Protector) ([]DNSTransport, error) {
+	raw := p.GetResolvers()
+	parsedResolvers.Lock()
+	defer parsedResolvers.Unlock()
+	if parsedResolvers.parsed && raw == parsedResolvers.raw {
+		return parsedResolvers.ts, parsedResolvers.err
+	}
+	ts, err := parseSystemResolvers(raw)
+	parsedResolvers.parsed = true
+	parsedResolvers.raw, parsedResolvers.ts, parsedResolvers.err = raw, ts, err
+	return ts, err
+}
+
+func parseSystemResolvers(raw string) ([]DNSTransport, error) {
+	entries := splitResolvers(raw)
+	any := false
+	for _, e := range entries {
+		if annotated(e) {
+			any = true
+			break
+		}
+	}
+	if !any {
+		return nil, nil
+	}
+	ts := make([]DNSTransport, 0, len(entries))
+	for _, e := range entries {
+		t, err := parseResolver(e)
+		if err != nil {
+			log.Warnf("skipping system resolver: %v", err)
+			continue
+		}
+		ts = append(ts, t)
+	}
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("system resolvers %s: %w", raw, ErrNoResolvers)
+	}
+	return ts, nil
+}
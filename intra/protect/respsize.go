@@ -0,0 +1,96 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minDNSResponseSize is the least max response size; all resolvers must
+// be able to answer in as many bytes (RFC 1035, section 2.3.4).
+const minDNSResponseSize = 512
+
+// ErrResponseTooLarge is returned for dns answers over the size set by
+// SetMaxDNSResponseSize.
+var ErrResponseTooLarge = errors.New("dns response too large")
+
+// maxResponse is the size beyond which dns answers are dropped, or 0 if
+// they aren't.
+var maxResponse int32
+
+// SetMaxDNSResponseSize has answers over n bytes, from any transport or
+// the system's resolvers, dropped with ErrResponseTooLarge, to bound the
+// memory a malicious resolver can have held; queries sent with an edns0
+// udp payload size over n advertise n instead. Sizes below 512 are taken
+// as 512; 0 or less removes the limit, beyond dns' own of 64k.
+func SetMaxDNSResponseSize(n int) {
+	if n <= 0 || n >= maxDNSMessageSize {
+		n = 0
+	} else if n < minDNSResponseSize {
+		n = minDNSResponseSize
+	}
+	atomic.StoreInt32(&maxResponse, int32(n))
+}
+
+// cappingResponses returns true if answers are limited in size.
+func cappingResponses() bool {
+	return atomic.LoadInt32(&maxResponse) > 0
+}
+
+func init() {
+	// for their answers to be capped in size
+	needDNSConn(func(*dialConfig) bool { return cappingResponses() })
+}
+
+// maxResponseSize returns the size beyond which answers are dropped.
+func maxResponseSize() int {
+	if n := int(atomic.LoadInt32(&maxResponse)); n > 0 {
+		return n
+	}
+	return maxDNSMessageSize
+}
+
+// tooLarge returns ErrResponseTooLarge if an answer of n bytes is over
+// the limit, or nil if it isn't.
+func tooLarge(n int) error {
+	if n > maxResponseSize() {
+		return ErrResponseTooLarge
+	}
+	return nil
+}
+
+// advertised returns q with its edns0 udp payload size lowered to the
+// max response size, if it is over it, or q if it isn't or can't be.
+func advertised(q []byte) []byte {
+	max := atomic.LoadInt32(&maxResponse)
+	if max <= 0 {
+		return q
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return q
+	}
+	for i := range msg.Additionals {
+		h := &msg.Additionals[i].Header
+		// the udp payload size is the class of the OPT record
+		if h.Type != dnsmessage.TypeOPT || int32(h.Class) <= max {
+			continue
+		}
+		h.Class = dnsmessage.Class(max)
+		b, err := msg.Pack()
+		if err != nil {
+			log.Warnf("dns: payload size not lowered: %v", err)
+			return q
+		}
+		return b
+	}
+	return q
+}
@@ -0,0 +1,205 @@
+package protect
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bigAnswer answers q with 100 A records, for well over 1k bytes.
+func bigAnswer(q []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.Additionals = nil
+	for i := 0; i < 100; i++ {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  msg.Questions[0].Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}},
+		})
+	}
+	ans, _ := msg.Pack()
+	return ans
+}
+
+func startBigUDPDNS(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		b := make([]byte, maxDNSMessageSize)
+		for {
+			n, from, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			c.WriteTo(bigAnswer(b[:n]), from)
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func startBigTCPDNS(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				var n [2]byte
+				if _, err := io.ReadFull(c, n[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(n[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				ans := bigAnswer(q)
+				binary.BigEndian.PutUint16(n[:], uint16(len(ans)))
+				c.Write(append(n[:], ans...))
+			}(c)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startBigDoH(t *testing.T) int {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		w.Write(bigAnswer(q))
+	}))
+	t.Cleanup(s.Close)
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(s.Certificate())
+	t.Cleanup(func() { rootCAs = nil })
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return port
+}
+
+func TestMaxDNSResponseSize(t *testing.T) {
+	for _, tr := range []DNSTransport{
+		{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: startBigUDPDNS(t)},
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: startBigTCPDNS(t)},
+		{Scheme: DNSSchemeDoH, Host: "127.0.0.1", Port: startBigDoH(t)},
+	} {
+		q := makeQuery(t, 7, "big.test.", dnsmessage.TypeA)
+		ans, err := tr.exchange(context.Background(), &net.Dialer{}, q)
+		if err != nil {
+			t.Fatalf("%s: %v", tr, err)
+		}
+		if len(ans) <= 1024 {
+			t.Fatalf("%s: answer of %d bytes, want over 1k", tr, len(ans))
+		}
+
+		SetMaxDNSResponseSize(1024)
+		ans, err = tr.exchange(context.Background(), &net.Dialer{}, q)
+		SetMaxDNSResponseSize(0)
+		if !errors.Is(err, ErrResponseTooLarge) {
+			t.Errorf("%s: got %d bytes, %v; want %v", tr, len(ans), err, ErrResponseTooLarge)
+		}
+	}
+}
+
+func TestMaxDNSResponseSizeLookup(t *testing.T) {
+	port := startBigTCPDNS(t)
+	if err := SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+	SetMaxDNSResponseSize(1024)
+	defer SetMaxDNSResponseSize(0)
+
+	d := MakeDialer(&fakeProtector{})
+	if ips, err := d.Resolver.LookupIP(context.Background(), "ip4", "big.test."); err == nil {
+		t.Errorf("got %d ips, want an error", len(ips))
+	}
+}
+
+func TestSetMaxDNSResponseSize(t *testing.T) {
+	defer SetMaxDNSResponseSize(0)
+	for _, c := range []struct{ n, want int }{
+		{0, maxDNSMessageSize},
+		{-1, maxDNSMessageSize},
+		{100, 512},
+		{4096, 4096},
+		{1 << 20, maxDNSMessageSize},
+	} {
+		SetMaxDNSResponseSize(c.n)
+		if got := maxResponseSize(); got != c.want {
+			t.Errorf("SetMaxDNSResponseSize(%d): %d, want %d", c.n, got, c.want)
+		}
+	}
+}
+
+func TestAdvertisedPayload(t *testing.T) {
+	defer SetMaxDNSResponseSize(0)
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("big.test."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(queryPayload, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := func(b []byte) int {
+		var m dnsmessage.Message
+		if err := m.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		return int(m.Additionals[0].Header.Class)
+	}
+
+	if got := payload(advertised(q)); got != queryPayload {
+		t.Errorf("payload %d without a limit, want %d", got, queryPayload)
+	}
+	SetMaxDNSResponseSize(4096)
+	if got := payload(advertised(q)); got != queryPayload {
+		t.Errorf("payload %d under the limit, want %d", got, queryPayload)
+	}
+	SetMaxDNSResponseSize(600)
+	if got := payload(advertised(q)); got != 600 {
+		t.Errorf("payload %d over the limit, want 600", got)
+	}
+	// queries without edns0 are sent as they are
+	plain := makeQuery(t, 7, "big.test.", dnsmessage.TypeA)
+	if got := advertised(plain); string(got) != string(plain) {
+		t.Error("query without edns0 changed")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// selfTestName is looked up by SelfTest.
+	selfTestName = "one.one.one.one."
+	// selfTestTimeout bounds SelfTest when ctx has no deadline.
+	selfTestTimeout = 10 * time.Second
+)
+
+// selfTestAddr is connected to by SelfTest; a var, for tests.
+var selfTestAddr = "1.1.1.1:443"
+
+// The steps of SelfTest, each with a protected dialer; vars, for tests.
+var (
+	selfTestLookup  = lookupStep
+	selfTestConnect = connectStep
+	selfTestDoH     = dohStep
+)
+
+var (
+	errNoAddrs = errors.New("no addresses")
+	// errSkipped is returned by steps that don't apply.
+	errSkipped = errors.New("skipped")
+)
+
+// SelfTestStep is the outcome of a step of SelfTest.
+type SelfTestStep struct {
+	// Ok is true if the step succeeded.
+	Ok bool `json:"ok"`
+	// Skipped is true if the step wasn't run, and so is neither ok nor not.
+	Skipped bool `json:"skipped,omitempty"`
+	// LatencyMs is how long the step took, in milliseconds.
+	LatencyMs int64 `json:"latencyMs"`
+	// Err describes why the step failed, if it did.
+	Err string `json:"err,omitempty"`
+}
+
+// SelfTestResult reports each step of SelfTest.
+type SelfTestResult struct {
+	// DNS is a lookup through the resolver of a protected dialer.
+	DNS SelfTestStep `json:"dns"`
+	// TCP is a protected tcp connect to a well-known address.
+	TCP SelfTestStep `json:"tcp"`
+	// DoH is a query to the first DoH transport set by SetDNSTransports,
+	// and is skipped if there is none.
+	DoH SelfTestStep `json:"doh"`
+}
+
+// Ok returns true if none of the steps failed.
+func (r SelfTestResult) Ok() bool {
+	for _, s := range []SelfTestStep{r.DNS, r.TCP, r.DoH} {
+		if !s.Ok && !s.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// JSON returns r serialized as a json object.
+func (r SelfTestResult) JSON() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// SelfTest checks that the dial path works with sockets protected by p:
+// it looks up a well-known name, connects to a well-known address and,
+// if set, queries a DoH transport. Steps are run in turn until ctx is
+// done, which fails the steps yet to finish. All sockets are closed by
+// the time SelfTest returns.
+func SelfTest(ctx context.Context, p Protector) SelfTestResult {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, selfTestTimeout)
+		defer cancel()
+	}
+	d := MakeDialer(p)
+	return SelfTestResult{
+		DNS: runStep(ctx, d, selfTestLookup),
+		TCP: runStep(ctx, d, selfTestConnect),
+		DoH: runStep(ctx, d, selfTestDoH),
+	}
+}
+
+func runStep(ctx context.Context, d *net.Dialer, step func(context.Context, *net.Dialer) error) (s SelfTestStep) {
+	start := time.Now()
+	err := ctx.Err()
+	if err == nil {
+		err = step(ctx, d)
+	}
+	s.LatencyMs = time.Since(start).Milliseconds()
+	switch err {
+	case nil:
+		s.Ok = true
+	case errSkipped:
+		s.Skipped = true
+	default:
+		s.Err = err.Error()
+	}
+	return
+}
+
+func lookupStep(ctx context.Context, d *net.Dialer) error {
+	ips, err := d.Resolver.LookupIPAddr(ctx, selfTestName)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return errNoAddrs
+	}
+	return nil
+}
+
+func connectStep(ctx context.Context, d *net.Dialer) error {
+	c, err := DialContext(ctx, d, "tcp", selfTestAddr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func dohStep(ctx context.Context, d *net.Dialer) error {
+	for _, t := range dnsTransports() {
+		if t.Scheme != DNSSchemeDoH {
+			continue
+		}
+		q, err := newQuery(selfTestName, dnsmessage.TypeA)
+		if err != nil {
+			return err
+		}
+		ans, err := t.exchange(ctx, d, q)
+		if err != nil {
+			return err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(ans)
+		if err != nil {
+			return err
+		}
+		if h.RCode != dnsmessage.RCodeSuccess {
+			return fmt.Errorf("doh %s: %s", t, h.RCode)
+		}
+		return nil
+	}
+	return errSkipped
+}
@@ -0,0 +1,120 @@
+package protect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubSelfTest replaces the steps of SelfTest until the returned func is called.
+func stubSelfTest(lookup, connect, doh func(context.Context, *net.Dialer) error) func() {
+	l, c, d := selfTestLookup, selfTestConnect, selfTestDoH
+	selfTestLookup, selfTestConnect, selfTestDoH = lookup, connect, doh
+	return func() {
+		selfTestLookup, selfTestConnect, selfTestDoH = l, c, d
+	}
+}
+
+func stepOk(context.Context, *net.Dialer) error      { return nil }
+func stepSkipped(context.Context, *net.Dialer) error { return errSkipped }
+
+func TestSelfTest(t *testing.T) {
+	refused := errors.New("refused")
+	for _, tc := range []struct {
+		name                 string
+		lookup, connect, doh func(context.Context, *net.Dialer) error
+		ok                   bool
+	}{
+		{"ok", stepOk, stepOk, stepOk, true},
+		{"no doh", stepOk, stepOk, stepSkipped, true},
+		{"dns fails", func(context.Context, *net.Dialer) error { return refused }, stepOk, stepSkipped, false},
+		{"tcp fails", stepOk, func(context.Context, *net.Dialer) error { return refused }, stepSkipped, false},
+		{"doh fails", stepOk, stepOk, func(context.Context, *net.Dialer) error { return refused }, false},
+	} {
+		restore := stubSelfTest(tc.lookup, tc.connect, tc.doh)
+		r := SelfTest(context.Background(), &fakeProtector{})
+		restore()
+		if r.Ok() != tc.ok {
+			t.Errorf("%s: ok %t, want %t: %s", tc.name, r.Ok(), tc.ok, r.JSON())
+		}
+		for _, s := range []SelfTestStep{r.DNS, r.TCP, r.DoH} {
+			if !s.Ok && !s.Skipped && s.Err != refused.Error() {
+				t.Errorf("%s: step failed with %q", tc.name, s.Err)
+			}
+		}
+	}
+}
+
+func TestSelfTestDeadline(t *testing.T) {
+	block := func(ctx context.Context, d *net.Dialer) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	defer stubSelfTest(stepOk, block, stepOk)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r := SelfTest(ctx, &fakeProtector{})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("self test took %s past its deadline", elapsed)
+	}
+	if !r.DNS.Ok {
+		t.Errorf("dns: %s", r.DNS.Err)
+	}
+	if r.TCP.Ok || r.DoH.Ok {
+		t.Errorf("steps past the deadline ok: %s", r.JSON())
+	}
+	if r.TCP.LatencyMs < 100 {
+		t.Errorf("tcp latency %dms, want the deadline", r.TCP.LatencyMs)
+	}
+}
+
+func TestSelfTestConnectCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := selfTestAddr
+	selfTestAddr = l.Addr().String()
+	defer func() { selfTestAddr = addr }()
+	defer stubSelfTest(stepOk, connectStep, stepSkipped)()
+
+	r := SelfTest(context.Background(), &fakeProtector{})
+	if !r.TCP.Ok {
+		t.Fatalf("tcp: %s", r.TCP.Err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("conn left open: %d %v", n, err)
+	}
+}
+
+func TestSelfTestJSON(t *testing.T) {
+	defer stubSelfTest(stepOk, stepOk, stepSkipped)()
+	var r map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(SelfTest(context.Background(), &fakeProtector{}).JSON()), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r["dns"]["ok"] != true || r["doh"]["skipped"] != true {
+		t.Errorf("got %v", r)
+	}
+}
+
+func TestDoHStepSkipped(t *testing.T) {
+	SetDNSTransports([]DNSTransport{{Scheme: DNSSchemeTCP, Host: "127.0.0.1"}})
+	defer SetDNSTransports(nil)
+	if err := dohStep(context.Background(), MakeDialer(&fakeProtector{})); err != errSkipped {
+		t.Errorf("got %v, want errSkipped", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// max number of servers whose tls sessions are kept for resumption.
+const tlsSessionCacheSize = 128
+
+// tlsSessions holds the tls.ClientSessionCache of DialTLS, DoT and DoH.
+var tlsSessions atomic.Value
+
+func init() {
+	ClearTLSSessionCache()
+}
+
+// ClearTLSSessionCache forgets the tls sessions kept to resume handshakes
+// with servers dialed before, by their server names, with DialTLS and the
+// DoT and DoH transports. Call it on network changes, as servers may be
+// different on the new network, and resumed sessions link the client's
+// handshakes across networks.
+func ClearTLSSessionCache() {
+	tlsSessions.Store(tls.NewLRUClientSessionCache(tlsSessionCacheSize))
+}
+
+func tlsSessionCache() tls.ClientSessionCache {
+	return tlsSessions.Load().(tls.ClientSessionCache)
+}
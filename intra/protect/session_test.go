@@ -0,0 +1,45 @@
+package protect
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// dialResumed dials the tls server at addr and returns whether the
+// handshake resumed a session.
+func dialResumed(t *testing.T, addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialTLS(ctx, MakeDialer(&fakeProtector{}), "tcp", addr, &TLSDialConfig{ServerName: "foo.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// tls 1.3 tickets arrive after the handshake; reading takes them in,
+	// until the server hangs up after the byte written.
+	c.Write([]byte{0})
+	c.Read(make([]byte, 1))
+	return c.ConnectionState().DidResume
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	cert := selfSigned(t, "foo.test")
+	defer func() { rootCAs = nil }()
+	l := startTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+	ClearTLSSessionCache()
+
+	if dialResumed(t, l.Addr().String()) {
+		t.Error("first handshake resumed")
+	}
+	if !dialResumed(t, l.Addr().String()) {
+		t.Error("second handshake not resumed")
+	}
+
+	ClearTLSSessionCache()
+	if dialResumed(t, l.Addr().String()) {
+		t.Error("handshake resumed after the cache was cleared")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// the os picks the source address of ipv6 sockets, as it's set to.
+	srcPrefDefault int32 = iota
+	// temporary (privacy) addresses, RFC 8981, are picked first.
+	srcPrefTemporary
+	// stable addresses are picked first.
+	srcPrefStable
+)
+
+// srcPref is the source address preference of ipv6 sockets.
+var srcPref int32
+
+// SetPreferTemporaryV6 has protected dialers pick, among the ipv6 source
+// addresses of the device, temporary (privacy) ones over stable ones if
+// prefer is set, and stable ones over temporary ones otherwise, as with
+// rule 7 of RFC 6724 source address selection; the RFC6724 sort policy
+// sees the sources so picked. Until set, the os picks as it's configured
+// to. Only supported on linux and android; a no-op elsewhere.
+func SetPreferTemporaryV6(prefer bool) {
+	pref := srcPrefStable
+	if prefer {
+		pref = srcPrefTemporary
+	}
+	atomic.StoreInt32(&srcPref, pref)
+}
+
+// srcPrefHook is a control hook that sets the source address preference,
+// if any, on sockets to ipv6 addresses.
+func srcPrefHook(network, address string, fd uintptr) error {
+	pref := atomic.LoadInt32(&srcPref)
+	if pref == srcPrefDefault {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		return nil
+	}
+	// best-effort; the os picks as it would otherwise
+	if err := setSrcPref(fd, pref == srcPrefTemporary); err != nil {
+		log.Warnf("source address preference of %s socket to %s: %v", network, address, err)
+	}
+	return nil
+}
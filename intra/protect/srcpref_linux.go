@@ -0,0 +1,31 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package protect
+
+import (
+	"syscall"
+)
+
+// from linux/in6.h; syscall has none of these.
+const (
+	ipv6AddrPreferences = 72 // IPV6_ADDR_PREFERENCES
+	preferSrcTmp        = 0x1
+	preferSrcPublic     = 0x2
+)
+
+// setSrcPref has ipv6 socket fd prefer temporary source addresses if tmp
+// is set, and public (stable) ones otherwise.
+func setSrcPref(fd uintptr, tmp bool) error {
+	v := preferSrcPublic
+	if tmp {
+		v = preferSrcTmp
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AddrPreferences, v)
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package protect
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestPreferTemporaryV6(t *testing.T) {
+	defer func() { srcPref = srcPrefDefault }()
+	l, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6: %v", err)
+	}
+	defer l.Close()
+
+	// reads the preference of each socket, after it's set
+	var got int
+	var gerr error
+	read := func(network, address string, fd uintptr) error {
+		got, gerr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AddrPreferences)
+		return nil
+	}
+	d := MakeDialerWithOpts(&fakeProtector{}, MakeDialerOpts{
+		ControlHooks: []func(string, string, uintptr) error{read},
+	})
+	dial := func(addr string) int {
+		gerr = nil
+		c, err := d.DialContext(context.Background(), "udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if gerr != nil {
+			t.Fatal(gerr)
+		}
+		return got
+	}
+
+	for _, tc := range []struct {
+		prefer bool
+		want   int
+	}{
+		{true, preferSrcTmp},
+		{false, preferSrcPublic},
+	} {
+		SetPreferTemporaryV6(tc.prefer)
+		if v := dial(l.LocalAddr().String()); v&(preferSrcTmp|preferSrcPublic) != tc.want {
+			t.Errorf("prefer temporary %v: preferences %#x, want %#x", tc.prefer, v, tc.want)
+		}
+	}
+
+	// ipv4 sockets, which have no such option, are left as is
+	c, err := d.DialContext(context.Background(), "udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
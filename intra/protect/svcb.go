@@ -0,0 +1,298 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeHTTPS is the HTTPS resource record type, RFC 9460 section 14.1.
+const typeHTTPS = dnsmessage.Type(65)
+
+// SvcParamKeys, RFC 9460 section 14.3.2.
+const (
+	svcParamMandatory     = 0
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+)
+
+// edns0 payload size advertised for queries; answers to HTTPS queries are
+// often too large for the classic 512 bytes once they carry ech configs.
+const queryPayload = 1232
+
+var (
+	errNoResolver   = errors.New("dialer has no resolver")
+	errBadSvcParams = errors.New("malformed svc params")
+)
+
+// HTTPSRecord is an HTTPS resource record, RFC 9460.
+type HTTPSRecord struct {
+	// Priority is 0 for records in alias mode, where only Target is set.
+	Priority uint16
+	// Target is the name to connect to; "." is the owner name itself.
+	Target string
+	// ALPN lists the protocols supported by the endpoint.
+	ALPN []string
+	// NoDefaultALPN is set if the endpoint doesn't support http/1.1.
+	NoDefaultALPN bool
+	// Port is the endpoint's port, or 0 if the default port is to be used.
+	Port int
+	// IPv4Hint and IPv6Hint are addresses of Target, which may be stale.
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+	// ECH is an ECHConfigList, see TLSDialConfig.
+	ECH []byte
+}
+
+// TLSDialConfig returns a config to DialTLS the endpoint in r, which
+// serves serverName, with the alpn and ech set by r.
+func (r *HTTPSRecord) TLSDialConfig(serverName string) *TLSDialConfig {
+	return &TLSDialConfig{
+		ServerName:    serverName,
+		NextProtos:    r.ALPN,
+		ECHConfigList: r.ECH,
+	}
+}
+
+// Addrs returns the hinted addresses of r as host:port, on r.Port if
+// set, or else on port.
+func (r *HTTPSRecord) Addrs(port int) []string {
+	if r.Port != 0 {
+		port = r.Port
+	}
+	p := strconv.Itoa(port)
+	addrs := make([]string, 0, len(r.IPv4Hint)+len(r.IPv6Hint))
+	for _, ip := range r.IPv4Hint {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+	}
+	for _, ip := range r.IPv6Hint {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+	}
+	return addrs
+}
+
+// ResolveHTTPS returns the HTTPS records of name, looked up through the
+// resolver of d, which must be from MakeDialer. Since net.Resolver can't
+// look these up, the query is sent on a conn from its Dial func; that is,
+// over the DNSTransports set or else to the system's resolvers.
+func ResolveHTTPS(ctx context.Context, d *net.Dialer, name string) ([]HTTPSRecord, error) {
+	if d.Resolver == nil || d.Resolver.Dial == nil {
+		return nil, errNoResolver
+	}
+	q, err := newQuery(name, typeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	ans, err := resolve(ctx, d.Resolver, q)
+	if err != nil {
+		return nil, err
+	}
+	return parseHTTPS(ans)
+}
+
+// resolve sends q over udp on a conn from r.Dial, and then over tcp if
+// the answer is truncated.
+func resolve(ctx context.Context, r *net.Resolver, q []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transportTimeout)
+		defer cancel()
+	}
+	ans, err := resolverExchange(ctx, r, "udp", q)
+	if err == nil && truncated(ans) {
+		ans, err = resolverExchange(ctx, r, "tcp", q)
+	}
+	return ans, err
+}
+
+func newQuery(name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  qname,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(queryPayload, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// resolverExchange sends q on a conn from r.Dial and returns its answer.
+func resolverExchange(ctx context.Context, r *net.Resolver, network string, q []byte) ([]byte, error) {
+	// the address is only used for its ip family, see replaceIP.
+	c, err := r.Dial(ctx, network, "0.0.0.0:53")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	return connExchange(c, q)
+}
+
+func parseHTTPS(ans []byte) ([]HTTPSRecord, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(ans)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("https query: %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var records []HTTPSRecord
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rh.Type != typeHTTPS {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		res, err := p.UnknownResource()
+		if err != nil {
+			return nil, err
+		}
+		r, err := parseSVCB(res.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// parseSVCB parses the rdata of an SVCB or HTTPS record, RFC 9460 section 2.2.
+func parseSVCB(b []byte) (r HTTPSRecord, err error) {
+	if len(b) < 2 {
+		return r, errShortMessage
+	}
+	r.Priority = binary.BigEndian.Uint16(b)
+	b = b[2:]
+
+	// the target name is never compressed, RFC 9460 section 2.2.
+	var labels []string
+	for {
+		if len(b) < 1 {
+			return r, errShortMessage
+		}
+		n := int(b[0])
+		b = b[1:]
+		if n == 0 {
+			break
+		}
+		if n > 63 || len(b) < n {
+			return r, errBadSvcParams
+		}
+		labels = append(labels, string(b[:n]))
+		b = b[n:]
+	}
+	r.Target = strings.Join(labels, ".") + "."
+
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return r, errBadSvcParams
+		}
+		key := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			return r, errBadSvcParams
+		}
+		v := b[:n]
+		b = b[n:]
+
+		switch key {
+		case svcParamALPN:
+			for len(v) > 0 {
+				l := int(v[0])
+				if l == 0 || len(v) < 1+l {
+					return r, errBadSvcParams
+				}
+				r.ALPN = append(r.ALPN, string(v[1:1+l]))
+				v = v[1+l:]
+			}
+		case svcParamNoDefaultALPN:
+			r.NoDefaultALPN = true
+		case svcParamPort:
+			if len(v) != 2 {
+				return r, errBadSvcParams
+			}
+			r.Port = int(binary.BigEndian.Uint16(v))
+		case svcParamIPv4Hint:
+			if len(v) == 0 || len(v)%net.IPv4len != 0 {
+				return r, errBadSvcParams
+			}
+			for ; len(v) > 0; v = v[net.IPv4len:] {
+				r.IPv4Hint = append(r.IPv4Hint, net.IP(append([]byte{}, v[:net.IPv4len]...)))
+			}
+		case svcParamIPv6Hint:
+			if len(v) == 0 || len(v)%net.IPv6len != 0 {
+				return r, errBadSvcParams
+			}
+			for ; len(v) > 0; v = v[net.IPv6len:] {
+				r.IPv6Hint = append(r.IPv6Hint, net.IP(append([]byte{}, v[:net.IPv6len]...)))
+			}
+		case svcParamECH:
+			r.ECH = append([]byte{}, v...)
+		case svcParamMandatory:
+			// all keys that this parser knows of are always parsed.
+		default:
+			log.Debugf("https record: unknown svc param %d", key)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,169 @@
+package protect
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var echConfig = []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+
+// cannedSVCB is the rdata of an HTTPS record in service mode for the
+// owner name, with alpn h2,h3, port 8443, ipv4hint 192.0.2.1,192.0.2.2,
+// ech echConfig and ipv6hint 2001:db8::1.
+func cannedSVCB() []byte {
+	b := []byte{0x00, 0x01} // priority
+	b = append(b, 0x00)     // target: "."
+	param := func(key uint16, v []byte) {
+		var kl [4]byte
+		binary.BigEndian.PutUint16(kl[:], key)
+		binary.BigEndian.PutUint16(kl[2:], uint16(len(v)))
+		b = append(b, kl[:]...)
+		b = append(b, v...)
+	}
+	param(svcParamALPN, []byte{2, 'h', '2', 2, 'h', '3'})
+	param(svcParamPort, []byte{0x20, 0xfb})
+	param(svcParamIPv4Hint, []byte{192, 0, 2, 1, 192, 0, 2, 2})
+	param(svcParamECH, echConfig)
+	param(svcParamIPv6Hint, net.ParseIP("2001:db8::1"))
+	return b
+}
+
+func wantHTTPSRecord() HTTPSRecord {
+	return HTTPSRecord{
+		Priority: 1,
+		Target:   ".",
+		ALPN:     []string{"h2", "h3"},
+		Port:     8443,
+		IPv4Hint: []net.IP{{192, 0, 2, 1}, {192, 0, 2, 2}},
+		IPv6Hint: []net.IP{net.ParseIP("2001:db8::1")},
+		ECH:      echConfig,
+	}
+}
+
+// httpsAnswer answers q with cannedSVCB, preceded by a cname.
+func httpsAnswer(t testing.TB, q []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	question, err := p.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	cname := dnsmessage.MustNewName("svc.test.")
+	b.CNAMEResource(dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  dnsmessage.TypeCNAME,
+		Class: dnsmessage.ClassINET,
+		TTL:   60,
+	}, dnsmessage.CNAMEResource{CNAME: cname})
+	if err := b.UnknownResource(dnsmessage.ResourceHeader{
+		Name:  cname,
+		Type:  typeHTTPS,
+		Class: dnsmessage.ClassINET,
+		TTL:   60,
+	}, dnsmessage.UnknownResource{Type: typeHTTPS, Data: cannedSVCB()}); err != nil {
+		t.Fatal(err)
+	}
+	ans, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ans
+}
+
+func TestParseHTTPS(t *testing.T) {
+	q, err := newQuery("foo.test", typeHTTPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := parseHTTPS(httpsAnswer(t, q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if want := wantHTTPSRecord(); !reflect.DeepEqual(records[0], want) {
+		t.Errorf("got %+v, want %+v", records[0], want)
+	}
+
+	addrs := records[0].Addrs(443)
+	if want := []string{"192.0.2.1:8443", "192.0.2.2:8443", "[2001:db8::1]:8443"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got addrs %v, want %v", addrs, want)
+	}
+	conf := records[0].TLSDialConfig("foo.test")
+	if !reflect.DeepEqual(conf.NextProtos, []string{"h2", "h3"}) || !reflect.DeepEqual(conf.ECHConfigList, echConfig) {
+		t.Errorf("hints not in tls config: %+v", conf)
+	}
+}
+
+func TestParseSVCBMalformed(t *testing.T) {
+	for name, rdata := range map[string][]byte{
+		"empty":          {},
+		"no target":      {0x00, 0x01},
+		"short label":    {0x00, 0x01, 0x05, 'a', 0x00},
+		"short param":    {0x00, 0x01, 0x00, 0x00, 0x03, 0x00},
+		"short value":    {0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x02, 0x01},
+		"bad ipv4hint":   {0x00, 0x01, 0x00, 0x00, 0x04, 0x00, 0x03, 1, 2, 3},
+		"bad alpn":       {0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x02, 0x05, 'h'},
+		"zero-len alpn":  {0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00},
+		"long port":      {0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x03, 0, 0, 1},
+		"empty ipv6hint": {0x00, 0x01, 0x00, 0x00, 0x06, 0x00, 0x00},
+	} {
+		if _, err := parseSVCB(rdata); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestResolveHTTPS(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			c.WriteTo(httpsAnswer(t, b[:n]), addr)
+		}
+	}()
+
+	err = SetDNSTransports([]DNSTransport{
+		{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: c.LocalAddr().(*net.UDPAddr).Port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	records, err := ResolveHTTPS(context.Background(), MakeDialer(&fakeProtector{}), "foo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], wantHTTPSRecord()) {
+		t.Errorf("unexpected records: %+v", records)
+	}
+}
+
+func TestResolveHTTPSNoResolver(t *testing.T) {
+	if _, err := ResolveHTTPS(context.Background(), &net.Dialer{}, "foo.test"); err != errNoResolver {
+		t.Errorf("got %v, want errNoResolver", err)
+	}
+}
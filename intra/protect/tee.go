@@ -0,0 +1,115 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// chunks queued for the inspector of a TeeConn; beyond this, chunks are
+// dropped rather than holding up the conn.
+const teeQueue = 64
+
+type teeChunk struct {
+	w io.Writer
+	b []byte
+}
+
+// TeeConn is a conn that mirrors the bytes read from it to rx and those
+// written to it to tx. Writes to rx and tx happen in the order the bytes
+// were read or written, but on a goroutine of their own, so that a slow
+// inspector never stalls the conn; once it falls behind by more than a
+// few chunks, further chunks are dropped until it catches up.
+type TeeConn struct {
+	net.Conn
+	rx, tx  io.Writer
+	dropped int64 // atomic
+
+	mu     sync.Mutex
+	closed bool
+	chunks chan teeChunk
+}
+
+// NewTeeConn returns c teeing its reads to rx and its writes to tx,
+// either of which may be nil.
+func NewTeeConn(c net.Conn, rx, tx io.Writer) *TeeConn {
+	t := &TeeConn{
+		Conn:   c,
+		rx:     rx,
+		tx:     tx,
+		chunks: make(chan teeChunk, teeQueue),
+	}
+	go t.drain()
+	return t
+}
+
+func (t *TeeConn) drain() {
+	for c := range t.chunks {
+		c.w.Write(c.b)
+	}
+}
+
+func (t *TeeConn) tee(w io.Writer, b []byte) {
+	if w == nil || len(b) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.chunks <- teeChunk{w, append([]byte{}, b...)}:
+	default:
+		atomic.AddInt64(&t.dropped, int64(len(b)))
+	}
+}
+
+func (t *TeeConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.tee(t.rx, b[:n])
+	return n, err
+}
+
+func (t *TeeConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.tee(t.tx, b[:n])
+	return n, err
+}
+
+// Close closes the conn; chunks already queued are still written out.
+func (t *TeeConn) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.chunks)
+	}
+	t.mu.Unlock()
+	return t.Conn.Close()
+}
+
+// Dropped returns the number of bytes not teed as the inspector fell behind.
+func (t *TeeConn) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+// MakeTeeDialer returns a dialer that dials with d and wraps each conn in
+// a TeeConn, teeing to the writers inspector returns for it.
+func MakeTeeDialer(d ContextDialer, inspector func(c net.Conn) (rx, tx io.Writer)) ContextDialer {
+	return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		rx, tx := inspector(c)
+		return NewTeeConn(c, rx, tx), nil
+	})
+}
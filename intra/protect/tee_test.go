@@ -0,0 +1,127 @@
+package protect
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for use by the tee goroutine and tests.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// stuckWriter blocks every write until unblocked.
+type stuckWriter struct {
+	unblock chan struct{}
+}
+
+func (s *stuckWriter) Write(p []byte) (int, error) {
+	<-s.unblock
+	return len(p), nil
+}
+
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTeeConn(t *testing.T) {
+	l := echoListener(t)
+	defer l.Close()
+
+	var rx, tx syncBuffer
+	d := MakeTeeDialer(&net.Dialer{}, func(net.Conn) (io.Writer, io.Writer) {
+		return &rx, &tx
+	})
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "hello, inspector"
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for (rx.String() != msg || tx.String() != msg) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rx.String() != msg {
+		t.Errorf("rx got %q, want %q", rx.String(), msg)
+	}
+	if tx.String() != msg {
+		t.Errorf("tx got %q, want %q", tx.String(), msg)
+	}
+}
+
+func TestTeeConnSlowInspector(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+
+	stuck := &stuckWriter{unblock: make(chan struct{})}
+	defer close(stuck.unblock)
+	c := NewTeeConn(a, nil, stuck)
+	defer c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10*teeQueue; i++ {
+			if _, err := c.Write([]byte("chunk")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes stalled by inspector")
+	}
+	if c.Dropped() == 0 {
+		t.Error("no bytes dropped")
+	}
+}
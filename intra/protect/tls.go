@@ -0,0 +1,139 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+var (
+	// ErrECHRejected is returned when the server declines the ECH config.
+	ErrECHRejected = errors.New("ech rejected")
+	// ErrECHUnsupported is returned when this build can't do ECH.
+	ErrECHUnsupported = errors.New("ech unsupported")
+	// ErrDisallowedALPN is returned when the negotiated protocol is not
+	// in TLSDialConfig.AllowedALPN.
+	ErrDisallowedALPN = errors.New("alpn not allowed")
+)
+
+// TLSDialConfig configures DialTLS.
+type TLSDialConfig struct {
+	// ServerName is verified against the server's certificate and sent
+	// as SNI; defaults to the host dialed.
+	ServerName string
+	// NextProtos are the ALPN protocols to offer; defaults to AllowedALPN.
+	NextProtos []string
+	// AllowedALPN, if set, fails dials that do not negotiate one of these
+	// protocols, such as to force h2 over http/1.1.
+	AllowedALPN []string
+	// ECHConfigList, as published in the ech param of HTTPS/SVCB records,
+	// encrypts the ClientHello; on-path observers see the public name of
+	// the config in place of ServerName.
+	ECHConfigList []byte
+	// ECHFallback redials with ServerName in plaintext if the server rejects
+	// ECHConfigList or this build doesn't support ECH. Else, such dials fail.
+	ECHFallback bool
+}
+
+// DialTLS dials addr over network using d and completes a tls handshake
+// on it, per cfg, which may be nil. Sessions are resumed where possible,
+// see ClearTLSSessionCache. The peer's certificates are reported to the
+// func of OnPeerCertificates, if any.
+func DialTLS(ctx context.Context, d *net.Dialer, network, addr string, cfg *TLSDialConfig) (*tls.Conn, error) {
+	if cfg == nil {
+		cfg = &TLSDialConfig{}
+	}
+	sni := cfg.ServerName
+	if len(sni) == 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		sni = host
+	}
+	nextProtos := cfg.NextProtos
+	if len(nextProtos) == 0 {
+		nextProtos = cfg.AllowedALPN
+	}
+	conf := &tls.Config{
+		ServerName:         sni,
+		NextProtos:         nextProtos,
+		RootCAs:            rootCAs,
+		ClientSessionCache: tlsSessionCache(),
+	}
+
+	c, err := dialTLS(ctx, d, network, addr, conf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkALPN(c, cfg.AllowedALPN); err != nil {
+		c.Close()
+		return nil, err
+	}
+	observePeerCertificates(sni, c.ConnectionState().PeerCertificates)
+	return c, nil
+}
+
+func dialTLS(ctx context.Context, d *net.Dialer, network, addr string, conf *tls.Config, cfg *TLSDialConfig) (*tls.Conn, error) {
+	if len(cfg.ECHConfigList) > 0 {
+		c, err := dialECH(ctx, d, network, addr, conf, cfg.ECHConfigList)
+		if err == nil || !cfg.ECHFallback {
+			return c, err
+		}
+		if !errors.Is(err, ErrECHRejected) && !errors.Is(err, ErrECHUnsupported) {
+			return nil, err
+		}
+		log.Warnf("tls %s: %v; falling back to plaintext sni", addr, err)
+	}
+	return tlsHandshake(ctx, d, network, addr, conf)
+}
+
+// checkALPN returns ErrDisallowedALPN if c negotiated none of allowed,
+// which, if empty, allows any protocol.
+func checkALPN(c *tls.Conn, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	proto := c.ConnectionState().NegotiatedProtocol
+	for _, a := range allowed {
+		if proto == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrDisallowedALPN, proto)
+}
+
+func dialECH(ctx context.Context, d *net.Dialer, network, addr string, conf *tls.Config, echConfigList []byte) (*tls.Conn, error) {
+	conf = conf.Clone()
+	if err := setECH(conf, echConfigList); err != nil {
+		return nil, err
+	}
+	c, err := tlsHandshake(ctx, d, network, addr, conf)
+	return c, echError(err)
+}
+
+func tlsHandshake(ctx context.Context, d *net.Dialer, network, addr string, conf *tls.Config) (*tls.Conn, error) {
+	c, err := DialContext(ctx, d, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, conf)
+	setDeadline(ctx, tc)
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
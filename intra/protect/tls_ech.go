@@ -0,0 +1,31 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.23
+// +build go1.23
+
+package protect
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+func setECH(conf *tls.Config, echConfigList []byte) error {
+	conf.EncryptedClientHelloConfigList = echConfigList
+	// ech is tls1.3 only
+	conf.MinVersion = tls.VersionTLS13
+	return nil
+}
+
+func echError(err error) error {
+	var rejected *tls.ECHRejectionError
+	if errors.As(err, &rejected) {
+		return fmt.Errorf("%w: %v", ErrECHRejected, err)
+	}
+	return err
+}
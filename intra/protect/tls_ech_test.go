@@ -0,0 +1,120 @@
+//go:build go1.24
+// +build go1.24
+
+package protect
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	echPublicName = "public.example"
+	echInnerName  = "secret.example"
+)
+
+// echKey returns an ECHConfig for echPublicName (draft-ietf-tls-esni-18,
+// section 4) with x25519, hkdf-sha256 and aes-128-gcm, and its private key.
+func echKey(t *testing.T) tls.EncryptedClientHelloKey {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var c []byte
+	c = append(c, 1)          // config_id
+	c = append(c, 0x00, 0x20) // kem_id: dhkem(x25519, hkdf-sha256)
+	c = binary.BigEndian.AppendUint16(c, uint16(len(pub)))
+	c = append(c, pub...)
+	c = append(c, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01) // hkdf-sha256, aes-128-gcm
+	c = append(c, 0)                                  // maximum_name_length
+	c = append(c, byte(len(echPublicName)))
+	c = append(c, echPublicName...)
+	c = append(c, 0x00, 0x00) // no extensions
+
+	var config []byte
+	config = append(config, 0xfe, 0x0d) // version
+	config = binary.BigEndian.AppendUint16(config, uint16(len(c)))
+	config = append(config, c...)
+
+	return tls.EncryptedClientHelloKey{
+		Config:      config,
+		PrivateKey:  priv.Bytes(),
+		SendAsRetry: true,
+	}
+}
+
+func echConfigList(k tls.EncryptedClientHelloKey) []byte {
+	l := binary.BigEndian.AppendUint16(nil, uint16(len(k.Config)))
+	return append(l, k.Config...)
+}
+
+func dialECHTest(t *testing.T, l net.Listener, echList []byte, fallback bool) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return DialTLS(ctx, MakeDialer(&fakeProtector{}), "tcp", l.Addr().String(), &TLSDialConfig{
+		ServerName:    echInnerName,
+		ECHConfigList: echList,
+		ECHFallback:   fallback,
+	})
+}
+
+func TestDialTLSWithECH(t *testing.T) {
+	cert := selfSigned(t, echPublicName, echInnerName)
+	defer func() { rootCAs = nil }()
+	key := echKey(t)
+	l := startTLS(t, &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key},
+	})
+	defer l.Close()
+
+	c, err := dialECHTest(t, l, echConfigList(key), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.ConnectionState().ECHAccepted {
+		t.Error("ech not accepted")
+	}
+	if !l.sawName(echPublicName) {
+		t.Error("outer sni is not the public name")
+	}
+	if l.sawName(echInnerName) {
+		t.Error("inner sni leaked")
+	}
+}
+
+func TestDialTLSECHRejected(t *testing.T) {
+	cert := selfSigned(t, echPublicName, echInnerName)
+	defer func() { rootCAs = nil }()
+	// the server doesn't do ech, and so answers for the public name
+	l := startTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+
+	list := echConfigList(echKey(t))
+	if _, err := dialECHTest(t, l, list, false); !errors.Is(err, ErrECHRejected) {
+		t.Fatalf("got %v, want ErrECHRejected", err)
+	}
+
+	c, err := dialECHTest(t, l, list, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.ConnectionState().ECHAccepted {
+		t.Error("ech accepted by a server without ech")
+	}
+	if !l.sawName(echInnerName) {
+		t.Error("fallback did not send plaintext sni")
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !go1.23
+// +build !go1.23
+
+package protect
+
+import "crypto/tls"
+
+// crypto/tls supports ech from go1.23.
+func setECH(conf *tls.Config, echConfigList []byte) error {
+	return ErrECHUnsupported
+}
+
+func echError(err error) error {
+	return err
+}
@@ -0,0 +1,155 @@
+package protect
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate valid for names, and adds it to rootCAs.
+func selfSigned(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// recordingListener keeps a copy of all bytes read from accepted conns.
+type recordingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	seen bytes.Buffer
+}
+
+type recordingConn struct {
+	net.Conn
+	l *recordingListener
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{c, l}, nil
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.l.mu.Lock()
+	c.l.seen.Write(b[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+func (l *recordingListener) sawName(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return bytes.Contains(l.seen.Bytes(), []byte(name))
+}
+
+// startTLS serves tls per conf, which may enable ech, until closed.
+func startTLS(t *testing.T, conf *tls.Config) *recordingListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &recordingListener{Listener: l}
+	go func() {
+		for {
+			c, err := rl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tc := tls.Server(c, conf)
+				tc.Handshake()
+				tc.Read(make([]byte, 1))
+			}(c)
+		}
+	}()
+	return rl
+}
+
+func TestDialTLSAllowedALPN(t *testing.T) {
+	cert := selfSigned(t, "foo.test")
+	defer func() { rootCAs = nil }()
+
+	for _, tc := range []struct {
+		server []string
+		want   error
+	}{
+		{[]string{"h2", "http/1.1"}, nil},
+		{[]string{"http/1.1"}, ErrDisallowedALPN},
+		{nil, ErrDisallowedALPN},
+	} {
+		l := startTLS(t, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   tc.server,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := DialTLS(ctx, MakeDialer(&fakeProtector{}), "tcp", l.Addr().String(), &TLSDialConfig{
+			ServerName:  "foo.test",
+			NextProtos:  []string{"h2", "http/1.1"},
+			AllowedALPN: []string{"h2"},
+		})
+		cancel()
+		l.Close()
+		if !errors.Is(err, tc.want) {
+			t.Errorf("server %v: got %v, want %v", tc.server, err, tc.want)
+		}
+		if err == nil {
+			if p := c.ConnectionState().NegotiatedProtocol; p != "h2" {
+				t.Errorf("server %v: negotiated %q", tc.server, p)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestDialTLSOffersAllowedALPN(t *testing.T) {
+	cert := selfSigned(t, "foo.test")
+	defer func() { rootCAs = nil }()
+	l := startTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	defer l.Close()
+
+	c, err := DialTLS(context.Background(), MakeDialer(&fakeProtector{}), "tcp", l.Addr().String(), &TLSDialConfig{
+		ServerName:  "foo.test",
+		AllowedALPN: []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
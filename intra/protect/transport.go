@@ -0,0 +1,655 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNSSchemeUDP = "udp"
+	DNSSchemeTCP = "tcp"
+	DNSSchemeDoT = "dot"
+	DNSSchemeDoH = "doh"
+)
+
+const (
+	// time given to a single transport before the next one is tried.
+	transportTimeout = 3 * time.Second
+	// max size of a dns message over any of the transports.
+	maxDNSMessageSize = 65535
+)
+
+var (
+	errNoTransport  = errors.New("no dns transport")
+	errBadScheme    = errors.New("unknown dns transport scheme")
+	errBadHost      = errors.New("dns transport host must be an ip address")
+	errIDMismatch   = errors.New("dns response id mismatch")
+	errBadAnswer    = errors.New("dns answer does not match query")
+	errShortMessage = errors.New("dns message too short")
+	errDoHStatus    = errors.New("doh server returned non-200 status")
+	errConnClosed   = errors.New("dns conn closed")
+)
+
+// rootCAs verify dot and doh servers; nil uses the system's roots.
+var rootCAs *x509.CertPool
+
+// strict is 1 when answers must match the query's question, not just its id.
+var strict int32 = 1
+
+// DNSTransport describes an upstream DNS server and the transport
+// used to reach it.
+type DNSTransport struct {
+	// Scheme is one of DNSSchemeUDP, DNSSchemeTCP, DNSSchemeDoT, DNSSchemeDoH.
+	Scheme string
+	// Host is the IP address of the server. Hostnames are not allowed
+	// since resolving them needs the very resolver being configured.
+	Host string
+	// Port is the server's port; 0 picks the scheme's default.
+	Port int
+	// ServerName is the name the certificates of DoT and DoH servers are
+	// verified against, and sent as sni; if empty, it is Host.
+	ServerName string
+
+	// time given to the server before the next one is tried, as set by
+	// SetResolverChain; 0 is transportTimeout.
+	timeout time.Duration
+}
+
+// SetDNSTransports sets the transports the resolver path queries, tried
+// in order until one answers. Once set, system resolvers from
+// Protector.GetResolvers are no longer used and neither is port 53
+// assumed. A nil or empty ts reverts to the system resolvers.
+func SetDNSTransports(ts []DNSTransport) error {
+	c, err := validTransports(ts)
+	if err != nil {
+		return err
+	}
+	updateDialConfig(func(dc *dialConfig) {
+		dc.transports = c
+	})
+	return nil
+}
+
+// validTransports returns a copy of ts, if all of them are valid.
+func validTransports(ts []DNSTransport) ([]DNSTransport, error) {
+	for _, t := range ts {
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+	}
+	c := make([]DNSTransport, len(ts))
+	copy(c, ts)
+	return c, nil
+}
+
+// SetStrictDNSValidation sets whether answers from DNSTransports must echo
+// the question (name, type, class) of the query besides its id. Answers that
+// don't are dropped as spoofed: over udp the resolver keeps waiting for the
+// genuine answer until its timeout, over other transports the query fails.
+// Enabled by default.
+func SetStrictDNSValidation(s bool) {
+	var v int32
+	if s {
+		v = 1
+	}
+	atomic.StoreInt32(&strict, v)
+}
+
+func dnsTransports() []DNSTransport {
+	return loadDialConfig().transports
+}
+
+func (t DNSTransport) validate() error {
+	switch t.Scheme {
+	case DNSSchemeUDP, DNSSchemeTCP, DNSSchemeDoT, DNSSchemeDoH:
+	default:
+		return fmt.Errorf("%w: %s", errBadScheme, t.Scheme)
+	}
+	if net.ParseIP(t.Host) == nil {
+		return fmt.Errorf("%w: %s", errBadHost, t.Host)
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid dns transport port: %d", t.Port)
+	}
+	return nil
+}
+
+func (t DNSTransport) port() int {
+	if t.Port > 0 {
+		return t.Port
+	}
+	switch t.Scheme {
+	case DNSSchemeDoT:
+		return 853
+	case DNSSchemeDoH:
+		return 443
+	default:
+		return 53
+	}
+}
+
+func (t DNSTransport) addr() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.port()))
+}
+
+func (t DNSTransport) String() string {
+	return t.Scheme + "://" + t.addr()
+}
+
+// exchange sends q to t's server over d and returns the answer.
+func (t DNSTransport) exchange(ctx context.Context, d *net.Dialer, q []byte) ([]byte, error) {
+	q = advertised(q)
+	switch t.Scheme {
+	case DNSSchemeUDP:
+		return cookieExchange(t.addr(), q, func(q []byte) ([]byte, error) {
+			return udpExchange(ctx, d, t.addr(), q)
+		})
+	case DNSSchemeTCP:
+		return cookieExchange(t.addr(), q, func(q []byte) ([]byte, error) {
+			return tcpExchange(ctx, d, t.addr(), q)
+		})
+	case DNSSchemeDoT:
+		return dotExchange(ctx, d, t.addr(), t.ServerName, padded(q))
+	case DNSSchemeDoH:
+		return dohExchange(ctx, d, t.addr(), t.ServerName, padded(q))
+	}
+	return nil, errBadScheme
+}
+
+// exchangeAny walks ts in order, returning the first answer to q, or the
+// errors of each if none answers.
+func exchangeAny(ctx context.Context, d *net.Dialer, ts []DNSTransport, q []byte) (ans []byte, err error) {
+	if len(ts) == 0 {
+		return nil, errNoTransport
+	}
+	var errs multiDialError
+	candidates := func() []string {
+		s := make([]string, len(ts))
+		for i, t := range ts {
+			s[i] = t.String()
+		}
+		return s
+	}
+	// the walk as a whole is bounded by the time given to each transport
+	ctx, cancelWalk := context.WithTimeout(ctx, walkTimeout(ts))
+	defer cancelWalk()
+	for _, t := range ts {
+		observeSelection(q, candidates, t.String())
+		timeout := t.timeoutOrDefault()
+		if attempt := dialConfigOf(ctx).attempt; attempt > 0 && t.timeout == 0 {
+			timeout = attempt
+		}
+		tctx, cancel := context.WithTimeout(ctx, timeout)
+		ans, err = t.exchange(tctx, d, q)
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Warnf("dns transport %s failed: %v", t, err)
+		errs.add(t.String(), err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errs.err()
+}
+
+func (t DNSTransport) timeoutOrDefault() time.Duration {
+	if t.timeout > 0 {
+		return t.timeout
+	}
+	return transportTimeout
+}
+
+// walkTimeout is the time exchangeAny takes, at most, to walk ts.
+func walkTimeout(ts []DNSTransport) (total time.Duration) {
+	for _, t := range ts {
+		total += t.timeoutOrDefault()
+	}
+	return
+}
+
+func queryID(q []byte) (uint16, error) {
+	if len(q) < 2 {
+		return 0, errShortMessage
+	}
+	return binary.BigEndian.Uint16(q), nil
+}
+
+// validate returns an error if ans is not an answer to q.
+func validate(q, ans []byte) error {
+	id, err := queryID(q)
+	if err != nil {
+		return err
+	}
+	if aid, err := queryID(ans); err != nil {
+		return err
+	} else if aid != id {
+		return errIDMismatch
+	}
+	if cookiesEnabled() {
+		if err := checkCookie(q, ans); err != nil {
+			return err
+		}
+	}
+	if atomic.LoadInt32(&strict) == 0 {
+		return nil
+	}
+
+	var qp, ap dnsmessage.Parser
+	if _, err := qp.Start(q); err != nil {
+		return err
+	}
+	h, err := ap.Start(ans)
+	if err != nil {
+		return err
+	}
+	if !h.Response {
+		return errBadAnswer
+	}
+	qq, err := qp.Question()
+	if err != nil {
+		return err
+	}
+	aq, err := ap.Question()
+	if err != nil {
+		return errBadAnswer
+	}
+	if qq.Type != aq.Type || qq.Class != aq.Class ||
+		!strings.EqualFold(qq.Name.String(), aq.Name.String()) {
+		return errBadAnswer
+	}
+	return nil
+}
+
+func truncated(ans []byte) bool {
+	return len(ans) > 2 && ans[2]&0x02 == 0x02
+}
+
+func setDeadline(ctx context.Context, c net.Conn) {
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	}
+}
+
+func udpExchange(ctx context.Context, d *net.Dialer, addr string, q []byte) ([]byte, error) {
+	if _, err := queryID(q); err != nil {
+		return nil, err
+	}
+	// A connected socket only sees datagrams from addr, but anyone
+	// on-path can still race a forged answer to it.
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+	b := make([]byte, maxDNSMessageSize)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := validate(q, b[:n]); err != nil {
+			// not ours; keep waiting for the real answer
+			log.Warnf("dns: dropped answer from %s: %v", addr, err)
+			continue
+		}
+		if truncated(b[:n]) {
+			return tcpExchange(ctx, d, addr, q)
+		}
+		if err := tooLarge(n); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+
+func tcpExchange(ctx context.Context, d *net.Dialer, addr string, q []byte) ([]byte, error) {
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+	return streamExchange(c, q)
+}
+
+func dotExchange(ctx context.Context, d *net.Dialer, addr, name string, q []byte) ([]byte, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) > 0 {
+		host = name
+	}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, &tls.Config{
+		ServerName:         host,
+		RootCAs:            rootCAs,
+		ClientSessionCache: tlsSessionCache(),
+	})
+	defer tc.Close()
+	setDeadline(ctx, tc)
+	if err = tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return streamExchange(tc, q)
+}
+
+// connExchange sends q on c, a dialed udp or tcp conn, and returns its answer.
+func connExchange(c net.Conn, q []byte) ([]byte, error) {
+	if _, ok := c.(net.PacketConn); !ok {
+		return streamExchange(c, q)
+	}
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		ans := buf[:n]
+		if err := validate(q, ans); err != nil {
+			log.Warnf("dns: dropped answer from %s: %v", c.RemoteAddr(), err)
+			continue
+		}
+		if err := tooLarge(n); err != nil {
+			return nil, err
+		}
+		return append([]byte{}, ans...), nil
+	}
+}
+
+// streamExchange writes q prefixed by its length to c and reads
+// back a similarly framed answer, as per RFC 7766.
+func streamExchange(c net.Conn, q []byte) ([]byte, error) {
+	if _, err := queryID(q); err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(q)+2)
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+	// oversized answers aren't read, let alone held
+	n := int(binary.BigEndian.Uint16(b))
+	if err := tooLarge(n); err != nil {
+		return nil, err
+	}
+	ans := make([]byte, n)
+	if _, err := io.ReadFull(c, ans); err != nil {
+		return nil, err
+	}
+	if err := validate(q, ans); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+func dohExchange(ctx context.Context, d *net.Dialer, addr, name string, q []byte) ([]byte, error) {
+	id, err := queryID(q)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 recommends a query id of 0 for cache friendliness.
+	zq := make([]byte, len(q))
+	copy(zq, q)
+	binary.BigEndian.PutUint16(zq, 0)
+
+	req, err := http.NewRequest(http.MethodPost, "https://"+addr+"/dns-query", bytes.NewReader(zq))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	const mimetype = "application/dns-message"
+	req.Header.Set("Content-Type", mimetype)
+	req.Header.Set("Accept", mimetype)
+	req.Header.Set("User-Agent", "")
+	if len(name) > 0 {
+		req.Host = name
+	}
+
+	tr := &http.Transport{
+		DialContext:       d.DialContext,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{ServerName: name, RootCAs: rootCAs, ClientSessionCache: tlsSessionCache()},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", errDoHStatus, res.StatusCode)
+	}
+	// a byte over the limit tells oversized answers apart
+	max := maxResponseSize()
+	ans, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ans) > max {
+		return nil, ErrResponseTooLarge
+	}
+	if len(ans) < 2 {
+		return nil, errShortMessage
+	}
+	binary.BigEndian.PutUint16(ans, id)
+	if err := validate(q, ans); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+// dnsAddr is the net.Addr of a dnsConn, and of conns to unresolved targets.
+type dnsAddr struct {
+	network string
+	address string
+}
+
+func (a dnsAddr) Network() string { return a.network }
+func (a dnsAddr) String() string  { return a.address }
+
+// dnsConn is handed to net.Resolver in place of a socket to a nameserver.
+// It answers every query written to it by calling exchange, which lets
+// the Go resolver speak to servers over transports it doesn't support
+// natively. Queries are length-prefixed when stream is set, just as
+// they would be on a tcp socket.
+type dnsConn struct {
+	ctx      context.Context
+	stream   bool
+	raddr    dnsAddr
+	exchange func(context.Context, []byte) ([]byte, error)
+
+	sync.Mutex
+	deadline time.Time
+	wbuf     []byte   // partially written queries (stream only)
+	rbuf     []byte   // unread answers (stream only)
+	answers  [][]byte // unread answers (packet only)
+	closed   bool
+}
+
+// dnsPacketConn is a dnsConn that the Go resolver treats as a udp socket.
+type dnsPacketConn struct {
+	*dnsConn
+}
+
+// dnsConnNeeds holds what needsDNSConn asks of each feature; features add
+// to it with needDNSConn from the init of their files.
+var dnsConnNeeds []func(cfg *dialConfig) bool
+
+// needDNSConn has needsDNSConn ask need whether a feature needs the queries
+// of dials configured by cfg.
+func needDNSConn(need func(cfg *dialConfig) bool) {
+	dnsConnNeeds = append(dnsConnNeeds, need)
+}
+
+// needsDNSConn returns true if queries to the system's resolvers, of dials
+// configured by cfg, go through a dnsConn, as some feature needs them.
+func needsDNSConn(cfg *dialConfig) bool {
+	for _, need := range dnsConnNeeds {
+		if need(cfg) {
+			return true
+		}
+	}
+	return false
+}
+
+func newDNSConn(ctx context.Context, network, address string,
+	exchange func(context.Context, []byte) ([]byte, error)) net.Conn {
+	c := &dnsConn{
+		ctx:      ctx,
+		stream:   network == "tcp" || network == "tcp4" || network == "tcp6",
+		raddr:    dnsAddr{network, address},
+		exchange: exchange,
+	}
+	if c.stream {
+		return c
+	}
+	return &dnsPacketConn{c}
+}
+
+func (c *dnsConn) query(q []byte) ([]byte, error) {
+	c.Lock()
+	deadline := c.deadline
+	c.Unlock()
+
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return c.exchange(ctx, q)
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return 0, errConnClosed
+	}
+	if !c.stream {
+		c.Unlock()
+		ans, err := c.query(b)
+		if err != nil {
+			return 0, err
+		}
+		c.Lock()
+		c.answers = append(c.answers, ans)
+		c.Unlock()
+		return len(b), nil
+	}
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf)) + 2
+		if len(c.wbuf) < n {
+			break
+		}
+		q := c.wbuf[2:n]
+		c.wbuf = c.wbuf[n:]
+		c.Unlock()
+		ans, err := c.query(q)
+		if err != nil {
+			return 0, err
+		}
+		c.Lock()
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(ans)))
+		c.rbuf = append(append(c.rbuf, l[:]...), ans...)
+	}
+	c.Unlock()
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return 0, errConnClosed
+	}
+	if !c.stream {
+		if len(c.answers) == 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		n := copy(b, c.answers[0])
+		c.answers = c.answers[1:]
+		return n, nil
+	}
+	if len(c.rbuf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *dnsConn) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return dnsAddr{c.raddr.network, ""} }
+func (c *dnsConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *dnsConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *dnsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.raddr, err
+}
+
+func (c *dnsPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
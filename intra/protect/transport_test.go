@@ -0,0 +1,320 @@
+package protect
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var fooIP = net.IPv4(10, 0, 0, 1)
+
+// answer responds to A queries with fooIP and to all others with no records.
+func answer(q []byte) []byte {
+	return answerWith(q, fooIP)
+}
+
+func answerWith(q []byte, ip net.IP) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Additionals = nil
+	for _, question := range msg.Questions {
+		if question.Type != dnsmessage.TypeA {
+			continue
+		}
+		var a [4]byte
+		copy(a[:], ip.To4())
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.AResource{A: a},
+		})
+	}
+	ans, _ := msg.Pack()
+	return ans
+}
+
+// serveTCPDNS answers length-prefixed queries on l with ip until l is closed.
+func serveTCPDNS(l net.Listener, ip net.IP) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			for {
+				var l [2]byte
+				if _, err := io.ReadFull(c, l[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				ans := answerWith(q, ip)
+				binary.BigEndian.PutUint16(l[:], uint16(len(ans)))
+				c.Write(append(l[:], ans...))
+			}
+		}(c)
+	}
+}
+
+func startTCPDNS(t testing.TB, ip net.IP) (net.Listener, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPDNS(l, ip)
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+// Returns a udp port on localhost that nothing listens on.
+func deadUDPPort(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	c.Close()
+	return port
+}
+
+// Returns a tcp port on localhost that refuses connections.
+func deadTCPPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func lookupFoo(t *testing.T, d *net.Dialer) {
+	ips, err := d.Resolver.LookupIPAddr(context.Background(), "foo.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].IP.Equal(fooIP) {
+		t.Fatalf("unexpected answer: %v", ips)
+	}
+}
+
+func TestTransportFallbackToTCP(t *testing.T) {
+	l, port := startTCPDNS(t, fooIP)
+	defer l.Close()
+
+	err := SetDNSTransports([]DNSTransport{
+		{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: deadUDPPort(t)},
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	p := &fakeProtector{}
+	lookupFoo(t, MakeDialer(p))
+	if len(p.fds) < 2 {
+		t.Errorf("transport sockets not protected: %v", p.fds)
+	}
+}
+
+func TestTransportFallbackToDoH(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q, _ := ioutil.ReadAll(r.Body)
+		if id := binary.BigEndian.Uint16(q); id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(answer(q))
+	}))
+	defer s.Close()
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(s.Certificate())
+	defer func() { rootCAs = nil }()
+
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	err := SetDNSTransports([]DNSTransport{
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: deadTCPPort(t)},
+		{Scheme: DNSSchemeDoH, Host: "127.0.0.1", Port: port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	lookupFoo(t, MakeDialer(&fakeProtector{}))
+}
+
+func TestTransportAllBlocked(t *testing.T) {
+	err := SetDNSTransports([]DNSTransport{
+		{Scheme: DNSSchemeUDP, Host: "127.0.0.1", Port: deadUDPPort(t)},
+		{Scheme: DNSSchemeTCP, Host: "127.0.0.1", Port: deadTCPPort(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDNSTransports(nil)
+
+	d := MakeDialer(&fakeProtector{})
+	if _, err := d.Resolver.LookupIPAddr(context.Background(), "foo.test."); err == nil {
+		t.Fatal("lookup succeeded with all transports blocked")
+	}
+}
+
+func TestInvalidTransports(t *testing.T) {
+	bad := []DNSTransport{
+		{Scheme: "quic", Host: "127.0.0.1"},
+		{Scheme: DNSSchemeDoT, Host: "dns.google"},
+		{Scheme: DNSSchemeUDP, Host: "8.8.8.8", Port: 65536},
+	}
+	for _, tr := range bad {
+		if err := SetDNSTransports([]DNSTransport{tr}); err == nil {
+			t.Errorf("%v accepted", tr)
+		}
+	}
+	if ts := dnsTransports(); len(ts) != 0 {
+		t.Errorf("invalid transports were set: %v", ts)
+	}
+}
+
+func TestTransportDefaultPorts(t *testing.T) {
+	for scheme, want := range map[string]string{
+		DNSSchemeUDP: "1.1.1.1:53",
+		DNSSchemeTCP: "1.1.1.1:53",
+		DNSSchemeDoT: "1.1.1.1:853",
+		DNSSchemeDoH: "1.1.1.1:443",
+	} {
+		tr := DNSTransport{Scheme: scheme, Host: "1.1.1.1"}
+		if got := tr.addr(); got != want {
+			t.Errorf("%s: got %s, want %s", scheme, got, want)
+		}
+	}
+}
+
+func makeQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// startSpoofingUDPDNS answers each query with spoofed answers first: one
+// with the wrong id and one for a different name, then with the real one.
+func startSpoofingUDPDNS(t *testing.T) (net.PacketConn, int) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := append([]byte{}, b[:n]...)
+			ans := answer(q)
+
+			wrongID := append([]byte{}, ans...)
+			binary.BigEndian.PutUint16(wrongID, binary.BigEndian.Uint16(q)+1)
+			c.WriteTo(wrongID, addr)
+
+			var msg dnsmessage.Message
+			msg.Unpack(q)
+			msg.Questions[0].Name = dnsmessage.MustNewName("evil.test.")
+			evilq, _ := msg.Pack()
+			c.WriteTo(answerWith(evilq, net.IPv4(6, 6, 6, 6)), addr)
+
+			c.WriteTo(ans, addr)
+		}
+	}()
+	return c, c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPExchangeDropsSpoofedAnswers(t *testing.T) {
+	c, port := startSpoofingUDPDNS(t)
+	defer c.Close()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	q := makeQuery(t, 0xbeef, "foo.test.", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ans, err := udpExchange(ctx, MakeDialer(&fakeProtector{}), addr, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(ans); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 0xbeef || msg.Questions[0].Name.String() != "foo.test." {
+		t.Fatalf("spoofed answer accepted: %+v", msg)
+	}
+	if a := msg.Answers[0].Body.(*dnsmessage.AResource).A; !net.IP(a[:]).Equal(fooIP) {
+		t.Fatalf("spoofed ip accepted: %v", a)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	q := makeQuery(t, 1, "foo.test.", dnsmessage.TypeA)
+	if err := validate(q, answer(q)); err != nil {
+		t.Errorf("valid answer rejected: %v", err)
+	}
+	// 0x20 randomized case must still match
+	if err := validate(q, answer(makeQuery(t, 1, "FoO.tEsT.", dnsmessage.TypeA))); err != nil {
+		t.Errorf("mixed-case answer rejected: %v", err)
+	}
+	for name, ans := range map[string][]byte{
+		"wrong id":    answer(makeQuery(t, 2, "foo.test.", dnsmessage.TypeA)),
+		"wrong name":  answer(makeQuery(t, 1, "bar.test.", dnsmessage.TypeA)),
+		"wrong type":  answer(makeQuery(t, 1, "foo.test.", dnsmessage.TypeAAAA)),
+		"not answer":  q,
+		"short":       {0},
+		"no question": {0, 1, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if err := validate(q, ans); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	SetStrictDNSValidation(false)
+	defer SetStrictDNSValidation(true)
+	if err := validate(q, answer(makeQuery(t, 1, "bar.test.", dnsmessage.TypeA))); err != nil {
+		t.Errorf("lax validation rejected answer: %v", err)
+	}
+}
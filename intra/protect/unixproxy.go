@@ -0,0 +1,290 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyProto is the protocol spoken to a proxy.
+type ProxyProto int
+
+const (
+	// ProxyProtoSOCKS5 is SOCKS5 without auth, RFC 1928; proxies that
+	// select any other auth method fail dials with ErrUnsupportedSocksAuth.
+	ProxyProtoSOCKS5 ProxyProto = iota
+	// ProxyProtoHTTP is an HTTP/1.1 CONNECT tunnel, RFC 7231 section 4.3.6.
+	ProxyProtoHTTP
+	// ProxyProtoSOCKS4 is SOCKS4 CONNECT to ipv4 addresses only.
+	ProxyProtoSOCKS4
+	// ProxyProtoSOCKS4A is SOCKS4a CONNECT, which also sends hostnames for
+	// the proxy to resolve.
+	ProxyProtoSOCKS4A
+)
+
+var (
+	errBadProxyProto = errors.New("unknown proxy protocol")
+	errProxyRefused  = errors.New("proxy refused connect")
+	errSOCKS4Addr    = errors.New("socks4 connects only to ipv4 addresses")
+	errSOCKS5Version = errors.New("socks5 proxy replied with another version")
+
+	// ErrUnsupportedSocksAuth is returned for socks5 proxies that select an
+	// auth method other than none, such as GSSAPI, or accept no method.
+	ErrUnsupportedSocksAuth = errors.New("socks5 proxy selected an unsupported auth method")
+)
+
+// socks5 auth methods, RFC 1928 section 3
+const (
+	socks5NoAuth       = 0x00
+	socks5GSSAPI       = 0x01
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+)
+
+// ContextDialer dials using a context.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type contextDialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f contextDialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// unixDialer dials the proxy at path; unix sockets never leave the
+// device, and so are not protected.
+type unixDialer struct {
+	net.Dialer
+	path string
+}
+
+func (d *unixDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *unixDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx, "unix", d.path)
+}
+
+// MakeUnixProxyDialer returns a dialer that tunnels tcp connections through
+// the proxy listening on the unix domain socket at socketPath, speaking proto.
+// Dials fail with an error if proto is unknown.
+func MakeUnixProxyDialer(socketPath string, proto ProxyProto) ContextDialer {
+	return proxyOver(proto, "unix", socketPath, &unixDialer{path: socketPath})
+}
+
+// forwarder dials the proxy at network and addr, whatever it is asked to dial.
+type forwarder interface {
+	proxy.Dialer
+	ContextDialer
+}
+
+// proxyOver returns a dialer that speaks proto to the proxy at network and
+// addr, over conns from fwd.
+func proxyOver(proto ProxyProto, network, addr string, fwd forwarder) ContextDialer {
+	switch proto {
+	case ProxyProtoSOCKS5:
+		return socks5Over(network, addr, fwd)
+	case ProxyProtoHTTP:
+		return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return httpConnect(ctx, fwd, network, addr)
+		})
+	case ProxyProtoSOCKS4, ProxyProtoSOCKS4A:
+		return contextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return socks4Connect(ctx, fwd, network, addr, proto == ProxyProtoSOCKS4A)
+		})
+	}
+	return contextDialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errBadProxyProto
+	})
+}
+
+// httpConnect asks the http proxy reached by d to tunnel to addr.
+func httpConnect(ctx context.Context, d ContextDialer, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http connect: network %s: %w", network, errBadProxyProto)
+	}
+	c, err := d.DialContext(ctx, "unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	setDeadline(ctx, c)
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	if _, err := c.Write([]byte(req)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("%w: %s: %s", errProxyRefused, addr, res.Status)
+	}
+	c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the proxy sent bytes from addr along with its response
+		return &bufferedConn{c, br}, nil
+	}
+	return c, nil
+}
+
+// socks4Connect asks the socks4 proxy reached by d to connect to addr; with
+// v4a, hostnames in addr are sent as-is for the proxy to resolve.
+func socks4Connect(ctx context.Context, d ContextDialer, network, addr string, v4a bool) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("socks4 connect: network %s: %w", network, errBadProxyProto)
+	}
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// VN, CD (connect), DSTPORT, DSTIP, USERID (empty) and its NUL
+	req := []byte{4, 1, byte(port >> 8), byte(port), 0, 0, 0, 0, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("%w: %s", errSOCKS4Addr, addr)
+		}
+		copy(req[4:8], ip4)
+	} else if v4a {
+		// 0.0.0.x, x non-zero, is followed by the NUL-terminated hostname
+		req[7] = 1
+		req = append(append(req, host...), 0)
+	} else {
+		return nil, fmt.Errorf("%w: %s", errSOCKS4Addr, addr)
+	}
+
+	c, err := d.DialContext(ctx, "unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	setDeadline(ctx, c)
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// VN (0), CD, DSTPORT, DSTIP
+	res := make([]byte, 8)
+	if _, err := io.ReadFull(c, res); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if res[1] != 90 { // request granted
+		c.Close()
+		return nil, fmt.Errorf("%w: %s: socks4 code %d", errProxyRefused, addr, res[1])
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// socks5Over returns a dialer that speaks socks5, offering no auth, to the
+// proxy at network and addr, over conns from d; hostnames are sent as-is
+// for the proxy to resolve. Its conns are those from d, so that their
+// sockets can be had, as they can for the other protocols.
+func socks5Over(network, addr string, d ContextDialer) ContextDialer {
+	// never fails; and the returned dialer always has DialWithConn
+	pd, _ := proxy.SOCKS5(network, addr, nil, nil)
+	sd := pd.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, addr string) (net.Addr, error)
+	})
+	return contextDialerFunc(func(ctx context.Context, dstNetwork, dst string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := sd.DialWithConn(ctx, &authCheckedConn{Conn: c}, dstNetwork, dst); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// authCheckedConn fails the read of the first reply of a socks5 proxy, its
+// method selection, unless no auth is selected; without auth, x/net/proxy
+// offers only that, but goes on with whatever method the proxy selects.
+type authCheckedConn struct {
+	net.Conn
+	checked bool
+	sel     []byte // the selection, yet to be read
+}
+
+func (c *authCheckedConn) Read(b []byte) (int, error) {
+	if !c.checked {
+		// VER, METHOD
+		sel := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, sel); err != nil {
+			return 0, err
+		}
+		if err := checkAuthMethod(sel); err != nil {
+			return 0, err
+		}
+		c.checked, c.sel = true, sel
+	}
+	if len(c.sel) > 0 {
+		n := copy(b, c.sel)
+		c.sel = c.sel[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// checkAuthMethod returns an error unless sel, a socks5 method selection,
+// selects no auth.
+func checkAuthMethod(sel []byte) error {
+	if sel[0] != 5 {
+		return fmt.Errorf("%w: %d", errSOCKS5Version, sel[0])
+	}
+	switch sel[1] {
+	case socks5NoAuth:
+		return nil
+	case socks5NoAcceptable:
+		return fmt.Errorf("%w: no acceptable methods", ErrUnsupportedSocksAuth)
+	case socks5GSSAPI:
+		return fmt.Errorf("%w: gssapi", ErrUnsupportedSocksAuth)
+	case socks5UserPass:
+		return fmt.Errorf("%w: username/password", ErrUnsupportedSocksAuth)
+	default:
+		return fmt.Errorf("%w: %#02x", ErrUnsupportedSocksAuth, sel[1])
+	}
+}
+
+// bufferedConn reads from r, which buffers the conn, before the conn itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
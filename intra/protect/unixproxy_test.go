@@ -0,0 +1,316 @@
+//go:build !windows
+// +build !windows
+
+package protect
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startEcho returns the address of a tcp server that echoes back.
+func startEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func listenUnix(t *testing.T) (net.Listener, string) {
+	dir, err := ioutil.TempDir("", "uds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, path
+}
+
+// serveProxy relays each conn accepted on l to the target that handshake
+// reads off it, until l is closed.
+func serveProxy(l net.Listener, handshake func(c net.Conn, r *bufio.Reader) (string, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			target, err := handshake(c, r)
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer up.Close()
+			go io.Copy(up, r)
+			io.Copy(c, up)
+		}()
+	}
+}
+
+// socks5Handshake serves a no-auth socks5 connect, RFC 1928.
+func socks5Handshake(c net.Conn, r *bufio.Reader) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, hdr[1])); err != nil {
+		return "", err
+	}
+	c.Write([]byte{5, 0}) // no auth
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks4Handshake serves a socks4 or socks4a connect.
+func socks4Handshake(c net.Conn, r *bufio.Reader) (string, error) {
+	req := make([]byte, 8)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	if req[0] != 4 || req[1] != 1 {
+		c.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+		return "", io.ErrUnexpectedEOF
+	}
+	if _, err := r.ReadString(0); err != nil { // userid
+		return "", err
+	}
+	host := net.IP(req[4:8]).String()
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+		name, err := r.ReadString(0)
+		if err != nil {
+			return "", err
+		}
+		host = name[:len(name)-1]
+		if host != "echo.test" {
+			c.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+			return "", io.ErrUnexpectedEOF
+		}
+		host = "127.0.0.1"
+	}
+	c.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(req[2:4])))), nil
+}
+
+func httpConnectHandshake(c net.Conn, r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		c.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return "", io.ErrUnexpectedEOF
+	}
+	c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host, nil
+}
+
+func echoThrough(t *testing.T, d ContextDialer, target string) {
+	c, err := d.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("got %q, want ping", b)
+	}
+}
+
+func TestUnixSOCKS5Proxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, socks5Handshake)
+
+	echoThrough(t, MakeUnixProxyDialer(path, ProxyProtoSOCKS5), echo.Addr().String())
+}
+
+func TestUnixHTTPProxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, httpConnectHandshake)
+
+	echoThrough(t, MakeUnixProxyDialer(path, ProxyProtoHTTP), echo.Addr().String())
+}
+
+func TestUnixSOCKS4Proxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, socks4Handshake)
+
+	d := MakeUnixProxyDialer(path, ProxyProtoSOCKS4)
+	echoThrough(t, d, echo.Addr().String())
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	for _, addr := range []string{net.JoinHostPort("echo.test", port), net.JoinHostPort("::1", port)} {
+		if _, err := d.DialContext(context.Background(), "tcp", addr); !errors.Is(err, errSOCKS4Addr) {
+			t.Errorf("%s: got %v, want errSOCKS4Addr", addr, err)
+		}
+	}
+}
+
+func TestUnixSOCKS4AProxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, socks4Handshake)
+
+	d := MakeUnixProxyDialer(path, ProxyProtoSOCKS4A)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	// the proxy alone knows echo.test
+	echoThrough(t, d, net.JoinHostPort("echo.test", port))
+	echoThrough(t, d, echo.Addr().String())
+	if _, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("nx.test", port)); !errors.Is(err, errProxyRefused) {
+		t.Errorf("got %v, want errProxyRefused", err)
+	}
+}
+
+func TestUnixProxyBadProto(t *testing.T) {
+	d := MakeUnixProxyDialer("/nonexistent.sock", ProxyProto(42))
+	if _, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:80"); err != errBadProxyProto {
+		t.Errorf("got %v, want errBadProxyProto", err)
+	}
+}
+
+// socks5SelectingHandshake serves a socks5 proxy that selects method and
+// then waits, as one expecting that method's subnegotiation would.
+func socks5SelectingHandshake(method byte) func(c net.Conn, r *bufio.Reader) (string, error) {
+	return func(c net.Conn, r *bufio.Reader) (string, error) {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(r, make([]byte, hdr[1])); err != nil {
+			return "", err
+		}
+		c.Write([]byte{5, method})
+		r.ReadByte()
+		return "", io.ErrUnexpectedEOF
+	}
+}
+
+func TestSOCKS5UnsupportedAuth(t *testing.T) {
+	for _, method := range []byte{socks5GSSAPI, socks5UserPass, 0x80, socks5NoAcceptable} {
+		l, path := listenUnix(t)
+		go serveProxy(l, socks5SelectingHandshake(method))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := MakeUnixProxyDialer(path, ProxyProtoSOCKS5).DialContext(ctx, "tcp", "192.0.2.1:80")
+		cancel()
+		l.Close()
+		if !errors.Is(err, ErrUnsupportedSocksAuth) {
+			t.Errorf("method %#x: got %v, want ErrUnsupportedSocksAuth", method, err)
+		}
+	}
+}
+
+func TestSOCKS5BadVersion(t *testing.T) {
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, func(c net.Conn, r *bufio.Reader) (string, error) {
+		c.Write([]byte{4, socks5NoAuth})
+		return "", io.ErrUnexpectedEOF
+	})
+	_, err := MakeUnixProxyDialer(path, ProxyProtoSOCKS5).DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if !errors.Is(err, errSOCKS5Version) {
+		t.Errorf("got %v, want errSOCKS5Version", err)
+	}
+}
+
+func TestSOCKS5Hostname(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	l, path := listenUnix(t)
+	defer l.Close()
+	go serveProxy(l, func(c net.Conn, r *bufio.Reader) (string, error) {
+		target, err := socks5Handshake(c, r)
+		if err != nil {
+			return "", err
+		}
+		host, port, _ := net.SplitHostPort(target)
+		if host != "echo.test" {
+			return "", io.ErrUnexpectedEOF
+		}
+		_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+		if port != echoPort {
+			return "", io.ErrUnexpectedEOF
+		}
+		return echo.Addr().String(), nil
+	})
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	echoThrough(t, MakeUnixProxyDialer(path, ProxyProtoSOCKS5), net.JoinHostPort("echo.test", port))
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// preConnectValidator holds the connValidator set, nil if none.
+var preConnectValidator atomic.Value
+
+type connValidator func(conn net.Conn, target string) error
+
+// SetPreConnectValidator sets f to be called with each conn DialContext
+// connects, and the address it was asked to dial, before the conn is
+// returned; if f returns an error, the conn is closed and the dial fails
+// with it. f may read from the conn, as to check for a captive portal,
+// and bytes it reads are read again by the dialer's caller. Reads and
+// writes f makes time out with the dial's context. A nil f removes it.
+func SetPreConnectValidator(f func(conn net.Conn, target string) error) {
+	preConnectValidator.Store(connValidator(f))
+}
+
+// validated returns c, as validated by the validator, if any; c is closed
+// if it isn't valid.
+func validated(ctx context.Context, c net.Conn, target string) (net.Conn, error) {
+	v, _ := preConnectValidator.Load().(connValidator)
+	if v == nil {
+		return c, nil
+	}
+	// cancelation of ctx, like its deadline, interrupts the validator's io
+	setDeadline(ctx, c)
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	pc := &peekingConn{Conn: c}
+	err := v(pc, target)
+	close(done)
+	<-exited
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	if len(pc.peeked) == 0 {
+		return c, nil
+	}
+	rc := &replayConn{Conn: c, replay: pc.peeked}
+	if tc, ok := c.(*net.TCPConn); ok {
+		return &replayTCPConn{rc, tc}, nil
+	}
+	return rc, nil
+}
+
+// peekingConn keeps the bytes read from it.
+type peekingConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.peeked = append(c.peeked, b[:n]...)
+	return n, err
+}
+
+// replayConn reads the bytes in replay before those still on the conn.
+type replayConn struct {
+	net.Conn
+	replay []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// replayTCPConn is a replayConn that can still be half-closed, as tcp
+// conns are by the tunnel.
+type replayTCPConn struct {
+	*replayConn
+	tcp *net.TCPConn
+}
+
+// SyscallConn returns the raw conn of the socket, as of *net.TCPConn.
+func (c *replayTCPConn) SyscallConn() (syscall.RawConn, error) { return c.tcp.SyscallConn() }
+
+func (c *replayTCPConn) CloseRead() error  { return c.tcp.CloseRead() }
+func (c *replayTCPConn) CloseWrite() error { return c.tcp.CloseWrite() }
+
+func (c *replayTCPConn) ReadFrom(r io.Reader) (int64, error) {
+	return c.tcp.ReadFrom(r)
+}
@@ -0,0 +1,104 @@
+package protect
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startGreeter serves conns that are sent greeting, and then closed.
+func startGreeter(t *testing.T, greeting string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(greeting))
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func TestPreConnectValidator(t *testing.T) {
+	errPortal := errors.New("captive portal")
+	var seen string
+	SetPreConnectValidator(func(c net.Conn, target string) error {
+		seen = target
+		b := make([]byte, 1)
+		if _, err := c.Read(b); err != nil {
+			return err
+		}
+		if b[0] == 'H' {
+			return errPortal
+		}
+		return nil
+	})
+	defer SetPreConnectValidator(nil)
+	d := MakeDialer(&fakeProtector{})
+
+	portal := startGreeter(t, "HTTP/1.1 302 Found")
+	defer portal.Close()
+	if _, err := DialContext(context.Background(), d, "tcp", portal.Addr().String()); err != errPortal {
+		t.Errorf("got %v, want errPortal", err)
+	}
+	if seen != portal.Addr().String() {
+		t.Errorf("validated %s, want %s", seen, portal.Addr())
+	}
+
+	// the byte peeked is read by the caller too
+	server := startGreeter(t, "SSH-2.0")
+	defer server.Close()
+	c, err := DialContext(context.Background(), d, "tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(interface{ CloseWrite() error }); !ok {
+		t.Error("tcp conn can't be half-closed")
+	}
+	if b, err := ioutil.ReadAll(c); err != nil || string(b) != "SSH-2.0" {
+		t.Errorf("read %q, %v; want SSH-2.0", b, err)
+	}
+}
+
+func TestPreConnectValidatorContext(t *testing.T) {
+	// a server that says nothing, for the validator to wait on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	SetPreConnectValidator(func(c net.Conn, target string) error {
+		_, err := c.Read(make([]byte, 1))
+		return err
+	})
+	defer SetPreConnectValidator(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := DialContext(ctx, MakeDialer(&fakeProtector{}), "tcp", l.Addr().String()); err == nil {
+		t.Error("dial succeeded after its context was canceled")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("validation took %v after cancel", took)
+	}
+}
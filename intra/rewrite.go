@@ -0,0 +1,64 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// targetRewriter holds the rewriterFunc of SetTargetRewriter, which may be
+// nil; a func of a named type, unlike a nil interface, can be stored.
+var targetRewriter atomic.Value
+
+type rewriterFunc func(protocol int32, target string) (string, error)
+
+// SetTargetRewriter sets f to be called with the protocol, 6 for tcp or 17
+// for udp as in protect.Flow, and target ip:port of each flow once it is
+// decided, but before it is dialed, say, to redirect it to a mirror. Flows
+// are dialed to the ip:port f returns instead, over the net-id they were
+// decided to, though apps still see them as to target; a hostname, which
+// the tunnel can't resolve in its stead, or an error blocks them. Flows to
+// dns, as intercepted by the tunnel, and to loopback aren't rewritten. f
+// is called as flows are set up and must not block. A nil f removes it.
+func SetTargetRewriter(f func(protocol int32, target string) (string, error)) {
+	targetRewriter.Store(rewriterFunc(f))
+}
+
+// rewriteTarget returns the ip and port the flow of protocol to target is
+// to be dialed to instead, if rewritten, and an error if it is blocked.
+func rewriteTarget(protocol int32, target string) (ip net.IP, port int, rewritten bool, err error) {
+	r, _ := targetRewriter.Load().(rewriterFunc)
+	if r == nil {
+		return nil, 0, false, nil
+	}
+	dst, err := r(protocol, target)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if dst == target {
+		return nil, 0, false, nil
+	}
+	host, p, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if ip = net.ParseIP(host); ip == nil {
+		return nil, 0, false, fmt.Errorf("target %s rewritten to a hostname, %s", target, dst)
+	}
+	if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+		return nil, 0, false, fmt.Errorf("target %s rewritten to bad port %s", target, p)
+	}
+	return ip, port, true, nil
+}
+
+// udpRewrite maps the target of a udp flow to what it is rewritten to.
+type udpRewrite struct {
+	from, to *net.UDPAddr
+}
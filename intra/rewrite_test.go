@@ -0,0 +1,139 @@
+package intra
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// fromUDPConn is a fakeUDPConn that reports the source of the datagrams
+// written to it.
+type fromUDPConn struct {
+	fakeUDPConn
+	from chan *net.UDPAddr
+}
+
+func (c *fromUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.from <- addr
+	return len(data), nil
+}
+
+func TestTargetRewriteTCP(t *testing.T) {
+	defer SetTargetRewriter(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mirror := l.Addr().String()
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}
+
+	var seen string
+	SetTargetRewriter(func(protocol int32, dst string) (string, error) {
+		if protocol != 6 {
+			t.Errorf("rewriter called for protocol %d", protocol)
+		}
+		seen = dst
+		return mirror, nil
+	})
+
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(&countingProtector{}), &fakeFlow{protect.NetIdActive}, mode, newFakeListener())
+	local, app := tcpPair(t)
+	defer app.Close()
+	defer local.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	if seen != target.String() {
+		t.Errorf("rewriter saw %s, want %s", seen, target)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	// flows are tracked once forwarded, which is after Handle returns
+	var conns []ConnInfo
+	for deadline := time.Now().Add(2 * time.Second); len(conns) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		conns = h.ActiveConns()
+	}
+	if len(conns) != 1 || conns[0].Target != target.String() || conns[0].Dialed != mirror {
+		t.Errorf("got %+v, want a flow to %s dialed to %s", conns, target, mirror)
+	}
+
+	// errors and hostnames block the flow
+	for _, rewriter := range []func(int32, string) (string, error){
+		func(int32, string) (string, error) { return "", errors.New("no") },
+		func(int32, string) (string, error) { return "mirror.test:80", nil },
+	} {
+		SetTargetRewriter(rewriter)
+		local, app := tcpPair(t)
+		if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+			t.Error("rewritten flow not blocked")
+		}
+		app.Close()
+		local.Close()
+	}
+}
+
+func TestTargetRewriteUDP(t *testing.T) {
+	defer SetTargetRewriter(nil)
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mirror := server.LocalAddr().(*net.UDPAddr)
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+	SetTargetRewriter(func(protocol int32, dst string) (string, error) {
+		if dst == target.String() {
+			return mirror.String(), nil
+		}
+		return dst, nil
+	})
+
+	h := newTestUDPHandler(protect.NetIdActive, newFakeListener())
+	conn := &fromUDPConn{
+		fakeUDPConn: fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}},
+		from:        make(chan *net.UDPAddr, 1),
+	}
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(conn)
+	if err := h.ReceiveTo(conn, []byte("hi"), target); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 16)
+	n, from, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("datagram not sent to the rewritten target: %v", err)
+	}
+	if string(b[:n]) != "hi" {
+		t.Fatalf("got %q", b[:n])
+	}
+	if _, err := server.WriteTo([]byte("hello"), from); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case src := <-conn.from:
+		if !src.IP.Equal(target.IP) || src.Port != target.Port {
+			t.Errorf("answer from %s, want it from %s", src, target)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("answer not relayed")
+	}
+
+	if conns := h.ActiveConns(); len(conns) != 1 || conns[0].Dialed != mirror.String() {
+		t.Errorf("got %+v, want a flow dialed to %s", conns, mirror)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Jigsaw-Code/getsni"
@@ -324,6 +325,14 @@ func (r *retrier) LocalAddr() net.Addr {
 	return r.conn.LocalAddr()
 }
 
+// SyscallConn returns the raw conn of the current underlying socket,
+// which a retry replaces.
+func (r *retrier) SyscallConn() (syscall.RawConn, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.conn.SyscallConn()
+}
+
 func (r *retrier) RemoteAddr() net.Addr {
 	return r.addr
 }
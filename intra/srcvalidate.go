@@ -0,0 +1,57 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ErrSpoofedSource is wrapped by the BlockedError of flows whose source
+// the validator of SetSourceValidator rejects.
+var ErrSpoofedSource = errors.New("spoofed source address")
+
+// sourceValidator holds the srcValidator set, nil if none.
+var sourceValidator atomic.Value
+
+type srcValidator func(ip net.IP, port int) bool
+
+// SetSourceValidator sets f to be called with the source ip and port, as
+// read off the tun, of each tcp and udp flow before protect.Flow is asked
+// of it; flows f returns false for, say, as their source is outside the
+// tun's own range, are blocked with a BlockedError wrapping
+// ErrSpoofedSource, loopback flows included. A nil f removes it.
+func SetSourceValidator(f func(ip net.IP, port int) bool) {
+	sourceValidator.Store(srcValidator(f))
+}
+
+// spoofedSource returns true if the validator rejects src.
+func spoofedSource(src net.Addr) bool {
+	v, _ := sourceValidator.Load().(srcValidator)
+	if v == nil {
+		return false
+	}
+	var ip net.IP
+	var port int
+	switch a := src.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		// addrs of neither kind can't be vouched for
+		return true
+	}
+	if v(ip, port) {
+		return false
+	}
+	log.Warnf("flow from spoofed source %s", src)
+	return true
+}
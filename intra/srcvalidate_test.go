@@ -0,0 +1,67 @@
+package intra
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+func TestSourceValidator(t *testing.T) {
+	tunRange := &net.IPNet{IP: net.IPv4(10, 111, 222, 0), Mask: net.CIDRMask(24, 32)}
+	SetSourceValidator(func(ip net.IP, port int) bool {
+		return tunRange.Contains(ip) && port > 0
+	})
+	defer SetSourceValidator(nil)
+
+	f := &countingFlow{}
+	tunMode := settings.NewTunMode(settings.DNSModeNone, settings.BlockModeFilter)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, f, tunMode, protect.MakeListenConfig(&countingProtector{}), newFakeListener())
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+
+	for _, src := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 168, 9, 9), Port: 5000},
+		{IP: net.IPv4(10, 111, 222, 1), Port: 0},
+		{IP: net.ParseIP("fd66::1"), Port: 5000},
+	} {
+		err := h.Connect(&fakeUDPConn{laddr: src}, target)
+		if !errors.Is(err, ErrSpoofedSource) {
+			t.Errorf("%s: got %v, want ErrSpoofedSource", src, err)
+		}
+	}
+	if n := atomic.LoadInt32(&f.n); n != 0 {
+		t.Errorf("flow asked %d times of spoofed flows", n)
+	}
+
+	// a valid source is up to the flow, which blocks it
+	err := h.Connect(&fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}, target)
+	if err == nil || errors.Is(err, ErrSpoofedSource) {
+		t.Errorf("got %v, want blocked by the flow", err)
+	}
+	if n := atomic.LoadInt32(&f.n); n != 1 {
+		t.Errorf("flow asked %d times, want 1", n)
+	}
+}
+
+func TestSourceValidatorTCP(t *testing.T) {
+	SetSourceValidator(func(ip net.IP, port int) bool { return !ip.IsLoopback() })
+	defer SetSourceValidator(nil)
+
+	f := &countingFlow{}
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(&countingProtector{}), f, mode, newFakeListener())
+	local, app := tcpPair(t)
+	defer app.Close()
+	defer local.Close()
+	// tcpPair's conns are from loopback
+	if err := h.Handle(&fakeTCPConn{local}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}); !errors.Is(err, ErrSpoofedSource) {
+		t.Errorf("got %v, want ErrSpoofedSource", err)
+	}
+	if n := atomic.LoadInt32(&f.n); n != 0 {
+		t.Errorf("flow asked %d times of a spoofed flow", n)
+	}
+}
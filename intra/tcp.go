@@ -26,11 +26,13 @@
 package intra
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -57,6 +59,12 @@ type TCPHandler interface {
 	SetDNSCryptProxy(*dnscrypt.Proxy)
 	SetProxyOptions(*settings.ProxyOptions) error
 	SetDNSProxy(dnsproxy.Transport)
+	SetUidRouteCacheSize(int)
+	ClearUidRoutes([]int)
+	SetBackend(string, Backend)
+	CloseConns(uid int) int
+	ActiveConns() []ConnInfo
+	ConnsPerHost() []HostConns
 }
 
 type tcpHandler struct {
@@ -73,6 +81,71 @@ type tcpHandler struct {
 	dnscrypt         *dnscrypt.Proxy
 	dnsproxy         dnsproxy.Transport
 	proxies          map[string]*proxy.Dialer
+	backends         map[string]Backend
+	routes           *uidRouteCache
+	flows            map[net.Conn]*tcpFlow
+	hosts            *hostLimiter
+}
+
+// tcpFlow is a flow being forwarded, for CloseConns and ActiveConns to find.
+type tcpFlow struct {
+	uid    int
+	netid  string
+	target string
+	start  time.Time
+	local  net.Conn
+	remote split.DuplexConn
+	watch  *pmtuWatch
+	// release uncounts the flow from hosts, if counted
+	release func()
+
+	tx, rx  int64 // atomic; bytes uploaded and downloaded so far
+	aborted int32 // atomic; 1 if closed by CloseConns
+	reset   int32 // atomic; 1 if the remote conn was reset
+}
+
+// dialed returns the ip:port the flow's remote conn was dialed to, if known.
+func (f *tcpFlow) dialed() string {
+	if addr := f.remote.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func newTCPFlow(uid int, netid, target string, local net.Conn, remote split.DuplexConn) *tcpFlow {
+	return &tcpFlow{uid: uid, netid: netid, target: target, start: time.Now(), local: local, remote: remote}
+}
+
+// flowReader counts bytes read from the app as uploaded by its flow.
+type flowReader struct {
+	io.Reader
+	f *tcpFlow
+}
+
+// flowWriter counts bytes written to the app as downloaded by its flow.
+type flowWriter struct {
+	io.Writer
+	f *tcpFlow
+}
+
+func (r *flowReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&r.f.tx, int64(n))
+		r.f.watch.sent(n)
+		rates.add(r.f.netid, 0, n)
+	}
+	return n, err
+}
+
+func (w *flowWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&w.f.rx, int64(n))
+		w.f.watch.received(n)
+		rates.add(w.f.netid, n, 0)
+	}
+	return n, err
 }
 
 // TCPSocketSummary provides information about each TCP socket, reported when it is closed.
@@ -82,6 +155,11 @@ type TCPSocketSummary struct {
 	Duration      int32 // Duration in seconds.
 	ServerPort    int16 // The server port.  All values except 53, 80, 443, and 0 are set to -1.
 	Synack        int32 // TCP handshake latency (ms)
+	Expired       bool  // True if the socket was closed on reaching its TTL.
+	Aborted       bool  // True if the socket was closed for its uid, see Tunnel.CloseConnectionsForUid.
+	// RemoteAddr is the ip:port the socket was dialed to, which may differ
+	// from the app's target, as when translated to nat64 or proxied.
+	RemoteAddr string
 	// Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
 	Retry *split.RetryStats
 }
@@ -91,6 +169,17 @@ type TCPListener interface {
 	OnTCPSocketClosed(*TCPSocketSummary)
 }
 
+// PMTUListener may be implemented by a TCPListener to be told of suspected
+// path-mtu black holes.
+type PMTUListener interface {
+	// OnPMTUBlackHoleSuspected is called, at most once per flow, when a flow
+	// to target (ip:port of the socket dialed, which is a proxy's if any)
+	// stalls as if its larger packets were dropped; say, to clamp the mss or
+	// mtu of the tunnel it goes over. Flows whose remote conn has no address,
+	// as some over backends, aren't watched.
+	OnPMTUBlackHoleSuspected(target string)
+}
+
 // NewTCPHandler returns a TCP forwarder with Intra-style behavior.
 // Connections to `fakedns` are redirected to DOH.
 // All other traffic is forwarded using `dialer`.
@@ -104,34 +193,93 @@ func NewTCPHandler(fakedns net.TCPAddr, dialer *net.Dialer, flow protect.Flow,
 		tunMode:  tunMode,
 		listener: listener,
 		proxies:  make(map[string]*proxy.Dialer, 8),
+		backends: make(map[string]Backend),
+		routes:   newUidRouteCache(),
+		flows:    make(map[net.Conn]*tcpFlow),
+		hosts:    newHostLimiter(),
 	}
 }
 
 // TODO: Propagate TCP RST using local.Abort(), on appropriate errors.
-func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64) {
-	bytes, _ := remote.ReadFrom(local)
+func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64, flow *tcpFlow) {
+	bytes, _ := remote.ReadFrom(&flowReader{local, flow})
 	local.CloseRead()
 	remote.CloseWrite()
 	upload <- bytes
 }
 
-func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn) (bytes int64, err error) {
-	bytes, err = io.Copy(local, remote)
+func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn, flow *tcpFlow) (bytes int64, err error) {
+	bytes, err = io.Copy(&flowWriter{local, flow}, remote)
+	if errors.Is(err, syscall.ECONNRESET) {
+		// the read took the reset, which peerGone can't see anymore
+		atomic.StoreInt32(&flow.reset, 1)
+	}
 	local.CloseWrite()
 	remote.CloseRead()
 	return
 }
 
-func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, summary *TCPSocketSummary) {
+// forward proxies the local and remote conns of flow until either closes
+// or, when non-zero, ttl lapses.
+func (h *tcpHandler) forward(flow *tcpFlow, summary *TCPSocketSummary, ttl time.Duration) {
+	local, remote := flow.local, flow.remote
+	if pl, ok := h.listener.(PMTUListener); ok {
+		if target := flow.dialed(); len(target) > 0 {
+			flow.watch = newPMTUWatch(target, pl)
+		}
+	}
+	h.Lock()
+	if h.flows == nil {
+		h.flows = make(map[net.Conn]*tcpFlow)
+	}
+	h.flows[local] = flow
+	h.Unlock()
+
 	localtcp := local.(core.TCPConn)
 	upload := make(chan int64)
 	start := time.Now()
-	go h.handleUpload(localtcp, remote, upload)
-	download, _ := h.handleDownload(localtcp, remote)
+	var expired int32
+	if ttl > 0 {
+		timer := time.AfterFunc(ttl, func() {
+			atomic.StoreInt32(&expired, 1)
+			log.Infof("tcp flow to %s expired after %s", remote.RemoteAddr(), ttl)
+			local.Close()
+			remote.Close()
+		})
+		defer timer.Stop()
+	}
+	if interval := reapInterval(); interval > 0 {
+		stop := reapHalfOpen(flow, interval)
+		defer stop()
+	}
+	go h.handleUpload(localtcp, remote, upload, flow)
+	download, _ := h.handleDownload(localtcp, remote, flow)
 	summary.DownloadBytes = download
 	summary.UploadBytes = <-upload
+	flow.watch.stop()
 	summary.Duration = int32(time.Since(start).Seconds())
+	summary.Expired = atomic.LoadInt32(&expired) == 1
+
+	h.Lock()
+	delete(h.flows, local)
+	h.Unlock()
+	if flow.release != nil {
+		flow.release()
+	}
+	summary.Aborted = atomic.LoadInt32(&flow.aborted) == 1
+	summary.RemoteAddr = flow.dialed()
 	h.listener.OnTCPSocketClosed(summary)
+	exportFlow(FlowRecord{
+		Protocol:  6,
+		Uid:       flow.uid,
+		NetId:     flow.netid,
+		TxBytes:   summary.UploadBytes,
+		RxBytes:   summary.DownloadBytes,
+		TxPackets: -1,
+		RxPackets: -1,
+		StartMs:   unixMillis(flow.start),
+		EndMs:     unixMillis(time.Now()),
+	}, local.LocalAddr(), flow.target, summary.RemoteAddr)
 }
 
 func filteredPort(addr net.Addr) int16 {
@@ -206,18 +354,18 @@ func (h *tcpHandler) dnsOverride(conn net.Conn, addr *net.TCPAddr) bool {
 	return false
 }
 
-func (h *tcpHandler) onConn(localConn net.Conn, target *net.TCPAddr) (netid string) {
-	// BlockModeNone returns false, BlockModeSink returns true
-	if h.tunMode.BlockMode == settings.BlockModeSink {
-		return protect.NetIdBlock
-	} else if h.tunMode.BlockMode == settings.BlockModeNone {
-		return protect.NetIdActive
+// onConn returns the uid that owns localConn, -1 if unknown, and the
+// decision of the flow on it.
+func (h *tcpHandler) onConn(localConn net.Conn, target *net.TCPAddr) (uid int, d protect.Decision) {
+	uid = -1
+	// BlockModeNone allows, BlockModeSink blocks
+	if d, ok := decideMode(h.tunMode); ok {
+		return uid, d
 	}
 	// Implict: BlockModeFilter or BlockModeFilterProc
 	localtcp := localConn.(core.TCPConn)
 	localaddr := localtcp.LocalAddr().(*net.TCPAddr)
 
-	uid := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
 		procEntry := settings.FindProcNetEntry("tcp", localaddr.IP, localaddr.Port, target.IP, target.Port)
 		if procEntry != nil {
@@ -225,9 +373,9 @@ func (h *tcpHandler) onConn(localConn net.Conn, target *net.TCPAddr) (netid stri
 		}
 	}
 
-	netid = h.flow.On(6 /*TCP*/, uid, localaddr.String(), target.String())
+	d = h.decideFlow(uid, localaddr.String(), target)
 
-	if netid == protect.NetIdBlock {
+	if d.NetId == protect.NetIdBlock {
 		log.Infof("firewalled connection from %s:%s to %s:%s",
 			localaddr.Network(), localaddr.String(), target.Network(), target.String())
 	}
@@ -235,28 +383,128 @@ func (h *tcpHandler) onConn(localConn net.Conn, target *net.TCPAddr) (netid stri
 	return
 }
 
-// TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid a type assertion.
-func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	netid := h.onConn(conn, target)
+// decideFlow decides the flow of uid from source, empty if unknown, to
+// target, or returns the decision cached for it.
+func (h *tcpHandler) decideFlow(uid int, source string, target *net.TCPAddr) protect.Decision {
+	// read before the decision, which may outlive a timeout, is made
+	f := h.flow
+	return h.routes.decide(uid, target.Port, func() (protect.Decision, bool) {
+		return decideWithin(target.String(), func() protect.Decision {
+			return protect.Decide(f, 6 /*TCP*/, uid, source, target.String())
+		})
+	})
+}
+
+// answersDNS returns true if flows to addr are answered by the tunnel's
+// own dns, see dnsOverride.
+func (h *tcpHandler) answersDNS(addr *net.TCPAddr) bool {
+	return h.isDoh(addr) || h.isDNSCrypt(addr) || h.isDNSProxy(addr)
+}
 
-	if netid == protect.NetIdBlock {
+// admit applies the rules a flow to target must pass before it is dialed,
+// in order, and returns how it is to be forwarded, the address it is to
+// be dialed at, which is target unless rewritten, and the error it is
+// blocked with, if any. decide decides flows not to loopback; conn is the
+// flow's, whose blocks are logged, or nil for previews. Flows answered by
+// the tunnel's own dns skip the rules past the point Handle answers them.
+func (h *tcpHandler) admit(conn net.Conn, target *net.TCPAddr, decide func() (int, protect.Decision)) (a admission, dst *net.TCPAddr, err *BlockedError) {
+	a = admission{uid: -1, decision: loopbackDecision, netid: protect.NetIdBlock}
+	logBlocked := func() {
+		if conn != nil {
+			logFlow("tcp", a.uid, conn.LocalAddr(), target, protect.NetIdBlock, nil)
+		}
+	}
+	if portBlocked(6, target.Port) {
+		logBlocked()
+		return a, nil, &BlockedError{Reason: reasonPort, err: ErrBlockedPort}
+	}
+	if conn != nil && spoofedSource(conn.LocalAddr()) {
+		logBlocked()
+		return a, nil, &BlockedError{Reason: reasonSpoofed, err: ErrSpoofedSource}
+	}
+	a.loopback = target.IP.IsLoopback()
+	if !a.loopback {
+		a.uid, a.decision = decide()
+	}
+	a.netid = routeOf(a.decision, h.routable)
+
+	if a.netid == protect.NetIdBlock {
+		logBlocked()
 		// an error here results in a core.tcpConn.Abort
-		return fmt.Errorf("tcp connection firewalled")
+		return a, nil, blockedBy(a.decision.Reason)
 	}
 
+	if a.netid == protect.NetIdBaseUnprotected && !a.loopback && !protect.UnprotectedAllowed() {
+		if conn != nil {
+			log.Warnf("unprotected tcp connection to %s firewalled", target)
+		}
+		return a, nil, blocked(reasonUnprotected)
+	}
+
+	if h.answersDNS(target) {
+		return a, target, nil
+	}
+
+	dst = target
+	if !a.loopback {
+		ip, port, rewritten, err := rewriteTarget(6, target.String())
+		if err != nil {
+			if conn != nil {
+				log.Warnf("tcp connection to %s not rewritten: %v", target, err)
+			}
+			logBlocked()
+			return a, nil, blocked(reasonRewrite + ": " + err.Error())
+		}
+		if rewritten {
+			dst = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+
+	if !h.routable(a.netid) {
+		return a, nil, blocked(reasonNoNetId + " " + a.netid)
+	}
+	return a, dst, nil
+}
+
+// TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid a type assertion.
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	a, dst, blockedErr := h.admit(conn, target, func() (int, protect.Decision) {
+		return h.onConn(conn, target)
+	})
+	if blockedErr != nil {
+		return blockedErr
+	}
+	uid, decision, netid, loopback := a.uid, a.decision, a.netid, a.loopback
+
 	if h.dnsOverride(conn, target) {
 		return nil
 	}
+	// dialed to dst, which is target unless rewritten
+	if dst != target {
+		log.Infof("tcp connection to %s rewritten to %s", target, dst)
+	}
 
+	direct := netid == protect.NetIdActive || netid == protect.NetIdBaseUnprotected
 	var forwarder *proxy.Dialer
-	if netid != protect.NetIdActive {
+	var backend Backend
+	if !direct {
 		h.RLock()
 		forwarder = h.proxies[netid]
+		backend = h.backends[netid]
 		h.RUnlock()
 	}
 
-	if forwarder == nil && netid != protect.NetIdActive {
-		return fmt.Errorf("connection to non-existent netid %s firewalled", netid)
+	if forwarder == nil && backend == nil && !direct {
+		return blocked(reasonNoNetId + " " + netid)
+	}
+
+	release := func() {}
+	if !loopback {
+		var ok bool
+		if release, ok = h.hosts.acquire(uid, target.IP.String()); !ok {
+			log.Warnf("tcp connection of uid %d to %s over the per-host limit", uid, target)
+			return blocked(reasonHostLimit)
+		}
 	}
 
 	var summary TCPSocketSummary
@@ -268,32 +516,56 @@ func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 	// TODO: Cancel dialing if c is closed
 	// Ref: https://stackoverflow.com/questions/63656117/
 	// Ref: https://stackoverflow.com/questions/40328025
-	if forwarder != nil {
+	if backend != nil {
+		var generic net.Conn
+		generic, err = backend.DialContext(context.Background(), "tcp", dst.String())
+		if generic != nil {
+			c = newBackendConn(generic)
+		}
+	} else if forwarder != nil {
 		var generic net.Conn
 		// deprecated: https://github.com/golang/go/issues/25104
-		generic, err = (*forwarder).Dial(target.Network(), target.String())
+		generic, err = (*forwarder).Dial(dst.Network(), dst.String())
+		if generic != nil {
+			c = generic.(*net.TCPConn)
+		}
+	} else if netid == protect.NetIdBaseUnprotected {
+		var generic net.Conn
+		// without a Control, the socket isn't protected
+		unprotected := *h.dialer
+		unprotected.Control = nil
+		generic, err = unprotected.Dial(dst.Network(), dst.String())
 		if generic != nil {
 			c = generic.(*net.TCPConn)
 		}
 	} else if summary.ServerPort == 443 || summary.ServerPort == 80 {
 		if summary.ServerPort == 443 && h.alwaysSplitHTTPS { // always split-dial https
-			c, err = split.DialWithSplit(h.dialer, target)
+			c, err = split.DialWithSplit(h.dialer, dst)
 		} else { // split with retry otherwise
 			summary.Retry = &split.RetryStats{}
-			c, err = split.DialWithSplitRetry(h.dialer, target, summary.Retry)
+			c, err = split.DialWithSplitRetry(h.dialer, dst, summary.Retry)
 		}
 	} else {
 		var generic net.Conn
-		generic, err = h.dialer.Dial(target.Network(), target.String())
+		generic, err = protect.DialContext(context.Background(), h.dialer, dst.Network(), dst.String())
 		if generic != nil {
-			c = generic.(*net.TCPConn)
+			// a *net.TCPConn, unless wrapped by a pre-connect validator
+			c = generic.(split.DuplexConn)
 		}
 	}
 	if err != nil {
+		release()
 		return err
 	}
+	if direct && decision.DSCP > 0 {
+		markDSCP(c, decision.DSCP)
+	}
+	c = withDeadlines(c, decision.ReadTimeout, decision.WriteTimeout)
 	summary.Synack = int32(time.Since(start).Seconds() * 1000)
-	go h.forward(conn, c, &summary)
+	logFlow("tcp", uid, conn.LocalAddr(), target, netid, c.RemoteAddr())
+	flow := newTCPFlow(uid, netid, target.String(), conn, c)
+	flow.release = release
+	go h.forward(flow, &summary, decision.TTL)
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
@@ -314,6 +586,77 @@ func (h *tcpHandler) SetDNSProxy(d dnsproxy.Transport) {
 	h.dnsproxy = d
 }
 
+// CloseConns closes the flows of uid being forwarded, and returns how many.
+func (h *tcpHandler) CloseConns(uid int) int {
+	var flows []*tcpFlow
+	h.RLock()
+	for _, f := range h.flows {
+		if f.uid == uid {
+			flows = append(flows, f)
+		}
+	}
+	h.RUnlock()
+
+	for _, f := range flows {
+		atomic.StoreInt32(&f.aborted, 1)
+		f.local.Close()
+		f.remote.Close()
+	}
+	if len(flows) > 0 {
+		log.Infof("closed %d tcp flows of uid %d", len(flows), uid)
+	}
+	return len(flows)
+}
+
+// OpenConns returns how many flows are being forwarded.
+func (h *tcpHandler) OpenConns() int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.flows)
+}
+
+// ActiveConns returns a snapshot of the flows being forwarded.
+func (h *tcpHandler) ActiveConns() []ConnInfo {
+	h.RLock()
+	flows := make([]*tcpFlow, 0, len(h.flows))
+	for _, f := range h.flows {
+		flows = append(flows, f)
+	}
+	h.RUnlock()
+
+	conns := make([]ConnInfo, 0, len(flows))
+	for _, f := range flows {
+		conns = append(conns, ConnInfo{
+			Uid:      f.uid,
+			Protocol: "tcp",
+			Source:   f.local.LocalAddr().String(),
+			Target:   f.target,
+			NetId:    f.netid,
+			Dialed:   f.dialed(),
+			RxBytes:  atomic.LoadInt64(&f.rx),
+			TxBytes:  atomic.LoadInt64(&f.tx),
+			AgeMs:    time.Since(f.start).Milliseconds(),
+		})
+	}
+	return conns
+}
+
+// ConnsPerHost returns how many flows each uid has open to each host.
+func (h *tcpHandler) ConnsPerHost() []HostConns {
+	return h.hosts.snapshot()
+}
+
+// SetUidRouteCacheSize caches up to size decisions of the flow per
+// (uid, target-port); 0 disables the cache.
+func (h *tcpHandler) SetUidRouteCacheSize(size int) {
+	h.routes.setSize(size)
+}
+
+// ClearUidRoutes forgets cached decisions for uids, or for all uids if empty.
+func (h *tcpHandler) ClearUidRoutes(uids []int) {
+	h.routes.clear(uids)
+}
+
 func (h *tcpHandler) SetProxyOptions(po *settings.ProxyOptions) (err error) {
 	if po.IsGrounded() {
 		h.Lock()
@@ -340,6 +683,17 @@ func (h *tcpHandler) SetProxyOptions(po *settings.ProxyOptions) (err error) {
 	return
 }
 
+// SetBackend routes flows of netid to d, or stops routing them if d is nil.
+func (h *tcpHandler) SetBackend(netid string, d Backend) {
+	h.Lock()
+	defer h.Unlock()
+	if d == nil {
+		delete(h.backends, netid)
+		return
+	}
+	h.backends[netid] = d
+}
+
 type httpproxy struct {
 	underlyingServer *goproxy.ProxyHttpServer
 }
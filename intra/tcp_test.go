@@ -0,0 +1,307 @@
+package intra
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// fakeTCPConn turns one end of a loopback connection into a core.TCPConn.
+type fakeTCPConn struct {
+	*net.TCPConn
+}
+
+func (c *fakeTCPConn) Sent(len uint16) error     { return nil }
+func (c *fakeTCPConn) Receive(data []byte) error { return nil }
+func (c *fakeTCPConn) Err(err error)             {}
+func (c *fakeTCPConn) LocalClosed() error        { return nil }
+func (c *fakeTCPConn) Poll() error               { return nil }
+func (c *fakeTCPConn) Abort()                    { c.Close() }
+
+// fakeListener forwards socket summaries to channels.
+type fakeListener struct {
+	tcp  chan *TCPSocketSummary
+	udp  chan *UDPSocketSummary
+	pmtu chan string
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{
+		tcp:  make(chan *TCPSocketSummary, 8),
+		udp:  make(chan *UDPSocketSummary, 8),
+		pmtu: make(chan string, 8),
+	}
+}
+
+func (l *fakeListener) OnTCPSocketClosed(s *TCPSocketSummary)  { l.tcp <- s }
+func (l *fakeListener) OnUDPSocketClosed(s *UDPSocketSummary)  { l.udp <- s }
+func (l *fakeListener) OnPMTUBlackHoleSuspected(target string) { l.pmtu <- target }
+
+// fakeFlow returns netid for every connection.
+type fakeFlow struct {
+	netid string
+}
+
+func (f *fakeFlow) On(protocol int32, uid int, source, target string) string {
+	return f.netid
+}
+
+// nonLoopbackIP returns an ipv4 address of this host other than loopback,
+// for servers whose flows must go through protect and the listener.
+func nonLoopbackIP(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			return ipnet.IP
+		}
+	}
+	t.Skip("no non-loopback address")
+	return nil
+}
+
+// tcpPair returns both ends of a loopback tcp connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+func TestTCPFlowExpires(t *testing.T) {
+	local, app := tcpPair(t)
+	defer app.Close()
+	remote, server := tcpPair(t)
+	defer server.Close()
+
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	ttl := 200 * time.Millisecond
+	start := time.Now()
+	go h.forward(newTCPFlow(-1, "", "", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, ttl)
+
+	// data flows until the ttl lapses
+	if _, err := app.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := server.Read(b); err != nil || string(b) != "hi" {
+		t.Fatalf("upload failed: %v %s", err, b)
+	}
+
+	select {
+	case s := <-l.tcp:
+		if elapsed := time.Since(start); elapsed < ttl {
+			t.Errorf("flow closed early: %s", elapsed)
+		}
+		if !s.Expired {
+			t.Error("summary not marked expired")
+		}
+		if s.UploadBytes != 2 {
+			t.Errorf("upload bytes: %d", s.UploadBytes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed at its ttl")
+	}
+}
+
+func TestTCPFlowWithoutTTL(t *testing.T) {
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	defer server.Close()
+
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	go h.forward(newTCPFlow(-1, "", "", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	select {
+	case <-l.tcp:
+		t.Fatal("flow without a ttl closed")
+	case <-time.After(300 * time.Millisecond):
+	}
+	app.Close()
+	server.Close()
+
+	select {
+	case s := <-l.tcp:
+		if s.Expired {
+			t.Error("summary marked expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed")
+	}
+}
+
+// countingProtector counts the sockets it protects.
+type countingProtector struct {
+	n int32
+}
+
+func (p *countingProtector) Protect(fd int32) bool {
+	atomic.AddInt32(&p.n, 1)
+	return true
+}
+
+func (p *countingProtector) GetResolvers() string { return "" }
+
+func (p *countingProtector) count() int32 { return atomic.LoadInt32(&p.n) }
+
+func TestTCPBaseUnprotected(t *testing.T) {
+	server, err := net.ListenTCP("tcp", &net.TCPAddr{IP: nonLoopbackIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	target := server.Addr().(*net.TCPAddr)
+
+	p := &countingProtector{}
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(p), &fakeFlow{protect.NetIdBaseUnprotected}, mode, newFakeListener())
+
+	local, app := tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+		t.Fatal("unprotected flow dialed without being allowed")
+	}
+
+	protect.SetAllowUnprotected(true)
+	defer protect.SetAllowUnprotected(false)
+	local, app = tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.count(); n != 0 {
+		t.Errorf("%d sockets protected for an unprotected flow", n)
+	}
+}
+
+func TestTCPCloseConns(t *testing.T) {
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	var apps, servers []*net.TCPConn
+	for _, uid := range []int{10, 20, 10} {
+		local, app := tcpPair(t)
+		defer app.Close()
+		remote, server := tcpPair(t)
+		defer server.Close()
+		apps, servers = append(apps, app), append(servers, server)
+		go h.forward(newTCPFlow(uid, "", "", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+	}
+	// each flow is registered once data goes through it
+	for i, app := range apps {
+		if _, err := app.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 2)
+		if _, err := servers[i].Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := h.CloseConns(10); n != 2 {
+		t.Fatalf("closed %d flows, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-l.tcp:
+			if !s.Aborted {
+				t.Error("summary not marked aborted")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("flow of uid not closed")
+		}
+	}
+	if n := h.CloseConns(10); n != 0 {
+		t.Errorf("closed %d flows again", n)
+	}
+
+	// the other uid's flow is untouched
+	if _, err := apps[1].Write([]byte("yo")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := servers[1].Read(b); err != nil || string(b) != "yo" {
+		t.Fatalf("flow of other uid broken: %v %s", err, b)
+	}
+	apps[1].Close()
+	servers[1].Close()
+	if s := <-l.tcp; s.Aborted {
+		t.Error("flow of other uid marked aborted")
+	}
+}
+
+// countingFlow blocks every flow, counting them.
+type countingFlow struct {
+	n int32
+}
+
+func (f *countingFlow) On(protocol int32, uid int, source, target string) string {
+	atomic.AddInt32(&f.n, 1)
+	return protect.NetIdBlock
+}
+
+func TestTCPLoopback(t *testing.T) {
+	server, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	p := &countingProtector{}
+	f := &countingFlow{}
+	mode := &settings.TunMode{DNSMode: settings.DNSModeNone, BlockMode: settings.BlockModeFilter}
+	h := NewTCPHandler(net.TCPAddr{}, protect.MakeDialer(p), f, mode, newFakeListener())
+
+	local, app := tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, server.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.count(); n != 0 {
+		t.Errorf("%d sockets protected for a loopback flow", n)
+	}
+	if n := atomic.LoadInt32(&f.n); n != 0 {
+		t.Errorf("flow called %d times for a loopback flow", n)
+	}
+
+	// others are up to the flow
+	local, app = tcpPair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}); err == nil {
+		t.Error("blocked flow forwarded")
+	}
+	if n := atomic.LoadInt32(&f.n); n != 1 {
+		t.Errorf("flow called %d times, want 1", n)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of one-second buckets rates are averaged over.
+const rateWindow = 5
+
+// Rate is the throughput of a net-id over the last few seconds.
+type Rate struct {
+	// RxBps is the bytes downloaded per second.
+	RxBps float64 `json:"rxBps"`
+	// TxBps is the bytes uploaded per second.
+	TxBps float64 `json:"txBps"`
+}
+
+// rateBucket holds the bytes moved in the second sec.
+type rateBucket struct {
+	sec    int64
+	rx, tx int64
+}
+
+// meter tracks the throughput of net-ids in a sliding window of buckets.
+type meter struct {
+	sync.Mutex
+	now     func() time.Time
+	buckets map[string]*[rateWindow]rateBucket
+}
+
+func newMeter(now func() time.Time) *meter {
+	return &meter{now: now, buckets: make(map[string]*[rateWindow]rateBucket)}
+}
+
+// rates meters the tcp and udp flows of all tunnels.
+var rates = newMeter(time.Now)
+
+// add notes rx bytes downloaded and tx bytes uploaded by a flow of netid.
+func (m *meter) add(netid string, rx, tx int) {
+	sec := m.now().Unix()
+	m.Lock()
+	defer m.Unlock()
+	w := m.buckets[netid]
+	if w == nil {
+		w = new([rateWindow]rateBucket)
+		m.buckets[netid] = w
+	}
+	b := &w[sec%rateWindow]
+	if b.sec != sec {
+		*b = rateBucket{sec: sec}
+	}
+	b.rx += int64(rx)
+	b.tx += int64(tx)
+}
+
+// rates returns the rate of each net-id that moved bytes in the window,
+// and forgets the others.
+func (m *meter) rates() map[string]Rate {
+	now := m.now().Unix()
+	m.Lock()
+	defer m.Unlock()
+	out := make(map[string]Rate, len(m.buckets))
+	for netid, w := range m.buckets {
+		var rx, tx int64
+		seen := false
+		for _, b := range w {
+			if b.sec > now-rateWindow && b.sec <= now {
+				rx += b.rx
+				tx += b.tx
+				seen = true
+			}
+		}
+		if !seen {
+			delete(m.buckets, netid)
+			continue
+		}
+		out[netid] = Rate{RxBps: float64(rx) / rateWindow, TxBps: float64(tx) / rateWindow}
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package intra
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestMeterRates(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	m := newMeter(clock.now)
+	for i := 0; i < rateWindow; i++ {
+		m.add("wg0", 1000, 0)
+		m.add("proxy", 0, 200)
+		m.add("proxy", 0, 300)
+		clock.t = clock.t.Add(time.Second)
+	}
+	clock.t = clock.t.Add(-time.Second)
+
+	got := m.rates()
+	want := map[string]Rate{
+		"wg0":   {RxBps: 1000},
+		"proxy": {TxBps: 500},
+	}
+	if len(got) != len(want) || got["wg0"] != want["wg0"] || got["proxy"] != want["proxy"] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// older seconds slide out of the window
+	clock.t = clock.t.Add(2 * time.Second)
+	m.add("wg0", 500, 0)
+	if r := m.rates()["wg0"]; r.RxBps != (3*1000+500)/rateWindow {
+		t.Errorf("got %v after sliding, want %v", r.RxBps, (3*1000+500)/rateWindow)
+	}
+
+	// idle net-ids are dropped
+	clock.t = clock.t.Add(rateWindow * time.Second)
+	if got := m.rates(); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+}
+
+func TestTCPThroughput(t *testing.T) {
+	l := newFakeListener()
+	h := &tcpHandler{listener: l}
+	local, app := tcpPair(t)
+	remote, server := tcpPair(t)
+	go h.forward(newTCPFlow(10, "meter0", "192.0.2.1:443", &fakeTCPConn{local}, remote), &TCPSocketSummary{}, 0)
+
+	if _, err := app.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5000)
+	for n := 0; n < len(b); {
+		m, err := server.Read(b[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	app.Close()
+	server.Close()
+	<-l.tcp
+
+	var got map[string]Rate
+	if err := json.Unmarshal([]byte((&intratunnel{}).ThroughputByNetId()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if r := got["meter0"]; r.TxBps != 5000.0/rateWindow {
+		t.Errorf("got %+v, want %v bytes/s up", r, 5000.0/rateWindow)
+	}
+}
@@ -24,10 +24,13 @@
 package intra
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/core"
@@ -79,6 +82,61 @@ type Tunnel interface {
 	SetRethinkDNS(rdns.RethinkDNS) error
 	// GetRethinkDNS gets rethinkdns in-use by various dns transports
 	GetRethinkDNS() rdns.RethinkDNS
+	// SetUidRouteCacheSize caches up to size flow decisions per (uid, target-port)
+	// for each of tcp and udp, evicting the least recently used; 0 disables it.
+	SetUidRouteCacheSize(size int)
+	// ClearUidRoutes drops cached flow decisions of uids (csv), or of all
+	// uids if empty. Call it whenever the policy for those uids changes.
+	ClearUidRoutes(uids string) error
+	// SetBackend routes tcp and udp flows decided to netid to d, which the
+	// embedder implements over, say, a userspace wireguard device. A nil d
+	// unsets netid. Reserved net-ids, such as protect.NetIdActive, can't be set.
+	SetBackend(netid string, d Backend) error
+	// SetMTUHint sets the max datagram size of udp flows to netid, say, one
+	// that tunnels them with some overhead, or unsets it if mtu is 0. The
+	// hint is reported for open flows in their ConnInfo, see
+	// ActiveConnections, for the app to clamp its datagrams to, and when
+	// they are closed, in their UDPSocketSummary; it doesn't change how
+	// datagrams are sent.
+	SetMTUHint(netid string, mtu int) error
+	// CloseConnectionsForUid closes all tcp and udp flows of uid, say, once
+	// the app is killed or loses network access, and returns how many it
+	// closed. Their summaries are marked Aborted.
+	CloseConnectionsForUid(uid int) int
+	// ActiveConnections returns the tcp and udp flows being forwarded as a
+	// json array of ConnInfo objects, since gomobile can't bind slices.
+	ActiveConnections() string
+	// ThroughputByNetId returns the rate at which the flows of each net-id
+	// moved bytes over the last few seconds, as a json object of Rates by
+	// net-id, since gomobile can't bind maps.
+	ThroughputByNetId() string
+	// ConnsPerHost returns how many tcp flows each uid has open to each
+	// destination ip, as a json array of HostConns, most first; see
+	// SetPerHostConnLimit.
+	ConnsPerHost() string
+	// FlowDecisionLatency returns how long Flow.On took to decide tcp and
+	// udp flows as a json array of LatencyBucket, shortest first, and, if
+	// reset, empties it; see OnSlowFlowDecision.
+	FlowDecisionLatency(reset bool) string
+	// WouldBlock tells whether a flow of uid to target (ip:port), on
+	// protocol 6 (tcp) or 17 (udp), would be blocked, and the net-id and
+	// reason it would be, per the same rules and flow decisions (cached
+	// as usual) as the flow would meet, without opening any socket.
+	WouldBlock(protocol int32, uid int, target string) (*Verdict, error)
+	// OpenConnectionCount returns how many tcp and udp flows are being
+	// forwarded, each of which holds a socket, and so a file descriptor,
+	// of its own; cheap enough to poll, to shed load before they run out.
+	OpenConnectionCount() int
+	// OpenFDCount estimates how many file descriptors the process has open,
+	// flows and everything else included, or returns -1 where it can't
+	// tell. Unlike OpenConnectionCount, it lists them, so poll it sparingly.
+	OpenFDCount() int
+	// MetricsText returns the counters and histograms of the tunnel and its
+	// dialers, as of OpenConnectionCount, FlowDecisionLatency (which it
+	// doesn't reset), ThroughputByNetId, protect.CacheStats and
+	// protect.GetHappyEyeballsStats, in the prometheus text exposition
+	// format, to be scraped or logged.
+	MetricsText() string
 }
 
 type intratunnel struct {
@@ -267,3 +325,98 @@ func (t *intratunnel) SetRethinkDNS(b rdns.RethinkDNS) error {
 func (t *intratunnel) GetRethinkDNS() rdns.RethinkDNS {
 	return t.rethinkdns
 }
+
+func (t *intratunnel) SetUidRouteCacheSize(size int) {
+	t.tcp.SetUidRouteCacheSize(size)
+	t.udp.SetUidRouteCacheSize(size)
+}
+
+func (t *intratunnel) ClearUidRoutes(csv string) error {
+	var uids []int
+	if len(csv) > 0 {
+		for _, s := range strings.Split(csv, ",") {
+			uid, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			uids = append(uids, uid)
+		}
+	}
+	t.tcp.ClearUidRoutes(uids)
+	t.udp.ClearUidRoutes(uids)
+	return nil
+}
+
+func (t *intratunnel) SetBackend(netid string, d Backend) error {
+	if isReservedNetId(netid) {
+		return errReservedNetId
+	}
+	t.tcp.SetBackend(netid, d)
+	t.udp.SetBackend(netid, d)
+	return nil
+}
+
+func (t *intratunnel) SetMTUHint(netid string, mtu int) error {
+	if mtu < 0 {
+		return errors.New("negative mtu")
+	}
+	t.udp.SetMTUHint(netid, mtu)
+	return nil
+}
+
+func (t *intratunnel) CloseConnectionsForUid(uid int) int {
+	if uid < 0 {
+		// flows of unknown uids belong to no app in particular
+		return 0
+	}
+	return t.tcp.CloseConns(uid) + t.udp.CloseConns(uid)
+}
+
+func (t *intratunnel) ActiveConnections() string {
+	conns := append(t.tcp.ActiveConns(), t.udp.ActiveConns()...)
+	b, _ := json.Marshal(conns)
+	return string(b)
+}
+
+func (t *intratunnel) ThroughputByNetId() string {
+	b, _ := json.Marshal(rates.rates())
+	return string(b)
+}
+
+func (t *intratunnel) ConnsPerHost() string {
+	b, _ := json.Marshal(t.tcp.ConnsPerHost())
+	return string(b)
+}
+
+func (t *intratunnel) FlowDecisionLatency(reset bool) string {
+	b, _ := json.Marshal(decisionLatency())
+	if reset {
+		resetDecisionLatency()
+	}
+	return string(b)
+}
+
+func (t *intratunnel) OpenConnectionCount() int {
+	return openConns(t.tcp) + openConns(t.udp)
+}
+
+// openConns returns how many flows h is forwarding, 0 if it doesn't count
+// them.
+func openConns(h interface{}) int {
+	if c, ok := h.(interface{ OpenConns() int }); ok {
+		return c.OpenConns()
+	}
+	return 0
+}
+
+func (t *intratunnel) OpenFDCount() int {
+	return openFDs()
+}
+
+func (t *intratunnel) MetricsText() string {
+	return metricsText(t.tcp, t.udp)
+}
+
+func (t *intratunnel) WouldBlock(protocol int32, uid int, target string) (*Verdict, error) {
+	return wouldBlock(t.tcp, t.udp, protocol, uid, target)
+}
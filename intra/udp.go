@@ -31,6 +31,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -51,6 +52,13 @@ type UDPSocketSummary struct {
 	UploadBytes   int64 // Amount uploaded (bytes)
 	DownloadBytes int64 // Amount downloaded (bytes)
 	Duration      int32 // How long the socket was open (seconds)
+	Expired       bool  // True if the socket was closed on reaching its TTL.
+	MTU           int32 // Max datagram size hinted for the flow's net-id, 0 if none.
+	Aborted       bool  // True if the socket was closed for its uid, see Tunnel.CloseConnectionsForUid.
+	// RemoteAddr is the ip:port the socket was connected to, which may
+	// differ from the app's target, as when proxied; the target itself if
+	// unconnected.
+	RemoteAddr string
 }
 
 // UDPListener is notified when a non-DNS UDP association is discarded.
@@ -61,23 +69,41 @@ type UDPListener interface {
 type tracker struct {
 	conn     interface{} // net.Conn and net.PacketConn
 	start    time.Time
-	upload   int64        // Non-DNS upload bytes
-	download int64        // Non-DNS download bytes
+	upload   int64        // Non-DNS upload bytes; atomic
+	download int64        // Non-DNS download bytes; atomic
 	ip       *net.UDPAddr // masked addr
+	expiry   *time.Timer  // closes the conn once its ttl lapses, if any
+	expired  bool         // true if conn was closed by expiry
+	mtu      int          // max datagram size hinted for the net-id, if any
+	uid      int          // owner of the flow, -1 if unknown
+	aborted  bool         // true if conn was closed by CloseConns
+	netid    string       // net-id the flow was decided to
+	target   string       // ip:port the app sent to, if known
+	sent     int64        // Non-DNS datagrams uploaded; atomic
+	received int64        // Non-DNS datagrams downloaded; atomic
+	dialed   string       // ip:port the conn is connected to, if any
+	rewrite  *udpRewrite  // target as rewritten, if it is
 }
 
 func makeTracker(conn interface{}) *tracker {
-	return &tracker{conn, time.Now(), 0, 0, nil}
+	return &tracker{conn: conn, start: time.Now(), uid: -1}
 }
 
 // UDPHandler adds DOH support to the base UDPConnHandler interface.
 type UDPHandler interface {
 	core.UDPConnHandler
 	SetDNS(dns doh.Transport)
-	onConn(localudp core.UDPConn, target *net.UDPAddr) string
+	onConn(localudp core.UDPConn, target *net.UDPAddr) (int, protect.Decision)
 	SetDNSCryptProxy(*dnscrypt.Proxy)
 	SetProxyOptions(*settings.ProxyOptions) error
 	SetDNSProxy(dnsproxy.Transport)
+	SetUidRouteCacheSize(int)
+	ClearUidRoutes([]int)
+	SetBackend(string, Backend)
+	SetMTUHint(string, int)
+	MTUHint(core.UDPConn) int
+	CloseConns(uid int) int
+	ActiveConns() []ConnInfo
 }
 
 type udpHandler struct {
@@ -95,6 +121,9 @@ type udpHandler struct {
 	flow     protect.Flow
 	listener UDPListener
 	proxies  map[string]*proxy.Dialer
+	backends map[string]Backend
+	mtus     map[string]int
+	routes   *uidRouteCache
 }
 
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
@@ -114,6 +143,9 @@ func NewUDPHandler(fakedns net.UDPAddr, timeout time.Duration, flow protect.Flow
 		config:   config,
 		listener: listener,
 		proxies:  make(map[string]*proxy.Dialer),
+		backends: make(map[string]Backend),
+		mtus:     make(map[string]int),
+		routes:   newUidRouteCache(),
 	}
 }
 
@@ -153,12 +185,18 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, nat *tracker) {
 		var udpaddr *net.UDPAddr
 		if nat.ip == nil && addr != nil {
 			udpaddr = addr.(*net.UDPAddr)
+			// answers of the rewritten target are from the target itself
+			if r := nat.rewrite; r != nil && udpaddr.IP.Equal(r.to.IP) && udpaddr.Port == r.to.Port {
+				udpaddr = r.from
+			}
 		} else {
 			// overwrite source-addr as set in t.ip
 			udpaddr = nat.ip
 		}
 
-		nat.download += int64(n)
+		atomic.AddInt64(&nat.download, int64(n))
+		atomic.AddInt64(&nat.received, 1)
+		rates.add(nat.netid, n, 0)
 		// writes data to conn (tun) with addr as source
 		_, err = conn.WriteFrom(buf[:n], udpaddr)
 		if err != nil {
@@ -168,20 +206,19 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, nat *tracker) {
 	}
 }
 
-func (h *udpHandler) onConn(localudp core.UDPConn, target *net.UDPAddr) (netid string) {
-	// BlockModeNone returns false, BlockModeSink returns true
-	if h.tunMode.BlockMode == settings.BlockModeSink {
-		return protect.NetIdBlock
-	}
-	if h.tunMode.BlockMode == settings.BlockModeNone {
-		return protect.NetIdActive
+// onConn returns the uid that owns localudp, -1 if unknown, and the
+// decision of the flow on it.
+func (h *udpHandler) onConn(localudp core.UDPConn, target *net.UDPAddr) (int, protect.Decision) {
+	// BlockModeNone allows, BlockModeSink blocks
+	if d, ok := decideMode(h.tunMode); ok {
+		return -1, d
 	}
 	// Next-up If: BlockModeFilter or BlockModeFilterProc
 	return h.onNewConn(localudp.LocalAddr(), target)
 }
 
-func (h *udpHandler) onNewConn(source *net.UDPAddr, target *net.UDPAddr) (netid string) {
-	uid := -1
+func (h *udpHandler) onNewConn(source *net.UDPAddr, target *net.UDPAddr) (uid int, d protect.Decision) {
+	uid = -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
 		procEntry := settings.FindProcNetEntry("udp", source.IP, source.Port, target.IP, target.Port)
 		if procEntry != nil {
@@ -189,9 +226,12 @@ func (h *udpHandler) onNewConn(source *net.UDPAddr, target *net.UDPAddr) (netid
 		}
 	}
 
-	netid = h.flow.On(17 /*UDP*/, uid, source.String(), target.String())
+	if target != nil && localUDP(target.IP) {
+		log.Debugf("udp connection from %s to local %s sent direct", source, target)
+	}
+	d = h.decideFlow(uid, source.String(), target)
 
-	if netid == protect.NetIdBlock {
+	if d.NetId == protect.NetIdBlock {
 		log.Infof("firewalled udp connection from %s:%s to %s:%s",
 			source.Network(), source.String(), target.Network(), target.String())
 	}
@@ -199,50 +239,177 @@ func (h *udpHandler) onNewConn(source *net.UDPAddr, target *net.UDPAddr) (netid
 	return
 }
 
-// Connect connects the proxy server. Note that target can be nil.
-func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	netid := h.onConn(conn, target)
+// decideFlow decides the flow of uid from source, empty if unknown, to
+// target, which may be nil, or returns the decision cached for it. Flows
+// to local addresses are sent direct.
+func (h *udpHandler) decideFlow(uid int, source string, target *net.UDPAddr) protect.Decision {
+	if target != nil && localUDP(target.IP) {
+		return localDecision
+	}
+	port := 0
+	if target != nil {
+		port = target.Port
+	}
+	// read before the decision, which may outlive a timeout, is made
+	f := h.flow
+	return h.routes.decide(uid, port, func() (protect.Decision, bool) {
+		return decideWithin(target.String(), func() protect.Decision {
+			return protect.Decide(f, 17 /*UDP*/, uid, source, target.String())
+		})
+	})
+}
+
+// admit is tcpHandler.admit for udp flows, per the rules of Connect;
+// target may be nil.
+func (h *udpHandler) admit(conn core.UDPConn, target *net.UDPAddr, decide func() (int, protect.Decision)) (a admission, dst *net.UDPAddr, err *BlockedError) {
+	a = admission{uid: -1, decision: loopbackDecision, netid: protect.NetIdBlock}
+	logBlocked := func() {
+		if conn != nil {
+			logFlow("udp", a.uid, conn.LocalAddr(), target, protect.NetIdBlock, nil)
+		}
+	}
+	if target != nil && portBlocked(17, target.Port) {
+		logBlocked()
+		return a, nil, &BlockedError{Reason: reasonPort, err: ErrBlockedPort}
+	}
+	if conn != nil && spoofedSource(conn.LocalAddr()) {
+		logBlocked()
+		return a, nil, &BlockedError{Reason: reasonSpoofed, err: ErrSpoofedSource}
+	}
+	a.loopback = target != nil && target.IP.IsLoopback()
+	if !a.loopback {
+		a.uid, a.decision = decide()
+	}
+	a.netid = routeOf(a.decision, h.routable)
 
-	if netid == protect.NetIdBlock {
+	if a.netid == protect.NetIdBlock {
+		logBlocked()
 		// an error here results in a core.udpConn.Close
-		return fmt.Errorf("udp connection firewalled")
+		return a, nil, blockedBy(a.decision.Reason)
+	}
+
+	if a.netid == protect.NetIdBaseUnprotected && !a.loopback && !protect.UnprotectedAllowed() {
+		if conn != nil {
+			log.Warnf("unprotected udp connection to %s firewalled", target)
+		}
+		return a, nil, blocked(reasonUnprotected)
+	}
+
+	if !h.routable(a.netid) {
+		return a, nil, blocked(reasonNoNetId + " " + a.netid)
+	}
+
+	dst = target
+	if target != nil && !a.loopback {
+		ip, port, rewritten, err := rewriteTarget(17, target.String())
+		if err != nil {
+			if conn != nil {
+				log.Warnf("udp connection to %s not rewritten: %v", target, err)
+			}
+			logBlocked()
+			return a, nil, blocked(reasonRewrite + ": " + err.Error())
+		}
+		if rewritten {
+			dst = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	return a, dst, nil
+}
+
+// Connect connects the proxy server. Note that target can be nil.
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	a, dst, blockedErr := h.admit(conn, target, func() (int, protect.Decision) {
+		return h.onConn(conn, target)
+	})
+	if blockedErr != nil {
+		return blockedErr
 	}
+	uid, decision, netid := a.uid, a.decision, a.netid
 
+	direct := netid == protect.NetIdActive || netid == protect.NetIdBaseUnprotected
 	var forwarder *proxy.Dialer
-	if netid != protect.NetIdActive {
-		h.RLock()
+	var backend Backend
+	h.RLock()
+	if !direct {
 		forwarder = h.proxies[netid]
-		h.RUnlock()
+		backend = h.backends[netid]
 	}
+	mtu := h.mtus[netid]
+	h.RUnlock()
 
-	if forwarder == nil && netid != protect.NetIdActive {
-		return fmt.Errorf("connection to non-existent netid %s firewalled", netid)
+	if forwarder == nil && backend == nil && !direct {
+		return blocked(reasonNoNetId + " " + netid)
+	}
+
+	// dialed to dst, which is target unless rewritten
+	var rewrite *udpRewrite
+	if dst != target {
+		rewrite = &udpRewrite{from: target, to: dst}
+		log.Infof("udp connection to %s rewritten to %s", target, dst)
 	}
 
 	var c interface{}
 	var err error
-	if forwarder != nil { // TODO: h.httpproxy.Dial with quic
+	if backend != nil {
+		if target == nil {
+			return blocked(reasonNoTarget + " for netid " + netid)
+		}
+		c, err = backend.DialContext(context.TODO(), "udp", dst.String())
+	} else if forwarder != nil { // TODO: h.httpproxy.Dial with quic
 		// deprecated: https://github.com/golang/go/issues/25104
 		// FIXME: target can be nil: What happens then?
-		c, err = (*forwarder).Dial(target.Network(), target.String())
+		c, err = (*forwarder).Dial(dst.Network(), dst.String())
 	} else {
+		config := h.config
+		if netid == protect.NetIdBaseUnprotected {
+			// without a Control, the socket isn't protected
+			unprotected := *h.config
+			unprotected.Control = nil
+			config = &unprotected
+		}
 		bindAddr := &net.UDPAddr{IP: nil, Port: 0}
-		c, err = h.config.ListenPacket(context.TODO(), bindAddr.Network(), bindAddr.String())
+		c, err = config.ListenPacket(context.TODO(), bindAddr.Network(), bindAddr.String())
 	}
 
 	if err != nil {
 		log.Errorf("failed to bind udp addr %s %w", target.String(), err)
 		return err
 	}
+	if direct && decision.DSCP > 0 {
+		markDSCP(c, decision.DSCP)
+	}
 
 	t := makeTracker(c)
+	t.mtu = mtu
+	t.uid = uid
+	t.netid = netid
+	t.rewrite = rewrite
+	if target != nil {
+		t.target = target.String()
+	}
 
-	if forwarder != nil {
+	if forwarder != nil || backend != nil {
 		t.ip = target
 	}
 
+	// unconnected sockets send to the target itself
+	var dialed net.Addr
+	if rc, ok := c.(net.Conn); ok {
+		dialed = rc.RemoteAddr()
+	}
+	if dialed == nil && target != nil {
+		dialed = dst
+	}
+	if dialed != nil {
+		t.dialed = dialed.String()
+	}
+	logFlow("udp", uid, conn.LocalAddr(), target, netid, dialed)
+
 	h.Lock()
 	h.udpConns[conn] = t
+	if decision.TTL > 0 {
+		t.expiry = time.AfterFunc(decision.TTL, func() { h.expire(conn) })
+	}
 	h.Unlock()
 
 	go h.fetchUDPInput(conn, t)
@@ -375,11 +542,16 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 		return nil
 	}
 
-	nat.upload += int64(len(data))
+	atomic.AddInt64(&nat.upload, int64(len(data)))
+	atomic.AddInt64(&nat.sent, 1)
+	rates.add(nat.netid, 0, len(data))
 
 	switch c := nat.conn.(type) {
 	case net.PacketConn:
 		c.SetDeadline(time.Now().Add(h.timeout))
+		if r := nat.rewrite; r != nil && addr.IP.Equal(r.from.IP) && addr.Port == r.from.Port {
+			addr = r.to
+		}
 		// writes packet payload, data, to addr
 		_, err = c.WriteTo(data, addr)
 	case net.Conn:
@@ -398,6 +570,21 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	return nil
 }
 
+// expire closes conn on reaching its ttl.
+func (h *udpHandler) expire(conn core.UDPConn) {
+	h.Lock()
+	t, ok := h.udpConns[conn]
+	if ok {
+		t.expired = true
+	}
+	h.Unlock()
+
+	if ok {
+		log.Infof("udp flow from %s expired", conn.LocalAddr())
+		h.Close(conn)
+	}
+}
+
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
 
@@ -412,13 +599,78 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 			c.Close()
 		default:
 		}
+		if t.expiry != nil {
+			t.expiry.Stop()
+		}
 		// TODO: Cancel any outstanding DoH queries.
 		duration := int32(time.Since(t.start).Seconds())
-		h.listener.OnUDPSocketClosed(&UDPSocketSummary{t.upload, t.download, duration})
+		upload, download := atomic.LoadInt64(&t.upload), atomic.LoadInt64(&t.download)
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{upload, download, duration, t.expired, int32(t.mtu), t.aborted, t.dialed})
+		exportFlow(FlowRecord{
+			Protocol:  17,
+			Uid:       t.uid,
+			NetId:     t.netid,
+			TxBytes:   upload,
+			RxBytes:   download,
+			TxPackets: atomic.LoadInt64(&t.sent),
+			RxPackets: atomic.LoadInt64(&t.received),
+			StartMs:   unixMillis(t.start),
+			EndMs:     unixMillis(time.Now()),
+		}, conn.LocalAddr(), t.target, t.dialed)
 		delete(h.udpConns, conn)
 	}
 }
 
+// CloseConns closes the flows of uid, and returns how many.
+func (h *udpHandler) CloseConns(uid int) int {
+	var conns []core.UDPConn
+	h.Lock()
+	for conn, t := range h.udpConns {
+		if t.uid == uid {
+			t.aborted = true
+			conns = append(conns, conn)
+		}
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	if len(conns) > 0 {
+		log.Infof("closed %d udp flows of uid %d", len(conns), uid)
+	}
+	return len(conns)
+}
+
+// OpenConns returns how many flows are being forwarded.
+func (h *udpHandler) OpenConns() int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.udpConns)
+}
+
+// ActiveConns returns a snapshot of the flows being forwarded.
+func (h *udpHandler) ActiveConns() []ConnInfo {
+	h.RLock()
+	conns := make([]ConnInfo, 0, len(h.udpConns))
+	for conn, t := range h.udpConns {
+		conns = append(conns, ConnInfo{
+			Uid:      t.uid,
+			Protocol: "udp",
+			Source:   conn.LocalAddr().String(),
+			Target:   t.target,
+			NetId:    t.netid,
+			Dialed:   t.dialed,
+			RxBytes:  atomic.LoadInt64(&t.download),
+			TxBytes:  atomic.LoadInt64(&t.upload),
+			AgeMs:    time.Since(t.start).Milliseconds(),
+			MTU:      t.mtu,
+		})
+	}
+	h.RUnlock()
+	return conns
+}
+
 func (h *udpHandler) SetDNS(dns doh.Transport) {
 	h.Lock()
 	h.dns = dns
@@ -437,6 +689,17 @@ func (h *udpHandler) SetDNSProxy(dnsproxy dnsproxy.Transport) {
 	h.Unlock()
 }
 
+// SetUidRouteCacheSize caches up to size decisions of the flow per
+// (uid, target-port); 0 disables the cache.
+func (h *udpHandler) SetUidRouteCacheSize(size int) {
+	h.routes.setSize(size)
+}
+
+// ClearUidRoutes forgets cached decisions for uids, or for all uids if empty.
+func (h *udpHandler) ClearUidRoutes(uids []int) {
+	h.routes.clear(uids)
+}
+
 func (h *udpHandler) SetProxyOptions(po *settings.ProxyOptions) (err error) {
 	if po.IsGrounded() {
 		h.Lock()
@@ -466,3 +729,36 @@ func (h *udpHandler) SetProxyOptions(po *settings.ProxyOptions) (err error) {
 
 	return
 }
+
+// SetBackend routes flows of netid to d, or stops routing them if d is nil.
+func (h *udpHandler) SetBackend(netid string, d Backend) {
+	h.Lock()
+	defer h.Unlock()
+	if d == nil {
+		delete(h.backends, netid)
+		return
+	}
+	h.backends[netid] = d
+}
+
+// SetMTUHint sets the max datagram size of flows to netid, or unsets it if 0.
+func (h *udpHandler) SetMTUHint(netid string, mtu int) {
+	h.Lock()
+	defer h.Unlock()
+	if mtu <= 0 {
+		delete(h.mtus, netid)
+		return
+	}
+	h.mtus[netid] = mtu
+}
+
+// MTUHint returns the max datagram size hinted for the net-id conn's flow
+// was sent to, or 0 if none was, or conn isn't connected.
+func (h *udpHandler) MTUHint(conn core.UDPConn) int {
+	h.RLock()
+	defer h.RUnlock()
+	if t, ok := h.udpConns[conn]; ok {
+		return t.mtu
+	}
+	return 0
+}
@@ -0,0 +1,267 @@
+package intra
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+type fakeUDPConn struct {
+	sync.Mutex
+	laddr  *net.UDPAddr
+	closed bool
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr { return c.laddr }
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	return nil
+}
+
+func (c *fakeUDPConn) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+func newTestUDPHandler(netid string, l UDPListener) *udpHandler {
+	fakedns := net.UDPAddr{IP: net.IPv4(10, 111, 222, 3), Port: 53}
+	tunMode := settings.NewTunMode(settings.DNSModeNone, settings.BlockModeFilter)
+	return NewUDPHandler(fakedns, time.Minute, &fakeFlow{netid}, tunMode, &net.ListenConfig{}, l).(*udpHandler)
+}
+
+func TestUDPFlowExpires(t *testing.T) {
+	l := newFakeListener()
+	h := newTestUDPHandler("allow#ttl=200ms", l)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+
+	start := time.Now()
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-l.udp:
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("flow closed early: %s", elapsed)
+		}
+		if !s.Expired {
+			t.Error("summary not marked expired")
+		}
+		if !conn.isClosed() {
+			t.Error("tun conn not closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed at its ttl")
+	}
+}
+
+func TestUDPFlowCloseStopsExpiry(t *testing.T) {
+	l := newFakeListener()
+	h := newTestUDPHandler("allow#ttl=200ms", l)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5001}}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	h.Close(conn)
+
+	s := <-l.udp
+	if s.Expired {
+		t.Error("closed flow marked expired")
+	}
+	select {
+	case <-l.udp:
+		t.Error("flow reported twice")
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestUDPBaseUnprotected(t *testing.T) {
+	p := &countingProtector{}
+	fakedns := net.UDPAddr{IP: net.IPv4(10, 111, 222, 3), Port: 53}
+	tunMode := settings.NewTunMode(settings.DNSModeNone, settings.BlockModeFilter)
+	h := NewUDPHandler(fakedns, time.Minute, &fakeFlow{protect.NetIdBaseUnprotected}, tunMode,
+		protect.MakeListenConfig(p), newFakeListener()).(*udpHandler)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+
+	if err := h.Connect(conn, target); err == nil {
+		t.Fatal("unprotected flow bound without being allowed")
+	}
+
+	protect.SetAllowUnprotected(true)
+	defer protect.SetAllowUnprotected(false)
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(conn)
+	if n := p.count(); n != 0 {
+		t.Errorf("%d sockets protected for an unprotected flow", n)
+	}
+}
+
+func TestUDPMTUHint(t *testing.T) {
+	wg := newFakeTunnel()
+	l := newFakeListener()
+	h := newTestUDPHandler("wg0", l)
+	h.SetBackend("wg0", wg)
+	h.SetMTUHint("wg0", 1280)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if mtu := h.MTUHint(conn); mtu != 1280 {
+		t.Errorf("hint %d, want 1280", mtu)
+	}
+	if conns := h.ActiveConns(); len(conns) != 1 || conns[0].MTU != 1280 {
+		t.Errorf("open flows %+v, want one with hint 1280", conns)
+	}
+	h.Close(conn)
+	if s := <-l.udp; s.MTU != 1280 {
+		t.Errorf("summary hint %d, want 1280", s.MTU)
+	}
+
+	// other net-ids have none
+	h = newTestUDPHandler(protect.NetIdActive, l)
+	h.SetMTUHint("wg0", 1280)
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if mtu := h.MTUHint(conn); mtu != 0 {
+		t.Errorf("hint %d for a net-id without one", mtu)
+	}
+	h.Close(conn)
+	if s := <-l.udp; s.MTU != 0 {
+		t.Errorf("summary hint %d for a net-id without one", s.MTU)
+	}
+}
+
+func TestUDPCloseConns(t *testing.T) {
+	l := newFakeListener()
+	h := newTestUDPHandler(protect.NetIdActive, l)
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+	var conns []*fakeUDPConn
+	for i, uid := range []int{10, 20, 10} {
+		conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000 + i}}
+		if err := h.Connect(conn, target); err != nil {
+			t.Fatal(err)
+		}
+		// uids of flows are only known with BlockModeFilterProc
+		h.Lock()
+		h.udpConns[conn].uid = uid
+		h.Unlock()
+		conns = append(conns, conn)
+	}
+	defer h.Close(conns[1])
+
+	if n := h.CloseConns(10); n != 2 {
+		t.Fatalf("closed %d flows, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if s := <-l.udp; !s.Aborted {
+			t.Error("summary not marked aborted")
+		}
+	}
+	if !conns[0].isClosed() || !conns[2].isClosed() {
+		t.Error("tun conns of uid not closed")
+	}
+	if conns[1].isClosed() {
+		t.Error("tun conn of other uid closed")
+	}
+	if n := h.CloseConns(10); n != 0 {
+		t.Errorf("closed %d flows again", n)
+	}
+}
+
+func TestUDPLoopback(t *testing.T) {
+	p := &countingProtector{}
+	f := &countingFlow{}
+	fakedns := net.UDPAddr{IP: net.IPv4(10, 111, 222, 3), Port: 53}
+	tunMode := settings.NewTunMode(settings.DNSModeNone, settings.BlockModeFilter)
+	h := NewUDPHandler(fakedns, time.Minute, f, tunMode, protect.MakeListenConfig(p), newFakeListener()).(*udpHandler)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 1, 2, 3), net.IPv6loopback} {
+		if err := h.Connect(conn, &net.UDPAddr{IP: ip, Port: 9}); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		h.Close(conn)
+	}
+	if n := p.count(); n != 0 {
+		t.Errorf("%d sockets protected for loopback flows", n)
+	}
+	if n := atomic.LoadInt32(&f.n); n != 0 {
+		t.Errorf("flow called %d times for loopback flows", n)
+	}
+
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}); err == nil {
+		t.Error("blocked flow bound")
+	}
+	if n := atomic.LoadInt32(&f.n); n != 1 {
+		t.Errorf("flow called %d times, want 1", n)
+	}
+}
+
+func TestUDPLocalDirect(t *testing.T) {
+	p := &countingProtector{}
+	f := &countingFlow{}
+	fakedns := net.UDPAddr{IP: net.IPv4(10, 111, 222, 3), Port: 53}
+	tunMode := settings.NewTunMode(settings.DNSModeNone, settings.BlockModeFilter)
+	h := NewUDPHandler(fakedns, time.Minute, f, tunMode, protect.MakeListenConfig(p), newFakeListener()).(*udpHandler)
+	conn := &fakeUDPConn{laddr: &net.UDPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 5000}}
+	targets := []*net.UDPAddr{
+		{IP: net.IPv4(224, 0, 0, 251), Port: 5353}, // mdns
+		{IP: net.ParseIP("ff02::fb"), Port: 5353},
+		{IP: net.IPv4bcast, Port: 67}, // dhcp
+		{IP: net.IPv4(169, 254, 1, 1), Port: 9},
+	}
+
+	SetLocalUDPDirect(true)
+	defer SetLocalUDPDirect(false)
+	for _, target := range targets {
+		if err := h.Connect(conn, target); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		h.Close(conn)
+		if netid, blocked := h.preview(10, target); blocked != nil || netid != protect.NetIdActive {
+			t.Errorf("%s: previewed to %s, %v", target, netid, blocked)
+		}
+	}
+	if n := atomic.LoadInt32(&f.n); n != 0 {
+		t.Errorf("flow called %d times for local flows", n)
+	}
+	if n := p.count(); int(n) != len(targets) {
+		t.Errorf("%d sockets protected, want %d", n, len(targets))
+	}
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}); err == nil {
+		t.Error("blocked flow bound")
+	}
+
+	// off, they are decided by the flow
+	SetLocalUDPDirect(false)
+	if err := h.Connect(conn, targets[0]); err == nil {
+		t.Error("blocked mdns flow bound")
+	}
+	if n := atomic.LoadInt32(&f.n); n != 2 {
+		t.Errorf("flow called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+type routeKey struct {
+	uid  int
+	port int
+}
+
+type route struct {
+	key      routeKey
+	decision protect.Decision
+}
+
+// uidRouteCache remembers the last decision of protect.Flow for a
+// (uid, target-port) pair, evicting the least recently used pair
+// once more than size pairs are cached. It is disabled when size is 0.
+type uidRouteCache struct {
+	sync.Mutex
+	size   int
+	lru    *list.List // of *route, most recently used first
+	routes map[routeKey]*list.Element
+}
+
+func newUidRouteCache() *uidRouteCache {
+	return &uidRouteCache{
+		lru:    list.New(),
+		routes: make(map[routeKey]*list.Element),
+	}
+}
+
+// setSize caps the cache to size entries; 0 empties and disables it.
+func (c *uidRouteCache) setSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.size = size
+	for c.lru.Len() > size {
+		c.evict(c.lru.Back())
+	}
+}
+
+// clear removes cached routes of uids, or all routes if uids is empty.
+func (c *uidRouteCache) clear(uids []int) {
+	c.Lock()
+	defer c.Unlock()
+	if len(uids) == 0 {
+		c.lru.Init()
+		c.routes = make(map[routeKey]*list.Element)
+		return
+	}
+	stale := make(map[int]bool, len(uids))
+	for _, uid := range uids {
+		stale[uid] = true
+	}
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if stale[e.Value.(*route).key.uid] {
+			c.evict(e)
+		}
+		e = next
+	}
+}
+
+func (c *uidRouteCache) evict(e *list.Element) {
+	delete(c.routes, e.Value.(*route).key)
+	c.lru.Remove(e)
+}
+
+func (c *uidRouteCache) get(k routeKey) (protect.Decision, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.routes[k]
+	if !ok {
+		return protect.Decision{}, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*route).decision, true
+}
+
+func (c *uidRouteCache) put(k routeKey, d protect.Decision) {
+	c.Lock()
+	defer c.Unlock()
+	if c.size == 0 {
+		return
+	}
+	if e, ok := c.routes[k]; ok {
+		e.Value.(*route).decision = d
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.routes[k] = c.lru.PushFront(&route{k, d})
+	if c.lru.Len() > c.size {
+		c.evict(c.lru.Back())
+	}
+}
+
+// decide returns the cached decision for uid and port, if any, or else
+// the decision returned by on, which is then cached unless on also
+// returns true, for a decision that only stands in for the flow's, as
+// when deciding it timed out. Flows of unknown uids (-1) are never cached.
+func (c *uidRouteCache) decide(uid, port int, on func() (protect.Decision, bool)) protect.Decision {
+	if uid < 0 {
+		d, _ := on()
+		return d
+	}
+	k := routeKey{uid, port}
+	if d, ok := c.get(k); ok {
+		return d
+	}
+	d, timedOut := on()
+	if !timedOut {
+		c.put(k, d)
+	}
+	return d
+}
@@ -0,0 +1,141 @@
+package intra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/protect"
+)
+
+// countingOn returns an On func for uidRouteCache.decide that counts its calls.
+func countingOn(netid string, calls *int) func() (protect.Decision, bool) {
+	return func() (protect.Decision, bool) {
+		*calls++
+		return protect.Decision{NetId: netid}, false
+	}
+}
+
+func TestUidRouteCacheHit(t *testing.T) {
+	c := newUidRouteCache()
+	c.setSize(8)
+
+	calls := 0
+	for i := 0; i < 3; i++ {
+		if d := c.decide(10001, 443, countingOn("proxyA", &calls)); d.NetId != "proxyA" {
+			t.Fatalf("got %s, want proxyA", d.NetId)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("On called %d times, want 1", calls)
+	}
+
+	// a different port or uid is a miss
+	c.decide(10001, 80, countingOn("proxyA", &calls))
+	c.decide(10002, 443, countingOn("proxyA", &calls))
+	if calls != 3 {
+		t.Errorf("On called %d times, want 3", calls)
+	}
+}
+
+func TestUidRouteCacheSkipsUnknownUid(t *testing.T) {
+	c := newUidRouteCache()
+	c.setSize(8)
+
+	calls := 0
+	c.decide(-1, 443, countingOn(protect.NetIdActive, &calls))
+	c.decide(-1, 443, countingOn(protect.NetIdActive, &calls))
+	if calls != 2 {
+		t.Errorf("On called %d times, want 2", calls)
+	}
+}
+
+func TestUidRouteCacheDisabled(t *testing.T) {
+	c := newUidRouteCache()
+
+	calls := 0
+	c.decide(10001, 443, countingOn(protect.NetIdActive, &calls))
+	c.decide(10001, 443, countingOn(protect.NetIdActive, &calls))
+	if calls != 2 {
+		t.Errorf("On called %d times, want 2", calls)
+	}
+}
+
+func TestUidRouteCacheEviction(t *testing.T) {
+	c := newUidRouteCache()
+	c.setSize(2)
+
+	calls := 0
+	c.decide(1, 443, countingOn("a", &calls))
+	c.decide(2, 443, countingOn("b", &calls))
+	// touch uid 1, so uid 2 is the least recently used
+	c.decide(1, 443, countingOn("a", &calls))
+	c.decide(3, 443, countingOn("c", &calls))
+
+	if n := c.lru.Len(); n != 2 {
+		t.Fatalf("%d routes cached, want 2", n)
+	}
+	if _, ok := c.get(routeKey{2, 443}); ok {
+		t.Error("least recently used route not evicted")
+	}
+	if _, ok := c.get(routeKey{1, 443}); !ok {
+		t.Error("recently used route evicted")
+	}
+
+	c.setSize(1)
+	if n := c.lru.Len(); n != 1 {
+		t.Errorf("%d routes cached after shrinking, want 1", n)
+	}
+	c.setSize(0)
+	if n := c.lru.Len(); n != 0 {
+		t.Errorf("%d routes cached after disabling, want 0", n)
+	}
+}
+
+func TestUidRouteCacheClear(t *testing.T) {
+	c := newUidRouteCache()
+	c.setSize(8)
+
+	calls := 0
+	c.decide(1, 443, countingOn("a", &calls))
+	c.decide(1, 80, countingOn("a", &calls))
+	c.decide(2, 443, countingOn("b", &calls))
+
+	c.clear([]int{1})
+	if _, ok := c.get(routeKey{1, 443}); ok {
+		t.Error("route of cleared uid still cached")
+	}
+	if _, ok := c.get(routeKey{1, 80}); ok {
+		t.Error("route of cleared uid still cached")
+	}
+	if _, ok := c.get(routeKey{2, 443}); !ok {
+		t.Error("route of another uid cleared")
+	}
+
+	c.clear(nil)
+	if n := c.lru.Len(); n != 0 {
+		t.Errorf("%d routes cached after clearing all, want 0", n)
+	}
+}
+
+func TestUidRouteCacheSkipsTimedOut(t *testing.T) {
+	defer SetFlowTimeout(0, false)
+	SetFlowTimeout(20*time.Millisecond, true)
+	c := newUidRouteCache()
+	c.setSize(8)
+	release := make(chan struct{})
+	defer close(release)
+	slow := func() (protect.Decision, bool) {
+		return decideWithin("192.0.2.1:443", func() protect.Decision {
+			<-release
+			return protect.Decision{NetId: "wg0"}
+		})
+	}
+	if d := c.decide(10001, 443, slow); d.NetId != protect.NetIdActive {
+		t.Fatalf("got %s, want %s", d.NetId, protect.NetIdActive)
+	}
+	// the stand-in isn't kept: the flow's own decision is asked for again
+	var calls int
+	if d := c.decide(10001, 443, countingOn("wg0", &calls)); d.NetId != "wg0" || calls != 1 {
+		t.Errorf("got %s after %d calls, want wg0 after 1", d.NetId, calls)
+	}
+}